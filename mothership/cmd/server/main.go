@@ -1,15 +1,29 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	"borg/mothership/internal/api"
+	"borg/mothership/internal/auth"
+	"borg/mothership/internal/cluster"
+	"borg/mothership/internal/events"
+	"borg/mothership/internal/journal"
+	"borg/mothership/internal/logstore"
 	"borg/mothership/internal/models"
+	"borg/mothership/internal/oidc"
+	"borg/mothership/internal/pki"
 	"borg/mothership/internal/queue"
+	"borg/mothership/internal/ratelimit"
+	"borg/mothership/internal/secrets"
 	"borg/mothership/internal/storage"
+	"borg/mothership/internal/webhook"
 	"borg/mothership/internal/websocket"
 
 	"github.com/joho/godotenv"
@@ -19,6 +33,10 @@ import (
 )
 
 func main() {
+	adminUsername := flag.String("admin-username", "", "Create an initial admin with this username if no enabled admin exists (or BORG_ADMIN_USERNAME)")
+	adminPassword := flag.String("admin-password", "", "Password for the initial admin, must be changed on first login (or BORG_ADMIN_PASSWORD)")
+	flag.Parse()
+
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
 		log.Println("No .env file found, using environment variables")
@@ -54,6 +72,31 @@ func main() {
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
 
+	// One-time admin setup
+	if *adminUsername == "" {
+		*adminUsername = os.Getenv("BORG_ADMIN_USERNAME")
+	}
+	if *adminPassword == "" {
+		*adminPassword = os.Getenv("BORG_ADMIN_PASSWORD")
+	}
+	if *adminUsername != "" || *adminPassword != "" {
+		admin, err := models.BootstrapAdmin(db, *adminUsername, *adminPassword)
+		switch {
+		case errors.Is(err, models.ErrAdminExists):
+			log.Println("An enabled admin already exists, skipping bootstrap admin")
+		case err != nil:
+			log.Fatalf("Failed to create bootstrap admin: %v", err)
+		default:
+			log.Printf("Bootstrap admin %q is ready, password must be changed on first login", admin.Username)
+		}
+	} else {
+		var adminCount int64
+		db.Model(&models.User{}).Where("role = ? AND disabled = ?", auth.RoleAdmin, false).Count(&adminCount)
+		if adminCount == 0 {
+			log.Println("No enabled admin exists. Set BORG_ADMIN_USERNAME and BORG_ADMIN_PASSWORD (or -admin-username/-admin-password) to create one")
+		}
+	}
+
 	// Initialize storage
 	storagePath := os.Getenv("STORAGE_PATH")
 	if storagePath == "" {
@@ -65,12 +108,26 @@ func main() {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
 
-	// Initialize queue
+	// Initialize queue, publishing job and task state changes
+	bus := events.NewBus()
 	q := queue.NewQueue(db)
+	q.SetEvents(bus)
 
-	// Initialize WebSocket hub
+	// Initialize WebSocket hub, forwarding events to subscribed dashboard clients
 	hub := websocket.NewHub()
 	go hub.Run()
+	bus.Subscribe(hub.PublishEvent)
+
+	// Messages between mothership instances sharing the database, and election of the
+	// instance running background work that must run once
+	clusterEnabled, err := cluster.EnabledFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure clustering: %v", err)
+	}
+	node := cluster.New(db, dsn)
+	if clusterEnabled {
+		node.ForwardEvents(bus)
+	}
 
 	// Initialize screen streaming hub
 	screenHub := websocket.NewScreenHub(func(runnerID string, shouldStream bool) {
@@ -84,23 +141,138 @@ func main() {
 
 	// Initialize REST API server
 	apiServer := api.NewServer(db, q, hub, screenHub, agentHub, storageService)
+	apiServer.SetEvents(bus)
+	go node.Elect(context.Background(), "runner-monitor", apiServer.RunRunnerMonitor)
+	go node.Elect(context.Background(), "idempotency-key-pruner", apiServer.RunIdempotencyKeyPruner)
+
+	// Task logs, with logs of tasks that finished long ago archived into storage
+	logStore := logstore.New(db, filepath.Join(storagePath, "logs"))
+	apiServer.SetLogStore(logStore)
+	logArchiveAfter, err := logstore.ArchiveAfterFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure log archiving: %v", err)
+	}
+	if logArchiveAfter > 0 {
+		go node.Elect(context.Background(), "log-archiver", func(ctx context.Context) {
+			logStore.RunArchiver(ctx, logArchiveAfter, time.Hour)
+		})
+	} else {
+		log.Println("LOG_ARCHIVE_AFTER is 0, task logs are not archived")
+	}
+
+	// Event journal for the server-sent event stream
+	journalConfig, err := journal.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure event journal: %v", err)
+	}
+	eventJournal := journal.New(db, journalConfig)
+	eventJournal.Subscribe(bus)
+	go eventJournal.Run(context.Background())
+	go node.Elect(context.Background(), "event-journal-pruner", eventJournal.RunPruner)
+	apiServer.EnableEventStream(eventJournal)
+
+	// Webhook deliveries
+	webhooks := webhook.NewDispatcher(db)
+	webhooks.Subscribe(bus)
+	go webhooks.Run(context.Background())
+	apiServer.EnableWebhooks(webhooks)
+
+	// Single sign-on (optional)
+	if oidcConfig, ok := oidc.ConfigFromEnv(); ok {
+		provider, err := oidc.NewProvider(context.Background(), oidcConfig)
+		if err != nil {
+			log.Fatalf("Failed to initialize OIDC provider: %v", err)
+		}
+		apiServer.EnableOIDC(provider)
+		log.Printf("Single sign-on enabled with issuer %s", oidcConfig.Issuer)
+	}
+
+	// Encrypted secrets store (optional)
+	secretsCipher, ok, err := secrets.CipherFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize secrets store: %v", err)
+	}
+	if ok {
+		apiServer.EnableSecrets(secretsCipher)
+	} else {
+		log.Println("SECRETS_KEY is not set, secrets are disabled")
+	}
+
+	// Rate limits and login lockouts
+	rateLimitConfig, err := ratelimit.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure rate limits: %v", err)
+	}
+	var rateLimitStore ratelimit.Store = ratelimit.NewMemoryStore()
+	if rateLimitConfig.Store == "postgres" {
+		rateLimitStore = ratelimit.NewPostgresStore(db)
+	}
+	apiServer.EnableRateLimits(ratelimit.New(rateLimitStore, rateLimitConfig))
+	if err := apiServer.SetTrustedProxies(rateLimitConfig.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	log.Printf("Rate limits (%s store): login %s, api %s, runner %s", rateLimitConfig.Store,
+		rateLimitConfig.Login, rateLimitConfig.API, rateLimitConfig.Runner)
+
+	// TLS and runner client certificates (optional)
+	pkiConfig, err := pki.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+	var ca *pki.CA
+	if pkiConfig.NeedsCA() {
+		ca, err = pki.LoadOrCreateCA(pkiConfig.Dir)
+		if err != nil {
+			log.Fatalf("Failed to load internal CA: %v", err)
+		}
+		apiServer.EnableRunnerCertificates(ca, pkiConfig)
+		log.Printf("Internal CA loaded from %s, runner mTLS: %s", pkiConfig.Dir, pkiConfig.RunnerMTLS)
+	}
 
 	// Set up agent message handler
 	apiServer.SetupAgentMessageHandler()
 
+	// Start exchanging messages with other instances once every channel is handled
+	if clusterEnabled {
+		apiServer.EnableCluster(context.Background(), node)
+		go node.Run(context.Background())
+		log.Printf("Clustering enabled, instance %s", node.ID())
+	}
+
 	// Start HTTP server
 	httpPort := os.Getenv("HTTP_PORT")
 	if httpPort == "" {
 		httpPort = "8080"
 	}
 
+	httpScheme, wsScheme := "http", "ws"
+	if pkiConfig.TLSEnabled() {
+		httpScheme, wsScheme = "https", "wss"
+	}
+
 	log.Printf("Starting HTTP server on 0.0.0.0:%s", httpPort)
-	log.Printf("WebSocket endpoint: ws://0.0.0.0:%s/ws", httpPort)
-	log.Printf("REST API endpoint: http://0.0.0.0:%s/api/v1", httpPort)
-	log.Printf("Web dashboard: http://0.0.0.0:%s", httpPort)
-	log.Printf("Runner API endpoint: http://0.0.0.0:%s/api/v1/runners", httpPort)
+	log.Printf("WebSocket endpoint: %s://0.0.0.0:%s/ws", wsScheme, httpPort)
+	log.Printf("REST API endpoint: %s://0.0.0.0:%s/api/v1", httpScheme, httpPort)
+	log.Printf("Web dashboard: %s://0.0.0.0:%s", httpScheme, httpPort)
+	log.Printf("Runner API endpoint: %s://0.0.0.0:%s/api/v1/runners", httpScheme, httpPort)
 
-	if err := http.ListenAndServe("0.0.0.0:"+httpPort, apiServer.GetRouter()); err != nil {
-		log.Fatalf("HTTP server failed: %v", err)
+	if !pkiConfig.TLSEnabled() {
+		if err := http.ListenAndServe("0.0.0.0:"+httpPort, apiServer.GetRouter()); err != nil {
+			log.Fatalf("HTTP server failed: %v", err)
+		}
+		return
+	}
+
+	tlsConfig, err := pki.ServerTLSConfig(pkiConfig, ca)
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+	httpServer := &http.Server{
+		Addr:      "0.0.0.0:" + httpPort,
+		Handler:   apiServer.GetRouter(),
+		TLSConfig: tlsConfig,
+	}
+	if err := httpServer.ListenAndServeTLS("", ""); err != nil {
+		log.Fatalf("HTTPS server failed: %v", err)
 	}
 }
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"borg/mothership/internal/models"
+)
+
+// Agent WebSocket protocol. Every message is a {"type", "data"} envelope whose data
+// carries an AgentHeader. Agents open a connection with "hello" and the server answers
+// "welcome" with the protocol version and features both sides support, or "error".
+// Agents that never say hello speak version 0, the unversioned protocol, and receive
+// the same replies, whose extra fields they ignore.
+
+// Protocol versions the server speaks
+const (
+	AgentProtocolVersion    = 1
+	minAgentProtocolVersion = 1 // Oldest version an agent may ask for in its hello
+)
+
+// Agent message types
+const (
+	AgentMsgHello              = "hello"
+	AgentMsgWelcome            = "welcome"
+	AgentMsgHeartbeat          = "heartbeat"
+	AgentMsgHeartbeatResponse  = "heartbeat_response"
+	AgentMsgTaskStatus         = "task_status"
+	AgentMsgTaskStatusResponse = "task_status_response"
+	AgentMsgError              = "error"
+)
+
+// Optional features negotiated in the handshake
+const (
+	AgentFeatureLogStreaming = "log_streaming"             // Output is streamed to POST /tasks/:id/logs
+	AgentFeatureCancel       = "cancel"                    // Running tasks can be cancelled
+	AgentFeatureFileCache    = "file_cache"                // Downloaded files are cached by the agent
+	AgentFeatureSandbox      = models.RunnerFeatureSandbox // Tasks of sandboxed jobs can be run
+)
+
+// agentFeatures are the features this server supports
+var agentFeatures = []string{AgentFeatureLogStreaming, AgentFeatureSandbox}
+
+// Error codes of "error" replies
+const (
+	AgentErrUnsupportedVersion = "unsupported_version"
+	AgentErrUnknownType        = "unknown_type"
+	AgentErrInvalidMessage     = "invalid_message"
+	AgentErrNotAssigned        = "not_assigned"
+	AgentErrInternal           = "internal"
+	AgentErrInProgress         = "in_progress" // A message with the same idempotency key is being handled
+)
+
+// AgentHeader correlates requests and replies
+type AgentHeader struct {
+	ID      string `json:"id,omitempty"`       // Chosen by the sender of a request
+	ReplyTo string `json:"reply_to,omitempty"` // ID of the request a reply answers
+}
+
+// AgentHello opens a connection
+type AgentHello struct {
+	AgentHeader
+	ProtocolVersion    int      `json:"protocol_version"`     // Newest version the agent speaks
+	MinProtocolVersion int      `json:"min_protocol_version"` // Oldest version the agent speaks
+	AgentVersion       string   `json:"agent_version"`
+	Features           []string `json:"features"`
+}
+
+// AgentWelcome accepts a hello
+type AgentWelcome struct {
+	AgentHeader
+	ProtocolVersion int      `json:"protocol_version"` // Version used on this connection
+	Features        []string `json:"features"`         // Features both sides support
+}
+
+// AgentHeartbeat reports a runner's state
+type AgentHeartbeat struct {
+	AgentHeader
+	HeartbeatRequest
+}
+
+// AgentHeartbeatResponse answers a heartbeat
+type AgentHeartbeatResponse struct {
+	AgentHeader
+	HeartbeatResponse
+}
+
+// AgentTaskStatus reports a task's status
+type AgentTaskStatus struct {
+	AgentHeader
+	TaskID         string `json:"task_id"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"` // As the Idempotency-Key header over HTTP
+	UpdateTaskStatusRequest
+}
+
+// AgentTaskStatusResponse answers a task status
+type AgentTaskStatusResponse struct {
+	AgentHeader
+	TaskID string `json:"task_id,omitempty"`
+	UpdateTaskStatusResponse
+}
+
+// AgentError rejects a message
+type AgentError struct {
+	AgentHeader
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Type    string `json:"type,omitempty"` // Type of the rejected message
+}
+
+// decodeAgentMessage decodes the data of an agent message into v
+func decodeAgentMessage(data interface{}, v interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// handleAgentMessage dispatches a message received from an agent
+func (h *Handler) handleAgentMessage(runnerID, messageType string, data interface{}) {
+	var header AgentHeader
+	if err := decodeAgentMessage(data, &header); err != nil {
+		h.replyAgentError(runnerID, header, messageType, AgentErrInvalidMessage, err.Error())
+		return
+	}
+
+	var err error
+	switch messageType {
+	case AgentMsgHello:
+		var msg AgentHello
+		if err = decodeAgentMessage(data, &msg); err == nil {
+			h.handleAgentHello(runnerID, &msg)
+		}
+	case AgentMsgHeartbeat:
+		var msg AgentHeartbeat
+		if err = decodeAgentMessage(data, &msg); err == nil {
+			h.handleWebSocketHeartbeat(runnerID, &msg)
+		}
+	case AgentMsgTaskStatus:
+		var msg AgentTaskStatus
+		if err = decodeAgentMessage(data, &msg); err == nil {
+			h.handleWebSocketTaskStatus(runnerID, &msg)
+		}
+	case AgentMsgError:
+		var msg AgentError
+		if err = decodeAgentMessage(data, &msg); err == nil {
+			log.Printf("Runner %s rejected a %s message (%s): %s", runnerID, msg.Type, msg.Code, msg.Message)
+		}
+	default:
+		log.Printf("Unknown message type from runner %s: %s", runnerID, messageType)
+		h.replyAgentError(runnerID, header, messageType, AgentErrUnknownType, "unknown message type "+messageType)
+		return
+	}
+	if err != nil {
+		log.Printf("Invalid %s message from runner %s: %v", messageType, runnerID, err)
+		h.replyAgentError(runnerID, header, messageType, AgentErrInvalidMessage, err.Error())
+	}
+}
+
+// handleAgentHello negotiates the protocol version and features of a connection
+func (h *Handler) handleAgentHello(runnerID string, msg *AgentHello) {
+	version := msg.ProtocolVersion
+	if version > AgentProtocolVersion {
+		version = AgentProtocolVersion
+	}
+	if version < minAgentProtocolVersion || version < msg.MinProtocolVersion {
+		log.Printf("Runner %s speaks agent protocol %d-%d, server speaks %d-%d", runnerID,
+			msg.MinProtocolVersion, msg.ProtocolVersion, minAgentProtocolVersion, AgentProtocolVersion)
+		h.replyAgentError(runnerID, msg.AgentHeader, AgentMsgHello, AgentErrUnsupportedVersion,
+			fmt.Sprintf("server speaks agent protocol versions %d to %d", minAgentProtocolVersion, AgentProtocolVersion))
+		return
+	}
+
+	features := supportedAgentFeatures(msg.Features)
+	featuresJSON, _ := json.Marshal(features)
+	if err := h.db.Model(&models.Runner{}).Where("id = ?", runnerID).Updates(map[string]interface{}{
+		"agent_version":    msg.AgentVersion,
+		"protocol_version": version,
+		"agent_features":   string(featuresJSON),
+	}).Error; err != nil {
+		log.Printf("Failed to record agent version of runner %s: %v", runnerID, err)
+	}
+	log.Printf("Runner %s connected with agent %s, protocol %d, features %v", runnerID, msg.AgentVersion, version, features)
+
+	h.agentHub.SendMessage(runnerID, AgentMsgWelcome, AgentWelcome{
+		AgentHeader:     AgentHeader{ReplyTo: msg.ID},
+		ProtocolVersion: version,
+		Features:        features,
+	})
+}
+
+// supportedAgentFeatures returns the features of an agent this server supports too
+func supportedAgentFeatures(requested []string) []string {
+	features := []string{}
+	for _, feature := range requested {
+		for _, supported := range agentFeatures {
+			if feature == supported {
+				features = append(features, feature)
+			}
+		}
+	}
+	return features
+}
+
+// replyAgentError rejects a message of an agent
+func (h *Handler) replyAgentError(runnerID string, request AgentHeader, messageType, code, message string) {
+	h.agentHub.SendMessage(runnerID, AgentMsgError, AgentError{
+		AgentHeader: AgentHeader{ReplyTo: request.ID},
+		Code:        code,
+		Message:     message,
+		Type:        messageType,
+	})
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"borg/mothership/internal/auth"
+	"borg/mothership/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// CreateAPIKeyRequest represents API key creation request
+type CreateAPIKeyRequest struct {
+	Name             string            `json:"name" binding:"required"`
+	Scopes           []auth.Permission `json:"scopes" binding:"required"` // Subset of the permissions of the user's role
+	ExpiresInSeconds int64             `json:"expires_in_seconds"`        // 0 = never expires
+}
+
+// CreateAPIKeyResponse contains the plaintext key, which is only returned once
+type CreateAPIKeyResponse struct {
+	Key    string         `json:"key"`
+	APIKey *models.APIKey `json:"api_key"`
+}
+
+// CreateAPIKey creates an API key for the current user
+func (h *Handler) CreateAPIKey(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one scope is required"})
+		return
+	}
+	role := c.GetString("role")
+	for _, scope := range req.Scopes {
+		if !auth.ValidPermission(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope: " + string(scope)})
+			return
+		}
+		if !auth.HasPermission(role, scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "your role does not grant scope: " + string(scope)})
+			return
+		}
+	}
+	if req.ExpiresInSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_seconds cannot be negative"})
+		return
+	}
+
+	key, prefix, err := auth.GenerateAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	scopesJSON, _ := json.Marshal(req.Scopes)
+
+	now := time.Now()
+	apiKey := &models.APIKey{
+		ID:        uuid.New().String(),
+		UserID:    c.GetString("user_id"),
+		Name:      req.Name,
+		KeyHash:   auth.HashToken(key),
+		Prefix:    prefix,
+		Scopes:    string(scopesJSON),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if req.ExpiresInSeconds > 0 {
+		expiresAt := now.Add(time.Duration(req.ExpiresInSeconds) * time.Second)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	if err := h.db.Create(apiKey).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "api_key.create", auditTarget{Type: "api_key", ID: apiKey.ID, Name: apiKey.Name}, nil,
+		gin.H{"prefix": apiKey.Prefix, "scopes": req.Scopes, "expires_at": apiKey.ExpiresAt})
+
+	c.JSON(http.StatusCreated, CreateAPIKeyResponse{
+		Key:    key,
+		APIKey: apiKey,
+	})
+}
+
+// ListAPIKeys returns the current user's API keys
+func (h *Handler) ListAPIKeys(c *gin.Context) {
+	var keys []models.APIKey
+	if err := h.db.Where("user_id = ?", c.GetString("user_id")).
+		Order("created_at DESC").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+// RevokeAPIKey revokes one of the current user's API keys
+func (h *Handler) RevokeAPIKey(c *gin.Context) {
+	var apiKey models.APIKey
+	if err := h.db.First(&apiKey, "id = ? AND user_id = ?", c.Param("id"), c.GetString("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	if apiKey.RevokedAt == nil {
+		now := time.Now()
+		apiKey.RevokedAt = &now
+		apiKey.UpdatedAt = now
+		if err := h.db.Save(&apiKey).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		h.audit(c, "api_key.revoke", auditTarget{Type: "api_key", ID: apiKey.ID, Name: apiKey.Name}, nil, nil)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "API key revoked",
+	})
+}
@@ -0,0 +1,325 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"borg/mothership/internal/models"
+	"borg/mothership/internal/oidc"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	maxAuditPageSize    = 500
+	auditExportPageSize = 1000
+)
+
+// auditTarget identifies the object an audited action was applied to
+type auditTarget struct {
+	Type string
+	ID   string
+	Name string
+}
+
+// newAuditEntry starts an audit entry for the request, taking the actor from the auth middleware
+func newAuditEntry(c *gin.Context, action string, target auditTarget) *models.AuditEntry {
+	return &models.AuditEntry{
+		ID:         uuid.New().String(),
+		Action:     action,
+		Success:    true,
+		ActorID:    c.GetString("user_id"),
+		ActorName:  c.GetString("username"),
+		APIKeyID:   c.GetString("api_key_id"),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  truncate(c.Request.UserAgent(), 500),
+		TargetType: target.Type,
+		TargetID:   target.ID,
+		TargetName: target.Name,
+		CreatedAt:  time.Now(),
+	}
+}
+
+// recordAudit stores an audit entry with before/after summaries. Failures are
+// logged but never fail the action that was audited.
+func (h *Handler) recordAudit(entry *models.AuditEntry, before, after interface{}) {
+	entry.Before = auditSummaryJSON(before)
+	entry.After = auditSummaryJSON(after)
+	if err := h.db.Create(entry).Error; err != nil {
+		log.Printf("Failed to record audit entry %s on %s %s: %v", entry.Action, entry.TargetType, entry.TargetID, err)
+	}
+}
+
+// audit records a successful action by the current user
+func (h *Handler) audit(c *gin.Context, action string, target auditTarget, before, after interface{}) {
+	h.recordAudit(newAuditEntry(c, action, target), before, after)
+}
+
+func auditSummaryJSON(summary interface{}) string {
+	if summary == nil {
+		return "null"
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return "null"
+	}
+	return string(data)
+}
+
+// jobAuditSummary lists the job fields worth keeping in the audit log
+func jobAuditSummary(job *models.Job) gin.H {
+	return gin.H{
+		"name":              job.Name,
+		"type":              job.Type,
+		"status":            job.Status,
+		"priority":          job.Priority,
+		"command":           job.Command,
+		"args":              json.RawMessage(orDefault(job.Args, "[]")),
+		"working_directory": job.WorkingDirectory,
+		"timeout_seconds":   job.TimeoutSeconds,
+		"max_retries":       job.MaxRetries,
+		"secret_env":        json.RawMessage(orDefault(job.SecretEnv, "{}")),
+		"limits":            job.Limits,
+		"sandbox":           job.Sandbox,
+	}
+}
+
+// userAuditSummary lists the user fields worth keeping in the audit log
+func userAuditSummary(user *models.User) gin.H {
+	return gin.H{
+		"username":      user.Username,
+		"role":          user.Role,
+		"disabled":      user.Disabled,
+		"auth_provider": user.AuthProvider,
+	}
+}
+
+// screenSettingsSummary lists a runner's screen capture settings
+func screenSettingsSummary(runner *models.Runner) gin.H {
+	return gin.H{
+		"quality":      runner.ScreenQuality,
+		"fps":          runner.ScreenFPS,
+		"screen_index": runner.SelectedScreenIndex,
+	}
+}
+
+// fileAuditSummary lists the file fields worth keeping in the audit log
+func fileAuditSummary(file *models.File) gin.H {
+	return gin.H{
+		"file_id": file.ID,
+		"name":    file.Name,
+		"size":    file.Size,
+		"hash":    file.Hash,
+	}
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// auditLogin records a password login attempt. user is nil if the username is unknown
+// and reason is empty for successful logins.
+func (h *Handler) auditLogin(c *gin.Context, user *models.User, username, reason string) {
+	action := "auth.login"
+	if reason != "" {
+		action = "auth.login_failed"
+	}
+
+	target := auditTarget{Type: "user", Name: username}
+	entry := newAuditEntry(c, action, target)
+	if user != nil {
+		entry.ActorID = user.ID
+		entry.ActorName = user.Username
+		entry.TargetID = user.ID
+	}
+
+	var after interface{}
+	if reason != "" {
+		entry.Success = false
+		after = gin.H{"reason": reason}
+	}
+	h.recordAudit(entry, nil, after)
+}
+
+// auditSSOLogin records a single sign-on login attempt. identity is nil if the provider
+// did not vouch for anyone, user is nil if the identity was not mapped to a user.
+func (h *Handler) auditSSOLogin(c *gin.Context, identity *oidc.Identity, user *models.User, reason string) {
+	action := "auth.login"
+	if reason != "" {
+		action = "auth.login_failed"
+	}
+
+	details := gin.H{"method": "oidc"}
+	target := auditTarget{Type: "user"}
+	if identity != nil {
+		details["issuer"] = identity.Issuer
+		details["subject"] = identity.Subject
+		target.Name = orDefault(identity.PreferredUsername, identity.Subject)
+	}
+	entry := newAuditEntry(c, action, target)
+	if user != nil {
+		entry.ActorID = user.ID
+		entry.ActorName = user.Username
+		entry.TargetID = user.ID
+		entry.TargetName = user.Username
+	}
+
+	if reason != "" {
+		entry.Success = false
+		details["reason"] = reason
+	}
+	h.recordAudit(entry, nil, details)
+}
+
+// auditViewerSession records when a dashboard user starts and stops watching a runner's screen
+func (h *Handler) auditViewerSession(c *gin.Context, runnerID string) func() {
+	target := auditTarget{Type: "runner", ID: runnerID}
+	var runner models.Runner
+	if err := h.db.Select("name").First(&runner, "id = ?", runnerID).Error; err == nil {
+		target.Name = runner.Name
+	}
+
+	started := time.Now()
+	h.audit(c, "screen.view_start", target, nil, nil)
+
+	// The gin context is reused after the handler returns, so copy what the end entry needs
+	end := newAuditEntry(c, "screen.view_end", target)
+	return func() {
+		end.CreatedAt = time.Now()
+		h.recordAudit(end, nil, gin.H{"duration_seconds": int64(end.CreatedAt.Sub(started).Seconds())})
+	}
+}
+
+// auditQuery applies the audit log filters from the query string
+func (h *Handler) auditQuery(c *gin.Context) (*gorm.DB, error) {
+	query := h.db.Model(&models.AuditEntry{})
+
+	if actions := c.Query("action"); actions != "" {
+		query = query.Where("action IN ?", strings.Split(actions, ","))
+	}
+	if actorID := c.Query("actor_id"); actorID != "" {
+		query = query.Where("actor_id = ?", actorID)
+	}
+	if actor := c.Query("actor"); actor != "" {
+		query = query.Where("actor_name = ?", actor)
+	}
+	if targetType := c.Query("target_type"); targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+	if targetID := c.Query("target_id"); targetID != "" {
+		query = query.Where("target_id = ?", targetID)
+	}
+	if success := c.Query("success"); success != "" {
+		ok, err := strconv.ParseBool(success)
+		if err != nil {
+			return nil, fmt.Errorf("invalid success: %q", success)
+		}
+		query = query.Where("success = ?", ok)
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since, expected RFC 3339: %q", since)
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if until := c.Query("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return nil, fmt.Errorf("invalid until, expected RFC 3339: %q", until)
+		}
+		query = query.Where("created_at < ?", t)
+	}
+
+	return query, nil
+}
+
+// ListAuditLog returns audit entries, newest first
+func (h *Handler) ListAuditLog(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if limit <= 0 || limit > maxAuditPageSize {
+		limit = maxAuditPageSize
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	query, err := h.auditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var entries []models.AuditEntry
+	if err := query.Order("created_at DESC, id DESC").Limit(limit).Offset(offset).Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// ExportAuditLog streams the matching audit entries as JSON Lines, oldest first
+func (h *Handler) ExportAuditLog(c *gin.Context) {
+	query, err := h.auditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.audit(c, "audit.export", auditTarget{Type: "audit_log"}, nil, gin.H{"filters": c.Request.URL.RawQuery})
+
+	filename := fmt.Sprintf("borg-audit-%s.jsonl", time.Now().UTC().Format("20060102-150405"))
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	var last *models.AuditEntry
+	for {
+		page := query.Session(&gorm.Session{})
+		if last != nil {
+			page = page.Where("(created_at, id) > (?, ?)", last.CreatedAt, last.ID)
+		}
+
+		var entries []models.AuditEntry
+		if err := page.Order("created_at ASC, id ASC").Limit(auditExportPageSize).Find(&entries).Error; err != nil {
+			// Headers are already sent, so the truncated export is all we can report
+			log.Printf("Audit log export failed: %v", err)
+			return
+		}
+		for i := range entries {
+			if err := encoder.Encode(&entries[i]); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+
+		if len(entries) < auditExportPageSize {
+			return
+		}
+		last = &entries[len(entries)-1]
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"borg/mothership/internal/cluster"
+)
+
+const (
+	clusterTasksChannel  = "borg_tasks"
+	clusterScreenChannel = "borg_screen_viewers"
+	clusterFrameChannel  = "borg_screen_frames"
+
+	screenViewersInterval = 10 * time.Second
+	screenViewersTTL      = 3 * screenViewersInterval // Covers instances that stopped
+	frameDropLogInterval  = time.Minute
+)
+
+// screenViewers announces the screen viewers connected to an instance
+type screenViewers struct {
+	Instance string         `json:"instance"`
+	Viewers  map[string]int `json:"viewers"` // Runner ID -> number of viewers
+	Full     bool           `json:"full"`    // Runners not listed have no viewers
+}
+
+// screenFrame is a frame for viewers connected to other instances
+type screenFrame struct {
+	RunnerID string `json:"runner_id"`
+	Frame    []byte `json:"frame"`
+}
+
+// remoteViewers tracks the screen viewers connected to other instances. A nil
+// remoteViewers has none.
+type remoteViewers struct {
+	mu        sync.Mutex
+	instances map[string]*instanceViewers
+}
+
+type instanceViewers struct {
+	viewers map[string]int
+	seen    time.Time
+}
+
+func newRemoteViewers() *remoteViewers {
+	return &remoteViewers{instances: make(map[string]*instanceViewers)}
+}
+
+// update applies an announcement of another instance
+func (r *remoteViewers) update(msg screenViewers) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	instance := r.instances[msg.Instance]
+	if instance == nil || msg.Full {
+		instance = &instanceViewers{viewers: make(map[string]int)}
+		r.instances[msg.Instance] = instance
+	}
+	instance.seen = time.Now()
+	for runnerID, n := range msg.Viewers {
+		if n > 0 {
+			instance.viewers[runnerID] = n
+		} else {
+			delete(instance.viewers, runnerID)
+		}
+	}
+}
+
+// count returns the number of viewers of a runner on other instances
+func (r *remoteViewers) count(runnerID string) int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	total := 0
+	for id, instance := range r.instances {
+		if time.Since(instance.seen) > screenViewersTTL {
+			delete(r.instances, id)
+			continue
+		}
+		total += instance.viewers[runnerID]
+	}
+	return total
+}
+
+// SetCluster connects the handler to the other mothership instances: agents connected
+// anywhere hear about new tasks, and screen frames reach viewers on every instance.
+// Call before the cluster runs.
+func (h *Handler) SetCluster(c *cluster.Cluster) {
+	h.cluster = c
+	h.remoteViewers = newRemoteViewers()
+
+	c.Handle(clusterTasksChannel, func([]byte) {
+		go h.notifyConnectedIdleAgents()
+	})
+	c.Handle(clusterScreenChannel, func(payload []byte) {
+		var msg screenViewers
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			log.Printf("Invalid screen viewers announcement: %v", err)
+			return
+		}
+		h.remoteViewers.update(msg)
+	})
+	c.Handle(clusterFrameChannel, func(payload []byte) {
+		var msg screenFrame
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			log.Printf("Invalid screen frame from another instance: %v", err)
+			return
+		}
+		h.screenHub.DeliverFrame(msg.RunnerID, msg.Frame)
+	})
+
+	h.screenHub.SetViewersChangeHandler(func(runnerID string, viewers int) {
+		c.Publish(clusterScreenChannel, screenViewers{Instance: c.ID(), Viewers: map[string]int{runnerID: viewers}})
+	})
+	// Frames only travel in notifications: storing them would write video into the
+	// database. Frames too large for a notification do not reach other instances.
+	var dropped, lastLog atomic.Int64
+	h.screenHub.SetFrameForwarder(func(runnerID string, frameData []byte) {
+		if h.remoteViewers.count(runnerID) == 0 {
+			return
+		}
+		if c.PublishTransient(clusterFrameChannel, screenFrame{RunnerID: runnerID, Frame: frameData}) {
+			return
+		}
+		total := dropped.Add(1)
+		now := time.Now().UnixNano()
+		last := lastLog.Load()
+		if now-last >= int64(frameDropLogInterval) && lastLog.CompareAndSwap(last, now) {
+			log.Printf("Screen frame of runner %s (%d bytes) too large to send to other instances, "+
+				"%d dropped so far; its viewers on other instances miss frames", runnerID, len(frameData), total)
+		}
+	})
+}
+
+// announceScreenViewers repeats this instance's screen viewers until ctx is cancelled,
+// so instances that started later or missed a change catch up
+func (h *Handler) announceScreenViewers(ctx context.Context) {
+	ticker := time.NewTicker(screenViewersInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.cluster.Publish(clusterScreenChannel, screenViewers{
+				Instance: h.cluster.ID(),
+				Viewers:  h.screenHub.Viewers(),
+				Full:     true,
+			})
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"borg/mothership/internal/auth"
+	"borg/mothership/internal/events"
+	"borg/mothership/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var errInvalidEnrollmentToken = errors.New("invalid, expired or exhausted enrollment token")
+
+// runnerSecretMatches reports whether secret is the runner's current, unrevoked secret
+func runnerSecretMatches(runner *models.Runner, secret string) bool {
+	if runner.CredentialRevokedAt != nil {
+		return false
+	}
+	return auth.ValidateToken(secret, runner.SecretHash)
+}
+
+// consumeEnrollmentToken validates an enrollment token and claims one use of it
+func (h *Handler) consumeEnrollmentToken(token string, now time.Time) (*models.EnrollmentToken, error) {
+	if token == "" {
+		return nil, errors.New("enrollment token required")
+	}
+
+	var enrollment models.EnrollmentToken
+	if err := h.db.Where("token_hash = ?", auth.HashToken(token)).First(&enrollment).Error; err != nil {
+		return nil, errInvalidEnrollmentToken
+	}
+	if !enrollment.IsUsable(now) {
+		return nil, errInvalidEnrollmentToken
+	}
+
+	// Claim the use atomically so concurrent registrations cannot exceed max_uses
+	result := h.db.Model(&models.EnrollmentToken{}).
+		Where("id = ? AND revoked_at IS NULL AND (max_uses = 0 OR use_count < max_uses)", enrollment.ID).
+		Updates(map[string]interface{}{
+			"use_count":    gorm.Expr("use_count + 1"),
+			"last_used_at": now,
+			"updated_at":   now,
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, errInvalidEnrollmentToken
+	}
+
+	return &enrollment, nil
+}
+
+// runnerLabels merges the labels reported by an agent with the preset labels of
+// the enrollment token it was enrolled with. Preset labels take precedence.
+func (h *Handler) runnerLabels(reported map[string]string, enrollmentTokenID string) map[string]string {
+	labels := make(map[string]string, len(reported))
+	for k, v := range reported {
+		labels[k] = v
+	}
+
+	if enrollmentTokenID == "" {
+		return labels
+	}
+
+	var enrollment models.EnrollmentToken
+	if err := h.db.First(&enrollment, "id = ?", enrollmentTokenID).Error; err != nil {
+		return labels
+	}
+
+	var preset map[string]string
+	if enrollment.Labels != "" {
+		json.Unmarshal([]byte(enrollment.Labels), &preset)
+	}
+	for k, v := range preset {
+		labels[k] = v
+	}
+
+	return labels
+}
+
+// CreateEnrollmentTokenRequest represents enrollment token creation request
+type CreateEnrollmentTokenRequest struct {
+	Name             string            `json:"name" binding:"required"`
+	MaxUses          *int32            `json:"max_uses"`           // Defaults to 1 (single-use), 0 = unlimited
+	ExpiresInSeconds int64             `json:"expires_in_seconds"` // 0 = never expires
+	Labels           map[string]string `json:"labels"`             // Preset labels for enrolled runners
+	ProjectID        string            `json:"project_id"`         // Dedicate enrolled runners to a project, empty = shared
+}
+
+// CreateEnrollmentTokenResponse contains the plaintext token, which is only returned once
+type CreateEnrollmentTokenResponse struct {
+	Token           string                  `json:"token"`
+	EnrollmentToken *models.EnrollmentToken `json:"enrollment_token"`
+}
+
+// CreateEnrollmentToken creates a new enrollment token
+func (h *Handler) CreateEnrollmentToken(c *gin.Context) {
+	var req CreateEnrollmentTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	maxUses := int32(1)
+	if req.MaxUses != nil {
+		if *req.MaxUses < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "max_uses cannot be negative"})
+			return
+		}
+		maxUses = *req.MaxUses
+	}
+
+	if req.ProjectID != "" {
+		var project models.Project
+		if err := h.db.First(&project, "id = ?", req.ProjectID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "project not found"})
+			return
+		}
+	}
+
+	token, err := auth.GenerateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	labels := req.Labels
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labelsJSON, _ := json.Marshal(labels)
+
+	now := time.Now()
+	enrollment := &models.EnrollmentToken{
+		ID:        uuid.New().String(),
+		Name:      req.Name,
+		TokenHash: auth.HashToken(token),
+		Prefix:    token[:8],
+		MaxUses:   maxUses,
+		Labels:    string(labelsJSON),
+		ProjectID: req.ProjectID,
+		CreatedBy: c.GetString("user_id"),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if req.ExpiresInSeconds > 0 {
+		expiresAt := now.Add(time.Duration(req.ExpiresInSeconds) * time.Second)
+		enrollment.ExpiresAt = &expiresAt
+	}
+
+	if err := h.db.Create(enrollment).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "enrollment_token.create", auditTarget{Type: "enrollment_token", ID: enrollment.ID, Name: enrollment.Name}, nil,
+		gin.H{"prefix": enrollment.Prefix, "max_uses": enrollment.MaxUses, "expires_at": enrollment.ExpiresAt, "project_id": enrollment.ProjectID})
+
+	c.JSON(http.StatusCreated, CreateEnrollmentTokenResponse{
+		Token:           token,
+		EnrollmentToken: enrollment,
+	})
+}
+
+// ListEnrollmentTokens returns all enrollment tokens
+func (h *Handler) ListEnrollmentTokens(c *gin.Context) {
+	var tokens []models.EnrollmentToken
+	if err := h.db.Order("created_at DESC").Find(&tokens).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// RevokeEnrollmentToken revokes an enrollment token so it can no longer be exchanged
+func (h *Handler) RevokeEnrollmentToken(c *gin.Context) {
+	tokenID := c.Param("id")
+
+	var enrollment models.EnrollmentToken
+	if err := h.db.First(&enrollment, "id = ?", tokenID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "enrollment token not found"})
+		return
+	}
+
+	if enrollment.RevokedAt == nil {
+		now := time.Now()
+		enrollment.RevokedAt = &now
+		enrollment.UpdatedAt = now
+		if err := h.db.Save(&enrollment).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		h.audit(c, "enrollment_token.revoke", auditTarget{Type: "enrollment_token", ID: enrollment.ID, Name: enrollment.Name}, nil, nil)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "enrollment token revoked",
+	})
+}
+
+// RevokeRunnerCredential revokes a runner's secret; the runner has to re-enroll to reconnect
+func (h *Handler) RevokeRunnerCredential(c *gin.Context) {
+	runnerID := c.Param("id")
+
+	var runner models.Runner
+	if err := h.db.First(&runner, "id = ?", runnerID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "runner not found"})
+		return
+	}
+
+	now := time.Now()
+	wasOffline := runnerOffline(&runner, now)
+	runner.CredentialRevokedAt = &now
+	runner.Status = "offline"
+	runner.UpdatedAt = now
+
+	if err := h.db.Save(&runner).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "runner.credential_revoke", auditTarget{Type: "runner", ID: runner.ID, Name: runner.Name}, nil, nil)
+	if !wasOffline {
+		h.publishRunner(events.RunnerOffline, &runner, "credential_revoked")
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "runner credential revoked",
+	})
+}
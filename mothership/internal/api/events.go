@@ -0,0 +1,261 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"borg/mothership/internal/auth"
+	"borg/mothership/internal/events"
+	"borg/mothership/internal/journal"
+	"borg/mothership/internal/models"
+	"borg/mothership/internal/webhook"
+	"borg/mothership/internal/websocket"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	eventStreamBatchSize = 500
+	eventStreamPoll      = 2 * time.Second // Fallback for entries appended by other instances
+	eventStreamKeepAlive = 15 * time.Second
+	eventStreamRetry     = 3000 // Milliseconds clients wait before reconnecting
+)
+
+// defaultEventTopics are streamed when a client names no topics
+var defaultEventTopics = []string{events.TopicJobs, events.TopicTasks, events.TopicRunners}
+
+// SetEvents publishes job, runner, task output and dataset state changes to bus
+func (h *Handler) SetEvents(bus *events.Bus) {
+	h.events = bus
+}
+
+// SetJournal enables the event stream, which reads events from j
+func (h *Handler) SetJournal(j *journal.Journal) {
+	h.journal = j
+}
+
+// eventAccess holds the permissions of an event subscriber. They are taken when it
+// connects and refreshed by revalidate.
+type eventAccess struct {
+	db *gorm.DB
+
+	mu      sync.RWMutex
+	request *gin.Context // Copy of the authenticated request
+}
+
+func newEventAccess(db *gorm.DB, c *gin.Context) *eventAccess {
+	return &eventAccess{db: db, request: c.Copy()}
+}
+
+// subscriberAccess builds the authorizer and revalidator of a dashboard WebSocket client
+func (h *Handler) subscriberAccess(c *gin.Context) (websocket.Authorizer, websocket.Revalidator) {
+	access := newEventAccess(h.db, c)
+	return access.authorize, access.revalidate
+}
+
+// authorize limits a subscriber to the events its user may read: runner events need
+// runners:read, every other event jobs:read in the project. The permission follows the
+// event type, not the topic, as a task event also reaches runner:<id> subscribers.
+func (a *eventAccess) authorize(eventType events.Type, projectID string) bool {
+	a.mu.RLock()
+	request := a.request
+	a.mu.RUnlock()
+
+	perm := auth.PermJobsRead
+	if strings.HasPrefix(string(eventType), "runner.") {
+		perm = auth.PermRunnersRead
+	}
+	if projectID == "" {
+		return hasPermission(request, perm)
+	}
+	return hasProjectPermission(request, projectID, perm)
+}
+
+// revalidate reports whether the subscriber's session or API key is still active and its
+// user enabled with the same role, and reloads the user's project roles. A subscriber
+// whose credentials were revoked or whose role changed has to reconnect.
+func (a *eventAccess) revalidate() bool {
+	a.mu.RLock()
+	request := a.request
+	a.mu.RUnlock()
+
+	userID := request.GetString("user_id")
+	now := time.Now()
+	var err error
+	if keyID, isKey := request.Get("api_key_id"); isKey {
+		var key models.APIKey
+		if err = a.db.First(&key, "id = ?", keyID).Error; err == nil && !key.IsActive(now) {
+			return false
+		}
+	} else {
+		var session models.Session
+		if err = a.db.First(&session, "id = ? AND user_id = ?", request.GetString("session_id"), userID).Error; err == nil &&
+			!session.IsActive(now) {
+			return false
+		}
+	}
+	var user models.User
+	if err == nil {
+		err = a.db.First(&user, "id = ?", userID).Error
+	}
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return false
+	case err != nil:
+		// Keep the subscriber while the database is unavailable
+		return true
+	case user.Disabled || user.MustChangePassword || user.Role != request.GetString("role"):
+		return false
+	}
+
+	refreshed := request.Copy()
+	refreshed.Set("project_roles", loadProjectRoles(a.db, userID))
+	a.mu.Lock()
+	a.request = refreshed
+	a.mu.Unlock()
+	return true
+}
+
+// StreamEvents streams job, task and runner events as server-sent events. The event
+// name is the event type, the event ID its journal sequence number and the data the
+// event as sent on /ws. Clients choose topics like /ws (topics=jobs,job:<id>, default
+// jobs,tasks,runners) and may narrow them to event types (types=job.*,runner.offline).
+// A client that reconnects with Last-Event-ID (or last_event_id) first receives the
+// events it missed; if those left the journal already it receives a "reset" event.
+func (h *Handler) StreamEvents(c *gin.Context) {
+	if h.journal == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "event stream is not enabled"})
+		return
+	}
+
+	topics := defaultEventTopics
+	if raw := c.Query("topics"); raw != "" {
+		topics = strings.Split(raw, ",")
+	}
+	subscribed := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		if !events.ValidTopic(topic) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid topic %q", topic)})
+			return
+		}
+		subscribed[topic] = true
+	}
+	var types []string
+	if raw := c.Query("types"); raw != "" {
+		types = strings.Split(raw, ",")
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	ctx := c.Request.Context()
+	var after uint64
+	resumed := lastEventID != ""
+	if resumed {
+		var err error
+		if after, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Last-Event-ID must be an event stream ID"})
+			return
+		}
+	} else {
+		latest, err := h.journal.Latest(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		after = latest
+	}
+
+	access := newEventAccess(h.db, c)
+	authorize := access.authorize
+	accepts := func(event *events.Event) bool {
+		if !webhook.Matches(types, event.Type) || !authorize(event.Type, event.ProjectID) {
+			return false
+		}
+		for _, topic := range event.Topics() {
+			if subscribed[topic] {
+				return true
+			}
+		}
+		return false
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	if _, err := fmt.Fprintf(c.Writer, "retry: %d\n\n", eventStreamRetry); err != nil {
+		return
+	}
+	c.Writer.Flush()
+
+	if resumed {
+		oldest, err := h.journal.Oldest(ctx)
+		if err != nil {
+			writeSSE(c, "error", "", gin.H{"error": err.Error()})
+			return
+		}
+		if oldest > after+1 {
+			if err := writeSSE(c, "reset", "", gin.H{"oldest_id": oldest}); err != nil {
+				return
+			}
+		}
+	}
+
+	poll := time.NewTicker(eventStreamPoll)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		// Taken before reading, so entries appended meanwhile wake the loop
+		changed := h.journal.Changed()
+
+		entries, err := h.journal.Since(ctx, after, eventStreamBatchSize)
+		if err != nil {
+			writeSSE(c, "error", "", gin.H{"error": err.Error()})
+			return
+		}
+		for i := range entries {
+			after = entries[i].ID
+			event := journal.Event(&entries[i])
+			if !accepts(&event) {
+				continue
+			}
+			if err := writeSSE(c, string(event.Type), strconv.FormatUint(after, 10), event); err != nil {
+				return
+			}
+		}
+		if len(entries) == eventStreamBatchSize {
+			continue
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+				waiting = false
+			case <-poll.C:
+				waiting = false
+			case <-keepAlive.C:
+				if !access.revalidate() {
+					writeSSE(c, "error", "", gin.H{"error": "credentials are no longer valid"})
+					return
+				}
+				if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+					return
+				}
+				c.Writer.Flush()
+			}
+		}
+	}
+}
@@ -14,12 +14,21 @@ import (
 	"time"
 
 	"borg/mothership/internal/auth"
+	"borg/mothership/internal/cluster"
 	"borg/mothership/internal/csvparser"
 	"borg/mothership/internal/dataset"
+	"borg/mothership/internal/events"
+	"borg/mothership/internal/journal"
+	"borg/mothership/internal/logstore"
 	"borg/mothership/internal/models"
+	"borg/mothership/internal/oidc"
+	"borg/mothership/internal/pki"
 	"borg/mothership/internal/processor"
 	"borg/mothership/internal/queue"
+	"borg/mothership/internal/ratelimit"
+	"borg/mothership/internal/secrets"
 	"borg/mothership/internal/storage"
+	"borg/mothership/internal/webhook"
 	"borg/mothership/internal/websocket"
 
 	"github.com/gin-gonic/gin"
@@ -36,6 +45,17 @@ type Handler struct {
 	agentHub      *websocket.AgentHub
 	processor     *processor.Processor
 	datasetParser *dataset.Parser
+	oidc          *oidc.Provider     // nil unless single sign-on is configured
+	secrets       *secrets.Cipher    // nil unless SECRETS_KEY is configured
+	limiter       *ratelimit.Limiter // nil disables rate limits and login lockouts
+	ca            *pki.CA            // nil unless runner certificates are enabled
+	pkiConfig     pki.Config
+	events        *events.Bus         // nil discards events raised by handlers
+	webhooks      *webhook.Dispatcher // nil unless webhooks are enabled
+	logs          *logstore.Store     // Set with SetLogStore before serving
+	journal       *journal.Journal    // nil unless the event stream is enabled
+	cluster       *cluster.Cluster    // nil for a single instance
+	remoteViewers *remoteViewers      // Screen viewers connected to other instances
 }
 
 // NewHandler creates a new API handler
@@ -51,17 +71,26 @@ func NewHandler(db *gorm.DB, q *queue.Queue, s *storage.Storage, screenHub *webs
 	}
 }
 
-// GetDashboardStats returns dashboard statistics
+// GetDashboardStats returns dashboard statistics for the projects the caller can see
 func (h *Handler) GetDashboardStats(c *gin.Context) {
-	stats, err := h.queue.GetStats(c.Request.Context())
+	projectIDs := listProjectIDs(c)
+	stats, err := h.queue.GetStats(c.Request.Context(), projectIDs)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Get runner count
+	// Get runner count, counting shared runners like ListRunners
 	var runnerCount int64
-	h.db.Model(&models.Runner{}).Count(&runnerCount)
+	runners := h.db.Model(&models.Runner{})
+	if projectIDs != nil {
+		if c.Query("project_id") != "" {
+			runners = runners.Where("project_id IN ?", projectIDs)
+		} else {
+			runners = runners.Where("project_id = '' OR project_id IS NULL OR project_id IN ?", projectIDs)
+		}
+	}
+	runners.Count(&runnerCount)
 	stats["runners"] = runnerCount
 
 	c.JSON(http.StatusOK, stats)
@@ -73,7 +102,7 @@ func (h *Handler) ListJobs(c *gin.Context) {
 	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
 	status := c.Query("status")
 
-	jobs, total, err := h.queue.ListJobs(limit, offset, status)
+	jobs, total, err := h.queue.ListJobs(limit, offset, status, listProjectIDs(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -102,19 +131,23 @@ func (h *Handler) GetJob(c *gin.Context) {
 
 // CreateJobRequest represents job creation request
 type CreateJobRequest struct {
-	Name                   string          `json:"name"`
-	Description            string          `json:"description"`
-	Type                   string          `json:"type"`
-	Priority               int32           `json:"priority"`
-	Command                string          `json:"command"`
-	Args                   json.RawMessage `json:"args"` // Can be array or null
-	Env                    json.RawMessage `json:"env"`  // Can be object or null
-	WorkingDirectory       string          `json:"working_directory"`
-	TimeoutSeconds         int64           `json:"timeout_seconds"`
-	MaxRetries             int32           `json:"max_retries"`
-	DatasetID              string          `json:"dataset_id"`                // For dataset type jobs
-	ProcessingScriptID     string          `json:"processing_script_id"`      // File ID of Python processing script
-	PostProcessingScriptID string          `json:"post_processing_script_id"` // File ID of Python post-processing script
+	Name                   string                `json:"name"`
+	Description            string                `json:"description"`
+	Type                   string                `json:"type"`
+	Priority               int32                 `json:"priority"`
+	Command                string                `json:"command"`
+	Args                   json.RawMessage       `json:"args"` // Can be array or null
+	Env                    json.RawMessage       `json:"env"`  // Can be object or null
+	WorkingDirectory       string                `json:"working_directory"`
+	TimeoutSeconds         int64                 `json:"timeout_seconds"`
+	MaxRetries             int32                 `json:"max_retries"`
+	DatasetID              string                `json:"dataset_id"`                // For dataset type jobs
+	ProcessingScriptID     string                `json:"processing_script_id"`      // File ID of Python processing script
+	PostProcessingScriptID string                `json:"post_processing_script_id"` // File ID of Python post-processing script
+	SecretEnv              map[string]string     `json:"secret_env"`                // Env var name -> secret name, injected on the runner
+	ProjectID              string                `json:"project_id"`                // Optional if the user belongs to a single project
+	Limits                 models.ResourceLimits `json:"limits"`                    // Per-task resource limits
+	Sandbox                models.SandboxOptions `json:"sandbox"`                   // Run tasks in a sandbox
 }
 
 // CreateJob creates a new job
@@ -131,6 +164,12 @@ func (h *Handler) CreateJob(c *gin.Context) {
 		return
 	}
 
+	projectID, err := projectForNewResource(c, req.ProjectID, auth.PermJobsCreate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Set defaults
 	if req.Type == "" {
 		req.Type = "shell"
@@ -149,22 +188,22 @@ func (h *Handler) CreateJob(c *gin.Context) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "processing_script_id is required for dataset type jobs"})
 			return
 		}
-		// Verify dataset exists
+		// Verify dataset exists in the job's project
 		var dataset models.Dataset
-		if err := h.db.First(&dataset, "id = ?", req.DatasetID).Error; err != nil {
+		if err := h.db.Where("project_id = ?", projectID).First(&dataset, "id = ?", req.DatasetID).Error; err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "dataset not found"})
 			return
 		}
 		// Verify processing script exists
 		var processingFile models.File
-		if err := h.db.First(&processingFile, "id = ?", req.ProcessingScriptID).Error; err != nil {
+		if err := h.db.First(&processingFile, "id = ? AND project_id = ?", req.ProcessingScriptID, projectID).Error; err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "processing script file not found"})
 			return
 		}
 		// Verify post-processing script if provided
 		if req.PostProcessingScriptID != "" {
 			var postProcessingFile models.File
-			if err := h.db.First(&postProcessingFile, "id = ?", req.PostProcessingScriptID).Error; err != nil {
+			if err := h.db.First(&postProcessingFile, "id = ? AND project_id = ?", req.PostProcessingScriptID, projectID).Error; err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "post-processing script file not found"})
 				return
 			}
@@ -177,6 +216,23 @@ func (h *Handler) CreateJob(c *gin.Context) {
 		}
 	}
 
+	if err := h.validateSecretRefs(c, projectID, req.SecretEnv); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateResourceLimits(req.Type, req.Limits); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateSandbox(req.Type, req.Sandbox); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	secretEnvJSON, _ := json.Marshal(req.SecretEnv)
+	if req.SecretEnv == nil {
+		secretEnvJSON = []byte("{}")
+	}
+
 	// Convert to Job model
 	job := &models.Job{
 		Name:             req.Name,
@@ -187,7 +243,12 @@ func (h *Handler) CreateJob(c *gin.Context) {
 		WorkingDirectory: req.WorkingDirectory,
 		TimeoutSeconds:   req.TimeoutSeconds,
 		MaxRetries:       req.MaxRetries,
+		Limits:           req.Limits,
+		Sandbox:          req.Sandbox,
 		Metadata:         "{}", // Initialize Metadata as empty JSON object
+		SecretEnv:        string(secretEnvJSON),
+		ProjectID:        projectID,
+		CreatedBy:        c.GetString("user_id"),
 	}
 
 	// Set dataset-specific fields
@@ -257,6 +318,7 @@ func (h *Handler) CreateJob(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.audit(c, "job.create", auditTarget{Type: "job", ID: job.ID, Name: job.Name}, nil, jobAuditSummary(job))
 
 	// For dataset jobs, parse CSV and create tasks in background
 	if req.Type == "dataset" {
@@ -264,11 +326,25 @@ func (h *Handler) CreateJob(c *gin.Context) {
 			tasks, err := h.datasetParser.ParseDatasetCSV(req.DatasetID, job.ID)
 			if err != nil {
 				log.Printf("Error parsing dataset CSV for job %s: %v", job.ID, err)
+				h.events.Publish(events.DatasetProcessed, job.ProjectID, map[string]interface{}{
+					"dataset_id": req.DatasetID,
+					"job_id":     job.ID,
+					"success":    false,
+					"error":      err.Error(),
+				})
 				// Update job status to failed
 				h.db.Model(&models.Job{}).Where("id = ?", job.ID).Update("status", "failed")
+				job.Status = "failed"
+				h.events.Publish(events.JobFailed, job.ProjectID, queue.JobEventData(job))
 				return
 			}
 			log.Printf("Created %d tasks from dataset for job %s", len(tasks), job.ID)
+			h.events.Publish(events.DatasetProcessed, job.ProjectID, map[string]interface{}{
+				"dataset_id": req.DatasetID,
+				"job_id":     job.ID,
+				"success":    true,
+				"tasks":      len(tasks),
+			})
 			// Notify agents that tasks are available
 			go h.notifyIdleAgentsOfTask()
 		}()
@@ -284,6 +360,17 @@ func (h *Handler) CreateJob(c *gin.Context) {
 func (h *Handler) PauseJob(c *gin.Context) {
 	jobID := c.Param("id")
 
+	var job models.Job
+	if err := h.db.First(&job, "id = ?", jobID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+
+	if !canManageJob(c, &job) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you can only manage your own jobs"})
+		return
+	}
+
 	if err := h.queue.PauseJob(jobID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -296,6 +383,17 @@ func (h *Handler) PauseJob(c *gin.Context) {
 func (h *Handler) ResumeJob(c *gin.Context) {
 	jobID := c.Param("id")
 
+	var job models.Job
+	if err := h.db.First(&job, "id = ?", jobID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+
+	if !canManageJob(c, &job) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you can only manage your own jobs"})
+		return
+	}
+
 	if err := h.queue.ResumeJob(jobID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -311,26 +409,41 @@ func (h *Handler) ResumeJob(c *gin.Context) {
 func (h *Handler) CancelJob(c *gin.Context) {
 	jobID := c.Param("id")
 
+	var job models.Job
+	if err := h.db.First(&job, "id = ?", jobID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+
+	if !canManageJob(c, &job) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you can only manage your own jobs"})
+		return
+	}
+
 	if err := h.queue.CancelJob(jobID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.audit(c, "job.cancel", auditTarget{Type: "job", ID: job.ID, Name: job.Name}, gin.H{"status": job.Status}, gin.H{"status": "cancelled"})
 
 	c.JSON(http.StatusOK, gin.H{"message": "job cancelled"})
 }
 
 // UpdateJobRequest represents job update request (all fields optional)
 type UpdateJobRequest struct {
-	Name             *string         `json:"name"`
-	Description      *string         `json:"description"`
-	Type             *string         `json:"type"`
-	Priority         *int32          `json:"priority"`
-	Command          *string         `json:"command"`
-	Args             json.RawMessage `json:"args"`
-	Env              json.RawMessage `json:"env"`
-	WorkingDirectory *string         `json:"working_directory"`
-	TimeoutSeconds   *int64          `json:"timeout_seconds"`
-	MaxRetries       *int32          `json:"max_retries"`
+	Name             *string                `json:"name"`
+	Description      *string                `json:"description"`
+	Type             *string                `json:"type"`
+	Priority         *int32                 `json:"priority"`
+	Command          *string                `json:"command"`
+	Args             json.RawMessage        `json:"args"`
+	Env              json.RawMessage        `json:"env"`
+	WorkingDirectory *string                `json:"working_directory"`
+	TimeoutSeconds   *int64                 `json:"timeout_seconds"`
+	MaxRetries       *int32                 `json:"max_retries"`
+	SecretEnv        *map[string]string     `json:"secret_env"`
+	Limits           *models.ResourceLimits `json:"limits"`  // Replaces all limits
+	Sandbox          *models.SandboxOptions `json:"sandbox"` // Replaces all sandbox options
 }
 
 // UpdateJob updates a job (only allowed for pending or paused jobs)
@@ -343,6 +456,11 @@ func (h *Handler) UpdateJob(c *gin.Context) {
 		return
 	}
 
+	if !canManageJob(c, &job) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you can only manage your own jobs"})
+		return
+	}
+
 	// Only allow updating pending or paused jobs
 	if job.Status != "pending" && job.Status != "paused" {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -356,6 +474,7 @@ func (h *Handler) UpdateJob(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	before := jobAuditSummary(&job)
 
 	// Update fields if provided
 	if req.Name != nil {
@@ -390,6 +509,28 @@ func (h *Handler) UpdateJob(c *gin.Context) {
 	if req.MaxRetries != nil {
 		job.MaxRetries = *req.MaxRetries
 	}
+	if req.SecretEnv != nil {
+		if err := h.validateSecretRefs(c, job.ProjectID, *req.SecretEnv); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		secretEnvJSON, _ := json.Marshal(*req.SecretEnv)
+		job.SecretEnv = string(secretEnvJSON)
+	}
+	if req.Limits != nil {
+		if err := validateResourceLimits(job.Type, *req.Limits); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		job.Limits = *req.Limits
+	}
+	if req.Sandbox != nil {
+		job.Sandbox = *req.Sandbox
+	}
+	if err := validateSandbox(job.Type, job.Sandbox); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// Handle Args update (only if provided - json.RawMessage is nil if field is missing)
 	if len(req.Args) > 0 {
@@ -448,6 +589,8 @@ func (h *Handler) UpdateJob(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.audit(c, "job.update", auditTarget{Type: "job", ID: job.ID, Name: job.Name}, before, jobAuditSummary(&job))
+	h.events.Publish(events.JobUpdated, job.ProjectID, queue.JobEventData(&job))
 
 	c.JSON(http.StatusOK, job)
 }
@@ -462,6 +605,11 @@ func (h *Handler) DeleteJob(c *gin.Context) {
 		return
 	}
 
+	if !canManageJob(c, &job) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you can only manage your own jobs"})
+		return
+	}
+
 	// Check if job has running tasks
 	var runningTaskCount int64
 	h.db.Model(&models.Task{}).Where("job_id = ? AND status = ?", jobID, "running").Count(&runningTaskCount)
@@ -477,6 +625,8 @@ func (h *Handler) DeleteJob(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.audit(c, "job.delete", auditTarget{Type: "job", ID: job.ID, Name: job.Name}, jobAuditSummary(&job), nil)
+	h.events.Publish(events.JobDeleted, job.ProjectID, queue.JobEventData(&job))
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -486,19 +636,28 @@ func (h *Handler) DeleteJob(c *gin.Context) {
 
 // ListRunners returns a list of runners with calculated offline status
 func (h *Handler) ListRunners(c *gin.Context) {
+	// Shared runners are visible to everyone, dedicated runners only to their project
+	query := h.db.Model(&models.Runner{})
+	if ids := listProjectIDs(c); ids != nil {
+		if c.Query("project_id") != "" {
+			query = query.Where("project_id IN ?", ids)
+		} else {
+			query = query.Where("project_id = '' OR project_id IS NULL OR project_id IN ?", ids)
+		}
+	}
+
 	var runners []models.Runner
-	if err := h.db.Find(&runners).Error; err != nil {
+	if err := query.Find(&runners).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Calculate offline status based on last heartbeat (2 minutes threshold)
+	// Calculate offline status based on last heartbeat
 	now := time.Now()
-	offlineThreshold := 2 * time.Minute
 
 	for i := range runners {
 		timeSinceHeartbeat := now.Sub(runners[i].LastHeartbeat)
-		if timeSinceHeartbeat > offlineThreshold {
+		if timeSinceHeartbeat > runnerOfflineAfter {
 			// Override status to offline if heartbeat is too old
 			runners[i].Status = "offline"
 		}
@@ -547,6 +706,7 @@ func (h *Handler) RenameRunner(c *gin.Context) {
 	}
 
 	// Update only the name, DeviceID remains unchanged
+	oldName := runner.Name
 	runner.Name = req.Name
 	runner.UpdatedAt = time.Now()
 
@@ -554,6 +714,8 @@ func (h *Handler) RenameRunner(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.audit(c, "runner.rename", auditTarget{Type: "runner", ID: runner.ID, Name: runner.Name}, gin.H{"name": oldName}, gin.H{"name": runner.Name})
+	h.publishRunner(events.RunnerUpdated, &runner)
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -585,6 +747,9 @@ func (h *Handler) DeleteRunner(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.audit(c, "runner.delete", auditTarget{Type: "runner", ID: runner.ID, Name: runner.Name},
+		gin.H{"name": runner.Name, "hostname": runner.Hostname, "device_id": runner.DeviceID, "status": runner.Status}, nil)
+	h.publishRunner(events.RunnerDeleted, &runner)
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -592,19 +757,9 @@ func (h *Handler) DeleteRunner(c *gin.Context) {
 	})
 }
 
-// GetTaskLogs returns logs for a task
+// GetTaskLogs returns a page of a task's logs, see logFilterFromQuery for the parameters
 func (h *Handler) GetTaskLogs(c *gin.Context) {
-	taskID := c.Param("id")
-
-	var logs []models.TaskLog
-	if err := h.db.Where("task_id = ?", taskID).
-		Order("timestamp ASC").
-		Find(&logs).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, logs)
+	h.findLogs(c, logstore.Scope{TaskID: c.Param("id")})
 }
 
 // Runner API endpoints
@@ -618,7 +773,9 @@ type RegisterRunnerRequest struct {
 	Architecture       string            `json:"architecture"`
 	MaxConcurrentTasks int32             `json:"max_concurrent_tasks"`
 	Labels             map[string]string `json:"labels"`
-	Token              string            `json:"token"`
+	Token              string            `json:"token"`         // Enrollment token (first registration)
+	RunnerSecret       string            `json:"runner_secret"` // Per-runner secret issued at enrollment
+	CSR                string            `json:"csr"`           // PEM certificate signing request for a client certificate
 	// Resource information
 	CPUCores                int32           `json:"cpu_cores"`
 	CPUModel                string          `json:"cpu_model"`
@@ -631,6 +788,7 @@ type RegisterRunnerRequest struct {
 	PublicIPs               []string        `json:"public_ips"`
 	ScreenMonitoringEnabled bool            `json:"screen_monitoring_enabled"`
 	Runtimes                []RuntimeConfig `json:"runtimes"`
+	Features                []string        `json:"features"` // Agent features, as in the WebSocket hello
 }
 
 // GPUInfo represents GPU information
@@ -649,13 +807,16 @@ type RuntimeConfig struct {
 
 // RegisterRunnerResponse represents runner registration response
 type RegisterRunnerResponse struct {
-	RunnerID string `json:"runner_id"`
-	Success  bool   `json:"success"`
-	Message  string `json:"message"`
+	RunnerID           string `json:"runner_id"`
+	RunnerSecret       string `json:"runner_secret,omitempty"` // Only set when a new secret was issued
+	Success            bool   `json:"success"`
+	Message            string `json:"message"`
+	*RunnerCertificate        // Set when a CSR was sent and runner certificates are enabled
 }
 
 // RegisterRunner registers a new runner or updates an existing one if the same device_id is found
 // Falls back to hostname matching for backward compatibility if device_id is not provided
+// Known runners authenticate with their runner secret; everyone else has to exchange an enrollment token
 func (h *Handler) RegisterRunner(c *gin.Context) {
 	var req RegisterRunnerRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -663,18 +824,16 @@ func (h *Handler) RegisterRunner(c *gin.Context) {
 		return
 	}
 
-	// TODO: Validate token
-	// For now, accept any non-empty token
-	if req.Token == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "token required"})
+	if req.Token == "" && req.RunnerSecret == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "enrollment token or runner secret required"})
 		return
 	}
 
 	now := time.Now()
-	labelsJSON, _ := json.Marshal(req.Labels)
 	gpuInfoJSON, _ := json.Marshal(req.GPUInfo)
 	publicIPsJSON, _ := json.Marshal(req.PublicIPs)
 	runtimesJSON, _ := json.Marshal(req.Runtimes)
+	featuresJSON, _ := json.Marshal(supportedAgentFeatures(req.Features))
 
 	// Check if a runner with the same device_id already exists (including soft-deleted)
 	// If device_id is not provided, fall back to hostname for backward compatibility
@@ -688,8 +847,50 @@ func (h *Handler) RegisterRunner(c *gin.Context) {
 		err = h.db.Unscoped().Where("hostname = ?", req.Hostname).First(&existingRunner).Error
 	}
 
-	if err == nil {
+	// Check if error is "not found" (expected) or a real database error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, RegisterRunnerResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	// A known runner may re-register with its own secret; otherwise consume an enrollment token
+	var enrollment *models.EnrollmentToken
+	if err != nil || !runnerSecretMatches(&existingRunner, req.RunnerSecret) {
+		var enrollErr error
+		enrollment, enrollErr = h.consumeEnrollmentToken(req.Token, now)
+		if enrollErr != nil {
+			c.JSON(http.StatusUnauthorized, RegisterRunnerResponse{
+				Success: false,
+				Message: enrollErr.Error(),
+			})
+			return
+		}
+	}
+
+	// Issue a fresh runner secret whenever an enrollment token was exchanged
+	var runnerSecret string
+	if enrollment != nil {
+		runnerSecret, err = auth.GenerateToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, RegisterRunnerResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+	}
+
+	if existingRunner.ID != "" {
 		// Runner exists - update it instead of creating a new one
+		enrollmentTokenID := existingRunner.EnrollmentTokenID
+		if enrollment != nil {
+			enrollmentTokenID = enrollment.ID
+		}
+		labelsJSON, _ := json.Marshal(h.runnerLabels(req.Labels, enrollmentTokenID))
+
 		existingRunner.Name = req.Name
 		existingRunner.Hostname = req.Hostname // Update hostname in case it changed
 		existingRunner.OS = req.OS
@@ -708,6 +909,7 @@ func (h *Handler) RegisterRunner(c *gin.Context) {
 		existingRunner.PublicIPs = string(publicIPsJSON)
 		existingRunner.ScreenMonitoringEnabled = req.ScreenMonitoringEnabled
 		existingRunner.Runtimes = string(runtimesJSON)
+		existingRunner.AgentFeatures = string(featuresJSON)
 		existingRunner.LastHeartbeat = now
 		existingRunner.UpdatedAt = now
 
@@ -716,6 +918,15 @@ func (h *Handler) RegisterRunner(c *gin.Context) {
 			existingRunner.DeviceID = req.DeviceID
 		}
 
+		// Replace the runner credential if it re-enrolled
+		if enrollment != nil {
+			existingRunner.SecretHash = auth.HashToken(runnerSecret)
+			existingRunner.EnrollmentTokenID = enrollment.ID
+			existingRunner.ProjectID = enrollment.ProjectID
+			existingRunner.CredentialIssuedAt = &now
+			existingRunner.CredentialRevokedAt = nil
+		}
+
 		// If runner was soft-deleted, restore it by clearing DeletedAt
 		if existingRunner.DeletedAt.Valid {
 			existingRunner.DeletedAt = gorm.DeletedAt{}
@@ -729,6 +940,15 @@ func (h *Handler) RegisterRunner(c *gin.Context) {
 			}
 		}
 
+		certificate, err := h.issueRunnerCertificate(&existingRunner, req.CSR)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, RegisterRunnerResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
 		if err := h.db.Save(&existingRunner).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, RegisterRunnerResponse{
 				Success: false,
@@ -737,25 +957,21 @@ func (h *Handler) RegisterRunner(c *gin.Context) {
 			return
 		}
 
-		c.JSON(http.StatusOK, RegisterRunnerResponse{
-			RunnerID: existingRunner.ID,
-			Success:  true,
-			Message:  "runner re-registered successfully",
-		})
-		return
-	}
+		h.publishRunner(events.RunnerRegistered, &existingRunner)
 
-	// Check if error is "not found" (expected) or a real database error
-	if !errors.Is(err, gorm.ErrRecordNotFound) {
-		c.JSON(http.StatusInternalServerError, RegisterRunnerResponse{
-			Success: false,
-			Message: err.Error(),
+		c.JSON(http.StatusOK, RegisterRunnerResponse{
+			RunnerID:          existingRunner.ID,
+			RunnerSecret:      runnerSecret,
+			Success:           true,
+			Message:           "runner re-registered successfully",
+			RunnerCertificate: certificate,
 		})
 		return
 	}
 
 	// Runner doesn't exist - create a new one
 	runnerID := uuid.New().String()
+	labelsJSON, _ := json.Marshal(h.runnerLabels(req.Labels, enrollment.ID))
 
 	// Use provided device_id or generate a new one
 	deviceID := req.DeviceID
@@ -784,12 +1000,26 @@ func (h *Handler) RegisterRunner(c *gin.Context) {
 		PublicIPs:               string(publicIPsJSON),
 		ScreenMonitoringEnabled: req.ScreenMonitoringEnabled,
 		Runtimes:                string(runtimesJSON),
+		AgentFeatures:           string(featuresJSON),
+		SecretHash:              auth.HashToken(runnerSecret),
+		EnrollmentTokenID:       enrollment.ID,
+		ProjectID:               enrollment.ProjectID,
+		CredentialIssuedAt:      &now,
 		RegisteredAt:            now,
 		LastHeartbeat:           now,
 		CreatedAt:               now,
 		UpdatedAt:               now,
 	}
 
+	certificate, err := h.issueRunnerCertificate(runner, req.CSR)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, RegisterRunnerResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
 	if err := h.db.Create(runner).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, RegisterRunnerResponse{
 			Success: false,
@@ -798,10 +1028,14 @@ func (h *Handler) RegisterRunner(c *gin.Context) {
 		return
 	}
 
+	h.publishRunner(events.RunnerRegistered, runner)
+
 	c.JSON(http.StatusOK, RegisterRunnerResponse{
-		RunnerID: runnerID,
-		Success:  true,
-		Message:  "runner registered successfully",
+		RunnerID:          runnerID,
+		RunnerSecret:      runnerSecret,
+		Success:           true,
+		Message:           "runner registered successfully",
+		RunnerCertificate: certificate,
 	})
 }
 
@@ -861,7 +1095,7 @@ func (h *Handler) Heartbeat(c *gin.Context) {
 		}
 	}
 
-	if err := h.db.Model(&models.Runner{}).Where("id = ?", runnerID).Updates(updates).Error; err != nil {
+	if err := h.updateRunnerHeartbeat(runnerID, updates); err != nil {
 		c.JSON(http.StatusNotFound, HeartbeatResponse{
 			Success: false,
 		})
@@ -879,7 +1113,7 @@ type GetNextTaskResponse struct {
 	TaskID           string                 `json:"task_id"`
 	JobID            string                 `json:"job_id"`
 	JobName          string                 `json:"job_name"`
-	Type             string                 `json:"type"` // shell, binary, docker, executor_binary
+	Type             string                 `json:"type"` // shell, binary, docker, executor_binary, wasm
 	Command          string                 `json:"command"`
 	Args             []string               `json:"args"`
 	Env              map[string]string      `json:"env"`
@@ -890,6 +1124,9 @@ type GetNextTaskResponse struct {
 	RequiredFiles    []string               `json:"required_files"`
 	ExecutorBinaryID string                 `json:"executor_binary_id,omitempty"` // For executor_binary type
 	TaskData         map[string]interface{} `json:"task_data,omitempty"`          // CSV row data
+	TaskToken        string                 `json:"task_token,omitempty"`         // Scoped token for reporting results of this task
+	Limits           *models.ResourceLimits `json:"limits,omitempty"`             // Resource limits of the task
+	Sandbox          *models.SandboxOptions `json:"sandbox,omitempty"`            // Run the task in a sandbox
 }
 
 // GetNextTask returns the next pending task for a runner
@@ -907,82 +1144,24 @@ func (h *Handler) GetNextTask(c *gin.Context) {
 		return
 	}
 
-	// Load job
-	var job models.Job
-	if err := h.db.First(&job, "id = ?", task.JobID).Error; err != nil {
+	response, err := h.buildTaskResponse(runnerID, task)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Load job files
-	var jobFiles []models.JobFile
-	h.db.Where("job_id = ?", job.ID).Find(&jobFiles)
-
-	var args []string
-	json.Unmarshal([]byte(job.Args), &args)
-
-	var env map[string]string
-	json.Unmarshal([]byte(job.Env), &env)
-	if env == nil {
-		env = make(map[string]string)
-	}
-
-	requiredFiles := make([]string, 0, len(jobFiles))
-	for _, jf := range jobFiles {
-		requiredFiles = append(requiredFiles, jf.FileID)
-	}
-
-	// If executor_binary type, add executor binary to required files
-	if job.Type == "executor_binary" && job.ExecutorBinaryID != "" {
-		var executorBinary models.ExecutorBinary
-		if err := h.db.Preload("File").First(&executorBinary, "id = ?", job.ExecutorBinaryID).Error; err == nil {
-			requiredFiles = append(requiredFiles, executorBinary.FileID)
-		}
-	}
-
-	// If dataset type, add processing script to required files
-	if job.Type == "dataset" && job.Command != "" {
-		// Command contains the processing script file ID
-		requiredFiles = append(requiredFiles, job.Command)
-	}
-
-	// Parse TaskData if present
-	var taskData map[string]interface{}
-	if task.TaskData != "" {
-		json.Unmarshal([]byte(task.TaskData), &taskData)
-	}
-
-	response := GetNextTaskResponse{
-		TaskID:           task.ID,
-		JobID:            job.ID,
-		JobName:          job.Name,
-		Type:             job.Type,
-		Command:          job.Command,
-		Args:             args,
-		Env:              env,
-		WorkingDirectory: job.WorkingDirectory,
-		TimeoutSeconds:   job.TimeoutSeconds,
-		DockerImage:      job.DockerImage,
-		Privileged:       job.Privileged,
-		RequiredFiles:    requiredFiles,
-		TaskData:         taskData,
-	}
-
-	if job.Type == "executor_binary" {
-		response.ExecutorBinaryID = job.ExecutorBinaryID
-	}
-
 	c.JSON(http.StatusOK, response)
 }
 
 // UpdateTaskStatusRequest represents task status update request
 type UpdateTaskStatusRequest struct {
-	Status       string `json:"status"` // pending, running, completed, failed, cancelled
-	ExitCode     *int32 `json:"exit_code"`
-	ErrorMessage string `json:"error_message"`
-	Stdout       []byte `json:"stdout"`
-	Stderr       []byte `json:"stderr"`
-	Timestamp    int64  `json:"timestamp"`
+	Status       string     `json:"status"` // pending, running, completed, failed, cancelled
+	ExitCode     *int32     `json:"exit_code"`
+	ErrorMessage string     `json:"error_message"`
+	Stdout       []byte     `json:"stdout"`
+	Stderr       []byte     `json:"stderr"`
+	Timestamp    int64      `json:"timestamp"`
+	Usage        *TaskUsage `json:"usage,omitempty"` // With the final status
 }
 
 // UpdateTaskStatusResponse represents task status update response
@@ -1001,11 +1180,17 @@ func (h *Handler) UpdateTaskStatus(c *gin.Context) {
 		return
 	}
 
+	if _, err := h.runnerTask(c, taskID); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "task is not assigned to this runner"})
+		return
+	}
+
 	exitCode := req.ExitCode
 	if exitCode != nil && *exitCode == -1 {
 		exitCode = nil
 	}
 
+	h.recordTaskUsage(taskID, req.Usage)
 	err := h.queue.UpdateTaskStatus(taskID, req.Status, exitCode, req.ErrorMessage)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, UpdateTaskStatusResponse{
@@ -1015,27 +1200,8 @@ func (h *Handler) UpdateTaskStatus(c *gin.Context) {
 		return
 	}
 
-	// Store logs if provided
-	if len(req.Stdout) > 0 || len(req.Stderr) > 0 {
-		var taskLog models.TaskLog
-		taskLog.TaskID = taskID
-		taskLog.Timestamp = time.Unix(req.Timestamp, 0)
-		if taskLog.Timestamp.IsZero() {
-			taskLog.Timestamp = time.Now()
-		}
-
-		if len(req.Stdout) > 0 {
-			taskLog.Level = "stdout"
-			taskLog.Message = string(req.Stdout)
-			h.db.Create(&taskLog)
-		}
-
-		if len(req.Stderr) > 0 {
-			taskLog.Level = "stderr"
-			taskLog.Message = string(req.Stderr)
-			h.db.Create(&taskLog)
-		}
-	}
+	// Store logs if provided, with secret values masked
+	h.storeTaskLogs(taskID, &req)
 
 	c.JSON(http.StatusOK, UpdateTaskStatusResponse{
 		Success: true,
@@ -1061,8 +1227,12 @@ func (h *Handler) UpdateTaskResult(c *gin.Context) {
 	}
 
 	// Get task
-	var task models.Task
-	if err := h.db.First(&task, "id = ?", taskID).Error; err != nil {
+	task, err := h.runnerTask(c, taskID)
+	if err == errTaskNotAssigned {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "task not found"})
 		return
 	}
@@ -1108,7 +1278,7 @@ func (h *Handler) UpdateTaskResult(c *gin.Context) {
 
 	task.UpdatedAt = time.Now()
 
-	if err := h.db.Save(&task).Error; err != nil {
+	if err := h.db.Save(task).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -1139,6 +1309,11 @@ func (h *Handler) UpdateTaskResult(c *gin.Context) {
 func (h *Handler) DownloadFile(c *gin.Context) {
 	fileID := c.Param("id")
 
+	if !h.runnerMayDownload(c.GetString("runner_id"), fileID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "file is not required by any task assigned to this runner"})
+		return
+	}
+
 	// Get file record
 	var file models.File
 	if err := h.db.First(&file, "id = ?", fileID).Error; err != nil {
@@ -1171,6 +1346,11 @@ func (h *Handler) UploadArtifact(c *gin.Context) {
 		return
 	}
 
+	if _, err := h.runnerTask(c, taskID); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "task is not assigned to this runner"})
+		return
+	}
+
 	file, err := c.FormFile("file")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -1344,8 +1524,10 @@ func (h *Handler) GetScreenStreamStatus(c *gin.Context) {
 		return
 	}
 
-	isStreaming := h.screenHub.IsStreaming(runnerID)
-	viewerCount := h.screenHub.ViewerCount(runnerID)
+	// Viewers may be connected to other instances than the one the agent polls
+	remoteViewers := h.remoteViewers.count(runnerID)
+	isStreaming := h.screenHub.IsStreaming(runnerID) || remoteViewers > 0
+	viewerCount := h.screenHub.ViewerCount(runnerID) + remoteViewers
 
 	// Use defaults if not set
 	quality := runner.ScreenQuality
@@ -1445,10 +1627,12 @@ type LoginRequest struct {
 
 // LoginResponse represents login response
 type LoginResponse struct {
-	Token   string       `json:"token"`
-	User    *models.User `json:"user"`
-	Success bool         `json:"success"`
-	Message string       `json:"message"`
+	Token        string       `json:"token"`
+	RefreshToken string       `json:"refresh_token,omitempty"`
+	ExpiresIn    int64        `json:"expires_in,omitempty"`
+	User         *models.User `json:"user"`
+	Success      bool         `json:"success"`
+	Message      string       `json:"message"`
 }
 
 // Login handles user authentication
@@ -1462,10 +1646,23 @@ func (h *Handler) Login(c *gin.Context) {
 		return
 	}
 
+	// Refuse attempts while the username or client IP is locked out after repeated failures
+	if lockedUntil := h.loginLockedUntil(c, req.Username); !lockedUntil.IsZero() {
+		h.auditLogin(c, nil, req.Username, "locked out")
+		setRetryAfter(c, time.Until(lockedUntil))
+		c.JSON(http.StatusTooManyRequests, LoginResponse{
+			Success: false,
+			Message: "too many failed login attempts, try again later",
+		})
+		return
+	}
+
 	// Find user by username
 	var user models.User
 	if err := h.db.Where("username = ?", req.Username).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
+			h.recordLoginFailure(c, req.Username)
+			h.auditLogin(c, nil, req.Username, "unknown user")
 			c.JSON(http.StatusUnauthorized, LoginResponse{
 				Success: false,
 				Message: "invalid username or password",
@@ -1478,6 +1675,8 @@ func (h *Handler) Login(c *gin.Context) {
 
 	// Verify password
 	if !auth.VerifyPassword(req.Password, user.PasswordHash) {
+		h.recordLoginFailure(c, req.Username)
+		h.auditLogin(c, &user, req.Username, "invalid password")
 		c.JSON(http.StatusUnauthorized, LoginResponse{
 			Success: false,
 			Message: "invalid username or password",
@@ -1485,26 +1684,41 @@ func (h *Handler) Login(c *gin.Context) {
 		return
 	}
 
-	// Generate JWT token
-	token, err := auth.GenerateJWT(user.ID, user.Username)
+	if user.Disabled {
+		h.auditLogin(c, &user, req.Username, "account disabled")
+		c.JSON(http.StatusForbidden, LoginResponse{
+			Success: false,
+			Message: "account is disabled",
+		})
+		return
+	}
+
+	// Start a session and generate its tokens
+	tokens, err := h.issueSession(c, &user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.resetLoginFailures(c, req.Username)
+	h.auditLogin(c, &user, req.Username, "")
 
 	// Return response (don't include password hash)
 	userResponse := &models.User{
-		ID:        user.ID,
-		Username:  user.Username,
-		CreatedAt: user.CreatedAt,
-		UpdatedAt: user.UpdatedAt,
+		ID:                 user.ID,
+		Username:           user.Username,
+		Role:               user.Role,
+		MustChangePassword: user.MustChangePassword,
+		CreatedAt:          user.CreatedAt,
+		UpdatedAt:          user.UpdatedAt,
 	}
 
 	c.JSON(http.StatusOK, LoginResponse{
-		Token:   token,
-		User:    userResponse,
-		Success: true,
-		Message: "login successful",
+		Token:        tokens.Token,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+		User:         userResponse,
+		Success:      true,
+		Message:      "login successful",
 	})
 }
 
@@ -1531,6 +1745,7 @@ func (h *Handler) UpdateScreenSettings(c *gin.Context) {
 		return
 	}
 
+	before := screenSettingsSummary(&runner)
 	runner.ScreenQuality = req.Quality
 	runner.ScreenFPS = req.FPS
 	if req.ScreenIndex != nil {
@@ -1543,6 +1758,9 @@ func (h *Handler) UpdateScreenSettings(c *gin.Context) {
 		return
 	}
 
+	h.audit(c, "runner.screen_settings", auditTarget{Type: "runner", ID: runner.ID, Name: runner.Name}, before, screenSettingsSummary(&runner))
+	h.publishRunner(events.RunnerUpdated, &runner)
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "screen settings updated successfully",
@@ -1567,29 +1785,20 @@ func (h *Handler) GetCurrentUser(c *gin.Context) {
 
 	// Return user without password hash
 	userResponse := &models.User{
-		ID:        user.ID,
-		Username:  user.Username,
-		CreatedAt: user.CreatedAt,
-		UpdatedAt: user.UpdatedAt,
+		ID:                 user.ID,
+		Username:           user.Username,
+		Role:               user.Role,
+		MustChangePassword: user.MustChangePassword,
+		CreatedAt:          user.CreatedAt,
+		UpdatedAt:          user.UpdatedAt,
 	}
 
 	c.JSON(http.StatusOK, userResponse)
 }
 
 // handleWebSocketHeartbeat handles heartbeat messages from agents via WebSocket
-func (h *Handler) handleWebSocketHeartbeat(runnerID string, data interface{}) {
-	// Convert data to HeartbeatRequest
-	dataBytes, err := json.Marshal(data)
-	if err != nil {
-		log.Printf("Failed to marshal heartbeat data from runner %s: %v", runnerID, err)
-		return
-	}
-
-	var req HeartbeatRequest
-	if err := json.Unmarshal(dataBytes, &req); err != nil {
-		log.Printf("Failed to unmarshal heartbeat request from runner %s: %v", runnerID, err)
-		return
-	}
+func (h *Handler) handleWebSocketHeartbeat(runnerID string, msg *AgentHeartbeat) {
+	req := &msg.HeartbeatRequest
 
 	now := time.Now()
 	updates := map[string]interface{}{
@@ -1616,81 +1825,105 @@ func (h *Handler) handleWebSocketHeartbeat(runnerID string, data interface{}) {
 		}
 	}
 
-	if err := h.db.Model(&models.Runner{}).Where("id = ?", runnerID).Updates(updates).Error; err != nil {
+	if err := h.updateRunnerHeartbeat(runnerID, updates); err != nil {
 		log.Printf("Failed to update heartbeat for runner %s: %v", runnerID, err)
+		h.replyAgentError(runnerID, msg.AgentHeader, AgentMsgHeartbeat, AgentErrInternal, "failed to record heartbeat")
 		return
 	}
 
 	// Send response via WebSocket if connected
-	h.agentHub.SendMessage(runnerID, "heartbeat_response", HeartbeatResponse{
-		Success:               true,
-		NextHeartbeatInterval: 30,
+	h.agentHub.SendMessage(runnerID, AgentMsgHeartbeatResponse, AgentHeartbeatResponse{
+		AgentHeader: AgentHeader{ReplyTo: msg.ID},
+		HeartbeatResponse: HeartbeatResponse{
+			Success:               true,
+			NextHeartbeatInterval: 30,
+		},
 	})
 }
 
 // handleWebSocketTaskStatus handles task status updates from agents via WebSocket
-func (h *Handler) handleWebSocketTaskStatus(runnerID string, data interface{}) {
-	// Convert data to UpdateTaskStatusRequest
-	dataBytes, err := json.Marshal(data)
-	if err != nil {
-		log.Printf("Failed to marshal task status data from runner %s: %v", runnerID, err)
+func (h *Handler) handleWebSocketTaskStatus(runnerID string, msg *AgentTaskStatus) {
+	taskID := msg.TaskID
+	if taskID == "" {
+		h.replyAgentError(runnerID, msg.AgentHeader, AgentMsgTaskStatus, AgentErrInvalidMessage, "task_id is required")
 		return
 	}
-
-	var req UpdateTaskStatusRequest
-	if err := json.Unmarshal(dataBytes, &req); err != nil {
-		log.Printf("Failed to unmarshal task status request from runner %s: %v", runnerID, err)
+	if len(msg.IdempotencyKey) > maxIdempotencyKey {
+		h.replyAgentError(runnerID, msg.AgentHeader, AgentMsgTaskStatus, AgentErrInvalidMessage, "idempotency_key is too long")
 		return
 	}
+	req := &msg.UpdateTaskStatusRequest
 
-	// Extract task ID from the request (it should be in the data)
-	var taskStatusData map[string]interface{}
-	if err := json.Unmarshal(dataBytes, &taskStatusData); err == nil {
-		if taskID, ok := taskStatusData["task_id"].(string); ok {
-			exitCode := req.ExitCode
-			if exitCode != nil && *exitCode == -1 {
-				exitCode = nil
-			}
-
-			err := h.queue.UpdateTaskStatus(taskID, req.Status, exitCode, req.ErrorMessage)
-			if err != nil {
-				log.Printf("Failed to update task status for task %s: %v", taskID, err)
-				return
-			}
+	var task models.Task
+	if err := h.db.First(&task, "id = ?", taskID).Error; err != nil || task.RunnerID != runnerID {
+		log.Printf("Rejected task status for task %s from runner %s: task is not assigned to this runner", taskID, runnerID)
+		h.replyAgentError(runnerID, msg.AgentHeader, AgentMsgTaskStatus, AgentErrNotAssigned, "task is not assigned to this runner")
+		return
+	}
 
-			// Store logs if provided
-			if len(req.Stdout) > 0 || len(req.Stderr) > 0 {
-				var taskLog models.TaskLog
-				taskLog.TaskID = taskID
-				taskLog.Timestamp = time.Unix(req.Timestamp, 0)
-				if taskLog.Timestamp.IsZero() {
-					taskLog.Timestamp = time.Now()
-				}
+	response := UpdateTaskStatusResponse{
+		Success: true,
+		Message: "task status updated",
+	}
 
-				if len(req.Stdout) > 0 {
-					taskLog.Level = "stdout"
-					taskLog.Message = string(req.Stdout)
-					h.db.Create(&taskLog)
-				}
+	// A status resent with the same key is applied once, like over HTTP
+	apply := true
+	if msg.IdempotencyKey != "" {
+		recorded, reserved, err := h.reserveRequest(runnerID, msg.IdempotencyKey)
+		switch {
+		case err != nil:
+			log.Printf("Failed to reserve request %s of runner %s: %v", msg.IdempotencyKey, runnerID, err)
+			h.replyAgentError(runnerID, msg.AgentHeader, AgentMsgTaskStatus, AgentErrInternal, "failed to check idempotency_key")
+			return
+		case !reserved && recorded.StatusCode == idempotencyPending:
+			h.replyAgentError(runnerID, msg.AgentHeader, AgentMsgTaskStatus, AgentErrInProgress, "a request with this idempotency_key is in progress")
+			return
+		}
+		apply = reserved
+	}
+	if apply {
+		exitCode := req.ExitCode
+		if exitCode != nil && *exitCode == -1 {
+			exitCode = nil
+		}
 
-				if len(req.Stderr) > 0 {
-					taskLog.Level = "stderr"
-					taskLog.Message = string(req.Stderr)
-					h.db.Create(&taskLog)
-				}
+		h.recordTaskUsage(taskID, req.Usage)
+		err := h.queue.UpdateTaskStatus(taskID, req.Status, exitCode, req.ErrorMessage)
+		if err != nil {
+			log.Printf("Failed to update task status for task %s: %v", taskID, err)
+			if msg.IdempotencyKey != "" {
+				h.releaseRequest(runnerID, msg.IdempotencyKey)
 			}
+			h.replyAgentError(runnerID, msg.AgentHeader, AgentMsgTaskStatus, AgentErrInternal, "failed to update task status")
+			return
+		}
 
-			// Send response via WebSocket
-			h.agentHub.SendMessage(runnerID, "task_status_response", UpdateTaskStatusResponse{
-				Success: true,
-				Message: "task status updated",
-			})
+		// Store logs if provided, with secret values masked
+		h.storeTaskLogs(taskID, req)
+
+		if msg.IdempotencyKey != "" {
+			body, _ := json.Marshal(response)
+			h.completeRequest(runnerID, msg.IdempotencyKey, http.StatusOK, string(body))
 		}
 	}
+
+	// Send response via WebSocket
+	h.agentHub.SendMessage(runnerID, AgentMsgTaskStatusResponse, AgentTaskStatusResponse{
+		AgentHeader:              AgentHeader{ReplyTo: msg.ID},
+		TaskID:                   taskID,
+		UpdateTaskStatusResponse: response,
+	})
 }
 
-// notifyIdleAgentsOfTask notifies all idle agents that tasks are available
+// notifyIdleAgentsOfTask notifies all idle agents that tasks are available, including
+// agents connected to other instances
 func (h *Handler) notifyIdleAgentsOfTask() {
+	h.cluster.Publish(clusterTasksChannel, nil)
+	h.notifyConnectedIdleAgents()
+}
+
+// notifyConnectedIdleAgents notifies the idle agents connected to this instance
+func (h *Handler) notifyConnectedIdleAgents() {
 	// Get all idle runners
 	var idleRunners []models.Runner
 	h.db.Where("status = ?", "idle").Find(&idleRunners)
@@ -1715,45 +1948,12 @@ func (h *Handler) NotifyAgentOfTask(runnerID string) {
 		return // No task available or error
 	}
 
-	// Load job
-	var job models.Job
-	if err := h.db.First(&job, "id = ?", task.JobID).Error; err != nil {
+	taskResponse, err := h.buildTaskResponse(runnerID, task)
+	if err != nil {
+		log.Printf("Failed to build task %s for runner %s: %v", task.ID, runnerID, err)
 		return
 	}
 
-	// Load job files
-	var jobFiles []models.JobFile
-	h.db.Where("job_id = ?", job.ID).Find(&jobFiles)
-
-	var args []string
-	json.Unmarshal([]byte(job.Args), &args)
-
-	var env map[string]string
-	json.Unmarshal([]byte(job.Env), &env)
-	if env == nil {
-		env = make(map[string]string)
-	}
-
-	requiredFiles := make([]string, 0, len(jobFiles))
-	for _, jf := range jobFiles {
-		requiredFiles = append(requiredFiles, jf.FileID)
-	}
-
-	taskResponse := GetNextTaskResponse{
-		TaskID:           task.ID,
-		JobID:            job.ID,
-		JobName:          job.Name,
-		Type:             job.Type,
-		Command:          job.Command,
-		Args:             args,
-		Env:              env,
-		WorkingDirectory: job.WorkingDirectory,
-		TimeoutSeconds:   job.TimeoutSeconds,
-		DockerImage:      job.DockerImage,
-		Privileged:       job.Privileged,
-		RequiredFiles:    requiredFiles,
-	}
-
 	// Send task via WebSocket
 	h.agentHub.SendTask(runnerID, taskResponse)
 }
@@ -1773,6 +1973,12 @@ func (h *Handler) UploadExecutorBinary(c *gin.Context) {
 
 	description := c.PostForm("description")
 
+	projectID, err := projectForNewResource(c, c.PostForm("project_id"), auth.PermFilesUpload)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Open uploaded file
 	src, err := file.Open()
 	if err != nil {
@@ -1796,6 +2002,7 @@ func (h *Handler) UploadExecutorBinary(c *gin.Context) {
 		Size:        size,
 		ContentType: file.Header.Get("Content-Type"),
 		Hash:        hash,
+		ProjectID:   projectID,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 	}
@@ -1819,6 +2026,11 @@ func (h *Handler) UploadExecutorBinary(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if err := h.db.Model(&models.ExecutorBinary{}).Where("id = ?", executorBinary.ID).Update("project_id", projectID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "file.upload", auditTarget{Type: "executor_binary", ID: executorBinary.ID, Name: executorBinary.Name}, nil, fileAuditSummary(fileRecord))
 
 	c.JSON(http.StatusCreated, executorBinary)
 }
@@ -1826,7 +2038,7 @@ func (h *Handler) UploadExecutorBinary(c *gin.Context) {
 // ListExecutorBinaries returns a list of executor binaries
 func (h *Handler) ListExecutorBinaries(c *gin.Context) {
 	var binaries []models.ExecutorBinary
-	if err := h.db.Preload("File").Find(&binaries).Error; err != nil {
+	if err := scopeToProjects(c, h.db.Model(&models.ExecutorBinary{})).Preload("File").Find(&binaries).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -1869,6 +2081,7 @@ func (h *Handler) DeleteExecutorBinary(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.audit(c, "file.delete", auditTarget{Type: "executor_binary", ID: binary.ID, Name: binary.Name}, gin.H{"file_id": binary.FileID}, nil)
 
 	c.JSON(http.StatusOK, gin.H{"message": "executor binary deleted"})
 }
@@ -1884,6 +2097,11 @@ func (h *Handler) UploadProcessorScript(c *gin.Context) {
 		return
 	}
 
+	if !canManageJob(c, &job) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you can only manage your own jobs"})
+		return
+	}
+
 	file, err := c.FormFile("file")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -1913,6 +2131,7 @@ func (h *Handler) UploadProcessorScript(c *gin.Context) {
 		Size:        size,
 		ContentType: file.Header.Get("Content-Type"),
 		Hash:        hash,
+		ProjectID:   job.ProjectID,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 	}
@@ -1942,6 +2161,8 @@ func (h *Handler) UploadProcessorScript(c *gin.Context) {
 	// Update job with processor script ID
 	job.ProcessorScriptID = processorScript.ID
 	h.db.Save(&job)
+	h.audit(c, "file.upload", auditTarget{Type: "processor_script", ID: processorScript.ID, Name: file.Filename}, nil,
+		gin.H{"job_id": job.ID, "file": fileAuditSummary(fileRecord)})
 
 	c.JSON(http.StatusCreated, processorScript)
 }
@@ -1957,6 +2178,11 @@ func (h *Handler) UploadCSVDataset(c *gin.Context) {
 		return
 	}
 
+	if !canManageJob(c, &job) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you can only manage your own jobs"})
+		return
+	}
+
 	file, err := c.FormFile("file")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -1994,6 +2220,7 @@ func (h *Handler) UploadCSVDataset(c *gin.Context) {
 		Size:        size,
 		ContentType: file.Header.Get("Content-Type"),
 		Hash:        hash,
+		ProjectID:   job.ProjectID,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 	}
@@ -2022,6 +2249,9 @@ func (h *Handler) UploadCSVDataset(c *gin.Context) {
 		return
 	}
 
+	h.audit(c, "file.upload", auditTarget{Type: "job_dataset", ID: fileID, Name: file.Filename}, nil,
+		gin.H{"job_id": job.ID, "tasks_count": len(tasks), "file": fileAuditSummary(fileRecord)})
+
 	c.JSON(http.StatusCreated, gin.H{
 		"message":     "CSV dataset uploaded and tasks created",
 		"tasks_count": len(tasks),
@@ -2040,6 +2270,12 @@ func (h *Handler) UploadJobResult(c *gin.Context) {
 		return
 	}
 
+	task, err := h.runnerTask(c, taskID)
+	if err != nil || task.JobID != jobID || c.Param("id") != jobID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "task is not assigned to this runner"})
+		return
+	}
+
 	// Validate JSON
 	var resultData interface{}
 	if err := json.Unmarshal([]byte(resultDataStr), &resultData); err != nil {
@@ -2128,6 +2364,12 @@ func (h *Handler) UploadDataset(c *gin.Context) {
 		return
 	}
 
+	projectID, err := projectForNewResource(c, c.PostForm("project_id"), auth.PermFilesUpload)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Check if dataset name already exists
 	var existingDataset models.Dataset
 	if err := h.db.Where("name = ?", name).First(&existingDataset).Error; err == nil {
@@ -2183,6 +2425,7 @@ func (h *Handler) UploadDataset(c *gin.Context) {
 		Size:        size,
 		ContentType: file.Header.Get("Content-Type"),
 		Hash:        hash,
+		ProjectID:   projectID,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 	}
@@ -2207,6 +2450,11 @@ func (h *Handler) UploadDataset(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if err := h.db.Model(&models.Dataset{}).Where("id = ?", dataset.ID).Update("project_id", projectID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "file.upload", auditTarget{Type: "dataset", ID: dataset.ID, Name: dataset.Name}, nil, fileAuditSummary(fileRecord))
 
 	c.JSON(http.StatusCreated, dataset)
 }
@@ -2219,12 +2467,12 @@ func (h *Handler) ListDatasets(c *gin.Context) {
 	var datasets []models.Dataset
 	var total int64
 
-	if err := h.db.Model(&models.Dataset{}).Count(&total).Error; err != nil {
+	if err := scopeToProjects(c, h.db.Model(&models.Dataset{})).Count(&total).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := h.db.Preload("File").Order("created_at DESC").Limit(limit).Offset(offset).Find(&datasets).Error; err != nil {
+	if err := scopeToProjects(c, h.db.Model(&models.Dataset{})).Preload("File").Order("created_at DESC").Limit(limit).Offset(offset).Find(&datasets).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -2273,6 +2521,7 @@ func (h *Handler) DeleteDataset(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.audit(c, "file.delete", auditTarget{Type: "dataset", ID: dataset.ID, Name: dataset.Name}, gin.H{"file_id": dataset.FileID}, nil)
 
 	c.JSON(http.StatusOK, gin.H{"message": "dataset deleted"})
 }
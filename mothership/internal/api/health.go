@@ -0,0 +1,34 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthCheckTimeout bounds the database check of GET /health
+const healthCheckTimeout = 2 * time.Second
+
+// Health reports whether this instance can serve requests. Agents probe it before
+// failing over to this instance, load balancers before routing to it.
+func (h *Handler) Health(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), healthCheckTimeout)
+	defer cancel()
+
+	sqlDB, err := h.db.DB()
+	if err == nil {
+		err = sqlDB.PingContext(ctx)
+	}
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "database unavailable: " + err.Error()})
+		return
+	}
+
+	status := gin.H{"status": "ok"}
+	if h.cluster != nil {
+		status["instance"] = h.cluster.ID()
+	}
+	c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"borg/mothership/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// idempotencyKeyHeader names a runner request; resent copies carry the same key
+	idempotencyKeyHeader  = "Idempotency-Key"
+	maxIdempotencyKey     = 128
+	idempotencyRetention  = 7 * 24 * time.Hour // Runners replay their journal within this time
+	idempotencyPruneEvery = time.Hour
+
+	// A reserved key is pending until its request completes
+	idempotencyPending        = 0
+	idempotencyPendingTimeout = 5 * time.Minute // Longer than any request takes
+	idempotencyRetryAfter     = "1"             // Seconds
+)
+
+// recordingWriter keeps a copy of the response body
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent answers requests carrying an Idempotency-Key the runner used before with
+// the response of the first request, so runners can safely resend requests whose
+// response they never received. The key is reserved before the request is handled,
+// so concurrent copies are answered 409 until the first completes. Only successful
+// responses are recorded; the key is released otherwise.
+func (h *Handler) idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			c.Abort()
+			return
+		}
+		runnerID := c.GetString("runner_id")
+
+		recorded, reserved, err := h.reserveRequest(runnerID, key)
+		if err != nil {
+			log.Printf("Failed to reserve request %s of runner %s: %v", key, runnerID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check Idempotency-Key"})
+			c.Abort()
+			return
+		}
+		if !reserved {
+			if recorded.StatusCode == idempotencyPending {
+				c.Header("Retry-After", idempotencyRetryAfter)
+				c.JSON(http.StatusConflict, gin.H{"error": "a request with this Idempotency-Key is in progress"})
+			} else {
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(recorded.StatusCode, "application/json; charset=utf-8", []byte(recorded.Response))
+			}
+			c.Abort()
+			return
+		}
+
+		applied := false
+		defer func() {
+			if !applied {
+				h.releaseRequest(runnerID, key)
+			}
+		}()
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		if status := writer.Status(); status >= 200 && status < 300 {
+			applied = true
+			h.completeRequest(runnerID, key, status, writer.body.String())
+		}
+	}
+}
+
+// reserveRequest reserves the key of a runner request before it is handled. If the
+// key was reserved before, it returns the recorded request instead. A reservation
+// older than idempotencyPendingTimeout was left by an instance that stopped while
+// handling the request and is taken over.
+func (h *Handler) reserveRequest(runnerID, key string) (*models.IdempotencyKey, bool, error) {
+	err := h.db.Where("runner_id = ? AND key = ? AND status_code = ? AND created_at < ?",
+		runnerID, key, idempotencyPending, time.Now().Add(-idempotencyPendingTimeout)).
+		Delete(&models.IdempotencyKey{}).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	result := h.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.IdempotencyKey{
+		RunnerID:   runnerID,
+		Key:        key,
+		StatusCode: idempotencyPending,
+	})
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return nil, true, nil
+	}
+
+	var recorded models.IdempotencyKey
+	if err := h.db.First(&recorded, "runner_id = ? AND key = ?", runnerID, key).Error; err != nil {
+		return nil, false, err
+	}
+	return &recorded, false, nil
+}
+
+// completeRequest records the response to a reserved runner request
+func (h *Handler) completeRequest(runnerID, key string, status int, response string) {
+	err := h.db.Model(&models.IdempotencyKey{}).
+		Where("runner_id = ? AND key = ?", runnerID, key).
+		Updates(map[string]interface{}{"status_code": status, "response": response}).Error
+	if err != nil {
+		log.Printf("Failed to record request %s of runner %s: %v", key, runnerID, err)
+	}
+}
+
+// releaseRequest removes the reservation of a runner request that was not applied, so
+// the runner can send it again
+func (h *Handler) releaseRequest(runnerID, key string) {
+	err := h.db.Where("runner_id = ? AND key = ? AND status_code = ?", runnerID, key, idempotencyPending).
+		Delete(&models.IdempotencyKey{}).Error
+	if err != nil {
+		log.Printf("Failed to release request %s of runner %s: %v", key, runnerID, err)
+	}
+}
+
+// pruneIdempotencyKeys removes recorded requests that runners no longer resend, until
+// ctx is cancelled
+func (h *Handler) pruneIdempotencyKeys(ctx context.Context) {
+	ticker := time.NewTicker(idempotencyPruneEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := h.db.WithContext(ctx).Where("created_at < ?", time.Now().Add(-idempotencyRetention)).Delete(&models.IdempotencyKey{}).Error
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Failed to prune idempotency keys: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"borg/mothership/internal/models"
+)
+
+// maxIOWeight is the largest cgroup v2 io.weight
+const maxIOWeight = 10000
+
+// TaskUsage is the resource usage of a finished task, reported by runners that measure it
+type TaskUsage struct {
+	PeakMemoryBytes int64 `json:"peak_memory_bytes"`
+	CPUTimeMs       int64 `json:"cpu_time_ms"`
+	OOMKilled       bool  `json:"oom_killed"` // Killed for exceeding the job's memory limit
+
+	LimitsNotEnforced string `json:"limits_not_enforced,omitempty"` // Why the job's limits were not enforced
+}
+
+// validateResourceLimits checks the resource limits of a job of the given type
+func validateResourceLimits(jobType string, limits models.ResourceLimits) error {
+	// Wasm tasks run inside the agent, which can only cap their memory
+	if jobType == "wasm" && (limits.CPU != 0 || limits.Pids != 0 || limits.IOWeight != 0) {
+		return errors.New("wasm jobs only support limits.memory_mb")
+	}
+	switch {
+	case limits.CPU < 0:
+		return errors.New("limits.cpu must not be negative")
+	case limits.MemoryMB < 0:
+		return errors.New("limits.memory_mb must not be negative")
+	case limits.Pids < 0:
+		return errors.New("limits.pids must not be negative")
+	case limits.IOWeight < 0 || limits.IOWeight > maxIOWeight:
+		return errors.New("limits.io_weight must be between 1 and 10000, or 0 for the default")
+	}
+	return nil
+}
+
+// validateSandbox checks that a job of the given type can run in its sandbox
+func validateSandbox(jobType string, sandbox models.SandboxOptions) error {
+	if !sandbox.Enabled {
+		return nil
+	}
+	switch jobType {
+	case "shell", "dataset":
+		return nil
+	}
+	return fmt.Errorf("sandbox is not supported for %s jobs, only for shell and dataset jobs", jobType)
+}
+
+// recordTaskUsage stores the resource usage reported with a task status
+func (h *Handler) recordTaskUsage(taskID string, usage *TaskUsage) {
+	if usage == nil {
+		return
+	}
+	if err := h.db.Model(&models.Task{}).Where("id = ?", taskID).Updates(map[string]interface{}{
+		"peak_memory_bytes": usage.PeakMemoryBytes,
+		"cpu_time_ms":       usage.CPUTimeMs,
+		"oom_killed":        usage.OOMKilled,
+
+		"limits_not_enforced": usage.LimitsNotEnforced,
+	}).Error; err != nil {
+		log.Printf("Failed to record resource usage of task %s: %v", taskID, err)
+	}
+}
@@ -1,48 +1,330 @@
 package api
 
 import (
+	"encoding/json"
 	"net/http"
 	"strings"
+	"time"
 
 	"borg/mothership/internal/auth"
+	"borg/mothership/internal/models"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
-// AuthMiddleware validates JWT tokens and sets user context
-func AuthMiddleware() gin.HandlerFunc {
+// passwordChangeRoutes remain reachable while a user has to change their password
+var passwordChangeRoutes = map[string]bool{
+	"/api/v1/auth/me":         true,
+	"/api/v1/auth/password":   true,
+	"/api/v1/auth/logout":     true,
+	"/api/v1/auth/logout-all": true,
+}
+
+// queryTokenRoutes accept the token as a "token" query parameter. Browsers cannot set
+// headers on WebSocket and EventSource connections; everywhere else the token would
+// leak into access logs and Referer headers, so only the Authorization header is read.
+var queryTokenRoutes = map[string]bool{
+	"/ws":                           true,
+	"/ws/screen/:runnerID":          true,
+	"/api/v1/events":                true,
+	"/api/v1/tasks/:id/logs/stream": true,
+}
+
+// AuthMiddleware validates JWT tokens or API keys and sets user context
+func AuthMiddleware(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		var tokenString string
+		if queryTokenRoutes[c.FullPath()] {
+			tokenString = c.Query("token")
+		}
+
 		// Get token from Authorization header
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
+		if authHeader := c.GetHeader("Authorization"); authHeader != "" {
+			// Check if it starts with "Bearer "
+			parts := strings.SplitN(authHeader, " ", 2)
+			if len(parts) != 2 || parts[0] != "Bearer" {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid authorization header format"})
+				c.Abort()
+				return
+			}
+			tokenString = parts[1]
+		}
+
+		if tokenString == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "authorization header required"})
 			c.Abort()
 			return
 		}
 
-		// Check if it starts with "Bearer "
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid authorization header format"})
+		var user *models.User
+		if auth.IsAPIKey(tokenString) {
+			key, keyUser, ok := authenticateAPIKey(db, tokenString)
+			if !ok {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid, expired or revoked API key"})
+				c.Abort()
+				return
+			}
+			user = keyUser
+
+			var scopes []auth.Permission
+			json.Unmarshal([]byte(key.Scopes), &scopes)
+			c.Set("api_key_id", key.ID)
+			c.Set("scopes", scopes)
+		} else {
+			// Validate token
+			claims, err := auth.ValidateJWT(tokenString)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
+				c.Abort()
+				return
+			}
+
+			// Logged out sessions, disabled users and changed roles invalidate issued tokens
+			var session models.Session
+			if err := db.First(&session, "id = ? AND user_id = ?", claims.SessionID, claims.UserID).Error; err != nil ||
+				!session.IsActive(time.Now()) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "session has ended, please log in again"})
+				c.Abort()
+				return
+			}
+
+			var jwtUser models.User
+			if err := db.First(&jwtUser, "id = ?", claims.UserID).Error; err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "account not found or disabled"})
+				c.Abort()
+				return
+			}
+			if jwtUser.Role != claims.Role {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "token is no longer valid, please log in again"})
+				c.Abort()
+				return
+			}
+			user = &jwtUser
+			c.Set("session_id", session.ID)
+		}
+
+		if user.Disabled {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "account not found or disabled"})
+			c.Abort()
+			return
+		}
+		if user.MustChangePassword && !passwordChangeRoutes[c.FullPath()] {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":                "password change required",
+				"must_change_password": true,
+			})
+			c.Abort()
+			return
+		}
+
+		// Set user context
+		c.Set("user_id", user.ID)
+		c.Set("username", user.Username)
+		c.Set("role", user.Role)
+		c.Set("project_roles", loadProjectRoles(db, user.ID))
+
+		c.Next()
+	}
+}
+
+// authenticateAPIKey resolves an API key to an active key and its owner, and records its use
+func authenticateAPIKey(db *gorm.DB, key string) (*models.APIKey, *models.User, bool) {
+	var apiKey models.APIKey
+	if err := db.Preload("User").Where("key_hash = ?", auth.HashToken(key)).First(&apiKey).Error; err != nil {
+		return nil, nil, false
+	}
+
+	now := time.Now()
+	if !apiKey.IsActive(now) {
+		return nil, nil, false
+	}
+
+	// Throttle last_used_at writes for keys used in tight loops
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > time.Minute {
+		db.Model(&models.APIKey{}).Where("id = ?", apiKey.ID).Update("last_used_at", now)
+	}
+
+	return &apiKey, &apiKey.User, true
+}
+
+// hasPermission reports whether the current request is allowed perm.
+// Requests made with an API key are additionally limited to the key's scopes.
+func hasPermission(c *gin.Context, perm auth.Permission) bool {
+	if !auth.HasPermission(c.GetString("role"), perm) {
+		return false
+	}
+
+	if _, isKey := c.Get("api_key_id"); !isKey {
+		return true
+	}
+	scopes, _ := c.Get("scopes")
+	scopeList, _ := scopes.([]auth.Permission)
+	for _, scope := range scopeList {
+		if scope == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission rejects requests whose role or API key scopes do not grant perm. Must run after AuthMiddleware.
+func RequirePermission(perm auth.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasPermission(c, perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "insufficient permissions", "required": perm})
 			c.Abort()
 			return
 		}
 
-		tokenString := parts[1]
+		c.Next()
+	}
+}
 
-		// Validate token
-		claims, err := auth.ValidateJWT(tokenString)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
+// RequireSession rejects requests authenticated with an API key, for endpoints that manage credentials
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, isKey := c.Get("api_key_id"); isKey {
+			c.JSON(http.StatusForbidden, gin.H{"error": "this endpoint cannot be used with an API key"})
 			c.Abort()
 			return
 		}
 
-		// Set user context
-		c.Set("user_id", claims.UserID)
-		c.Set("username", claims.Username)
+		c.Next()
+	}
+}
+
+// canManageJob reports whether the current user may modify a job.
+// Users without jobs:manage_any in the job's project are limited to jobs they created.
+func canManageJob(c *gin.Context, job *models.Job) bool {
+	if hasProjectPermission(c, job.ProjectID, auth.PermJobsManageAny) {
+		return true
+	}
+	return job.CreatedBy != "" && job.CreatedBy == c.GetString("user_id") &&
+		hasProjectPermission(c, job.ProjectID, auth.PermJobsCreate)
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header
+func bearerToken(c *gin.Context) (string, bool) {
+	parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// authenticateRunner resolves a runner secret to an enrolled runner with an unrevoked credential
+func authenticateRunner(db *gorm.DB, secret string) (*models.Runner, bool) {
+	var runner models.Runner
+	if err := db.Where("secret_hash = ? AND credential_revoked_at IS NULL", auth.HashToken(secret)).
+		First(&runner).Error; err != nil {
+		return nil, false
+	}
+	return &runner, true
+}
+
+// RunnerAuthMiddleware authenticates solder agents by their client certificate or per-runner secret
+// and sets runner context. A certificate that matches no runner, such as one issued before the
+// runner was re-enrolled, falls back to the secret so the agent can still request a new one;
+// requireRunnerCertificate rejects that fallback when RUNNER_MTLS=required.
+func RunnerAuthMiddleware(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		runner, presented := runnerFromCertificate(db, c)
+		if runner != nil {
+			c.Set("runner_id", runner.ID)
+			c.Set("runner_auth", "certificate")
+			c.Next()
+			return
+		}
+
+		secret, ok := bearerToken(c)
+		if !ok {
+			message := "runner credential required"
+			if presented {
+				message = "invalid or revoked runner certificate"
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+			c.Abort()
+			return
+		}
+
+		runner, ok = authenticateRunner(db, secret)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or revoked runner credential"})
+			c.Abort()
+			return
+		}
+
+		c.Set("runner_id", runner.ID)
+		c.Set("runner_auth", "secret")
+
+		c.Next()
+	}
+}
+
+// TaskAuthMiddleware accepts a runner certificate, a runner secret or a task token issued for the task in the :id parameter.
+// Task tokens are handed to task processes so they can report results without seeing the runner secret.
+func TaskAuthMiddleware(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if runner, presented := runnerFromCertificate(db, c); presented && runner != nil {
+			c.Set("runner_id", runner.ID)
+			c.Set("runner_auth", "certificate")
+			c.Next()
+			return
+		}
+
+		token, ok := bearerToken(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "runner credential or task token required"})
+			c.Abort()
+			return
+		}
+
+		if claims, err := auth.ValidateTaskToken(token); err == nil {
+			if claims.TaskID != c.Param("id") {
+				c.JSON(http.StatusForbidden, gin.H{"error": "task token is not valid for this task"})
+				c.Abort()
+				return
+			}
+			// Revoking or deleting the runner also invalidates the task tokens it handed out
+			var count int64
+			if err := db.Model(&models.Runner{}).
+				Where("id = ? AND credential_revoked_at IS NULL", claims.RunnerID).
+				Count(&count).Error; err != nil || count == 0 {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "task token belongs to a revoked or deleted runner"})
+				c.Abort()
+				return
+			}
+			c.Set("runner_id", claims.RunnerID)
+			c.Set("runner_auth", "task_token")
+			c.Set("task_scope", claims.TaskID)
+			c.Next()
+			return
+		}
+
+		runner, ok := authenticateRunner(db, token)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or revoked runner credential"})
+			c.Abort()
+			return
+		}
+
+		c.Set("runner_id", runner.ID)
+		c.Set("runner_auth", "secret")
 
 		c.Next()
 	}
 }
 
+// RequireRunnerParam ensures the authenticated runner matches the runner ID in the given route parameter
+func RequireRunnerParam(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Param(param) != c.GetString("runner_id") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "runner credential does not match runner ID"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"borg/mothership/internal/models"
+	"borg/mothership/internal/pki"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RunnerCertificate is a client certificate issued to a runner
+type RunnerCertificate struct {
+	Certificate   string    `json:"certificate"`    // PEM
+	CACertificate string    `json:"ca_certificate"` // PEM, trust anchor for the mothership's certificate
+	ExpiresAt     time.Time `json:"certificate_expires_at"`
+}
+
+// SetPKI enables runner client certificates issued by the internal CA
+func (h *Handler) SetPKI(ca *pki.CA, config pki.Config) {
+	h.ca = ca
+	h.pkiConfig = config
+}
+
+// runnerCertificatesEnabled reports whether runners are issued client certificates
+func (h *Handler) runnerCertificatesEnabled() bool {
+	return h.ca != nil && h.pkiConfig.RunnerMTLS != pki.MTLSOff
+}
+
+// issueRunnerCertificate signs a runner's CSR and records the serial on the runner, which the
+// caller saves. Returns nil without a CSR or when runner certificates are disabled.
+func (h *Handler) issueRunnerCertificate(runner *models.Runner, csrPEM string) (*RunnerCertificate, error) {
+	if csrPEM == "" || !h.runnerCertificatesEnabled() {
+		return nil, nil
+	}
+
+	issued, err := h.ca.SignRunnerCSR([]byte(csrPEM), runner.ID, h.pkiConfig.RunnerCertTTL)
+	if err != nil {
+		return nil, err
+	}
+	runner.CertificateSerial = issued.Serial
+	runner.CertificateExpiresAt = &issued.NotAfter
+
+	return &RunnerCertificate{
+		Certificate:   string(issued.CertPEM),
+		CACertificate: string(h.ca.CertPEM()),
+		ExpiresAt:     issued.NotAfter,
+	}, nil
+}
+
+// runnerFromCertificate resolves a verified client certificate to its runner. presented is
+// false if the request carries no verified certificate. Only the runner's latest
+// certificate is accepted, and none after its credential was revoked.
+func runnerFromCertificate(db *gorm.DB, c *gin.Context) (runner *models.Runner, presented bool) {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	leaf := state.VerifiedChains[0][0]
+
+	var found models.Runner
+	if err := db.Where("id = ? AND certificate_serial = ? AND credential_revoked_at IS NULL",
+		leaf.Subject.CommonName, pki.SerialHex(leaf)).First(&found).Error; err != nil {
+		return nil, true
+	}
+	return &found, true
+}
+
+// requireRunnerCertificate rejects runners that authenticated with a bare secret when
+// RUNNER_MTLS=required. It must run after RunnerAuthMiddleware or TaskAuthMiddleware;
+// task tokens are still accepted because task processes never hold the certificate.
+func (h *Handler) requireRunnerCertificate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h.ca != nil && h.pkiConfig.RunnerMTLS == pki.MTLSRequired && !runnerAuthAllowedWithMTLS(c.GetString("runner_auth")) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "runner client certificate required"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// runnerAuthAllowedWithMTLS reports whether an authentication method is acceptable under RUNNER_MTLS=required
+func runnerAuthAllowedWithMTLS(method string) bool {
+	return method == "certificate" || method == "task_token"
+}
+
+// RenewRunnerCertificateRequest carries a CSR for a fresh key
+type RenewRunnerCertificateRequest struct {
+	CSR string `json:"csr" binding:"required"`
+}
+
+// RenewRunnerCertificate issues a new client certificate to an authenticated runner.
+// The previous certificate stops being accepted once the new one is issued.
+func (h *Handler) RenewRunnerCertificate(c *gin.Context) {
+	if !h.runnerCertificatesEnabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "runner certificates are not enabled"})
+		return
+	}
+
+	var req RenewRunnerCertificateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var runner models.Runner
+	if err := h.db.First(&runner, "id = ?", c.GetString("runner_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "runner not found"})
+		return
+	}
+
+	certificate, err := h.issueRunnerCertificate(&runner, req.CSR)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.db.Model(&runner).Updates(map[string]interface{}{
+		"certificate_serial":     runner.CertificateSerial,
+		"certificate_expires_at": runner.CertificateExpiresAt,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Renewed client certificate of runner %s, valid until %s", runner.ID, certificate.ExpiresAt.Format(time.RFC3339))
+
+	c.JSON(http.StatusOK, certificate)
+}
+
+// GetCACertificate returns the internal CA certificate so clients can trust the mothership
+func (h *Handler) GetCACertificate(c *gin.Context) {
+	if h.ca == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "internal CA is not enabled"})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/x-pem-file", h.ca.CertPEM())
+}
@@ -0,0 +1,539 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"borg/mothership/internal/auth"
+	"borg/mothership/internal/events"
+	"borg/mothership/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var errProjectRequired = errors.New("project_id is required")
+
+// loadProjectRoles returns the user's role in each project they are a member of
+func loadProjectRoles(db *gorm.DB, userID string) map[string]string {
+	var members []models.ProjectMember
+	db.Where("user_id = ?", userID).Find(&members)
+
+	roles := make(map[string]string, len(members))
+	for _, m := range members {
+		roles[m.ProjectID] = m.Role
+	}
+	return roles
+}
+
+// projectRole returns the current user's role in a project
+func projectRole(c *gin.Context, projectID string) (string, bool) {
+	value, _ := c.Get("project_roles")
+	roles, _ := value.(map[string]string)
+	role, ok := roles[projectID]
+	return role, ok
+}
+
+// seesAllProjects reports whether the current user may access every project
+func seesAllProjects(c *gin.Context) bool {
+	return hasPermission(c, auth.PermProjectsManage)
+}
+
+// hasProjectPermission reports whether the current request is allowed perm in a project.
+// Both the global role (and API key scopes) and the project role must grant it.
+func hasProjectPermission(c *gin.Context, projectID string, perm auth.Permission) bool {
+	if !hasPermission(c, perm) {
+		return false
+	}
+	if seesAllProjects(c) {
+		return true
+	}
+	role, ok := projectRole(c, projectID)
+	return ok && auth.HasPermission(role, perm)
+}
+
+// canManageProjectMembers reports whether the current user administers a project's membership
+func canManageProjectMembers(c *gin.Context, projectID string) bool {
+	if seesAllProjects(c) {
+		return true
+	}
+	if _, isKey := c.Get("api_key_id"); isKey {
+		return false
+	}
+	role, ok := projectRole(c, projectID)
+	return ok && role == auth.RoleAdmin
+}
+
+// callerProjectIDs returns the projects the current user belongs to, or all=true if they see every project
+func callerProjectIDs(c *gin.Context) (ids []string, all bool) {
+	if seesAllProjects(c) {
+		return nil, true
+	}
+	value, _ := c.Get("project_roles")
+	roles, _ := value.(map[string]string)
+	ids = make([]string, 0, len(roles))
+	for id := range roles {
+		ids = append(ids, id)
+	}
+	return ids, false
+}
+
+// listProjectIDs returns the projects a list endpoint should cover: the caller's projects,
+// narrowed to the project_id query parameter if given. nil means all projects.
+func listProjectIDs(c *gin.Context) []string {
+	ids, all := callerProjectIDs(c)
+	requested := c.Query("project_id")
+	if requested == "" {
+		if all {
+			return nil
+		}
+		return ids
+	}
+
+	if all {
+		return []string{requested}
+	}
+	for _, id := range ids {
+		if id == requested {
+			return []string{requested}
+		}
+	}
+	return []string{}
+}
+
+// scopeToProjects limits a list query to the projects from listProjectIDs
+func scopeToProjects(c *gin.Context, query *gorm.DB) *gorm.DB {
+	if ids := listProjectIDs(c); ids != nil {
+		return query.Where("project_id IN ?", ids)
+	}
+	return query
+}
+
+// projectForNewResource picks the project a new resource is created in. Without an explicit
+// project the caller's only project is used.
+func projectForNewResource(c *gin.Context, requested string, perm auth.Permission) (string, error) {
+	if requested == "" {
+		ids, all := callerProjectIDs(c)
+		if all || len(ids) != 1 {
+			return "", errProjectRequired
+		}
+		requested = ids[0]
+	}
+
+	if !hasProjectPermission(c, requested, perm) {
+		return "", errors.New("you cannot create resources in this project")
+	}
+	return requested, nil
+}
+
+// projectResolver looks up the project that owns a resource
+type projectResolver func(id string) (string, error)
+
+// projectOfRow returns a resolver for tables with a project_id column.
+// Soft-deleted rows still resolve; the handler reports them as not found.
+func (h *Handler) projectOfRow(table string) projectResolver {
+	return func(id string) (string, error) {
+		var row struct{ ProjectID *string }
+		result := h.db.Table(table).Select("project_id").Where("id = ?", id).Scan(&row)
+		if result.Error != nil {
+			return "", result.Error
+		}
+		if result.RowsAffected == 0 {
+			return "", gorm.ErrRecordNotFound
+		}
+		if row.ProjectID == nil {
+			return "", nil
+		}
+		return *row.ProjectID, nil
+	}
+}
+
+// projectOfTask resolves a task to the project of its job
+func (h *Handler) projectOfTask(id string) (string, error) {
+	var task models.Task
+	if err := h.db.Select("id", "job_id").First(&task, "id = ?", id).Error; err != nil {
+		return "", err
+	}
+	return h.projectOfRow("jobs")(task.JobID)
+}
+
+// requireProjectPermission checks perm in the project owning the resource named by a route parameter.
+// Resources in projects the user cannot read are reported as not found.
+func (h *Handler) requireProjectPermission(param string, resolve projectResolver, perm auth.Permission, resource string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		projectID, err := resolve(c.Param(param))
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": resource + " not found"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			c.Abort()
+			return
+		}
+
+		if !hasProjectPermission(c, projectID, perm) {
+			if hasProjectPermission(c, projectID, auth.PermJobsRead) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "insufficient permissions", "required": perm})
+			} else {
+				c.JSON(http.StatusNotFound, gin.H{"error": resource + " not found"})
+			}
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// requireRunnerPermission checks perm for a runner. Shared runners only need the global
+// permission, dedicated runners also need it in their project.
+func (h *Handler) requireRunnerPermission(param string, perm auth.Permission) gin.HandlerFunc {
+	dedicated := h.requireProjectPermission(param, h.projectOfRow("runners"), perm, "runner")
+	return func(c *gin.Context) {
+		projectID, err := h.projectOfRow("runners")(c.Param(param))
+		if err == nil && projectID == "" {
+			if !hasPermission(c, perm) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "insufficient permissions", "required": perm})
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+		dedicated(c)
+	}
+}
+
+// ListProjects returns the caller's projects, or all projects for administrators
+func (h *Handler) ListProjects(c *gin.Context) {
+	query := h.db.Order("name ASC")
+	if ids, all := callerProjectIDs(c); !all {
+		query = query.Where("id IN ?", ids)
+	}
+
+	var projects []models.Project
+	if err := query.Find(&projects).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, projects)
+}
+
+// GetProject returns a single project the caller belongs to
+func (h *Handler) GetProject(c *gin.Context) {
+	var project models.Project
+	if err := h.db.First(&project, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "project not found"})
+		return
+	}
+	if _, member := projectRole(c, project.ID); !member && !seesAllProjects(c) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "project not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, project)
+}
+
+// CreateProjectRequest represents project creation request
+type CreateProjectRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+}
+
+// CreateProject creates a project
+func (h *Handler) CreateProject(c *gin.Context) {
+	var req CreateProjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	var existing int64
+	h.db.Model(&models.Project{}).Where("name = ?", req.Name).Count(&existing)
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "project already exists"})
+		return
+	}
+
+	now := time.Now()
+	project := &models.Project{
+		ID:          uuid.New().String(),
+		Name:        req.Name,
+		Description: req.Description,
+		CreatedBy:   c.GetString("user_id"),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := h.db.Create(project).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "project.create", auditTarget{Type: "project", ID: project.ID, Name: project.Name}, nil, gin.H{"description": project.Description})
+
+	c.JSON(http.StatusCreated, project)
+}
+
+// UpdateProjectRequest represents project update request (all fields optional)
+type UpdateProjectRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+// UpdateProject renames a project or changes its description
+func (h *Handler) UpdateProject(c *gin.Context) {
+	var req UpdateProjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var project models.Project
+	if err := h.db.First(&project, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "project not found"})
+		return
+	}
+
+	before := gin.H{"name": project.Name, "description": project.Description}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name cannot be empty"})
+			return
+		}
+		var existing int64
+		h.db.Model(&models.Project{}).Where("name = ? AND id <> ?", name, project.ID).Count(&existing)
+		if existing > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "project already exists"})
+			return
+		}
+		project.Name = name
+	}
+	if req.Description != nil {
+		project.Description = *req.Description
+	}
+	project.UpdatedAt = time.Now()
+
+	if err := h.db.Save(&project).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "project.update", auditTarget{Type: "project", ID: project.ID, Name: project.Name}, before,
+		gin.H{"name": project.Name, "description": project.Description})
+
+	c.JSON(http.StatusOK, project)
+}
+
+// DeleteProject deletes a project that no longer owns anything
+func (h *Handler) DeleteProject(c *gin.Context) {
+	var project models.Project
+	if err := h.db.First(&project, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "project not found"})
+		return
+	}
+
+	owned := []struct {
+		model interface{}
+		name  string
+	}{
+		{&models.Job{}, "jobs"},
+		{&models.Dataset{}, "datasets"},
+		{&models.ExecutorBinary{}, "executor binaries"},
+		{&models.Secret{}, "secrets"},
+		{&models.Runner{}, "runners"},
+	}
+	for _, resource := range owned {
+		var count int64
+		if err := h.db.Model(resource.model).Where("project_id = ?", project.ID).Count(&count).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cannot delete project that still owns " + resource.name})
+			return
+		}
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("project_id = ?", project.ID).Delete(&models.ProjectMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&project).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "project.delete", auditTarget{Type: "project", ID: project.ID, Name: project.Name}, gin.H{"name": project.Name}, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "project deleted successfully",
+	})
+}
+
+// ListProjectMembers returns the members of a project
+func (h *Handler) ListProjectMembers(c *gin.Context) {
+	projectID := c.Param("id")
+	if _, member := projectRole(c, projectID); !member && !seesAllProjects(c) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "project not found"})
+		return
+	}
+
+	var members []models.ProjectMember
+	if err := h.db.Preload("User").Where("project_id = ?", projectID).Order("created_at ASC").Find(&members).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// SetProjectMemberRequest represents a membership change
+type SetProjectMemberRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// SetProjectMember adds a user to a project or changes their project role
+func (h *Handler) SetProjectMember(c *gin.Context) {
+	projectID := c.Param("id")
+	userID := c.Param("userID")
+
+	if !canManageProjectMembers(c, projectID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only project admins can manage members"})
+		return
+	}
+
+	var req SetProjectMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.ValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role. Must be one of: admin, operator, submitter, viewer"})
+		return
+	}
+
+	var project models.Project
+	if err := h.db.First(&project, "id = ?", projectID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "project not found"})
+		return
+	}
+	var user models.User
+	if err := h.db.First(&user, "id = ?", userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	now := time.Now()
+	var member models.ProjectMember
+	var before interface{}
+	err := h.db.Where("project_id = ? AND user_id = ?", projectID, userID).First(&member).Error
+	switch {
+	case err == nil:
+		before = gin.H{"role": member.Role}
+		member.Role = req.Role
+		member.UpdatedAt = now
+		err = h.db.Save(&member).Error
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		member = models.ProjectMember{ProjectID: projectID, UserID: userID, Role: req.Role, CreatedAt: now, UpdatedAt: now}
+		err = h.db.Create(&member).Error
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "project.member_set", auditTarget{Type: "project", ID: project.ID, Name: project.Name}, before,
+		gin.H{"user_id": user.ID, "username": user.Username, "role": member.Role})
+
+	c.JSON(http.StatusOK, member)
+}
+
+// RemoveProjectMember removes a user from a project
+func (h *Handler) RemoveProjectMember(c *gin.Context) {
+	projectID := c.Param("id")
+	userID := c.Param("userID")
+
+	if !canManageProjectMembers(c, projectID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only project admins can manage members"})
+		return
+	}
+
+	result := h.db.Where("project_id = ? AND user_id = ?", projectID, userID).Delete(&models.ProjectMember{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "member not found"})
+		return
+	}
+	h.audit(c, "project.member_remove", auditTarget{Type: "project", ID: projectID}, gin.H{"user_id": userID}, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "member removed",
+	})
+}
+
+// SetRunnerProjectRequest dedicates a runner to a project, or shares it when project_id is empty
+type SetRunnerProjectRequest struct {
+	ProjectID string `json:"project_id"`
+}
+
+// SetRunnerProject dedicates a runner to a project or makes it shared
+func (h *Handler) SetRunnerProject(c *gin.Context) {
+	var req SetRunnerProjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var runner models.Runner
+	if err := h.db.First(&runner, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "runner not found"})
+		return
+	}
+
+	// Shared runners serve every project, so only administrators may share or claim them
+	if (runner.ProjectID == "" || req.ProjectID == "") && !seesAllProjects(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only administrators can share runners or dedicate shared runners"})
+		return
+	}
+	if runner.ProjectID != "" && !hasProjectPermission(c, runner.ProjectID, auth.PermRunnersManage) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "insufficient permissions in the runner's current project"})
+		return
+	}
+	if req.ProjectID != "" {
+		var project models.Project
+		if err := h.db.First(&project, "id = ?", req.ProjectID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "project not found"})
+			return
+		}
+		if !hasProjectPermission(c, req.ProjectID, auth.PermRunnersManage) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "insufficient permissions in the target project"})
+			return
+		}
+	}
+
+	before := gin.H{"project_id": runner.ProjectID}
+	runner.ProjectID = req.ProjectID
+	runner.UpdatedAt = time.Now()
+	if err := h.db.Save(&runner).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "runner.project", auditTarget{Type: "runner", ID: runner.ID, Name: runner.Name}, before, gin.H{"project_id": runner.ProjectID})
+	h.publishRunner(events.RunnerUpdated, &runner)
+
+	c.JSON(http.StatusOK, runner)
+}
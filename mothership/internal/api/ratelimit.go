@@ -0,0 +1,148 @@
+package api
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"borg/mothership/internal/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rate limit scopes applied by rateLimit
+const (
+	limitLogin  = "login"
+	limitAPI    = "api"
+	limitRunner = "runner"
+)
+
+// SetRateLimiter enables rate limits and login lockouts
+func (h *Handler) SetRateLimiter(limiter *ratelimit.Limiter) {
+	h.limiter = limiter
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounded up
+func setRetryAfter(c *gin.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+}
+
+// rateLimitKey identifies the caller a scope is limited by
+func rateLimitKey(c *gin.Context, scope string) string {
+	switch {
+	case scope == limitAPI && c.GetString("api_key_id") != "":
+		return scope + ":key:" + c.GetString("api_key_id")
+	case scope == limitAPI && c.GetString("user_id") != "":
+		return scope + ":user:" + c.GetString("user_id")
+	case scope == limitRunner && c.GetString("runner_id") != "":
+		return scope + ":runner:" + c.GetString("runner_id")
+	}
+	return scope + ":ip:" + c.ClientIP()
+}
+
+// rateLimit limits requests with the token bucket of a scope. It must run after the
+// authentication middleware of the route group. Requests are allowed if the store fails.
+func (h *Handler) rateLimit(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h.limiter == nil {
+			c.Next()
+			return
+		}
+
+		var limit ratelimit.Limit
+		switch scope {
+		case limitLogin:
+			limit = h.limiter.Config().Login
+		case limitAPI:
+			limit = h.limiter.Config().API
+		case limitRunner:
+			limit = h.limiter.Config().Runner
+		}
+		if limit.Unlimited() {
+			c.Next()
+			return
+		}
+
+		result, err := h.limiter.Take(c.Request.Context(), rateLimitKey(c, scope), limit)
+		if err != nil {
+			log.Printf("Rate limit check failed, allowing request: %v", err)
+			c.Next()
+			return
+		}
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		if !result.Allowed {
+			setRetryAfter(c, result.RetryAfter)
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// loginLockoutKeys returns the lockout keys of a login attempt
+func loginLockoutKeys(c *gin.Context, username string) (userKey, ipKey string) {
+	return "lockout:user:" + strings.ToLower(strings.TrimSpace(username)), "lockout:ip:" + c.ClientIP()
+}
+
+// loginLockedUntil returns until when logins for the username or from the client IP are locked
+func (h *Handler) loginLockedUntil(c *gin.Context, username string) time.Time {
+	if h.limiter == nil {
+		return time.Time{}
+	}
+
+	var until time.Time
+	userKey, ipKey := loginLockoutKeys(c, username)
+	for _, key := range []string{userKey, ipKey} {
+		lockedUntil, err := h.limiter.Store().LockedUntil(c.Request.Context(), key)
+		if err != nil {
+			log.Printf("Login lockout check failed: %v", err)
+			continue
+		}
+		if lockedUntil.After(until) {
+			until = lockedUntil
+		}
+	}
+	return until
+}
+
+// recordLoginFailure counts a failed login against the username and the client IP
+func (h *Handler) recordLoginFailure(c *gin.Context, username string) {
+	if h.limiter == nil {
+		return
+	}
+
+	userKey, ipKey := loginLockoutKeys(c, username)
+	config := h.limiter.Config()
+	for _, failure := range []struct {
+		key    string
+		policy ratelimit.LockoutPolicy
+	}{{userKey, config.UserLockout}, {ipKey, config.IPLockout}} {
+		if _, err := h.limiter.Store().RecordFailure(c.Request.Context(), failure.key, failure.policy); err != nil {
+			log.Printf("Failed to record login failure: %v", err)
+		}
+	}
+}
+
+// resetLoginFailures clears the failures of a username after a successful login.
+// Failures of the client IP are kept so one valid account cannot unlock guessing others.
+func (h *Handler) resetLoginFailures(c *gin.Context, username string) {
+	if h.limiter == nil {
+		return
+	}
+
+	userKey, _ := loginLockoutKeys(c, username)
+	if err := h.limiter.Store().Reset(c.Request.Context(), userKey); err != nil {
+		log.Printf("Failed to reset login failures: %v", err)
+	}
+}
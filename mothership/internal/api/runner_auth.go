@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"borg/mothership/internal/auth"
+	"borg/mothership/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errTaskNotAssigned = errors.New("task is not assigned to this runner")
+
+// defaultTaskTokenTTL is used for task tokens of jobs without a timeout
+const defaultTaskTokenTTL = 24 * time.Hour
+
+// runnerTask loads a task and verifies it is assigned to the authenticated runner.
+// Requests authenticated with a task token are additionally limited to that task.
+func (h *Handler) runnerTask(c *gin.Context, taskID string) (*models.Task, error) {
+	if scope := c.GetString("task_scope"); scope != "" && scope != taskID {
+		return nil, errTaskNotAssigned
+	}
+
+	var task models.Task
+	if err := h.db.First(&task, "id = ?", taskID).Error; err != nil {
+		return nil, err
+	}
+	if task.RunnerID == "" || task.RunnerID != c.GetString("runner_id") {
+		return nil, errTaskNotAssigned
+	}
+
+	return &task, nil
+}
+
+// requiredFilesForJob returns the IDs of all files a runner needs to execute a job
+func (h *Handler) requiredFilesForJob(job *models.Job) []string {
+	var jobFiles []models.JobFile
+	h.db.Where("job_id = ?", job.ID).Find(&jobFiles)
+
+	requiredFiles := make([]string, 0, len(jobFiles))
+	for _, jf := range jobFiles {
+		requiredFiles = append(requiredFiles, jf.FileID)
+	}
+
+	// If executor_binary type, add executor binary to required files
+	if job.Type == "executor_binary" && job.ExecutorBinaryID != "" {
+		var executorBinary models.ExecutorBinary
+		if err := h.db.First(&executorBinary, "id = ?", job.ExecutorBinaryID).Error; err == nil {
+			requiredFiles = append(requiredFiles, executorBinary.FileID)
+		}
+	}
+
+	// If dataset type, add processing script to required files
+	if job.Type == "dataset" && job.Command != "" {
+		// Command contains the processing script file ID
+		requiredFiles = append(requiredFiles, job.Command)
+	}
+
+	return requiredFiles
+}
+
+// runnerMayDownload reports whether a file is required by a running task assigned to the runner
+func (h *Handler) runnerMayDownload(runnerID, fileID string) bool {
+	var tasks []models.Task
+	if err := h.db.Where("runner_id = ? AND status = ?", runnerID, "running").Find(&tasks).Error; err != nil {
+		return false
+	}
+
+	checked := make(map[string]bool)
+	for _, task := range tasks {
+		if checked[task.JobID] {
+			continue
+		}
+		checked[task.JobID] = true
+
+		var job models.Job
+		if err := h.db.First(&job, "id = ?", task.JobID).Error; err != nil {
+			continue
+		}
+		for _, id := range h.requiredFilesForJob(&job) {
+			if id == fileID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// buildTaskResponse assembles the task payload sent to a runner, including a task token
+// scoped to the task that task processes use to report results
+func (h *Handler) buildTaskResponse(runnerID string, task *models.Task) (*GetNextTaskResponse, error) {
+	var job models.Job
+	if err := h.db.First(&job, "id = ?", task.JobID).Error; err != nil {
+		return nil, err
+	}
+
+	var args []string
+	json.Unmarshal([]byte(job.Args), &args)
+
+	var env map[string]string
+	json.Unmarshal([]byte(job.Env), &env)
+	if env == nil {
+		env = make(map[string]string)
+	}
+
+	// Secrets are only ever resolved here, for the runner the task is assigned to
+	secretEnv, err := h.resolveSecrets(&job)
+	if err != nil {
+		h.queue.UpdateTaskStatus(task.ID, "failed", nil, "failed to resolve secrets: "+err.Error())
+		return nil, err
+	}
+	for name, value := range secretEnv {
+		env[name] = value
+	}
+
+	// Parse TaskData if present
+	var taskData map[string]interface{}
+	if task.TaskData != "" {
+		json.Unmarshal([]byte(task.TaskData), &taskData)
+	}
+
+	ttl := defaultTaskTokenTTL
+	if job.TimeoutSeconds > 0 {
+		ttl = time.Duration(job.TimeoutSeconds)*time.Second + time.Hour
+	}
+	taskToken, err := auth.GenerateTaskToken(runnerID, task.ID, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GetNextTaskResponse{
+		TaskID:           task.ID,
+		JobID:            job.ID,
+		JobName:          job.Name,
+		Type:             job.Type,
+		Command:          job.Command,
+		Args:             args,
+		Env:              env,
+		WorkingDirectory: job.WorkingDirectory,
+		TimeoutSeconds:   job.TimeoutSeconds,
+		DockerImage:      job.DockerImage,
+		Privileged:       job.Privileged,
+		RequiredFiles:    h.requiredFilesForJob(&job),
+		TaskData:         taskData,
+		TaskToken:        taskToken,
+	}
+
+	if job.Type == "executor_binary" {
+		response.ExecutorBinaryID = job.ExecutorBinaryID
+	}
+	if !job.Limits.IsZero() {
+		limits := job.Limits
+		response.Limits = &limits
+	}
+	if job.Sandbox.Enabled {
+		sandbox := job.Sandbox
+		response.Sandbox = &sandbox
+	}
+
+	return response, nil
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"borg/mothership/internal/events"
+	"borg/mothership/internal/models"
+
+	"gorm.io/gorm/clause"
+)
+
+// runnerOfflineAfter is how long a runner may miss heartbeats before it counts as offline
+const runnerOfflineAfter = 2 * time.Minute
+
+// publishRunner publishes a runner event, with the reason of offline events
+func (h *Handler) publishRunner(t events.Type, runner *models.Runner, reason ...string) {
+	data := map[string]interface{}{
+		"runner_id":      runner.ID,
+		"name":           runner.Name,
+		"hostname":       runner.Hostname,
+		"status":         runner.Status,
+		"active_tasks":   runner.ActiveTasks,
+		"last_heartbeat": runner.LastHeartbeat,
+	}
+	if len(reason) > 0 {
+		data["reason"] = reason[0]
+	}
+	h.events.Publish(t, runner.ProjectID, data)
+}
+
+// runnerOffline reports whether a runner was offline before its latest heartbeat
+func runnerOffline(runner *models.Runner, now time.Time) bool {
+	return runner.Status == "offline" || now.Sub(runner.LastHeartbeat) > runnerOfflineAfter
+}
+
+// updateRunnerHeartbeat applies a heartbeat and publishes runner.online or runner.offline
+// when the runner's reachability changes, or runner.updated when its status changes
+func (h *Handler) updateRunnerHeartbeat(runnerID string, updates map[string]interface{}) error {
+	var before models.Runner
+	if err := h.db.First(&before, "id = ?", runnerID).Error; err != nil {
+		return err
+	}
+	if err := h.db.Model(&models.Runner{}).Where("id = ?", runnerID).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	wasOffline := runnerOffline(&before, now)
+	after := before
+	after.LastHeartbeat = now
+	after.Status, _ = updates["status"].(string)
+	after.ActiveTasks, _ = updates["active_tasks"].(int32)
+	isOffline := after.Status == "offline"
+	switch {
+	case wasOffline && !isOffline:
+		h.publishRunner(events.RunnerOnline, &after)
+	case !wasOffline && isOffline:
+		h.publishRunner(events.RunnerOffline, &after, "shutdown")
+	case after.Status != before.Status || after.ActiveTasks != before.ActiveTasks:
+		h.publishRunner(events.RunnerUpdated, &after)
+	}
+	return nil
+}
+
+// markStaleRunnersOffline persists the offline status of runners that stopped sending
+// heartbeats and publishes runner.offline once for each
+func (h *Handler) markStaleRunnersOffline() error {
+	var stale []models.Runner
+	result := h.db.Model(&stale).
+		Clauses(clause.Returning{}).
+		Where("status <> ? AND last_heartbeat < ?", "offline", time.Now().Add(-runnerOfflineAfter)).
+		Updates(map[string]interface{}{"status": "offline"})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	for i := range stale {
+		h.publishRunner(events.RunnerOffline, &stale[i], "heartbeat_timeout")
+	}
+	return nil
+}
+
+// monitorRunners marks runners offline that stopped sending heartbeats until ctx is cancelled
+func (h *Handler) monitorRunners(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.markStaleRunnersOffline(); err != nil {
+				log.Printf("Failed to mark stale runners offline: %v", err)
+			}
+		}
+	}
+}
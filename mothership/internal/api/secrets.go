@@ -0,0 +1,336 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"borg/mothership/internal/auth"
+	"borg/mothership/internal/models"
+	"borg/mothership/internal/secrets"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var (
+	secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,255}$`)
+	envNamePattern    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	errSecretsDisabled = errors.New("secrets are not configured, set SECRETS_KEY on the mothership")
+)
+
+// SetSecretsCipher enables the secrets store
+func (h *Handler) SetSecretsCipher(cipher *secrets.Cipher) {
+	h.secrets = cipher
+}
+
+// parseSecretEnv decodes a job's secret references (env var name -> secret name)
+func parseSecretEnv(raw string) map[string]string {
+	var refs map[string]string
+	if raw != "" {
+		json.Unmarshal([]byte(raw), &refs)
+	}
+	return refs
+}
+
+// validateSecretRefs checks that a job may reference the given secrets and that they exist in its project
+func (h *Handler) validateSecretRefs(c *gin.Context, projectID string, refs map[string]string) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	if !hasProjectPermission(c, projectID, auth.PermSecretsUse) {
+		return errors.New("insufficient permissions to use secrets")
+	}
+	if h.secrets == nil {
+		return errSecretsDisabled
+	}
+
+	names := make([]string, 0, len(refs))
+	for envName, secretName := range refs {
+		if !envNamePattern.MatchString(envName) {
+			return fmt.Errorf("invalid environment variable name %q", envName)
+		}
+		names = append(names, secretName)
+	}
+
+	var found []string
+	if err := h.db.Model(&models.Secret{}).Where("project_id = ? AND name IN ?", projectID, names).Pluck("name", &found).Error; err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(found))
+	for _, name := range found {
+		existing[name] = true
+	}
+	for _, name := range names {
+		if !existing[name] {
+			return fmt.Errorf("secret %q not found", name)
+		}
+	}
+	return nil
+}
+
+// resolveSecrets decrypts the secrets referenced by a job, keyed by env var name.
+// Only call this when sending a task to an authenticated runner.
+func (h *Handler) resolveSecrets(job *models.Job) (map[string]string, error) {
+	refs := parseSecretEnv(job.SecretEnv)
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	if h.secrets == nil {
+		return nil, errSecretsDisabled
+	}
+
+	values := make(map[string]string, len(refs))
+	for envName, secretName := range refs {
+		var secret models.Secret
+		if err := h.db.First(&secret, "project_id = ? AND name = ?", job.ProjectID, secretName).Error; err != nil {
+			return nil, fmt.Errorf("secret %q not found", secretName)
+		}
+		value, err := h.secrets.Decrypt(secret.Name, secret.Ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		values[envName] = value
+	}
+	return values, nil
+}
+
+// taskSecretValues returns the secret values a task has access to, for masking its output
+func (h *Handler) taskSecretValues(taskID string) []string {
+	var task models.Task
+	if err := h.db.Preload("Job").First(&task, "id = ?", taskID).Error; err != nil {
+		return nil
+	}
+
+	resolved, err := h.resolveSecrets(&task.Job)
+	if err != nil {
+		log.Printf("Failed to resolve secrets for masking output of task %s: %v", taskID, err)
+		return nil
+	}
+
+	values := make([]string, 0, len(resolved))
+	for _, value := range resolved {
+		values = append(values, value)
+	}
+	return values
+}
+
+// storeTaskLogs stores output reported with a status update, as sent by runners that
+// do not stream it, with secret values masked
+func (h *Handler) storeTaskLogs(taskID string, req *UpdateTaskStatusRequest) {
+	if len(req.Stdout) == 0 && len(req.Stderr) == 0 {
+		return
+	}
+
+	timestamp := time.Unix(req.Timestamp, 0)
+	if req.Timestamp == 0 {
+		timestamp = time.Now()
+	}
+	secretValues := h.taskSecretValues(taskID)
+	projectID := ""
+	if h.events != nil {
+		projectID, _ = h.projectOfTask(taskID)
+	}
+
+	for _, output := range []struct {
+		level string
+		data  []byte
+	}{{"stdout", req.Stdout}, {"stderr", req.Stderr}} {
+		if len(output.data) == 0 {
+			continue
+		}
+		entry := &models.TaskLog{
+			TaskID:    taskID,
+			Level:     output.level,
+			Message:   secrets.MaskValues(string(output.data), secretValues),
+			Timestamp: timestamp,
+		}
+		if _, err := h.appendTaskLog(entry, projectID); err != nil {
+			log.Printf("Failed to store %s of task %s: %v", output.level, taskID, err)
+		}
+	}
+}
+
+// CreateSecretRequest represents a new secret
+type CreateSecretRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Value       string `json:"value" binding:"required"`
+	Description string `json:"description"`
+	ProjectID   string `json:"project_id"` // Optional if the user belongs to a single project
+}
+
+// CreateSecret stores a new encrypted secret
+func (h *Handler) CreateSecret(c *gin.Context) {
+	if h.secrets == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errSecretsDisabled.Error()})
+		return
+	}
+
+	var req CreateSecretRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !secretNamePattern.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name may only contain letters, digits, '_', '.' and '-'"})
+		return
+	}
+
+	projectID, err := projectForNewResource(c, req.ProjectID, auth.PermSecretsManage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var existing int64
+	h.db.Model(&models.Secret{}).Where("project_id = ? AND name = ?", projectID, req.Name).Count(&existing)
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "secret already exists"})
+		return
+	}
+
+	ciphertext, err := h.secrets.Encrypt(req.Name, req.Value)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	secret := &models.Secret{
+		ID:          uuid.New().String(),
+		ProjectID:   projectID,
+		Name:        req.Name,
+		Description: req.Description,
+		Ciphertext:  ciphertext,
+		CreatedBy:   c.GetString("user_id"),
+		UpdatedBy:   c.GetString("user_id"),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := h.db.Create(secret).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "secret.create", auditTarget{Type: "secret", ID: secret.ID, Name: secret.Name}, nil, gin.H{"description": secret.Description})
+
+	c.JSON(http.StatusCreated, secret)
+}
+
+// ListSecrets returns secret names and metadata, never values
+func (h *Handler) ListSecrets(c *gin.Context) {
+	var list []models.Secret
+	if err := scopeToProjects(c, h.db.Model(&models.Secret{})).Order("name ASC").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// findSecret loads the secret named in the path within ?project_id, or the
+// caller's only project, and checks that the caller may manage it
+func (h *Handler) findSecret(c *gin.Context) (*models.Secret, bool) {
+	projectID := c.Query("project_id")
+	if projectID == "" {
+		ids, all := callerProjectIDs(c)
+		if all || len(ids) != 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": errProjectRequired.Error()})
+			return nil, false
+		}
+		projectID = ids[0]
+	}
+	if !hasProjectPermission(c, projectID, auth.PermSecretsManage) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "insufficient permissions", "required": auth.PermSecretsManage})
+		return nil, false
+	}
+
+	var secret models.Secret
+	if err := h.db.First(&secret, "project_id = ? AND name = ?", projectID, c.Param("name")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "secret not found"})
+		return nil, false
+	}
+	return &secret, true
+}
+
+// UpdateSecretRequest represents a secret update (all fields optional)
+type UpdateSecretRequest struct {
+	Value       *string `json:"value"`
+	Description *string `json:"description"`
+}
+
+// UpdateSecret replaces a secret's value or description
+func (h *Handler) UpdateSecret(c *gin.Context) {
+	if h.secrets == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errSecretsDisabled.Error()})
+		return
+	}
+
+	var req UpdateSecretRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	secret, ok := h.findSecret(c)
+	if !ok {
+		return
+	}
+
+	before := gin.H{"description": secret.Description}
+	if req.Value != nil {
+		ciphertext, err := h.secrets.Encrypt(secret.Name, *req.Value)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		secret.Ciphertext = ciphertext
+	}
+	if req.Description != nil {
+		secret.Description = *req.Description
+	}
+	secret.UpdatedBy = c.GetString("user_id")
+	secret.UpdatedAt = time.Now()
+
+	if err := h.db.Save(secret).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "secret.update", auditTarget{Type: "secret", ID: secret.ID, Name: secret.Name}, before,
+		gin.H{"description": secret.Description, "value_changed": req.Value != nil})
+
+	c.JSON(http.StatusOK, secret)
+}
+
+// DeleteSecret deletes a secret that no unfinished job references
+func (h *Handler) DeleteSecret(c *gin.Context) {
+	secret, ok := h.findSecret(c)
+	if !ok {
+		return
+	}
+
+	var jobCount int64
+	h.db.Model(&models.Job{}).
+		Where("project_id = ? AND status IN ?", secret.ProjectID, []string{"pending", "running", "paused"}).
+		Where("EXISTS (SELECT 1 FROM jsonb_each_text(COALESCE(secret_env, '{}'::jsonb)) WHERE value = ?)", secret.Name).
+		Count(&jobCount)
+	if jobCount > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot delete secret that is used by unfinished jobs"})
+		return
+	}
+
+	if err := h.db.Delete(secret).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "secret.delete", auditTarget{Type: "secret", ID: secret.ID, Name: secret.Name}, gin.H{"description": secret.Description}, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "secret deleted",
+	})
+}
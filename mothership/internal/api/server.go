@@ -1,12 +1,23 @@
 package api
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
+	"time"
 
+	"borg/mothership/internal/auth"
+	"borg/mothership/internal/cluster"
+	"borg/mothership/internal/events"
+	"borg/mothership/internal/journal"
+	"borg/mothership/internal/logstore"
+	"borg/mothership/internal/oidc"
+	"borg/mothership/internal/pki"
 	"borg/mothership/internal/queue"
+	"borg/mothership/internal/ratelimit"
+	"borg/mothership/internal/secrets"
 	"borg/mothership/internal/storage"
+	"borg/mothership/internal/webhook"
 	"borg/mothership/internal/websocket"
 	
 	"github.com/gin-gonic/gin"
@@ -50,6 +61,10 @@ func NewServer(db *gorm.DB, q *queue.Queue, hub *websocket.Hub, screenHub *webso
 	}))
 	router.Use(gin.Recovery())
 	
+	// X-Forwarded-For is ignored until trusted proxies are configured, so clients cannot
+	// choose the IP that rate limits, lockouts and the audit log see
+	router.SetTrustedProxies(nil)
+	
 	// CORS middleware
 	router.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
@@ -66,16 +81,16 @@ func NewServer(db *gorm.DB, q *queue.Queue, hub *websocket.Hub, screenHub *webso
 	})
 	
 	// WebSocket endpoint
-	router.GET("/ws", websocket.HandleWebSocket(hub))
+	router.GET("/ws", AuthMiddleware(db), websocket.HandleWebSocket(hub, handler.subscriberAccess))
 	
 	// Screen streaming WebSocket endpoint (for viewers)
-	router.GET("/ws/screen/:runnerID", websocket.HandleScreenWebSocket(screenHub))
+	router.GET("/ws/screen/:runnerID", AuthMiddleware(db), handler.requireRunnerPermission("runnerID", auth.PermScreensView), websocket.HandleScreenWebSocket(screenHub, handler.auditViewerSession))
 	
 	// Screen streaming WebSocket endpoint (for agents to send frames)
-	router.GET("/ws/screen/agent/:runnerID", websocket.HandleAgentScreenWebSocket(screenHub))
+	router.GET("/ws/screen/agent/:runnerID", RunnerAuthMiddleware(db), handler.requireRunnerCertificate(), RequireRunnerParam("runnerID"), websocket.HandleAgentScreenWebSocket(screenHub))
 	
 	// Agent WebSocket endpoint (for real-time communication)
-	router.GET("/ws/agent/:runnerID", websocket.HandleAgentWebSocket(agentHub, db))
+	router.GET("/ws/agent/:runnerID", RunnerAuthMiddleware(db), handler.requireRunnerCertificate(), RequireRunnerParam("runnerID"), websocket.HandleAgentWebSocket(agentHub, db))
 	
 	// Download endpoint (before API routes)
 	router.GET("/api/v1/download/solder.exe", handler.DownloadSolder)
@@ -84,79 +99,156 @@ func NewServer(db *gorm.DB, q *queue.Queue, hub *websocket.Hub, screenHub *webso
 	api := router.Group("/api/v1")
 	{
 		// Public auth endpoints (no authentication required)
-		api.POST("/auth/login", handler.Login)
+		api.POST("/auth/login", handler.rateLimit(limitLogin), handler.Login)
+		api.POST("/auth/refresh", handler.rateLimit(limitLogin), handler.RefreshSession)
+		api.GET("/auth/oidc/config", handler.GetOIDCConfig)
+		api.GET("/auth/oidc/login", handler.rateLimit(limitLogin), handler.OIDCLogin)
+		api.GET("/auth/oidc/callback", handler.rateLimit(limitLogin), handler.OIDCCallback)
 		
 		// Protected dashboard endpoints (require authentication)
 		protected := api.Group("")
-		protected.Use(AuthMiddleware())
+		protected.Use(AuthMiddleware(db), handler.rateLimit(limitAPI))
 		{
 			// Dashboard
-			protected.GET("/stats", handler.GetDashboardStats)
+			protected.GET("/stats", RequirePermission(auth.PermJobsRead), handler.GetDashboardStats)
 			
-			// Jobs
-			protected.GET("/jobs", handler.ListJobs)
-			protected.POST("/jobs", handler.CreateJob)
-			protected.GET("/jobs/:id", handler.GetJob)
-			protected.PATCH("/jobs/:id", handler.UpdateJob)
-			protected.DELETE("/jobs/:id", handler.DeleteJob)
-			protected.POST("/jobs/:id/pause", handler.PauseJob)
-			protected.POST("/jobs/:id/resume", handler.ResumeJob)
-			protected.POST("/jobs/:id/cancel", handler.CancelJob)
+			// Jobs (submitters can only modify their own jobs, enforced in the handlers)
+			protected.GET("/jobs", RequirePermission(auth.PermJobsRead), handler.ListJobs)
+			protected.POST("/jobs", RequirePermission(auth.PermJobsCreate), handler.CreateJob)
+			protected.GET("/jobs/:id", handler.requireProjectPermission("id", handler.projectOfRow("jobs"), auth.PermJobsRead, "job"), handler.GetJob)
+			protected.PATCH("/jobs/:id", handler.requireProjectPermission("id", handler.projectOfRow("jobs"), auth.PermJobsCreate, "job"), handler.UpdateJob)
+			protected.DELETE("/jobs/:id", handler.requireProjectPermission("id", handler.projectOfRow("jobs"), auth.PermJobsCreate, "job"), handler.DeleteJob)
+			protected.POST("/jobs/:id/pause", handler.requireProjectPermission("id", handler.projectOfRow("jobs"), auth.PermJobsCreate, "job"), handler.PauseJob)
+			protected.POST("/jobs/:id/resume", handler.requireProjectPermission("id", handler.projectOfRow("jobs"), auth.PermJobsCreate, "job"), handler.ResumeJob)
+			protected.POST("/jobs/:id/cancel", handler.requireProjectPermission("id", handler.projectOfRow("jobs"), auth.PermJobsCreate, "job"), handler.CancelJob)
 			
 			// Runners (dashboard endpoints - protected)
-			protected.GET("/runners", handler.ListRunners)
-			protected.GET("/runners/:id", handler.GetRunner)
-			protected.PATCH("/runners/:id/rename", handler.RenameRunner)
-			protected.PATCH("/runners/:id/screen-settings", handler.UpdateScreenSettings)
-			protected.DELETE("/runners/:id", handler.DeleteRunner)
+			protected.GET("/runners", RequirePermission(auth.PermRunnersRead), handler.ListRunners)
+			protected.GET("/runners/:id", handler.requireRunnerPermission("id", auth.PermRunnersRead), handler.GetRunner)
+			protected.PATCH("/runners/:id/rename", handler.requireRunnerPermission("id", auth.PermRunnersManage), handler.RenameRunner)
+			protected.PATCH("/runners/:id/screen-settings", handler.requireRunnerPermission("id", auth.PermRunnersManage), handler.UpdateScreenSettings)
+			protected.DELETE("/runners/:id", handler.requireRunnerPermission("id", auth.PermRunnersManage), handler.DeleteRunner)
+			protected.POST("/runners/:id/credential/revoke", handler.requireRunnerPermission("id", auth.PermRunnersManage), handler.RevokeRunnerCredential)
+			protected.PATCH("/runners/:id/project", RequirePermission(auth.PermRunnersManage), handler.SetRunnerProject)
+			
+			// Runner enrollment tokens
+			protected.POST("/enrollment-tokens", RequirePermission(auth.PermEnrollmentManage), handler.CreateEnrollmentToken)
+			protected.GET("/enrollment-tokens", RequirePermission(auth.PermEnrollmentManage), handler.ListEnrollmentTokens)
+			protected.DELETE("/enrollment-tokens/:id", RequirePermission(auth.PermEnrollmentManage), handler.RevokeEnrollmentToken)
 			
 			// Logs
-			protected.GET("/tasks/:id/logs", handler.GetTaskLogs)
+			protected.GET("/tasks/:id/logs", handler.requireProjectPermission("id", handler.projectOfTask, auth.PermJobsRead, "task"), handler.GetTaskLogs)
+			protected.GET("/tasks/:id/logs/stream", handler.requireProjectPermission("id", handler.projectOfTask, auth.PermJobsRead, "task"), handler.StreamTaskLogs)
+			protected.GET("/tasks/:id/logs/download", handler.requireProjectPermission("id", handler.projectOfTask, auth.PermJobsRead, "task"), handler.DownloadTaskLogs)
+			protected.GET("/jobs/:id/logs", handler.requireProjectPermission("id", handler.projectOfRow("jobs"), auth.PermJobsRead, "job"), handler.GetJobLogs)
+			
+			// Event stream, filtered by the caller's permissions
+			protected.GET("/events", handler.StreamEvents)
 			
 			// Executor binaries
-			protected.POST("/executor-binaries/upload", handler.UploadExecutorBinary)
-			protected.GET("/executor-binaries", handler.ListExecutorBinaries)
-			protected.GET("/executor-binaries/:id", handler.GetExecutorBinary)
-			protected.DELETE("/executor-binaries/:id", handler.DeleteExecutorBinary)
+			protected.POST("/executor-binaries/upload", RequirePermission(auth.PermFilesUpload), handler.UploadExecutorBinary)
+			protected.GET("/executor-binaries", RequirePermission(auth.PermJobsRead), handler.ListExecutorBinaries)
+			protected.GET("/executor-binaries/:id", handler.requireProjectPermission("id", handler.projectOfRow("executor_binaries"), auth.PermJobsRead, "executor binary"), handler.GetExecutorBinary)
+			protected.DELETE("/executor-binaries/:id", handler.requireProjectPermission("id", handler.projectOfRow("executor_binaries"), auth.PermFilesDelete, "executor binary"), handler.DeleteExecutorBinary)
 
 			// Job processor scripts and datasets
-			protected.POST("/jobs/:id/processor-script/upload", handler.UploadProcessorScript)
-			protected.POST("/jobs/:id/dataset/upload", handler.UploadCSVDataset)
-			protected.GET("/jobs/:id/results", handler.ListJobResults)
+			protected.POST("/jobs/:id/processor-script/upload", handler.requireProjectPermission("id", handler.projectOfRow("jobs"), auth.PermFilesUpload, "job"), handler.UploadProcessorScript)
+			protected.POST("/jobs/:id/dataset/upload", handler.requireProjectPermission("id", handler.projectOfRow("jobs"), auth.PermFilesUpload, "job"), handler.UploadCSVDataset)
+			protected.GET("/jobs/:id/results", handler.requireProjectPermission("id", handler.projectOfRow("jobs"), auth.PermJobsRead, "job"), handler.ListJobResults)
 
 			// Datasets
-			protected.POST("/datasets", handler.UploadDataset)
-			protected.GET("/datasets", handler.ListDatasets)
-			protected.GET("/datasets/:id", handler.GetDataset)
-			protected.DELETE("/datasets/:id", handler.DeleteDataset)
+			protected.POST("/datasets", RequirePermission(auth.PermFilesUpload), handler.UploadDataset)
+			protected.GET("/datasets", RequirePermission(auth.PermJobsRead), handler.ListDatasets)
+			protected.GET("/datasets/:id", handler.requireProjectPermission("id", handler.projectOfRow("datasets"), auth.PermJobsRead, "dataset"), handler.GetDataset)
+			protected.DELETE("/datasets/:id", handler.requireProjectPermission("id", handler.projectOfRow("datasets"), auth.PermFilesDelete, "dataset"), handler.DeleteDataset)
 
-			// Current user endpoint
+			// Current user endpoints
 			protected.GET("/auth/me", handler.GetCurrentUser)
+			protected.POST("/auth/password", RequireSession(), handler.ChangePassword)
+			protected.POST("/auth/logout", RequireSession(), handler.Logout)
+			protected.POST("/auth/logout-all", RequireSession(), handler.LogoutAll)
+			protected.GET("/auth/sessions", RequireSession(), handler.ListSessions)
+			
+			// Personal API keys
+			protected.POST("/api-keys", RequireSession(), handler.CreateAPIKey)
+			protected.GET("/api-keys", RequireSession(), handler.ListAPIKeys)
+			protected.DELETE("/api-keys/:id", RequireSession(), handler.RevokeAPIKey)
+			
+			// Secrets (values are write-only)
+			protected.GET("/secrets", RequirePermission(auth.PermSecretsUse), handler.ListSecrets)
+			protected.POST("/secrets", RequirePermission(auth.PermSecretsManage), handler.CreateSecret)
+			protected.PATCH("/secrets/:name", RequirePermission(auth.PermSecretsManage), handler.UpdateSecret)
+			protected.DELETE("/secrets/:name", RequirePermission(auth.PermSecretsManage), handler.DeleteSecret)
+			
+			// Projects (members manage their own project's membership, enforced in the handlers)
+			protected.GET("/projects", handler.ListProjects)
+			protected.POST("/projects", RequirePermission(auth.PermProjectsManage), handler.CreateProject)
+			protected.GET("/projects/:id", handler.GetProject)
+			protected.PATCH("/projects/:id", RequirePermission(auth.PermProjectsManage), handler.UpdateProject)
+			protected.DELETE("/projects/:id", RequirePermission(auth.PermProjectsManage), handler.DeleteProject)
+			protected.GET("/projects/:id/members", handler.ListProjectMembers)
+			protected.PUT("/projects/:id/members/:userID", handler.SetProjectMember)
+			protected.DELETE("/projects/:id/members/:userID", handler.RemoveProjectMember)
+			
+			// Webhooks (global webhooks are visible to administrators only)
+			protected.GET("/webhooks", RequirePermission(auth.PermWebhooksManage), handler.ListWebhooks)
+			protected.POST("/webhooks", RequirePermission(auth.PermWebhooksManage), handler.CreateWebhook)
+			protected.GET("/webhooks/:id", handler.requireProjectPermission("id", handler.projectOfRow("webhooks"), auth.PermWebhooksManage, "webhook"), handler.GetWebhook)
+			protected.PATCH("/webhooks/:id", handler.requireProjectPermission("id", handler.projectOfRow("webhooks"), auth.PermWebhooksManage, "webhook"), handler.UpdateWebhook)
+			protected.DELETE("/webhooks/:id", handler.requireProjectPermission("id", handler.projectOfRow("webhooks"), auth.PermWebhooksManage, "webhook"), handler.DeleteWebhook)
+			protected.GET("/webhooks/:id/deliveries", handler.requireProjectPermission("id", handler.projectOfRow("webhooks"), auth.PermWebhooksManage, "webhook"), handler.ListWebhookDeliveries)
+			protected.POST("/webhooks/:id/deliveries/:deliveryID/redeliver", handler.requireProjectPermission("id", handler.projectOfRow("webhooks"), auth.PermWebhooksManage, "webhook"), handler.RedeliverWebhookDelivery)
+			
+			// Audit log (admin)
+			protected.GET("/audit", RequirePermission(auth.PermAuditRead), handler.ListAuditLog)
+			protected.GET("/audit/export", RequirePermission(auth.PermAuditRead), handler.ExportAuditLog)
+			
+			// User management (admin)
+			protected.GET("/users", RequirePermission(auth.PermUsersManage), handler.ListUsers)
+			protected.POST("/users", RequirePermission(auth.PermUsersManage), handler.CreateUser)
+			protected.GET("/users/:id", RequirePermission(auth.PermUsersManage), handler.GetUser)
+			protected.PATCH("/users/:id", RequirePermission(auth.PermUsersManage), handler.UpdateUser)
+			protected.POST("/users/:id/password", RequirePermission(auth.PermUsersManage), handler.ResetUserPassword)
+			protected.DELETE("/users/:id", RequirePermission(auth.PermUsersManage), handler.DeleteUser)
 		}
 		
-		// Runner API endpoints (unprotected - for agents)
-		api.POST("/runners/register", handler.RegisterRunner)
-		api.POST("/runners/:id/heartbeat", handler.Heartbeat)
-		api.GET("/runners/:id/tasks/next", handler.GetNextTask)
-		api.POST("/tasks/:id/status", handler.UpdateTaskStatus)
-		api.POST("/tasks/:id/result", handler.UpdateTaskResult)
-		api.GET("/files/:id/download", handler.DownloadFile)
-		api.POST("/artifacts/upload", handler.UploadArtifact)
-
-		// Job results upload (for solder agents)
-		api.POST("/jobs/:id/results/upload", handler.UploadJobResult)
-
-		// Screen streaming endpoints (unprotected - for agents)
-		api.POST("/runners/:id/screen/frame", handler.UploadScreenFrame)
-		api.GET("/runners/:id/screen/status", handler.GetScreenStreamStatus)
+		// Runner registration (authenticated by enrollment token or runner secret in the body)
+		api.POST("/runners/register", handler.rateLimit(limitLogin), handler.RegisterRunner)
+		api.GET("/pki/ca.crt", handler.GetCACertificate)
+		api.GET("/health", handler.Health)
+		
+		// Runner API endpoints (require runner credential - for agents)
+		runnerAPI := api.Group("")
+		runnerAPI.Use(RunnerAuthMiddleware(db), handler.requireRunnerCertificate(), handler.rateLimit(limitRunner))
+		{
+			runnerAPI.POST("/runners/:id/heartbeat", RequireRunnerParam("id"), handler.Heartbeat)
+			runnerAPI.GET("/runners/:id/tasks/next", RequireRunnerParam("id"), handler.GetNextTask)
+			runnerAPI.POST("/runners/:id/certificate", RequireRunnerParam("id"), handler.RenewRunnerCertificate)
+			runnerAPI.POST("/tasks/:id/status", handler.idempotent(), handler.UpdateTaskStatus)
+			runnerAPI.POST("/tasks/:id/logs", handler.AppendTaskLogs)
+			runnerAPI.GET("/files/:id/download", handler.DownloadFile)
+			runnerAPI.POST("/artifacts/upload", handler.idempotent(), handler.UploadArtifact)
+			
+			// Job results upload (for solder agents)
+			runnerAPI.POST("/jobs/:id/results/upload", handler.idempotent(), handler.UploadJobResult)
+			
+			// Screen streaming endpoints (for agents)
+			runnerAPI.POST("/runners/:id/screen/frame", RequireRunnerParam("id"), handler.UploadScreenFrame)
+			runnerAPI.GET("/runners/:id/screen/status", RequireRunnerParam("id"), handler.GetScreenStreamStatus)
+			
+			// Screenshot upload (deprecated - kept for backward compatibility)
+			runnerAPI.POST("/runners/:id/screenshots", RequireRunnerParam("id"), handler.UploadScreenshot)
+		}
+		
+		// Task result reporting (runner credential or task token - for task processes)
+		api.POST("/tasks/:id/result", TaskAuthMiddleware(db), handler.requireRunnerCertificate(), handler.rateLimit(limitRunner), handler.UpdateTaskResult)
 		
 		// Screen information endpoint (protected - for dashboard)
-		protected.GET("/runners/:id/screens", handler.GetAvailableScreens)
+		protected.GET("/runners/:id/screens", handler.requireRunnerPermission("id", auth.PermScreensView), handler.GetAvailableScreens)
 		
-		// Screenshot endpoints (deprecated - kept for backward compatibility, unprotected)
-		api.POST("/runners/:id/screenshots", handler.UploadScreenshot)
-		api.GET("/runners/:id/screenshots", handler.GetScreenshots)
-		api.GET("/runners/:id/screenshots/:filename", handler.GetScreenshot)
+		// Screenshot endpoints (deprecated - kept for backward compatibility, protected - for dashboard)
+		protected.GET("/runners/:id/screenshots", handler.requireRunnerPermission("id", auth.PermScreensView), handler.GetScreenshots)
+		protected.GET("/runners/:id/screenshots/:filename", handler.requireRunnerPermission("id", auth.PermScreensView), handler.GetScreenshot)
 	}
 	
 	// Serve static files (web app) - must be last
@@ -171,6 +263,68 @@ func NewServer(db *gorm.DB, q *queue.Queue, hub *websocket.Hub, screenHub *webso
 	}
 }
 
+// EnableSecrets enables the encrypted secrets store
+func (s *Server) EnableSecrets(cipher *secrets.Cipher) {
+	s.handler.SetSecretsCipher(cipher)
+}
+
+// EnableRateLimits enables rate limits and login lockouts
+func (s *Server) EnableRateLimits(limiter *ratelimit.Limiter) {
+	s.handler.SetRateLimiter(limiter)
+}
+
+// SetTrustedProxies sets the reverse proxies whose X-Forwarded-For header gives the client IP
+func (s *Server) SetTrustedProxies(proxies []string) error {
+	return s.router.SetTrustedProxies(proxies)
+}
+
+// EnableRunnerCertificates issues runner client certificates from the internal CA
+func (s *Server) EnableRunnerCertificates(ca *pki.CA, config pki.Config) {
+	s.handler.SetPKI(ca, config)
+}
+
+// SetEvents publishes job, runner, task output and dataset state changes to bus
+func (s *Server) SetEvents(bus *events.Bus) {
+	s.handler.SetEvents(bus)
+}
+
+// EnableWebhooks enables webhook deliveries and redelivery
+func (s *Server) EnableWebhooks(dispatcher *webhook.Dispatcher) {
+	s.handler.SetWebhooks(dispatcher)
+}
+
+// EnableEventStream enables the server-sent event stream backed by an event journal
+func (s *Server) EnableEventStream(j *journal.Journal) {
+	s.handler.SetJournal(j)
+}
+
+// RunRunnerMonitor marks runners offline that stop sending heartbeats until ctx is cancelled
+func (s *Server) RunRunnerMonitor(ctx context.Context) {
+	s.handler.monitorRunners(ctx, 30*time.Second)
+}
+
+// RunIdempotencyKeyPruner removes old records of runner requests until ctx is cancelled
+func (s *Server) RunIdempotencyKeyPruner(ctx context.Context) {
+	s.handler.pruneIdempotencyKeys(ctx)
+}
+
+// EnableCluster shares task notifications and screen frames with the other mothership
+// instances until ctx is cancelled
+func (s *Server) EnableCluster(ctx context.Context, c *cluster.Cluster) {
+	s.handler.SetCluster(c)
+	go s.handler.announceScreenViewers(ctx)
+}
+
+// SetLogStore sets the store task logs are read from. Required.
+func (s *Server) SetLogStore(store *logstore.Store) {
+	s.handler.SetLogStore(store)
+}
+
+// EnableOIDC enables single sign-on through an OpenID Connect provider
+func (s *Server) EnableOIDC(provider *oidc.Provider) {
+	s.handler.SetOIDCProvider(provider)
+}
+
 // GetHub returns the WebSocket hub
 func (s *Server) GetHub() *websocket.Hub {
 	return s.hub
@@ -188,17 +342,7 @@ func (s *Server) GetAgentHub() *websocket.AgentHub {
 
 // SetupAgentMessageHandler sets up the callback for handling agent WebSocket messages
 func (s *Server) SetupAgentMessageHandler() {
-	s.agentHub.SetMessageHandler(func(runnerID string, messageType string, data interface{}) {
-		// Handle incoming WebSocket messages from agents
-		switch messageType {
-		case "heartbeat":
-			s.handler.handleWebSocketHeartbeat(runnerID, data)
-		case "task_status":
-			s.handler.handleWebSocketTaskStatus(runnerID, data)
-		default:
-			log.Printf("Unknown message type from runner %s: %s", runnerID, messageType)
-		}
-	})
+	s.agentHub.SetMessageHandler(s.handler.handleAgentMessage)
 }
 
 // GetRouter returns the router (for WebSocket setup)
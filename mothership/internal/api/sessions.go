@@ -0,0 +1,201 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"borg/mothership/internal/auth"
+	"borg/mothership/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var errInvalidRefreshToken = errors.New("invalid or expired refresh token")
+
+// SessionTokens is returned whenever a session is created or refreshed
+type SessionTokens struct {
+	Token        string `json:"token"`         // Access token
+	RefreshToken string `json:"refresh_token"` // Single-use, rotated on every refresh
+	ExpiresIn    int64  `json:"expires_in"`    // Access token lifetime in seconds
+}
+
+// issueSession creates a server-side session for a user and returns its first tokens
+func (h *Handler) issueSession(c *gin.Context, user *models.User) (*SessionTokens, error) {
+	refreshToken, err := auth.GenerateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		ID:               uuid.New().String(),
+		UserID:           user.ID,
+		RefreshTokenHash: auth.HashToken(refreshToken),
+		UserAgent:        truncate(c.Request.UserAgent(), 500),
+		IPAddress:        c.ClientIP(),
+		ExpiresAt:        now.Add(auth.RefreshTokenTTL),
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if err := h.db.Create(session).Error; err != nil {
+		return nil, err
+	}
+
+	token, err := auth.GenerateJWT(user.ID, user.Username, user.Role, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SessionTokens{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(auth.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// revokeUserSessions revokes all active sessions of a user
+func (h *Handler) revokeUserSessions(userID string) error {
+	return h.db.Model(&models.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// RefreshSessionRequest represents a refresh token exchange
+type RefreshSessionRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// RefreshSession exchanges a refresh token for a new access token and refresh token.
+// Presenting an already rotated refresh token revokes the whole session, since it
+// means the token was copied.
+func (h *Handler) RefreshSession(c *gin.Context) {
+	var req RefreshSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, err := h.rotateRefreshToken(c, req.RefreshToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// rotateRefreshToken validates a refresh token, replaces it and issues a new access token
+func (h *Handler) rotateRefreshToken(c *gin.Context, refreshToken string) (*SessionTokens, error) {
+	now := time.Now()
+	presentedHash := auth.HashToken(refreshToken)
+
+	var session models.Session
+	if err := h.db.First(&session, "refresh_token_hash = ?", presentedHash).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+
+		// Reuse of a rotated token: revoke the session it belonged to
+		if err := h.db.First(&session, "previous_refresh_token_hash = ?", presentedHash).Error; err == nil && session.RevokedAt == nil {
+			log.Printf("Refresh token reuse detected for session %s of user %s, revoking session", session.ID, session.UserID)
+			h.db.Model(&models.Session{}).Where("id = ?", session.ID).Update("revoked_at", now)
+		}
+		return nil, errInvalidRefreshToken
+	}
+	if !session.IsActive(now) {
+		return nil, errInvalidRefreshToken
+	}
+
+	var user models.User
+	if err := h.db.First(&user, "id = ?", session.UserID).Error; err != nil || user.Disabled {
+		return nil, errInvalidRefreshToken
+	}
+
+	newRefreshToken, err := auth.GenerateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// Rotate only if the token is still current, so concurrent refreshes cannot both succeed
+	result := h.db.Model(&models.Session{}).
+		Where("id = ? AND refresh_token_hash = ? AND revoked_at IS NULL", session.ID, presentedHash).
+		Updates(map[string]interface{}{
+			"refresh_token_hash":          auth.HashToken(newRefreshToken),
+			"previous_refresh_token_hash": presentedHash,
+			"expires_at":                  now.Add(auth.RefreshTokenTTL),
+			"last_used_at":                now,
+			"updated_at":                  now,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errInvalidRefreshToken
+	}
+
+	token, err := auth.GenerateJWT(user.ID, user.Username, user.Role, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SessionTokens{
+		Token:        token,
+		RefreshToken: newRefreshToken,
+		ExpiresIn:    int64(auth.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// Logout revokes the current session
+func (h *Handler) Logout(c *gin.Context) {
+	if err := h.db.Model(&models.Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", c.GetString("session_id"), c.GetString("user_id")).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "logged out",
+	})
+}
+
+// LogoutAll revokes every session of the current user
+func (h *Handler) LogoutAll(c *gin.Context) {
+	if err := h.revokeUserSessions(c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "all sessions logged out",
+	})
+}
+
+// ListSessions returns the current user's active sessions
+func (h *Handler) ListSessions(c *gin.Context) {
+	var sessions []models.Session
+	if err := h.db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", c.GetString("user_id"), time.Now()).
+		Order("created_at DESC").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"current_session_id": c.GetString("session_id"),
+		"sessions":           sessions,
+	})
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"borg/mothership/internal/auth"
+	"borg/mothership/internal/models"
+	"borg/mothership/internal/oidc"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var errNoMappedRole = errors.New("your account is not in a group that has access to borg")
+
+// oidcLoginCookie binds a pending single sign-on login to the browser that started it
+const (
+	oidcLoginCookie     = "borg_oidc_login"
+	oidcLoginCookiePath = "/api/v1/auth/oidc"
+)
+
+// SetOIDCProvider enables single sign-on through the given provider
+func (h *Handler) SetOIDCProvider(provider *oidc.Provider) {
+	h.oidc = provider
+}
+
+// redirectToLogin sends the browser back to the dashboard login page with an error
+func redirectToLogin(c *gin.Context, message string) {
+	c.Redirect(http.StatusFound, "/login?error="+url.QueryEscape(message))
+}
+
+// GetOIDCConfig tells the dashboard whether single sign-on is available
+func (h *Handler) GetOIDCConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"enabled": h.oidc != nil})
+}
+
+// OIDCLogin starts an authorization-code login with PKCE at the identity provider
+func (h *Handler) OIDCLogin(c *gin.Context) {
+	if h.oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "single sign-on is not configured"})
+		return
+	}
+
+	state, err := oidc.RandomString()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	verifier, err := oidc.RandomString()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	cookie, err := oidc.EncodeLoginState(oidc.LoginState{State: state, Nonce: nonce, CodeVerifier: verifier})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Lax still sends the cookie on the provider's top-level redirect back to the callback
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcLoginCookie, cookie, int(oidc.LoginStateTTL.Seconds()), oidcLoginCookiePath, "", c.Request.TLS != nil, true)
+
+	c.Redirect(http.StatusFound, h.oidc.AuthCodeURL(state, nonce, oidc.CodeChallenge(verifier)))
+}
+
+// OIDCCallback completes a single sign-on login and hands the dashboard a session token
+func (h *Handler) OIDCCallback(c *gin.Context) {
+	if h.oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "single sign-on is not configured"})
+		return
+	}
+
+	// Each login cookie is used once, whatever the outcome
+	cookie, _ := c.Cookie(oidcLoginCookie)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcLoginCookie, "", -1, oidcLoginCookiePath, "", c.Request.TLS != nil, true)
+
+	if errCode := c.Query("error"); errCode != "" {
+		h.auditSSOLogin(c, nil, nil, "provider error: "+truncate(errCode, 100))
+		redirectToLogin(c, "Single sign-on failed: "+errCode)
+		return
+	}
+
+	login, ok := oidc.DecodeLoginState(cookie, c.Query("state"))
+	if !ok {
+		h.auditSSOLogin(c, nil, nil, "invalid or expired login state")
+		redirectToLogin(c, "Single sign-on session expired, please try again")
+		return
+	}
+
+	rawIDToken, err := h.oidc.Exchange(c.Request.Context(), c.Query("code"), login.CodeVerifier)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		h.auditSSOLogin(c, nil, nil, "code exchange failed")
+		redirectToLogin(c, "Single sign-on failed")
+		return
+	}
+
+	identity, err := h.oidc.VerifyIDToken(c.Request.Context(), rawIDToken, login.Nonce)
+	if err != nil {
+		log.Printf("OIDC ID token rejected: %v", err)
+		h.auditSSOLogin(c, nil, nil, "ID token rejected")
+		redirectToLogin(c, "Single sign-on failed")
+		return
+	}
+
+	user, err := h.upsertOIDCUser(identity)
+	if err != nil {
+		if !errors.Is(err, errNoMappedRole) {
+			log.Printf("OIDC user mapping failed for %s: %v", identity.Subject, err)
+		}
+		h.auditSSOLogin(c, identity, nil, err.Error())
+		redirectToLogin(c, err.Error())
+		return
+	}
+	if user.Disabled {
+		h.auditSSOLogin(c, identity, user, "account disabled")
+		redirectToLogin(c, "account is disabled")
+		return
+	}
+
+	tokens, err := h.issueSession(c, user)
+	if err != nil {
+		h.auditSSOLogin(c, identity, user, "session could not be created")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.auditSSOLogin(c, identity, user, "")
+
+	// The tokens travel in the fragment so they never reach server logs
+	fragment := url.Values{
+		"token":         {tokens.Token},
+		"refresh_token": {tokens.RefreshToken},
+	}
+	c.Redirect(http.StatusFound, "/login#"+fragment.Encode())
+}
+
+// upsertOIDCUser maps a verified identity to a local user, creating it on first login.
+// The role is synced from the identity's groups on every login.
+func (h *Handler) upsertOIDCUser(identity *oidc.Identity) (*models.User, error) {
+	role, ok := h.oidc.RoleForGroups(identity.Groups)
+	if !ok {
+		return nil, errNoMappedRole
+	}
+
+	externalID := identity.Issuer + "|" + identity.Subject
+	now := time.Now()
+
+	var user models.User
+	err := h.db.Where("external_id = ?", externalID).First(&user).Error
+	if err == nil {
+		if user.Role != role {
+			user.Role = role
+			user.UpdatedAt = now
+			if err := h.db.Save(&user).Error; err != nil {
+				return nil, err
+			}
+		}
+		return &user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	username, err := h.availableUsername(identity, externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	user = models.User{
+		ID:           uuid.New().String(),
+		Username:     username,
+		AuthProvider: "oidc",
+		ExternalID:   &externalID,
+		Role:         role,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := h.db.Create(&user).Error; err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created single sign-on user %q with role %s", user.Username, user.Role)
+	return &user, nil
+}
+
+// availableUsername picks a username for a new single sign-on user that does not clash with existing users
+func (h *Handler) availableUsername(identity *oidc.Identity, externalID string) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base = identity.Email
+	}
+	if base == "" {
+		base = identity.Subject
+	}
+
+	candidates := []string{base, fmt.Sprintf("%s-%s", base, auth.HashToken(externalID)[:8])}
+	for _, candidate := range candidates {
+		var count int64
+		if err := h.db.Model(&models.User{}).Where("username = ?", candidate).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("username %q is already taken", base)
+}
@@ -0,0 +1,375 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"borg/mothership/internal/events"
+	"borg/mothership/internal/logstore"
+	"borg/mothership/internal/models"
+	"borg/mothership/internal/secrets"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxTaskLogsBody    = 4 << 20 // Runners send at most 1 MiB of output per request
+	defaultLogPageSize = 1000
+	maxLogPageSize     = 5000
+	logStreamBatchSize = 500
+	logStreamPoll      = 2 * time.Second // Fallback for output stored by other instances
+	logStreamKeepAlive = 15 * time.Second
+)
+
+// SetLogStore sets the store task logs are read from
+func (h *Handler) SetLogStore(store *logstore.Store) {
+	h.logs = store
+}
+
+// appendTaskLog stores a log entry and publishes it to subscribers of the task's logs.
+// Returns false if the entry is a chunk that was already stored.
+func (h *Handler) appendTaskLog(entry *models.TaskLog, projectID string) (bool, error) {
+	// Postgres text columns reject NUL bytes and invalid UTF-8
+	entry.Message = strings.ToValidUTF8(strings.ReplaceAll(entry.Message, "\x00", ""), "\uFFFD")
+
+	result := h.db.Clauses(clause.OnConflict{DoNothing: true}).Create(entry)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+
+	data := map[string]interface{}{
+		"task_id":   entry.TaskID,
+		"log_id":    entry.ID,
+		"level":     entry.Level,
+		"message":   entry.Message,
+		"timestamp": entry.Timestamp,
+	}
+	if entry.Seq > 0 {
+		data["seq"] = entry.Seq
+	}
+	h.events.Publish(events.TaskLog, projectID, data)
+	return true, nil
+}
+
+// TaskLogChunk is a piece of output streamed by a runner
+type TaskLogChunk struct {
+	Seq       int64  `json:"seq" binding:"required,min=1"`
+	Stream    string `json:"stream" binding:"required,oneof=stdout stderr"`
+	Data      []byte `json:"data"`      // Base64 in JSON
+	Timestamp int64  `json:"timestamp"` // Unix milliseconds
+}
+
+// AppendTaskLogsRequest carries output chunks of a running task
+type AppendTaskLogsRequest struct {
+	Chunks []TaskLogChunk `json:"chunks" binding:"dive"`
+}
+
+// AppendTaskLogs stores output chunks streamed by the runner executing a task. Chunks
+// are numbered per task, so resent chunks are acknowledged without being stored twice.
+func (h *Handler) AppendTaskLogs(c *gin.Context) {
+	taskID := c.Param("id")
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxTaskLogsBody)
+	var req AppendTaskLogsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := h.runnerTask(c, taskID); err != nil {
+		if err == errTaskNotAssigned {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "task not found"})
+		return
+	}
+
+	var acked int64
+	if len(req.Chunks) > 0 {
+		// Secrets split across two chunks are not masked; runners send whole writes
+		// of the task as one chunk where possible
+		secretValues := h.taskSecretValues(taskID)
+		projectID := ""
+		if h.events != nil {
+			projectID, _ = h.projectOfTask(taskID)
+		}
+
+		for _, chunk := range req.Chunks {
+			timestamp := time.UnixMilli(chunk.Timestamp)
+			if chunk.Timestamp == 0 {
+				timestamp = time.Now()
+			}
+			entry := &models.TaskLog{
+				TaskID:    taskID,
+				Seq:       chunk.Seq,
+				Level:     chunk.Stream,
+				Message:   secrets.MaskValues(string(chunk.Data), secretValues),
+				Timestamp: timestamp,
+			}
+			if _, err := h.appendTaskLog(entry, projectID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if chunk.Seq > acked {
+				acked = chunk.Seq
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"acked_seq": acked,
+	})
+}
+
+// logFilterFromQuery reads log query parameters: cursor (log ID to continue after),
+// limit, since/until (RFC 3339), level (comma-separated) and q (words to search for)
+func logFilterFromQuery(c *gin.Context) (logstore.Filter, int, error) {
+	var f logstore.Filter
+	if cursor := c.Query("cursor"); cursor != "" {
+		id, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return f, 0, fmt.Errorf("invalid cursor: %q", cursor)
+		}
+		f.Cursor = uint(id)
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return f, 0, fmt.Errorf("invalid since, expected RFC 3339: %q", since)
+		}
+		f.Since = t
+	}
+	if until := c.Query("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return f, 0, fmt.Errorf("invalid until, expected RFC 3339: %q", until)
+		}
+		f.Until = t
+	}
+	if level := c.Query("level"); level != "" {
+		f.Levels = strings.Split(level, ",")
+	}
+	f.Query = c.Query("q")
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLogPageSize)))
+	if limit <= 0 || limit > maxLogPageSize {
+		limit = maxLogPageSize
+	}
+	return f, limit, nil
+}
+
+// findLogs responds with a page of log entries. next_cursor continues after the page.
+func (h *Handler) findLogs(c *gin.Context, scope logstore.Scope) {
+	f, limit, err := logFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entries, more, err := h.logs.Find(c.Request.Context(), scope, f, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	next := f.Cursor
+	if len(entries) > 0 {
+		next = entries[len(entries)-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"logs":        entries,
+		"next_cursor": next,
+		"has_more":    more,
+	})
+}
+
+// GetJobLogs returns a page of the logs of every task of a job, to search a whole job
+func (h *Handler) GetJobLogs(c *gin.Context) {
+	h.findLogs(c, logstore.Scope{JobID: c.Param("id")})
+}
+
+// DownloadTaskLogs returns a task's output as plain text, or gzip-compressed with
+// gzip=true. The filters of GetTaskLogs apply.
+func (h *Handler) DownloadTaskLogs(c *gin.Context) {
+	taskID := c.Param("id")
+	f, _, err := logFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	compress, _ := strconv.ParseBool(c.Query("gzip"))
+
+	filename := "task-" + taskID + ".log"
+	var w io.Writer = c.Writer
+	if compress {
+		gz := gzip.NewWriter(c.Writer)
+		defer gz.Close()
+		w = gz
+		filename += ".gz"
+		c.Header("Content-Type", "application/gzip")
+	} else {
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Status(http.StatusOK)
+
+	for more := true; more; {
+		var entries []logstore.Entry
+		entries, more, err = h.logs.Find(c.Request.Context(), logstore.Scope{TaskID: taskID}, f, maxLogPageSize)
+		if err != nil {
+			// The status was sent already; a truncated download is all that can be signalled
+			log.Printf("Failed to read logs of task %s for download: %v", taskID, err)
+			return
+		}
+		for _, entry := range entries {
+			if _, err := io.WriteString(w, entry.Message); err != nil {
+				return
+			}
+			f.Cursor = entry.ID
+		}
+	}
+}
+
+// taskFinished reports whether a task status is final, including the "success" status
+// reported by executor binaries
+func taskFinished(status string) bool {
+	switch status {
+	case "completed", "success", "failed", "cancelled":
+		return true
+	}
+	return false
+}
+
+// StreamTaskLogs streams a task's output as server-sent events. Every "log" event carries
+// one log entry and its ID as event ID; the offset query parameter or a Last-Event-ID
+// header resumes after that entry. Without follow the stream ends after the stored
+// output; with follow=true it stays open until the task finishes. Either way it closes
+// with an "end" event carrying the task status.
+func (h *Handler) StreamTaskLogs(c *gin.Context) {
+	taskID := c.Param("id")
+
+	var after uint
+	offset := c.GetHeader("Last-Event-ID")
+	if offset == "" {
+		offset = c.Query("offset")
+	}
+	if offset != "" {
+		id, err := strconv.ParseUint(offset, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a log ID"})
+			return
+		}
+		after = uint(id)
+	}
+	follow, _ := strconv.ParseBool(c.Query("follow"))
+
+	var task models.Task
+	if err := h.db.Select("id", "status").First(&task, "id = ?", taskID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "task not found"})
+		return
+	}
+
+	// New output and status changes of the task wake the stream; polling covers output
+	// stored by other mothership instances
+	wake := make(chan struct{}, 1)
+	if follow && h.events != nil {
+		unsubscribe := h.events.Subscribe(func(event events.Event) {
+			if id, _ := event.Data["task_id"].(string); id == taskID {
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		})
+		defer unsubscribe()
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	poll := time.NewTicker(logStreamPoll)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(logStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		// The status is read before the output, so output stored before the task
+		// finished is always sent before "end"
+		if err := h.db.Select("id", "status").First(&task, "id = ?", taskID).Error; err != nil {
+			writeSSE(c, "error", "", gin.H{"error": "task not found"})
+			return
+		}
+
+		for more := true; more; {
+			var entries []logstore.Entry
+			var err error
+			entries, more, err = h.logs.Find(c.Request.Context(), logstore.Scope{TaskID: taskID}, logstore.Filter{Cursor: after}, logStreamBatchSize)
+			if err != nil {
+				writeSSE(c, "error", "", gin.H{"error": err.Error()})
+				return
+			}
+			for _, entry := range entries {
+				if err := writeSSE(c, "log", strconv.FormatUint(uint64(entry.ID), 10), entry); err != nil {
+					return
+				}
+				after = entry.ID
+			}
+		}
+
+		if !follow || taskFinished(task.Status) {
+			writeSSE(c, "end", "", gin.H{"task_id": taskID, "status": task.Status})
+			return
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-wake:
+				waiting = false
+			case <-poll.C:
+				waiting = false
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+					return
+				}
+				c.Writer.Flush()
+			}
+		}
+	}
+}
+
+// writeSSE writes one server-sent event with a JSON payload and flushes it
+func writeSSE(c *gin.Context, event, id string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(c.Writer, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
@@ -0,0 +1,350 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"borg/mothership/internal/auth"
+	"borg/mothership/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// minPasswordLength is the minimum length of user passwords
+const minPasswordLength = 8
+
+var errLastAdmin = errors.New("cannot remove the last active admin")
+
+// validatePassword checks a new password against the password policy
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("password must be at least 8 characters")
+	}
+	return nil
+}
+
+// ensureOtherActiveAdmin returns errLastAdmin if userID is the only enabled admin
+func (h *Handler) ensureOtherActiveAdmin(userID string) error {
+	var count int64
+	if err := h.db.Model(&models.User{}).
+		Where("role = ? AND disabled = ? AND id <> ?", auth.RoleAdmin, false, userID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return errLastAdmin
+	}
+	return nil
+}
+
+// ListUsers returns all users
+func (h *Handler) ListUsers(c *gin.Context) {
+	var users []models.User
+	if err := h.db.Order("username ASC").Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// GetUser returns a single user
+func (h *Handler) GetUser(c *gin.Context) {
+	var user models.User
+	if err := h.db.First(&user, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// CreateUserRequest represents user creation request
+type CreateUserRequest struct {
+	Username           string `json:"username" binding:"required"`
+	Password           string `json:"password" binding:"required"`
+	Role               string `json:"role" binding:"required"`
+	MustChangePassword *bool  `json:"must_change_password"` // Defaults to true
+}
+
+// CreateUser creates a new user
+func (h *Handler) CreateUser(c *gin.Context) {
+	var req CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !auth.ValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role. Must be one of: admin, operator, submitter, viewer"})
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var existing int64
+	h.db.Model(&models.User{}).Where("username = ?", req.Username).Count(&existing)
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "username already exists"})
+		return
+	}
+
+	passwordHash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	mustChange := true
+	if req.MustChangePassword != nil {
+		mustChange = *req.MustChangePassword
+	}
+
+	now := time.Now()
+	user := &models.User{
+		ID:                 uuid.New().String(),
+		Username:           req.Username,
+		PasswordHash:       passwordHash,
+		AuthProvider:       "local",
+		Role:               req.Role,
+		MustChangePassword: mustChange,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	}
+
+	if err := h.db.Create(user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "user.create", auditTarget{Type: "user", ID: user.ID, Name: user.Username}, nil, userAuditSummary(user))
+
+	c.JSON(http.StatusCreated, user)
+}
+
+// UpdateUserRequest represents user update request (all fields optional)
+type UpdateUserRequest struct {
+	Role     *string `json:"role"`
+	Disabled *bool   `json:"disabled"`
+}
+
+// UpdateUser changes a user's role or disables/enables the account
+func (h *Handler) UpdateUser(c *gin.Context) {
+	userID := c.Param("id")
+
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, "id = ?", userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	wasActiveAdmin := user.Role == auth.RoleAdmin && !user.Disabled
+	before := userAuditSummary(&user)
+
+	if req.Role != nil {
+		if !auth.ValidRole(*req.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role. Must be one of: admin, operator, submitter, viewer"})
+			return
+		}
+		user.Role = *req.Role
+	}
+	if req.Disabled != nil {
+		if *req.Disabled && userID == c.GetString("user_id") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cannot disable your own account"})
+			return
+		}
+		user.Disabled = *req.Disabled
+	}
+
+	// Demoting or disabling an admin must leave at least one active admin
+	if wasActiveAdmin && (user.Role != auth.RoleAdmin || user.Disabled) {
+		if err := h.ensureOtherActiveAdmin(user.ID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	user.UpdatedAt = time.Now()
+	if err := h.db.Save(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if user.Disabled {
+		h.revokeUserSessions(user.ID)
+	}
+	h.audit(c, "user.update", auditTarget{Type: "user", ID: user.ID, Name: user.Username}, before, userAuditSummary(&user))
+
+	c.JSON(http.StatusOK, user)
+}
+
+// ResetUserPasswordRequest represents an admin password reset request
+type ResetUserPasswordRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// ResetUserPassword sets a new password for a user, who has to change it on next login
+func (h *Handler) ResetUserPassword(c *gin.Context) {
+	var req ResetUserPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	if user.AuthProvider == "oidc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password is managed by the identity provider"})
+		return
+	}
+
+	if err := h.setPassword(&user, req.Password, true); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "user.password_reset", auditTarget{Type: "user", ID: user.ID, Name: user.Username}, nil, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "password reset, user must change it on next login",
+	})
+}
+
+// DeleteUser deletes a user
+func (h *Handler) DeleteUser(c *gin.Context) {
+	userID := c.Param("id")
+
+	if userID == c.GetString("user_id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot delete your own account"})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, "id = ?", userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	if user.Role == auth.RoleAdmin && !user.Disabled {
+		if err := h.ensureOtherActiveAdmin(user.ID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.ProjectMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "user.delete", auditTarget{Type: "user", ID: user.ID, Name: user.Username}, userAuditSummary(&user), nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "user deleted successfully",
+	})
+}
+
+// ChangePasswordRequest represents a self-service password change
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// ChangePassword changes the current user's password and returns tokens for a new session,
+// since all existing sessions are revoked
+func (h *Handler) ChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, "id = ?", c.GetString("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	if user.AuthProvider == "oidc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password is managed by the identity provider"})
+		return
+	}
+
+	if !auth.VerifyPassword(req.CurrentPassword, user.PasswordHash) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "current password is incorrect"})
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "new password must differ from the current password"})
+		return
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.setPassword(&user, req.NewPassword, false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Changing the password ends all sessions, including this one, so start a new one
+	tokens, err := h.issueSession(c, &user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"message":       "password changed",
+		"token":         tokens.Token,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"user":          user,
+	})
+}
+
+// setPassword stores a new password hash and revokes all sessions of the user
+func (h *Handler) setPassword(user *models.User, password string, mustChange bool) error {
+	passwordHash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	user.PasswordHash = passwordHash
+	user.MustChangePassword = mustChange
+	user.PasswordChangedAt = &now
+	user.UpdatedAt = now
+
+	if err := h.db.Model(user).Select("password_hash", "must_change_password", "password_changed_at", "updated_at").
+		Updates(user).Error; err != nil {
+		return err
+	}
+	return h.revokeUserSessions(user.ID)
+}
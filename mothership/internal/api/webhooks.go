@@ -0,0 +1,318 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"borg/mothership/internal/auth"
+	"borg/mothership/internal/models"
+	"borg/mothership/internal/webhook"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var errWebhooksDisabled = errors.New("webhooks are not enabled")
+
+// SetWebhooks enables webhook deliveries
+func (h *Handler) SetWebhooks(dispatcher *webhook.Dispatcher) {
+	h.webhooks = dispatcher
+}
+
+// newWebhookSecret generates a signing secret
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// webhookEventsJSON validates an event filter and encodes it for storage
+func webhookEventsJSON(filter []string) (string, error) {
+	if err := webhook.ValidFilter(filter); err != nil {
+		return "", err
+	}
+	if filter == nil {
+		filter = []string{}
+	}
+	data, _ := json.Marshal(filter)
+	return string(data), nil
+}
+
+func webhookAuditSummary(hook *models.Webhook) gin.H {
+	return gin.H{
+		"name":       hook.Name,
+		"url":        hook.URL,
+		"events":     json.RawMessage(hook.Events),
+		"active":     hook.Active,
+		"project_id": hook.ProjectID,
+	}
+}
+
+// CreateWebhookRequest represents a new webhook
+type CreateWebhookRequest struct {
+	Name      string   `json:"name" binding:"required"`
+	URL       string   `json:"url" binding:"required"`
+	Secret    string   `json:"secret"`     // Generated if empty
+	Events    []string `json:"events"`     // Empty for every event
+	ProjectID string   `json:"project_id"` // Empty for administrators to receive events of every project
+	Active    *bool    `json:"active"`
+}
+
+// CreateWebhookResponse includes the signing secret, which is not returned again
+type CreateWebhookResponse struct {
+	*models.Webhook
+	Secret string `json:"secret"`
+}
+
+// CreateWebhook registers a webhook
+func (h *Handler) CreateWebhook(c *gin.Context) {
+	var req CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := webhook.ValidateURL(req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	eventsJSON, err := webhookEventsJSON(req.Events)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Administrators may register webhooks for every project
+	projectID := ""
+	if req.ProjectID != "" || !seesAllProjects(c) {
+		if projectID, err = projectForNewResource(c, req.ProjectID, auth.PermWebhooksManage); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		if secret, err = newWebhookSecret(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	now := time.Now()
+	hook := &models.Webhook{
+		ID:        uuid.New().String(),
+		ProjectID: projectID,
+		Name:      req.Name,
+		URL:       req.URL,
+		Secret:    secret,
+		Events:    eventsJSON,
+		Active:    req.Active == nil || *req.Active,
+		CreatedBy: c.GetString("user_id"),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := h.db.Create(hook).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "webhook.create", auditTarget{Type: "webhook", ID: hook.ID, Name: hook.Name}, nil, webhookAuditSummary(hook))
+
+	c.JSON(http.StatusCreated, CreateWebhookResponse{Webhook: hook, Secret: secret})
+}
+
+// ListWebhooks returns the webhooks of the caller's projects; administrators also see global webhooks
+func (h *Handler) ListWebhooks(c *gin.Context) {
+	query := h.db.Model(&models.Webhook{})
+	if ids := listProjectIDs(c); ids != nil {
+		query = query.Where("project_id IN ?", ids)
+	}
+
+	var hooks []models.Webhook
+	if err := query.Order("created_at ASC").Find(&hooks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, hooks)
+}
+
+// GetWebhook returns a webhook
+func (h *Handler) GetWebhook(c *gin.Context) {
+	var hook models.Webhook
+	if err := h.db.First(&hook, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, hook)
+}
+
+// UpdateWebhookRequest represents a webhook update (all fields optional)
+type UpdateWebhookRequest struct {
+	Name         *string   `json:"name"`
+	URL          *string   `json:"url"`
+	Events       *[]string `json:"events"`
+	Active       *bool     `json:"active"`
+	Secret       *string   `json:"secret"`
+	RotateSecret bool      `json:"rotate_secret"` // Generate a new secret and return it
+}
+
+// UpdateWebhook changes a webhook. A new secret is returned once.
+func (h *Handler) UpdateWebhook(c *gin.Context) {
+	var req UpdateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var hook models.Webhook
+	if err := h.db.First(&hook, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+	before := webhookAuditSummary(&hook)
+
+	if req.Name != nil {
+		hook.Name = *req.Name
+	}
+	if req.URL != nil {
+		if err := webhook.ValidateURL(*req.URL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		hook.URL = *req.URL
+	}
+	if req.Events != nil {
+		eventsJSON, err := webhookEventsJSON(*req.Events)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		hook.Events = eventsJSON
+	}
+	if req.Active != nil {
+		hook.Active = *req.Active
+	}
+
+	newSecret := ""
+	switch {
+	case req.RotateSecret:
+		secret, err := newWebhookSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		newSecret = secret
+	case req.Secret != nil && *req.Secret != "":
+		newSecret = *req.Secret
+	}
+	if newSecret != "" {
+		hook.Secret = newSecret
+	}
+	hook.UpdatedAt = time.Now()
+
+	if err := h.db.Save(&hook).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	after := webhookAuditSummary(&hook)
+	after["secret_changed"] = newSecret != ""
+	h.audit(c, "webhook.update", auditTarget{Type: "webhook", ID: hook.ID, Name: hook.Name}, before, after)
+
+	if req.RotateSecret {
+		c.JSON(http.StatusOK, CreateWebhookResponse{Webhook: &hook, Secret: newSecret})
+		return
+	}
+	c.JSON(http.StatusOK, hook)
+}
+
+// DeleteWebhook deletes a webhook with its delivery log
+func (h *Handler) DeleteWebhook(c *gin.Context) {
+	var hook models.Webhook
+	if err := h.db.First(&hook, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+
+	if err := h.db.Delete(&hook).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.db.Where("webhook_id = ?", hook.ID).Delete(&models.WebhookDelivery{})
+	h.audit(c, "webhook.delete", auditTarget{Type: "webhook", ID: hook.ID, Name: hook.Name}, webhookAuditSummary(&hook), nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "webhook deleted",
+	})
+}
+
+// ListWebhookDeliveries returns a webhook's delivery log, newest first
+func (h *Handler) ListWebhookDeliveries(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	query := h.db.Model(&models.WebhookDelivery{}).Where("webhook_id = ?", c.Param("id"))
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if eventType := c.Query("event_type"); eventType != "" {
+		query = query.Where("event_type = ?", eventType)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var deliveries []models.WebhookDelivery
+	if err := query.Order("created_at DESC").Limit(limit).Offset(offset).Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deliveries": deliveries,
+		"total":      total,
+		"limit":      limit,
+		"offset":     offset,
+	})
+}
+
+// RedeliverWebhookDelivery sends the payload of an earlier delivery again as a new delivery
+func (h *Handler) RedeliverWebhookDelivery(c *gin.Context) {
+	if h.webhooks == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errWebhooksDisabled.Error()})
+		return
+	}
+
+	var original models.WebhookDelivery
+	if err := h.db.First(&original, "id = ? AND webhook_id = ?", c.Param("deliveryID"), c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "delivery not found"})
+		return
+	}
+
+	delivery, err := h.webhooks.Redeliver(&original)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, "webhook.redeliver", auditTarget{Type: "webhook", ID: original.WebhookID}, nil,
+		gin.H{"delivery_id": original.ID, "redelivery_id": delivery.ID, "event_type": original.EventType})
+
+	c.JSON(http.StatusAccepted, delivery)
+}
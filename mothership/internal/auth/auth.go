@@ -2,30 +2,37 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// JWT secret key - in production, this should be from environment variable
-var jwtSecret = []byte(getJWTSecret())
+// AccessTokenTTL is the lifetime of access tokens; sessions are extended with refresh tokens
+var AccessTokenTTL = durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
 
-func getJWTSecret() string {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "borg-default-secret-key-change-in-production"
+// RefreshTokenTTL is the lifetime of a session without activity
+var RefreshTokenTTL = durationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+		return d
 	}
-	return secret
+	return fallback
 }
 
 // Claims represents JWT claims
 type Claims struct {
-	UserID   string `json:"user_id"`
-	Username string `json:"username"`
+	UserID    string `json:"user_id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
@@ -38,12 +45,42 @@ func GenerateToken() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// ValidateToken validates a runner token (simple implementation)
-// In production, this would check against a database or token store
-func ValidateToken(token string) bool {
-	// For now, accept any non-empty token
-	// TODO: Implement proper token validation
-	return len(token) > 0
+// APIKeyPrefix starts every API key so it can be told apart from JWTs
+const APIKeyPrefix = "borg_"
+
+// GenerateAPIKey generates a new API key of the form borg_<prefix>_<secret>.
+// The returned prefix identifies the key in listings without revealing the secret.
+func GenerateAPIKey() (key, prefix string, err error) {
+	prefixBytes := make([]byte, 4)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return "", "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	secret, err := GenerateToken()
+	if err != nil {
+		return "", "", err
+	}
+	prefix = APIKeyPrefix + hex.EncodeToString(prefixBytes)
+	return prefix + "_" + secret, prefix, nil
+}
+
+// IsAPIKey reports whether a bearer token looks like an API key
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// HashToken returns the SHA256 hex digest of a token.
+// Enrollment tokens and runner secrets are only ever stored in hashed form.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidateToken checks a presented token against a stored hash in constant time
+func ValidateToken(token, hash string) bool {
+	if token == "" || hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(hash)) == 1
 }
 
 // HashPassword hashes a password using bcrypt
@@ -61,22 +98,22 @@ func VerifyPassword(password, hash string) bool {
 	return err == nil
 }
 
-// GenerateJWT generates a JWT token for a user
-func GenerateJWT(userID, username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour) // Token expires in 24 hours
-	
+// GenerateJWT generates a short-lived access token for a user session
+func GenerateJWT(userID, username, role, sessionID string) (string, error) {
+	now := time.Now()
 	claims := &Claims{
-		UserID:   userID,
-		Username: username,
+		UserID:    userID,
+		Username:  username,
+		Role:      role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
+	tokenString, err := signingKeys.sign(claims)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate token: %w", err)
 	}
@@ -84,23 +121,119 @@ func GenerateJWT(userID, username string) (string, error) {
 	return tokenString, nil
 }
 
+// taskTokenAudience marks JWTs that are scoped to a single task
+const taskTokenAudience = "borg-task"
+
+// TaskClaims represents claims of a task-scoped token handed to task processes
+type TaskClaims struct {
+	RunnerID string `json:"runner_id"`
+	TaskID   string `json:"task_id"`
+	jwt.RegisteredClaims
+}
+
+// GenerateTaskToken generates a token that lets a task process report on its own task only
+func GenerateTaskToken(runnerID, taskID string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := &TaskClaims{
+		RunnerID: runnerID,
+		TaskID:   taskID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{taskTokenAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+
+	tokenString, err := signingKeys.sign(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate task token: %w", err)
+	}
+
+	return tokenString, nil
+}
+
+// ValidateTaskToken validates a task-scoped token and returns its claims
+func ValidateTaskToken(tokenString string) (*TaskClaims, error) {
+	claims := &TaskClaims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, signingKeys.keyFunc, jwt.WithAudience(taskTokenAudience))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid || claims.TaskID == "" || claims.RunnerID == "" {
+		return nil, fmt.Errorf("invalid task token")
+	}
+
+	return claims, nil
+}
+
+// loginStateAudience marks JWTs that carry a pending single sign-on login
+const loginStateAudience = "borg-oidc-login"
+
+// LoginStateClaims represents claims of a pending single sign-on login, kept in a browser cookie
+// between redirecting to the identity provider and handling its callback
+type LoginStateClaims struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	jwt.RegisteredClaims
+}
+
+// GenerateLoginStateToken signs a pending single sign-on login
+func GenerateLoginStateToken(state, nonce, codeVerifier string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := &LoginStateClaims{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{loginStateAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+
+	tokenString, err := signingKeys.sign(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate login state token: %w", err)
+	}
+
+	return tokenString, nil
+}
+
+// ValidateLoginStateToken validates a pending single sign-on login and returns its claims
+func ValidateLoginStateToken(tokenString string) (*LoginStateClaims, error) {
+	claims := &LoginStateClaims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, signingKeys.keyFunc, jwt.WithAudience(loginStateAudience))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid || claims.State == "" || claims.Nonce == "" || claims.CodeVerifier == "" {
+		return nil, fmt.Errorf("invalid login state token")
+	}
+
+	return claims, nil
+}
+
 // ValidateJWT validates a JWT token and returns the claims
 func ValidateJWT(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		// Validate signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, signingKeys.keyFunc)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if !token.Valid {
+	// Task tokens are signed with the same keys but carry no user or session
+	if !token.Valid || claims.UserID == "" || claims.SessionID == "" {
 		return nil, fmt.Errorf("invalid token")
 	}
 
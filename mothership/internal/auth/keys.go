@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// legacyKeyID identifies the key configured through JWT_SECRET. Tokens without
+// a "kid" header were signed with it before key IDs were introduced.
+const legacyKeyID = "default"
+
+// keyring holds the HMAC keys accepted for JWTs and the ID of the key used for signing
+type keyring struct {
+	keys      map[string][]byte
+	activeKID string
+}
+
+var signingKeys = loadKeyring()
+
+// loadKeyring reads signing keys from the environment.
+//
+// JWT_SIGNING_KEYS is a comma-separated list of kid:secret pairs and JWT_ACTIVE_KID
+// selects the key used for new tokens (default: the first one). To rotate, add a new
+// key, make it active, and remove the old key once its tokens have expired.
+// JWT_SECRET is still accepted as a single key. Without any key a random one is
+// generated, so tokens do not survive a restart.
+func loadKeyring() *keyring {
+	kr := &keyring{keys: make(map[string][]byte)}
+
+	for _, pair := range strings.Split(os.Getenv("JWT_SIGNING_KEYS"), ",") {
+		kid, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || kid == "" || secret == "" {
+			continue
+		}
+		kr.keys[kid] = []byte(secret)
+		if kr.activeKID == "" {
+			kr.activeKID = kid
+		}
+	}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		if _, exists := kr.keys[legacyKeyID]; !exists {
+			kr.keys[legacyKeyID] = []byte(secret)
+		}
+		if kr.activeKID == "" {
+			kr.activeKID = legacyKeyID
+		}
+	}
+
+	if active := os.Getenv("JWT_ACTIVE_KID"); active != "" {
+		if _, exists := kr.keys[active]; !exists {
+			log.Fatalf("JWT_ACTIVE_KID %q is not in JWT_SIGNING_KEYS", active)
+		}
+		kr.activeKID = active
+	}
+
+	if kr.activeKID == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Failed to generate JWT signing key: %v", err)
+		}
+		kr.activeKID = "ephemeral"
+		kr.keys[kr.activeKID] = secret
+		log.Println("WARNING: JWT_SIGNING_KEYS and JWT_SECRET are not set, using a random signing key. Sessions will not survive a restart.")
+	}
+
+	return kr
+}
+
+// sign signs claims with the active key and records its ID in the "kid" header
+func (kr *keyring) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = kr.activeKID
+	return token.SignedString(kr.keys[kr.activeKID])
+}
+
+// keyFunc resolves the verification key of a token by its "kid" header
+func (kr *keyring) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = legacyKeyID
+	}
+	key, ok := kr.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
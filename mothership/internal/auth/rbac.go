@@ -0,0 +1,82 @@
+package auth
+
+// Roles that can be assigned to dashboard users
+const (
+	RoleAdmin     = "admin"     // Full access, including user management
+	RoleOperator  = "operator"  // Operates runners and manages all jobs
+	RoleSubmitter = "submitter" // Submits jobs and manages their own jobs
+	RoleViewer    = "viewer"    // Read-only access
+)
+
+// Permission names a capability that is checked on the server
+type Permission string
+
+const (
+	PermJobsRead         Permission = "jobs:read"
+	PermJobsCreate       Permission = "jobs:create"
+	PermJobsManageAny    Permission = "jobs:manage_any" // Pause, resume, cancel, edit and delete jobs of any owner
+	PermRunnersRead      Permission = "runners:read"
+	PermRunnersManage    Permission = "runners:manage" // Rename, configure, delete and revoke runners
+	PermScreensView      Permission = "screens:view"
+	PermFilesUpload      Permission = "files:upload" // Upload executor binaries, scripts and datasets
+	PermFilesDelete      Permission = "files:delete"
+	PermEnrollmentManage Permission = "enrollment:manage"
+	PermUsersManage      Permission = "users:manage"
+	PermAuditRead        Permission = "audit:read"
+	PermSecretsUse       Permission = "secrets:use"     // List secret names and reference them from jobs
+	PermSecretsManage    Permission = "secrets:manage"  // Create, update and delete secrets
+	PermProjectsManage   Permission = "projects:manage" // Create and delete projects; access to every project
+	PermWebhooksManage   Permission = "webhooks:manage" // Register webhooks and inspect their deliveries
+)
+
+// rolePermissions maps each role to the permissions it grants
+var rolePermissions = map[string][]Permission{
+	RoleAdmin: {
+		PermJobsRead, PermJobsCreate, PermJobsManageAny,
+		PermRunnersRead, PermRunnersManage, PermScreensView,
+		PermFilesUpload, PermFilesDelete,
+		PermEnrollmentManage, PermUsersManage,
+		PermAuditRead,
+		PermSecretsUse, PermSecretsManage,
+		PermProjectsManage,
+		PermWebhooksManage,
+	},
+	RoleOperator: {
+		PermJobsRead, PermJobsCreate, PermJobsManageAny,
+		PermRunnersRead, PermRunnersManage, PermScreensView,
+		PermFilesUpload, PermFilesDelete,
+		PermSecretsUse, PermSecretsManage,
+		PermWebhooksManage,
+	},
+	RoleSubmitter: {
+		PermJobsRead, PermJobsCreate,
+		PermRunnersRead,
+		PermFilesUpload,
+		PermSecretsUse,
+	},
+	RoleViewer: {
+		PermJobsRead,
+		PermRunnersRead,
+	},
+}
+
+// ValidRole reports whether role is a known role
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// ValidPermission reports whether perm is a known permission
+func ValidPermission(perm Permission) bool {
+	return HasPermission(RoleAdmin, perm)
+}
+
+// HasPermission reports whether role grants perm
+func HasPermission(role string, perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
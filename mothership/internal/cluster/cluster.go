@@ -0,0 +1,263 @@
+// Package cluster connects mothership instances that share a database. Instances
+// exchange messages over Postgres LISTEN/NOTIFY, and background work that must run
+// once per cluster is assigned to one instance through advisory locks.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"borg/mothership/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	// Postgres rejects notification payloads of 8000 bytes or more
+	maxNotifyPayload = 7900
+	envelopeOverhead = 64 // Origin and field names around the data of a message
+	outboxSize       = 10000
+	reconnectDelay   = 5 * time.Second
+
+	// Large messages are read by listeners right after they are notified
+	messageRetention = time.Minute
+	pruneInterval    = time.Minute
+)
+
+// Handler receives the payload of a message published by another instance
+type Handler func(payload []byte)
+
+// envelope is the notification payload
+type envelope struct {
+	Origin string          `json:"o"`
+	Data   json.RawMessage `json:"d,omitempty"`
+	Ref    uint64          `json:"r,omitempty"` // ClusterMessage holding a large payload
+}
+
+type message struct {
+	channel   string
+	data      []byte
+	transient bool // Never stored in cluster_messages
+}
+
+// Cluster is this instance's connection to the other instances. A nil Cluster
+// publishes nothing, for a single instance.
+type Cluster struct {
+	db     *gorm.DB
+	dsn    string
+	id     string
+	outbox chan message
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// New creates a cluster connection. dsn is the database connection string; listening
+// and holding advisory locks need connections of their own.
+func New(db *gorm.DB, dsn string) *Cluster {
+	return &Cluster{
+		db:       db,
+		dsn:      dsn,
+		id:       uuid.New().String(),
+		outbox:   make(chan message, outboxSize),
+		handlers: make(map[string]Handler),
+	}
+}
+
+// ID identifies this instance
+func (c *Cluster) ID() string {
+	return c.id
+}
+
+// Handle registers fn for messages published on channel by other instances. Handlers
+// are registered before Run and called one at a time, so they must not block.
+func (c *Cluster) Handle(channel string, fn Handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[channel] = fn
+}
+
+// Publish sends payload, encoded as JSON, to the other instances listening on channel.
+// Messages are sent in the background and dropped if the database falls far behind.
+func (c *Cluster) Publish(channel string, payload interface{}) {
+	if c == nil {
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode cluster message on %s: %v", channel, err)
+		return
+	}
+	c.enqueue(message{channel: channel, data: data})
+}
+
+// PublishTransient sends payload like Publish if it fits in a notification, and
+// reports false without sending it otherwise. For frequent, disposable messages such
+// as screen frames, which must not be written to the database.
+func (c *Cluster) PublishTransient(channel string, payload interface{}) bool {
+	if c == nil {
+		return false
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode cluster message on %s: %v", channel, err)
+		return false
+	}
+	if len(data)+envelopeOverhead > maxNotifyPayload {
+		return false
+	}
+	c.enqueue(message{channel: channel, data: data, transient: true})
+	return true
+}
+
+func (c *Cluster) enqueue(msg message) {
+	select {
+	case c.outbox <- msg:
+	default:
+		log.Printf("Cluster outbox full, dropping message on %s", msg.channel)
+	}
+}
+
+// Run sends published messages and delivers the messages of other instances until ctx
+// is cancelled. Messages published while the listening connection is down are lost.
+func (c *Cluster) Run(ctx context.Context) {
+	go c.send(ctx)
+	go c.Elect(ctx, "cluster-messages", c.pruneMessages)
+
+	for {
+		if err := c.listen(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Cluster listener failed, reconnecting in %s: %v", reconnectDelay, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// send notifies the published messages
+func (c *Cluster) send(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-c.outbox:
+			if err := c.notify(msg); err != nil {
+				log.Printf("Failed to send cluster message on %s: %v", msg.channel, err)
+			}
+		}
+	}
+}
+
+func (c *Cluster) notify(msg message) error {
+	payload, err := json.Marshal(envelope{Origin: c.id, Data: msg.data})
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxNotifyPayload {
+		if msg.transient {
+			return fmt.Errorf("%d byte message exceeds the notification limit", len(payload))
+		}
+		stored := models.ClusterMessage{Channel: msg.channel, Payload: string(msg.data)}
+		if err := c.db.Create(&stored).Error; err != nil {
+			return err
+		}
+		if payload, err = json.Marshal(envelope{Origin: c.id, Ref: stored.ID}); err != nil {
+			return err
+		}
+	}
+	return c.db.Exec("SELECT pg_notify(?, ?)", msg.channel, string(payload)).Error
+}
+
+// listen delivers notifications until the connection fails or ctx is cancelled
+func (c *Cluster) listen(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, c.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	c.mu.RLock()
+	channels := make([]string, 0, len(c.handlers))
+	for channel := range c.handlers {
+		channels = append(channels, channel)
+	}
+	c.mu.RUnlock()
+	sort.Strings(channels)
+
+	for _, channel := range channels {
+		if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			return fmt.Errorf("listen on %s: %w", channel, err)
+		}
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		c.deliver(notification.Channel, []byte(notification.Payload))
+	}
+}
+
+// deliver hands a notification of another instance to the channel's handler
+func (c *Cluster) deliver(channel string, payload []byte) {
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		log.Printf("Invalid cluster message on %s: %v", channel, err)
+		return
+	}
+	if env.Origin == c.id {
+		return
+	}
+
+	c.mu.RLock()
+	fn := c.handlers[channel]
+	c.mu.RUnlock()
+	if fn == nil {
+		return
+	}
+
+	data := []byte(env.Data)
+	if env.Ref != 0 {
+		var stored models.ClusterMessage
+		if err := c.db.First(&stored, "id = ?", env.Ref).Error; err != nil {
+			log.Printf("Failed to read cluster message %d on %s: %v", env.Ref, channel, err)
+			return
+		}
+		data = []byte(stored.Payload)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Cluster message handler panicked on %s: %v", channel, r)
+		}
+	}()
+	fn(data)
+}
+
+// pruneMessages removes large messages once every listener has read them
+func (c *Cluster) pruneMessages(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := c.db.WithContext(ctx).Where("created_at < ?", time.Now().Add(-messageRetention)).Delete(&models.ClusterMessage{}).Error
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Failed to prune cluster messages: %v", err)
+			}
+		}
+	}
+}
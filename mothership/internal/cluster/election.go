@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// electionInterval is how often followers try to take over and leaders check that
+// they still hold their lock
+const electionInterval = 10 * time.Second
+
+// lockKey derives the advisory lock key of a task name
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("borg:" + name))
+	return int64(h.Sum64())
+}
+
+// Elect runs fn on one instance of the cluster at a time until ctx is cancelled. The
+// instance holding the task's advisory lock runs it; when its database connection is
+// lost, fn's context is cancelled and another instance takes over. A nil Cluster
+// runs fn directly.
+func (c *Cluster) Elect(ctx context.Context, name string, fn func(ctx context.Context)) {
+	if c == nil {
+		fn(ctx)
+		return
+	}
+
+	for {
+		if err := c.lead(ctx, name, fn); err != nil && ctx.Err() == nil {
+			log.Printf("Election for %s failed, retrying in %s: %v", name, electionInterval, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(electionInterval):
+		}
+	}
+}
+
+// lead waits for the task's lock and runs fn while holding it
+func (c *Cluster) lead(ctx context.Context, name string, fn func(ctx context.Context)) error {
+	// Session advisory locks belong to a connection, so the lock gets one of its own
+	conn, err := pgx.Connect(ctx, c.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	key := lockKey(name)
+	ticker := time.NewTicker(electionInterval)
+	defer ticker.Stop()
+
+	for {
+		var acquired bool
+		if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired); err != nil {
+			return err
+		}
+		if acquired {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+
+	log.Printf("Instance %s runs %s", c.id, name)
+	workCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(workCtx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-done:
+			_, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+			return err
+		case <-ticker.C:
+			if err := conn.Ping(ctx); err != nil {
+				log.Printf("Instance %s lost the lock for %s", c.id, name)
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"borg/mothership/internal/events"
+)
+
+// EventsChannel carries the events published on every instance's bus
+const EventsChannel = "borg_events"
+
+// EnabledFromEnv reads CLUSTER_ENABLED, which turns on message exchange between
+// instances sharing the database
+func EnabledFromEnv() (bool, error) {
+	value := os.Getenv("CLUSTER_ENABLED")
+	if value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("CLUSTER_ENABLED must be true or false, got %q", value)
+	}
+	return enabled, nil
+}
+
+// ForwardEvents shares events between the buses of all instances, so dashboard
+// clients see state changes wherever they happened. Task log chunks stay local: they
+// can be far larger than a notification, and log streams read other instances'
+// output from the database. Register before Run.
+func (c *Cluster) ForwardEvents(bus *events.Bus) {
+	bus.Subscribe(func(event events.Event) {
+		if !event.Remote && event.Type != events.TaskLog {
+			c.Publish(EventsChannel, event)
+		}
+	})
+	c.Handle(EventsChannel, func(payload []byte) {
+		var event events.Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			log.Printf("Invalid event from another instance: %v", err)
+			return
+		}
+		bus.Forward(event)
+	})
+}
@@ -0,0 +1,217 @@
+// Package events publishes job, task, runner and dataset state changes to
+// subscribers inside the mothership process.
+package events
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Type names a kind of state change
+type Type string
+
+const (
+	JobCreated       Type = "job.created"
+	JobUpdated       Type = "job.updated"
+	JobStarted       Type = "job.started"
+	JobPaused        Type = "job.paused"
+	JobResumed       Type = "job.resumed"
+	JobCompleted     Type = "job.completed"
+	JobFailed        Type = "job.failed"
+	JobCancelled     Type = "job.cancelled"
+	JobDeleted       Type = "job.deleted"
+	TaskQueued       Type = "task.queued"
+	TaskStarted      Type = "task.started"
+	TaskPaused       Type = "task.paused"
+	TaskCompleted    Type = "task.completed"
+	TaskFailed       Type = "task.failed"
+	TaskCancelled    Type = "task.cancelled"
+	TaskUpdated      Type = "task.updated" // Any other task status
+	TaskLog          Type = "task.log"
+	RunnerRegistered Type = "runner.registered"
+	RunnerUpdated    Type = "runner.updated" // Status, name or settings changed
+	RunnerOnline     Type = "runner.online"
+	RunnerOffline    Type = "runner.offline"
+	RunnerDeleted    Type = "runner.deleted"
+	DatasetProcessed Type = "dataset.processed"
+)
+
+// TaskStatusType returns the event type of a task entering status
+func TaskStatusType(status string) Type {
+	switch status {
+	case "pending":
+		return TaskQueued
+	case "running":
+		return TaskStarted
+	case "paused":
+		return TaskPaused
+	case "completed", "success":
+		return TaskCompleted
+	case "failed":
+		return TaskFailed
+	case "cancelled":
+		return TaskCancelled
+	}
+	return TaskUpdated
+}
+
+// Subscription topics covering every event of a kind
+const (
+	TopicJobs    = "jobs"
+	TopicTasks   = "tasks"
+	TopicRunners = "runners"
+)
+
+// JobTopic covers a job and its tasks
+func JobTopic(jobID string) string { return "job:" + jobID }
+
+// TaskTopic covers the state changes of a task
+func TaskTopic(taskID string) string { return "task:" + taskID }
+
+// TaskLogsTopic covers the output of a task
+func TaskLogsTopic(taskID string) string { return "task:" + taskID + ":logs" }
+
+// RunnerTopic covers a runner and the tasks assigned to it
+func RunnerTopic(runnerID string) string { return "runner:" + runnerID }
+
+// ValidTopic reports whether a client may subscribe to topic
+func ValidTopic(topic string) bool {
+	switch topic {
+	case TopicJobs, TopicTasks, TopicRunners:
+		return true
+	}
+	kind, id, ok := strings.Cut(topic, ":")
+	if !ok || id == "" {
+		return false
+	}
+	switch kind {
+	case "job", "runner":
+		return !strings.Contains(id, ":")
+	case "task":
+		taskID, suffix, hasSuffix := strings.Cut(id, ":")
+		return taskID != "" && (!hasSuffix || suffix == "logs")
+	}
+	return false
+}
+
+// Event is a state change
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      Type                   `json:"type"`
+	Time      time.Time              `json:"time"`
+	ProjectID string                 `json:"project_id,omitempty"` // Empty for shared runners
+	Data      map[string]interface{} `json:"data"`
+
+	// Remote is set on events published by another mothership instance. They are
+	// already journaled and delivered to webhooks there.
+	Remote bool `json:"-"`
+}
+
+// Topics returns the subscription topics an event is published on
+func (e Event) Topics() []string {
+	id := func(key string) string {
+		value, _ := e.Data[key].(string)
+		return value
+	}
+
+	var topics []string
+	switch {
+	case e.Type == TaskLog:
+		return []string{TaskLogsTopic(id("task_id"))}
+	case e.Type == DatasetProcessed || strings.HasPrefix(string(e.Type), "job."):
+		topics = append(topics, TopicJobs, JobTopic(id("job_id")))
+	case strings.HasPrefix(string(e.Type), "task."):
+		topics = append(topics, TopicTasks, JobTopic(id("job_id")), TaskTopic(id("task_id")))
+		if runnerID := id("runner_id"); runnerID != "" {
+			topics = append(topics, RunnerTopic(runnerID))
+		}
+	case strings.HasPrefix(string(e.Type), "runner."):
+		topics = append(topics, TopicRunners, RunnerTopic(id("runner_id")))
+	}
+	return topics
+}
+
+// Bus delivers published events to every subscriber. A nil Bus discards events.
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers []subscriber
+	nextID      uint64
+}
+
+type subscriber struct {
+	id uint64
+	fn func(Event)
+}
+
+// NewBus creates an event bus
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe registers fn for every event published from now on and returns a function
+// that removes it again. fn runs on the publisher's goroutine and must not block.
+func (b *Bus) Subscribe(fn func(Event)) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	id := b.nextID
+	b.subscribers = append(b.subscribers, subscriber{id: id, fn: fn})
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		// Publish iterates over a snapshot, so the slice is copied rather than modified
+		subscribers := make([]subscriber, 0, len(b.subscribers))
+		for _, s := range b.subscribers {
+			if s.id != id {
+				subscribers = append(subscribers, s)
+			}
+		}
+		b.subscribers = subscribers
+	}
+}
+
+// Publish creates an event and hands it to the subscribers
+func (b *Bus) Publish(t Type, projectID string, data map[string]interface{}) {
+	if b == nil {
+		return
+	}
+
+	event := Event{
+		ID:        uuid.New().String(),
+		Type:      t,
+		Time:      time.Now().UTC(),
+		ProjectID: projectID,
+		Data:      data,
+	}
+	b.deliver(event)
+}
+
+// Forward hands an event published by another mothership instance to the subscribers
+func (b *Bus) Forward(event Event) {
+	if b == nil {
+		return
+	}
+	event.Remote = true
+	b.deliver(event)
+}
+
+func (b *Bus) deliver(event Event) {
+	b.mu.RLock()
+	subscribers := b.subscribers
+	b.mu.RUnlock()
+	for _, s := range subscribers {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Event subscriber panicked on %s: %v", event.Type, r)
+				}
+			}()
+			s.fn(event)
+		}()
+	}
+}
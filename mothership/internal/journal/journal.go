@@ -0,0 +1,301 @@
+// Package journal records published events in Postgres, numbered in publication
+// order, so clients of the event stream can resume after a reconnect. The journal
+// is bounded by age and by number of entries.
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"borg/mothership/internal/events"
+	"borg/mothership/internal/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	queueSize     = 10000
+	batchSize     = 200
+	pruneInterval = time.Minute
+
+	// Failed appends are retried with backoff; a batch that still fails is appended one
+	// entry at a time so a single bad entry cannot hold up the journal
+	maxAppendAttempts = 8
+	baseRetryDelay    = 500 * time.Millisecond
+	maxRetryDelay     = 30 * time.Second
+	dropLogInterval   = time.Minute
+
+	// appendLockKey serializes appends of all mothership instances, so entries become
+	// visible in ID order and readers never skip an entry committed late
+	appendLockKey = 0x626f7267_6a726e6c
+)
+
+// Config bounds the journal
+type Config struct {
+	Retention  time.Duration // Entries older than this are removed
+	MaxEntries int64         // Only the newest entries are kept
+}
+
+// ConfigFromEnv reads the journal bounds:
+//
+//	EVENT_JOURNAL_RETENTION=24h
+//	EVENT_JOURNAL_MAX_ENTRIES=100000
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Retention: 24 * time.Hour, MaxEntries: 100000}
+	if v := strings.TrimSpace(os.Getenv("EVENT_JOURNAL_RETENTION")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("EVENT_JOURNAL_RETENTION must be a positive duration, got %q", v)
+		}
+		cfg.Retention = d
+	}
+	if v := strings.TrimSpace(os.Getenv("EVENT_JOURNAL_MAX_ENTRIES")); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("EVENT_JOURNAL_MAX_ENTRIES must be a positive number, got %q", v)
+		}
+		cfg.MaxEntries = n
+	}
+	return cfg, nil
+}
+
+// Recorded reports whether events of type t are journaled. Task output has its own
+// stream and would crowd out state changes.
+func Recorded(t events.Type) bool {
+	return t != events.TaskLog
+}
+
+// Journal records events and tells readers about new entries
+type Journal struct {
+	db      *gorm.DB
+	config  Config
+	pending chan events.Event
+	dropped atomic.Uint64 // Events that never made it into the journal
+	lastLog atomic.Int64  // Unix nanoseconds of the last drop warning
+
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+// New creates a journal
+func New(db *gorm.DB, config Config) *Journal {
+	return &Journal{
+		db:      db,
+		config:  config,
+		pending: make(chan events.Event, queueSize),
+		changed: make(chan struct{}),
+	}
+}
+
+// Subscribe records the events published on bus. Publishers never wait for the
+// database: when it falls so far behind that the queue is full, events are dropped
+// and counted. Events of other instances are recorded by them.
+func (j *Journal) Subscribe(bus *events.Bus) {
+	bus.Subscribe(func(event events.Event) {
+		if event.Remote || !Recorded(event.Type) {
+			return
+		}
+		select {
+		case j.pending <- event:
+		default:
+			j.drop("the journal queue is full")
+		}
+	})
+}
+
+// drop counts an event that was not recorded, warning at most once per dropLogInterval
+func (j *Journal) drop(reason string) {
+	total := j.dropped.Add(1)
+	now := time.Now().UnixNano()
+	last := j.lastLog.Load()
+	if now-last < int64(dropLogInterval) || !j.lastLog.CompareAndSwap(last, now) {
+		return
+	}
+	log.Printf("WARNING: events are not recorded in the event journal because %s (%d dropped so far); "+
+		"clients resuming the event stream miss them", reason, total)
+}
+
+// Changed returns a channel that is closed when entries are appended next
+func (j *Journal) Changed() <-chan struct{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.changed
+}
+
+// notify wakes readers waiting on Changed
+func (j *Journal) notify() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// Run appends recorded events until ctx is cancelled
+func (j *Journal) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-j.pending:
+			batch := []events.Event{event}
+		drain:
+			for len(batch) < batchSize {
+				select {
+				case event := <-j.pending:
+					batch = append(batch, event)
+				default:
+					break drain
+				}
+			}
+			if !j.appendWithRetry(ctx, batch) {
+				return
+			}
+			j.notify()
+		}
+	}
+}
+
+// appendWithRetry appends a batch, retrying with backoff while the database is unavailable.
+// Returns false if ctx was cancelled first.
+func (j *Journal) appendWithRetry(ctx context.Context, batch []events.Event) bool {
+	entries := j.entries(batch)
+	if len(entries) == 0 {
+		return true
+	}
+
+	delay := baseRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := j.append(entries)
+		if err == nil {
+			return true
+		}
+		log.Printf("Failed to record %d events in the journal (attempt %d): %v", len(entries), attempt, err)
+		if attempt == maxAppendAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+
+	// Keep what can be kept
+	for i := range entries {
+		if err := j.append(entries[i : i+1]); err != nil {
+			log.Printf("Failed to record %s event %s in the journal: %v", entries[i].Type, entries[i].EventID, err)
+			j.drop("appending them failed")
+		}
+	}
+	return true
+}
+
+// entries encodes events as journal entries. Events that cannot be encoded are dropped.
+func (j *Journal) entries(batch []events.Event) []models.JournalEntry {
+	entries := make([]models.JournalEntry, 0, len(batch))
+	for _, event := range batch {
+		data, err := json.Marshal(event.Data)
+		if err != nil {
+			log.Printf("Failed to encode %s event %s for the journal: %v", event.Type, event.ID, err)
+			j.drop("they could not be encoded")
+			continue
+		}
+		entries = append(entries, models.JournalEntry{
+			EventID:   event.ID,
+			Type:      string(event.Type),
+			ProjectID: event.ProjectID,
+			Data:      string(data),
+			CreatedAt: event.Time,
+		})
+	}
+	return entries
+}
+
+// append stores entries in one transaction holding the append lock. The entries are
+// copied, so IDs assigned by a failed attempt are not reused by the next one.
+func (j *Journal) append(entries []models.JournalEntry) error {
+	rows := make([]models.JournalEntry, len(entries))
+	copy(rows, entries)
+	return j.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", appendLockKey).Error; err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	})
+}
+
+// RunPruner removes old entries until ctx is cancelled. One instance prunes for all.
+func (j *Journal) RunPruner(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := j.prune(); err != nil {
+				log.Printf("Failed to prune event journal: %v", err)
+			}
+		}
+	}
+}
+
+// prune removes entries beyond the configured age and count
+func (j *Journal) prune() error {
+	if err := j.db.Where("created_at < ?", time.Now().Add(-j.config.Retention)).Delete(&models.JournalEntry{}).Error; err != nil {
+		return err
+	}
+	return j.db.Exec("DELETE FROM event_journal WHERE id <= (SELECT MAX(id) FROM event_journal) - ?", j.config.MaxEntries).Error
+}
+
+// Latest returns the ID of the newest entry, or 0 if the journal is empty
+func (j *Journal) Latest(ctx context.Context) (uint64, error) {
+	var id *uint64
+	if err := j.db.WithContext(ctx).Model(&models.JournalEntry{}).Select("MAX(id)").Scan(&id).Error; err != nil || id == nil {
+		return 0, err
+	}
+	return *id, nil
+}
+
+// Oldest returns the ID of the oldest retained entry, or 0 if the journal is empty
+func (j *Journal) Oldest(ctx context.Context) (uint64, error) {
+	var id *uint64
+	if err := j.db.WithContext(ctx).Model(&models.JournalEntry{}).Select("MIN(id)").Scan(&id).Error; err != nil || id == nil {
+		return 0, err
+	}
+	return *id, nil
+}
+
+// Since returns up to limit entries after the given ID, oldest first
+func (j *Journal) Since(ctx context.Context, afterID uint64, limit int) ([]models.JournalEntry, error) {
+	var entries []models.JournalEntry
+	err := j.db.WithContext(ctx).Where("id > ?", afterID).Order("id ASC").Limit(limit).Find(&entries).Error
+	return entries, err
+}
+
+// Event restores the event a journal entry was recorded from
+func Event(entry *models.JournalEntry) events.Event {
+	event := events.Event{
+		ID:        entry.EventID,
+		Type:      events.Type(entry.Type),
+		Time:      entry.CreatedAt.UTC(),
+		ProjectID: entry.ProjectID,
+	}
+	if err := json.Unmarshal([]byte(entry.Data), &event.Data); err != nil {
+		log.Printf("Journal entry %d has invalid data: %v", entry.ID, err)
+	}
+	return event
+}
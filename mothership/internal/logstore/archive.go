@@ -0,0 +1,268 @@
+package logstore
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"borg/mothership/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	archiveReadBatch   = 1000
+	segmentMaxEntries  = 10000
+	segmentMaxBytes    = 4 << 20 // Uncompressed
+	archiveTasksPerRun = 100
+)
+
+// ArchiveAfterFromEnv returns how long after a task finished its logs are archived,
+// from LOG_ARCHIVE_AFTER (default 168h). 0 disables archiving.
+func ArchiveAfterFromEnv() (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv("LOG_ARCHIVE_AFTER"))
+	if value == "" {
+		return 7 * 24 * time.Hour, nil
+	}
+	after, err := time.ParseDuration(value)
+	if err != nil || after < 0 {
+		return 0, fmt.Errorf("LOG_ARCHIVE_AFTER must be a duration like 168h, got %q", value)
+	}
+	return after, nil
+}
+
+// RunArchiver archives the logs of tasks that finished more than after ago, every
+// interval until ctx is cancelled
+func (s *Store) RunArchiver(ctx context.Context, after, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := s.Archive(ctx, time.Now().Add(-after), archiveTasksPerRun)
+			if err != nil {
+				log.Printf("Failed to archive task logs: %v", err)
+			}
+			if n < archiveTasksPerRun {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Archive moves the logs of up to limit tasks that finished before cutoff into archives.
+// Returns how many tasks were archived; tasks that fail are logged and skipped.
+func (s *Store) Archive(ctx context.Context, cutoff time.Time, limit int) (int, error) {
+	var taskIDs []string
+	err := s.db.WithContext(ctx).Raw(`
+		SELECT t.id FROM tasks t
+		WHERE t.status IN ? AND COALESCE(t.completed_at, t.updated_at) < ?
+			AND EXISTS (SELECT 1 FROM task_logs l WHERE l.task_id = t.id)
+		LIMIT ?`, []string{"completed", "success", "failed", "cancelled"}, cutoff, limit).
+		Scan(&taskIDs).Error
+	if err != nil {
+		return 0, err
+	}
+
+	archived := 0
+	for _, taskID := range taskIDs {
+		ok, err := s.archiveTask(ctx, taskID)
+		if err != nil {
+			log.Printf("Failed to archive logs of task %s: %v", taskID, err)
+			continue
+		}
+		if ok {
+			archived++
+		}
+	}
+	return archived, nil
+}
+
+// archiveTask writes the logs of a task to a new archive, indexes its segments and
+// deletes the archived rows in one transaction. Returns false if another instance is
+// archiving the task.
+func (s *Store) archiveTask(ctx context.Context, taskID string) (bool, error) {
+	var path string
+	archived := false
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Another instance archiving the same task holds the lock
+		var task models.Task
+		err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Select("id").First(&task, "id = ?", taskID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		file, relPath, err := s.createArchive(taskID)
+		if err != nil {
+			return err
+		}
+		path = relPath
+		w := newArchiveWriter(file, taskID, relPath)
+
+		var lastID uint
+		for {
+			var logs []models.TaskLog
+			if err := tx.Where("task_id = ? AND id > ?", taskID, lastID).
+				Order("id ASC").Limit(archiveReadBatch).Find(&logs).Error; err != nil {
+				file.Close()
+				return err
+			}
+			if len(logs) == 0 {
+				break
+			}
+			for i := range logs {
+				if err := w.add(&logs[i]); err != nil {
+					file.Close()
+					return err
+				}
+			}
+			lastID = logs[len(logs)-1].ID
+		}
+
+		segments, err := w.close()
+		if err != nil {
+			return err
+		}
+		if len(segments) == 0 {
+			return errNothingArchived
+		}
+		if err := tx.Create(&segments).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("task_id = ? AND id <= ?", taskID, lastID).Delete(&models.TaskLog{}).Error; err != nil {
+			return err
+		}
+		archived = true
+		return nil
+	})
+
+	if err != nil && path != "" {
+		if removeErr := s.deleteArchive(path); removeErr != nil {
+			log.Printf("Failed to remove unused log archive %s: %v", path, removeErr)
+		}
+	}
+	if errors.Is(err, errNothingArchived) {
+		return false, nil
+	}
+	return archived, err
+}
+
+var errNothingArchived = errors.New("no logs to archive")
+
+// archiveWriter writes entries to an archive file as a sequence of gzip members
+type archiveWriter struct {
+	file    *os.File
+	taskID  string
+	path    string
+	offset  int64
+	current *segmentWriter
+	done    []models.TaskLogSegment
+}
+
+type segmentWriter struct {
+	segment models.TaskLogSegment
+	gz      *gzip.Writer
+	encoder *json.Encoder
+	size    int
+}
+
+// countingWriter tracks the archive offset
+type countingWriter struct {
+	w *archiveWriter
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.file.Write(p)
+	c.w.offset += int64(n)
+	return n, err
+}
+
+func newArchiveWriter(file *os.File, taskID, path string) *archiveWriter {
+	return &archiveWriter{file: file, taskID: taskID, path: path}
+}
+
+func (w *archiveWriter) add(row *models.TaskLog) error {
+	if w.current == nil {
+		gz := gzip.NewWriter(countingWriter{w})
+		w.current = &segmentWriter{
+			segment: models.TaskLogSegment{
+				TaskID:       w.taskID,
+				Path:         w.path,
+				Offset:       w.offset,
+				FirstLogID:   row.ID,
+				MinTimestamp: row.Timestamp,
+				MaxTimestamp: row.Timestamp,
+			},
+			gz:      gz,
+			encoder: json.NewEncoder(gz),
+		}
+	}
+
+	cur := w.current
+	entry := entryFromModel(row)
+	entry.TaskID = "" // Stored once in the segment index
+	if err := cur.encoder.Encode(&entry); err != nil {
+		return err
+	}
+	cur.size += len(row.Message)
+	cur.segment.Entries++
+	cur.segment.LastLogID = row.ID
+	if row.Timestamp.Before(cur.segment.MinTimestamp) {
+		cur.segment.MinTimestamp = row.Timestamp
+	}
+	if row.Timestamp.After(cur.segment.MaxTimestamp) {
+		cur.segment.MaxTimestamp = row.Timestamp
+	}
+
+	if cur.segment.Entries >= segmentMaxEntries || cur.size >= segmentMaxBytes {
+		return w.finishSegment()
+	}
+	return nil
+}
+
+func (w *archiveWriter) finishSegment() error {
+	cur := w.current
+	if cur == nil {
+		return nil
+	}
+	if err := cur.gz.Close(); err != nil {
+		return err
+	}
+	cur.segment.Length = w.offset - cur.segment.Offset
+	cur.segment.CreatedAt = time.Now()
+	w.done = append(w.done, cur.segment)
+	w.current = nil
+	return nil
+}
+
+// close finishes the last segment, syncs and closes the file and returns the segments
+func (w *archiveWriter) close() ([]models.TaskLogSegment, error) {
+	err := w.finishSegment()
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w.done, nil
+}
@@ -0,0 +1,314 @@
+// Package logstore keeps task logs in two tiers: recent entries in the task_logs
+// table, and entries of tasks that finished long ago in compressed archives in
+// storage, with only an index of archive segments left in the database. Queries
+// read both tiers transparently.
+package logstore
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"borg/mothership/internal/models"
+
+	"github.com/google/uuid"
+
+	"gorm.io/gorm"
+)
+
+// searchPrefix is how much of each message the full-text index covers
+const searchPrefix = 65536
+
+// Entry is a task log entry
+type Entry struct {
+	ID        uint      `json:"id"`
+	TaskID    string    `json:"task_id"`
+	Seq       int64     `json:"seq,omitempty"`
+	Level     string    `json:"level"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func entryFromModel(row *models.TaskLog) Entry {
+	return Entry{
+		ID:        row.ID,
+		TaskID:    row.TaskID,
+		Seq:       row.Seq,
+		Level:     row.Level,
+		Message:   row.Message,
+		Timestamp: row.Timestamp,
+	}
+}
+
+// Scope selects the logs of one task, or of every task of a job
+type Scope struct {
+	TaskID string
+	JobID  string
+}
+
+func (s Scope) apply(query *gorm.DB) *gorm.DB {
+	if s.TaskID != "" {
+		return query.Where("task_id = ?", s.TaskID)
+	}
+	return query.Where("task_id IN (SELECT id FROM tasks WHERE job_id = ?)", s.JobID)
+}
+
+// Filter selects log entries. Zero fields do not filter.
+type Filter struct {
+	Cursor uint      // Only entries with a greater log ID
+	Since  time.Time // Inclusive
+	Until  time.Time // Exclusive
+	Levels []string
+	Query  string // Words that must all appear in the message
+}
+
+// terms splits a search query into lower-case words, as Postgres' simple text search
+// configuration does
+func terms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// apply adds the filter to a task_logs query
+func (f *Filter) apply(query *gorm.DB) *gorm.DB {
+	if f.Cursor > 0 {
+		query = query.Where("id > ?", f.Cursor)
+	}
+	if !f.Since.IsZero() {
+		query = query.Where("timestamp >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		query = query.Where("timestamp < ?", f.Until)
+	}
+	if len(f.Levels) > 0 {
+		query = query.Where("level IN ?", f.Levels)
+	}
+	if words := terms(f.Query); len(words) > 0 {
+		query = query.Where(fmt.Sprintf("to_tsvector('simple'::regconfig, left(message, %d)) @@ plainto_tsquery('simple'::regconfig, ?)", searchPrefix),
+			strings.Join(words, " "))
+	}
+	return query
+}
+
+// matcher applies a filter to archived entries
+type matcher struct {
+	filter *Filter
+	levels map[string]bool
+	words  []string
+}
+
+func newMatcher(f *Filter) *matcher {
+	m := &matcher{filter: f, words: terms(f.Query)}
+	if len(f.Levels) > 0 {
+		m.levels = make(map[string]bool, len(f.Levels))
+		for _, level := range f.Levels {
+			m.levels[level] = true
+		}
+	}
+	return m
+}
+
+// segment reports whether a segment may contain matching entries
+func (m *matcher) segment(seg *models.TaskLogSegment) bool {
+	f := m.filter
+	return seg.LastLogID > f.Cursor &&
+		(f.Since.IsZero() || !seg.MaxTimestamp.Before(f.Since)) &&
+		(f.Until.IsZero() || seg.MinTimestamp.Before(f.Until))
+}
+
+func (m *matcher) entry(e *Entry) bool {
+	f := m.filter
+	if e.ID <= f.Cursor ||
+		(!f.Since.IsZero() && e.Timestamp.Before(f.Since)) ||
+		(!f.Until.IsZero() && !e.Timestamp.Before(f.Until)) ||
+		(m.levels != nil && !m.levels[e.Level]) {
+		return false
+	}
+	if len(m.words) == 0 {
+		return true
+	}
+
+	message := e.Message
+	if len(message) > searchPrefix {
+		message = message[:searchPrefix]
+	}
+	present := make(map[string]bool)
+	for _, word := range terms(message) {
+		present[word] = true
+	}
+	for _, word := range m.words {
+		if !present[word] {
+			return false
+		}
+	}
+	return true
+}
+
+// Store reads and archives task logs
+type Store struct {
+	db  *gorm.DB
+	dir string // Archive directory
+}
+
+// New creates a log store keeping archives in dir
+func New(db *gorm.DB, dir string) *Store {
+	return &Store{db: db, dir: dir}
+}
+
+// createArchive creates an archive file for logs of a task and returns it with its path
+// relative to the archive directory
+func (s *Store) createArchive(taskID string) (*os.File, string, error) {
+	relPath := filepath.Join(time.Now().Format("2006/01/02"), taskID+"-"+uuid.New().String()+".jsonl.gz")
+	filePath := filepath.Join(s.dir, relPath)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create log archive: %w", err)
+	}
+	return file, relPath, nil
+}
+
+func (s *Store) openArchive(relPath string) (*os.File, error) {
+	return os.Open(filepath.Join(s.dir, filepath.Clean("/"+relPath)))
+}
+
+func (s *Store) deleteArchive(relPath string) error {
+	return os.Remove(filepath.Join(s.dir, filepath.Clean("/"+relPath)))
+}
+
+// Find returns up to limit matching entries in log ID order, and whether more follow.
+// Pass the ID of the last entry as the next filter's cursor to continue.
+func (s *Store) Find(ctx context.Context, scope Scope, f Filter, limit int) ([]Entry, bool, error) {
+	// Recent entries are read first: entries archived in the meantime then show up in
+	// both tiers instead of in neither
+	var recent []models.TaskLog
+	query := f.apply(scope.apply(s.db.WithContext(ctx).Model(&models.TaskLog{})))
+	if err := query.Order("id ASC").Limit(limit + 1).Find(&recent).Error; err != nil {
+		return nil, false, err
+	}
+
+	var segments []models.TaskLogSegment
+	query = scope.apply(s.db.WithContext(ctx).Model(&models.TaskLogSegment{})).Where("last_log_id > ?", f.Cursor)
+	if err := query.Order("first_log_id ASC").Find(&segments).Error; err != nil {
+		return nil, false, err
+	}
+
+	entries := make([]Entry, 0, len(recent))
+	for i := range recent {
+		entries = append(entries, entryFromModel(&recent[i]))
+	}
+
+	if len(segments) > 0 {
+		archived, err := s.findArchived(segments, newMatcher(&f), limit)
+		if err != nil {
+			return nil, false, err
+		}
+		entries = mergeEntries(entries, archived)
+	}
+
+	if len(entries) > limit {
+		return entries[:limit], true, nil
+	}
+	return entries, false, nil
+}
+
+// findArchived reads matching entries from segments sorted by first log ID until the
+// first limit+1 matches are certain
+func (s *Store) findArchived(segments []models.TaskLogSegment, m *matcher, limit int) ([]Entry, error) {
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	var matches []Entry
+	for i := range segments {
+		seg := &segments[i]
+		// Segments of concurrent tasks overlap, so later segments can only be skipped
+		// once they start after the last match needed
+		if len(matches) > limit && matches[limit].ID < seg.FirstLogID {
+			break
+		}
+		if !m.segment(seg) {
+			continue
+		}
+
+		file, ok := files[seg.Path]
+		if !ok {
+			var err error
+			if file, err = s.openArchive(seg.Path); err != nil {
+				return nil, fmt.Errorf("failed to open log archive of task %s: %w", seg.TaskID, err)
+			}
+			files[seg.Path] = file
+		}
+		err := readSegment(file, seg, func(e *Entry) {
+			if m.entry(e) {
+				matches = append(matches, *e)
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read log archive of task %s: %w", seg.TaskID, err)
+		}
+
+		sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+		if len(matches) > limit+1 {
+			matches = matches[:limit+1]
+		}
+	}
+	return matches, nil
+}
+
+// readSegment decodes the entries of one segment
+func readSegment(file *os.File, seg *models.TaskLogSegment, fn func(e *Entry)) error {
+	gz, err := gzip.NewReader(io.NewSectionReader(file, seg.Offset, seg.Length))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	decoder := json.NewDecoder(gz)
+	for {
+		var e Entry
+		if err := decoder.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		e.TaskID = seg.TaskID
+		fn(&e)
+	}
+}
+
+// mergeEntries merges two lists sorted by ID, dropping duplicates
+func mergeEntries(a, b []Entry) []Entry {
+	merged := make([]Entry, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i].ID < b[j].ID):
+			merged = append(merged, a[i])
+			i++
+		case i == len(a) || b[j].ID < a[i].ID:
+			merged = append(merged, b[j])
+			j++
+		default:
+			merged = append(merged, a[i])
+			i++
+			j++
+		}
+	}
+	return merged
+}
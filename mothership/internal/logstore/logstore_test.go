@@ -0,0 +1,268 @@
+package logstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"borg/mothership/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+func ids(entries []Entry) []uint {
+	out := make([]uint, len(entries))
+	for i, entry := range entries {
+		out[i] = entry.ID
+	}
+	return out
+}
+
+func entriesWithIDs(ids ...uint) []Entry {
+	entries := make([]Entry, len(ids))
+	for i, id := range ids {
+		entries[i] = Entry{ID: id}
+	}
+	return entries
+}
+
+func TestMergeEntries(t *testing.T) {
+	for _, tc := range []struct {
+		a, b []uint
+		want []uint
+	}{
+		{a: []uint{1, 3, 5}, b: []uint{2, 4}, want: []uint{1, 2, 3, 4, 5}},
+		{a: []uint{1, 2, 3}, b: []uint{2, 3, 4}, want: []uint{1, 2, 3, 4}},
+		{a: []uint{5, 6}, b: []uint{1, 2}, want: []uint{1, 2, 5, 6}},
+		{a: nil, b: []uint{1, 2}, want: []uint{1, 2}},
+		{a: []uint{1, 2}, b: nil, want: []uint{1, 2}},
+		{a: nil, b: nil, want: []uint{}},
+	} {
+		got := ids(mergeEntries(entriesWithIDs(tc.a...), entriesWithIDs(tc.b...)))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("mergeEntries(%v, %v) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+// logRows returns n log rows of a task with IDs from first, alternating between stdout and stderr
+func logRows(taskID string, first uint, n int) []models.TaskLog {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := make([]models.TaskLog, n)
+	for i := range rows {
+		id := first + uint(i)
+		level := "stdout"
+		if id%2 == 0 {
+			level = "stderr"
+		}
+		rows[i] = models.TaskLog{
+			ID:        id,
+			TaskID:    taskID,
+			Seq:       int64(id),
+			Level:     level,
+			Message:   fmt.Sprintf("line %d", id),
+			Timestamp: base.Add(time.Duration(id) * time.Millisecond),
+		}
+	}
+	return rows
+}
+
+// writeArchive archives rows the way archiveTask does and returns the segment index
+func writeArchive(t *testing.T, s *Store, taskID string, rows []models.TaskLog) []models.TaskLogSegment {
+	t.Helper()
+	file, relPath, err := s.createArchive(taskID)
+	if err != nil {
+		t.Fatalf("createArchive: %v", err)
+	}
+	w := newArchiveWriter(file, taskID, relPath)
+	for i := range rows {
+		if err := w.add(&rows[i]); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	segments, err := w.close()
+	if err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	return segments
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	s := New(nil, t.TempDir())
+	taskID := uuid.New().String()
+	rows := logRows(taskID, 1, 2*segmentMaxEntries+500)
+	segments := writeArchive(t, s, taskID, rows)
+
+	if len(segments) != 3 {
+		t.Fatalf("archive has %d segments, want 3", len(segments))
+	}
+	var offset int64
+	for i, seg := range segments {
+		first := uint(i*segmentMaxEntries + 1)
+		if seg.FirstLogID != first || seg.Offset != offset || seg.TaskID != taskID {
+			t.Fatalf("segment %d starts at log %d, offset %d, want log %d, offset %d", i, seg.FirstLogID, seg.Offset, first, offset)
+		}
+		offset += seg.Length
+	}
+	if last := segments[2]; last.Entries != 500 || last.LastLogID != uint(len(rows)) {
+		t.Fatalf("last segment holds %d entries up to log %d, want 500 up to %d", last.Entries, last.LastLogID, len(rows))
+	}
+
+	file, err := s.openArchive(segments[0].Path)
+	if err != nil {
+		t.Fatalf("openArchive: %v", err)
+	}
+	defer file.Close()
+	var read []Entry
+	for i := range segments {
+		if err := readSegment(file, &segments[i], func(e *Entry) { read = append(read, *e) }); err != nil {
+			t.Fatalf("readSegment %d: %v", i, err)
+		}
+	}
+	if len(read) != len(rows) {
+		t.Fatalf("read %d entries, want %d", len(read), len(rows))
+	}
+	for i := range rows {
+		want := entryFromModel(&rows[i])
+		if got := read[i]; got.ID != want.ID || got.TaskID != want.TaskID || got.Seq != want.Seq ||
+			got.Level != want.Level || got.Message != want.Message || !got.Timestamp.Equal(want.Timestamp) {
+			t.Fatalf("entry %d = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestFindArchivedAcrossSegments(t *testing.T) {
+	s := New(nil, t.TempDir())
+	taskID := uuid.New().String()
+	rows := logRows(taskID, 1, 2*segmentMaxEntries+500)
+	segments := writeArchive(t, s, taskID, rows)
+
+	// A page that starts at the end of one segment continues in the next
+	f := Filter{Cursor: segmentMaxEntries - 5}
+	got, err := s.findArchived(segments, newMatcher(&f), 10)
+	if err != nil {
+		t.Fatalf("findArchived: %v", err)
+	}
+	if len(got) != 11 || got[0].ID != segmentMaxEntries-4 || got[10].ID != segmentMaxEntries+6 {
+		t.Fatalf("findArchived after log %d = %v, want the 11 following entries", f.Cursor, ids(got))
+	}
+
+	f = Filter{Levels: []string{"stderr"}, Query: "LINE 15002"}
+	got, err = s.findArchived(segments, newMatcher(&f), 10)
+	if err != nil {
+		t.Fatalf("findArchived: %v", err)
+	}
+	if !reflect.DeepEqual(ids(got), []uint{15002}) {
+		t.Fatalf("findArchived of stderr line 15002 = %v", ids(got))
+	}
+
+	base := rows[0].Timestamp.Add(-time.Millisecond)
+	f = Filter{Since: base.Add(20001 * time.Millisecond), Until: base.Add(20004 * time.Millisecond)}
+	got, err = s.findArchived(segments, newMatcher(&f), 10)
+	if err != nil {
+		t.Fatalf("findArchived: %v", err)
+	}
+	if !reflect.DeepEqual(ids(got), []uint{20001, 20002, 20003}) {
+		t.Fatalf("findArchived between logs 20001 and 20004 = %v", ids(got))
+	}
+}
+
+// testDB connects to the Postgres database in TEST_DATABASE_URL, skipping the test without one
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+	if err := models.Migrate(db); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	return db
+}
+
+func TestFindReadsBothTiers(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	s := New(db, t.TempDir())
+
+	job := models.Job{ID: uuid.New().String(), Name: "logstore test", Type: "shell", Command: "true"}
+	task := models.Task{ID: uuid.New().String(), JobID: job.ID, Status: "completed"}
+	if err := db.Create(&job).Error; err != nil {
+		t.Fatalf("failed to create job: %v", err)
+	}
+	if err := db.Omit(clause.Associations).Create(&task).Error; err != nil {
+		t.Fatalf("failed to create task: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Where("task_id = ?", task.ID).Delete(&models.TaskLog{})
+		db.Where("task_id = ?", task.ID).Delete(&models.TaskLogSegment{})
+		db.Unscoped().Delete(&task)
+		db.Delete(&job)
+	})
+
+	addLogs := func(n int) []uint {
+		var added []uint
+		for _, row := range logRows(task.ID, 1, n) {
+			row.ID = 0 // Assigned by the database
+			if err := db.Omit(clause.Associations).Create(&row).Error; err != nil {
+				t.Fatalf("failed to create log: %v", err)
+			}
+			added = append(added, row.ID)
+		}
+		return added
+	}
+
+	archivedIDs := addLogs(5)
+	if ok, err := s.archiveTask(ctx, task.ID); err != nil || !ok {
+		t.Fatalf("archiveTask = %v, %v", ok, err)
+	}
+	var remaining int64
+	db.Model(&models.TaskLog{}).Where("task_id = ?", task.ID).Count(&remaining)
+	if remaining != 0 {
+		t.Fatalf("%d archived rows are left in task_logs", remaining)
+	}
+	recentIDs := addLogs(3)
+	all := append(append([]uint{}, archivedIDs...), recentIDs...)
+
+	// Pages of 3 cross from the archive into the table
+	var got []uint
+	var f Filter
+	for {
+		entries, more, err := s.Find(ctx, Scope{TaskID: task.ID}, f, 3)
+		if err != nil {
+			t.Fatalf("Find: %v", err)
+		}
+		got = append(got, ids(entries)...)
+		if !more {
+			break
+		}
+		f.Cursor = entries[len(entries)-1].ID
+	}
+	if !reflect.DeepEqual(got, all) {
+		t.Fatalf("Find returned logs %v, want %v", got, all)
+	}
+
+	entries, _, err := s.Find(ctx, Scope{JobID: job.ID}, Filter{Levels: []string{"stdout"}}, 100)
+	if err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Level != "stdout" || entry.TaskID != task.ID {
+			t.Fatalf("Find of the job's stdout returned %+v", entry)
+		}
+	}
+	if len(entries) != 5 {
+		t.Fatalf("Find of the job's stdout returned %d entries, want 5", len(entries))
+	}
+}
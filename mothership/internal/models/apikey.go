@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+)
+
+// APIKey is a long-lived, scoped credential that a user creates for automation
+type APIKey struct {
+	ID         string     `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	UserID     string     `gorm:"not null;type:varchar(36);index" json:"user_id"`
+	Name       string     `gorm:"not null;type:varchar(255)" json:"name"`
+	KeyHash    string     `gorm:"uniqueIndex;not null;type:varchar(64)" json:"-"` // SHA256 hash of the key
+	Prefix     string     `gorm:"type:varchar(32)" json:"prefix"`                 // Public part of the key, for identification
+	Scopes     string     `gorm:"type:jsonb" json:"scopes"`                       // JSON array of permissions
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `gorm:"not null" json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+
+	User User `gorm:"foreignKey:UserID" json:"-"`
+}
+
+func (APIKey) TableName() string {
+	return "api_keys"
+}
+
+// IsActive reports whether the key can still be used to authenticate
+func (k *APIKey) IsActive(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	if k.ExpiresAt != nil && now.After(*k.ExpiresAt) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+// AuditEntry records a security-relevant or destructive action. Entries are
+// append-only: the database rejects updates and deletes (see Migrate).
+type AuditEntry struct {
+	ID         string    `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	Action     string    `gorm:"not null;type:varchar(64);index" json:"action"` // e.g. job.delete, auth.login
+	Success    bool      `gorm:"not null;default:true" json:"success"`
+	ActorID    string    `gorm:"type:varchar(36);index" json:"actor_id"` // User ID, empty for failed logins of unknown users
+	ActorName  string    `gorm:"type:varchar(255)" json:"actor_name"`
+	APIKeyID   string    `gorm:"type:varchar(36)" json:"api_key_id,omitempty"` // Set when the action was made with an API key
+	IPAddress  string    `gorm:"type:varchar(64)" json:"ip_address"`
+	UserAgent  string    `gorm:"type:varchar(500)" json:"user_agent"`
+	TargetType string    `gorm:"type:varchar(64);index:idx_audit_target" json:"target_type"` // job, runner, user, file, ...
+	TargetID   string    `gorm:"type:varchar(255);index:idx_audit_target" json:"target_id"`
+	TargetName string    `gorm:"type:varchar(255)" json:"target_name"`
+	Before     string    `gorm:"type:jsonb" json:"before"` // Summary of the target before the action
+	After      string    `gorm:"type:jsonb" json:"after"`  // Summary of the target after the action
+	CreatedAt  time.Time `gorm:"not null;index" json:"created_at"`
+}
+
+func (AuditEntry) TableName() string {
+	return "audit_log"
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"borg/mothership/internal/auth"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ErrAdminExists is returned when a bootstrap admin is requested but an enabled admin exists
+var ErrAdminExists = errors.New("an enabled admin already exists, bootstrap admin is only created without one")
+
+// BootstrapAdmin creates the initial admin account on a database without an enabled admin,
+// such as an empty database or one whose default account was disabled on upgrade.
+// A disabled account with the same username, such as that default account, is reset and
+// re-enabled instead, and its sessions and API keys are revoked.
+// The admin has to change the password on first login.
+func BootstrapAdmin(db *gorm.DB, username, password string) (*User, error) {
+	if username == "" || password == "" {
+		return nil, errors.New("bootstrap admin requires a username and a password")
+	}
+
+	var user *User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var adminCount int64
+		if err := tx.Model(&User{}).Where("role = ? AND disabled = ?", auth.RoleAdmin, false).
+			Count(&adminCount).Error; err != nil {
+			return err
+		}
+		if adminCount > 0 {
+			return ErrAdminExists
+		}
+
+		passwordHash, err := auth.HashPassword(password)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		var existing User
+		err = tx.Where("username = ?", username).First(&existing).Error
+		switch {
+		case err == nil && !existing.Disabled:
+			return fmt.Errorf("user %q already exists and is not an admin, choose another username", username)
+		case err == nil:
+			if err := tx.Model(&Session{}).Where("user_id = ? AND revoked_at IS NULL", existing.ID).
+				Update("revoked_at", now).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&APIKey{}).Where("user_id = ? AND revoked_at IS NULL", existing.ID).
+				Update("revoked_at", now).Error; err != nil {
+				return err
+			}
+			existing.PasswordHash = passwordHash
+			existing.AuthProvider = "local"
+			existing.Role = auth.RoleAdmin
+			existing.Disabled = false
+			existing.MustChangePassword = true
+			existing.UpdatedAt = now
+			user = &existing
+			return tx.Save(user).Error
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return err
+		}
+
+		user = &User{
+			ID:                 uuid.New().String(),
+			Username:           username,
+			PasswordHash:       passwordHash,
+			AuthProvider:       "local",
+			Role:               auth.RoleAdmin,
+			MustChangePassword: true,
+			CreatedAt:          now,
+			UpdatedAt:          now,
+		}
+		return tx.Create(user).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,14 @@
+package models
+
+import (
+	"time"
+)
+
+// ClusterMessage holds a message between mothership instances that is too large for
+// a Postgres notification. The notification carries its ID instead.
+type ClusterMessage struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	Channel   string    `gorm:"not null;type:varchar(63)" json:"channel"`
+	Payload   string    `gorm:"not null;type:text" json:"payload"`
+	CreatedAt time.Time `gorm:"not null;index" json:"created_at"`
+}
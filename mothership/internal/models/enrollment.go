@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+)
+
+// EnrollmentToken is an admin-issued token that runners exchange for a
+// per-runner secret during registration
+type EnrollmentToken struct {
+	ID         string     `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	Name       string     `gorm:"not null;type:varchar(255)" json:"name"`
+	TokenHash  string     `gorm:"uniqueIndex;not null;type:varchar(64)" json:"-"` // SHA256 hash of the token
+	Prefix     string     `gorm:"type:varchar(16)" json:"prefix"`                 // First characters of the token, for identification
+	MaxUses    int32      `gorm:"default:1" json:"max_uses"`                      // 0 = unlimited
+	UseCount   int32      `gorm:"default:0" json:"use_count"`
+	Labels     string     `gorm:"type:jsonb" json:"labels"`           // JSON map applied to runners enrolled with this token
+	ProjectID  string     `gorm:"type:varchar(36)" json:"project_id"` // Runners enrolled with this token are dedicated to the project
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedBy  string     `gorm:"type:varchar(255)" json:"created_by"`
+	CreatedAt  time.Time  `gorm:"not null" json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+func (EnrollmentToken) TableName() string {
+	return "enrollment_tokens"
+}
+
+// IsUsable reports whether the token can still be exchanged for a runner secret
+func (t *EnrollmentToken) IsUsable(now time.Time) bool {
+	if t.RevokedAt != nil {
+		return false
+	}
+	if t.ExpiresAt != nil && now.After(*t.ExpiresAt) {
+		return false
+	}
+	if t.MaxUses > 0 && t.UseCount >= t.MaxUses {
+		return false
+	}
+	return true
+}
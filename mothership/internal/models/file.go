@@ -14,6 +14,7 @@ type File struct {
 	ContentType string    `gorm:"type:varchar(255)" json:"content_type"`
 	Hash        string    `gorm:"type:varchar(64);index" json:"hash"` // SHA256 hash
 	UploadedBy  string    `gorm:"type:varchar(255)" json:"uploaded_by"`
+	ProjectID   string    `gorm:"type:varchar(36);index" json:"project_id"`
 	CreatedAt   time.Time `gorm:"not null" json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
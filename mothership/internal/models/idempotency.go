@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// IdempotencyKey records a runner request that was handled, so a resent copy of it is
+// answered with the stored response instead of being applied twice
+type IdempotencyKey struct {
+	RunnerID   string    `gorm:"primaryKey;type:varchar(36)" json:"runner_id"`
+	Key        string    `gorm:"primaryKey;type:varchar(128)" json:"key"`
+	StatusCode int       `gorm:"not null" json:"status_code"`
+	Response   string    `gorm:"type:text" json:"response"`
+	CreatedAt  time.Time `gorm:"not null;index" json:"created_at"`
+}
@@ -10,21 +10,25 @@ type Job struct {
 	ID              string    `gorm:"primaryKey;type:varchar(36)" json:"id"`
 	Name            string    `gorm:"not null;type:varchar(255)" json:"name"`
 	Description     string    `gorm:"type:text" json:"description"`
-	Type            string    `gorm:"not null;type:varchar(50)" json:"type"` // shell, binary, docker
+	Type            string    `gorm:"not null;type:varchar(50)" json:"type"` // shell, binary, docker, wasm
 	Priority        int32     `gorm:"default:1" json:"priority"` // 0=low, 1=normal, 2=high, 3=urgent
 	Command         string    `gorm:"not null;type:text" json:"command"`
 	Args            string    `gorm:"type:jsonb" json:"args"` // JSON array
 	Env             string    `gorm:"type:jsonb" json:"env"` // JSON map
+	SecretEnv       string    `gorm:"type:jsonb" json:"secret_env"` // JSON map of env var name to secret name, resolved only for runners
 	WorkingDirectory string   `gorm:"type:varchar(500)" json:"working_directory"`
 	TimeoutSeconds  int64     `gorm:"default:0" json:"timeout_seconds"`
 	MaxRetries      int32     `gorm:"default:0" json:"max_retries"`
 	DockerImage     string    `gorm:"type:varchar(500)" json:"docker_image"`
 	Privileged      bool      `gorm:"default:false" json:"privileged"`
+	Limits          ResourceLimits `gorm:"embedded;embeddedPrefix:limit_" json:"limits"` // Per-task limits, enforced by Linux runners
+	Sandbox         SandboxOptions `gorm:"embedded;embeddedPrefix:sandbox_" json:"sandbox"` // Confine shell and dataset tasks on Linux runners
 	Metadata        string    `gorm:"type:jsonb" json:"metadata"` // JSON map
 	ExecutorBinaryID string   `gorm:"type:varchar(36);index" json:"executor_binary_id"` // Reusable executor binary
 	ProcessorScriptID string   `gorm:"type:varchar(36);index" json:"processor_script_id"` // Processor script for this job
 	CSVDatasetID    string    `gorm:"type:varchar(36);index" json:"csv_dataset_id"` // CSV dataset file
 	Status          string    `gorm:"not null;type:varchar(50);default:'pending'" json:"status"`
+	ProjectID       string    `gorm:"type:varchar(36);index" json:"project_id"`
 	CreatedBy       string    `gorm:"type:varchar(255)" json:"created_by"`
 	CreatedAt       time.Time `gorm:"not null" json:"created_at"`
 	UpdatedAt       time.Time `json:"updated_at"`
@@ -39,6 +43,26 @@ func (Job) TableName() string {
 	return "jobs"
 }
 
+// ResourceLimits are the resources each task of a job may use. Zero means unlimited.
+type ResourceLimits struct {
+	CPU      float64 `gorm:"default:0" json:"cpu"`       // CPU cores, e.g. 0.5 for half a core
+	MemoryMB int64   `gorm:"default:0" json:"memory_mb"` // Memory including page cache; tasks above it are OOM-killed
+	Pids     int32   `gorm:"default:0" json:"pids"`      // Processes and threads
+	IOWeight int32   `gorm:"default:0" json:"io_weight"` // Relative share of disk bandwidth, 1-10000 (default 100)
+}
+
+// IsZero reports whether no limit is set
+func (l ResourceLimits) IsZero() bool {
+	return l == ResourceLimits{}
+}
+
+// SandboxOptions confine the tasks of a job to their task directory and read-only system
+// paths, without access to other tasks or the runner's configuration
+type SandboxOptions struct {
+	Enabled bool `gorm:"default:false" json:"enabled"`
+	Network bool `gorm:"default:false" json:"network"` // Keep network access inside the sandbox
+}
+
 // JobFile represents files required for a job
 type JobFile struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+)
+
+// JournalEntry is a published event, kept for a while so clients that reconnect to the
+// event stream can replay what they missed
+type JournalEntry struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement" json:"id"` // Sequence number, used as event stream ID
+	EventID   string    `gorm:"not null;type:varchar(36)" json:"event_id"`
+	Type      string    `gorm:"not null;type:varchar(100)" json:"type"`
+	ProjectID string    `gorm:"type:varchar(36)" json:"project_id"`
+	Data      string    `gorm:"not null;type:jsonb" json:"data"`
+	CreatedAt time.Time `gorm:"not null;index" json:"created_at"` // Event time
+}
+
+func (JournalEntry) TableName() string {
+	return "event_journal"
+}
@@ -1,9 +1,11 @@
 package models
 
 import (
-	"borg/mothership/internal/auth"
+	"log"
 	"time"
 
+	"borg/mothership/internal/auth"
+
 	"gorm.io/gorm"
 	"github.com/google/uuid"
 )
@@ -53,6 +55,21 @@ func Migrate(db *gorm.DB) error {
 		}
 	}
 
+	// Users created before roles existed keep full access
+	if db.Migrator().HasTable(&User{}) && !db.Migrator().HasColumn(&User{}, "role") {
+		if err := db.Migrator().AddColumn(&User{}, "role"); err == nil {
+			db.Exec("UPDATE users SET role = ?", auth.RoleAdmin)
+		}
+	}
+
+	// Secret names became unique per project
+	db.Exec("DROP INDEX IF EXISTS idx_secrets_name")
+
+	// Webhook response bodies are no longer kept, they could carry data of internal endpoints
+	if db.Migrator().HasTable(&WebhookDelivery{}) && db.Migrator().HasColumn(&WebhookDelivery{}, "response_body") {
+		db.Migrator().DropColumn(&WebhookDelivery{}, "response_body")
+	}
+
 	// Run full migration including User model
 	if err := db.AutoMigrate(
 		&User{},
@@ -67,33 +84,138 @@ func Migrate(db *gorm.DB) error {
 		&ProcessorScript{},
 		&JobResult{},
 		&Dataset{},
+		&EnrollmentToken{},
+		&APIKey{},
+		&Session{},
+		&AuditEntry{},
+		&Secret{},
+		&Project{},
+		&ProjectMember{},
+		&RateLimitBucket{},
+		&LoginFailure{},
+		&Webhook{},
+		&WebhookDelivery{},
+		&TaskLogSegment{},
+		&JournalEntry{},
+		&ClusterMessage{},
+		&IdempotencyKey{},
 	); err != nil {
 		return err
 	}
+
+	if err := migrateProjects(db); err != nil {
+		return err
+	}
+	disableLegacyDefaultUser(db)
+
+	// Streamed output chunks are stored once, however often the runner resends them
+	if err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_task_logs_task_seq ON task_logs (task_id, seq) WHERE seq > 0").Error; err != nil {
+		return err
+	}
+	// Full-text search over task output. Matches the expression logstore queries with.
+	if err := db.Exec("CREATE INDEX IF NOT EXISTS idx_task_logs_message_fts ON task_logs USING gin (to_tsvector('simple'::regconfig, left(message, 65536)))").Error; err != nil {
+		return err
+	}
+
+	// The audit log is append-only
+	if err := db.Exec(`
+		CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_log is append-only';
+		END;
+		$$ LANGUAGE plpgsql`).Error; err != nil {
+		return err
+	}
+	if err := db.Exec("DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log").Error; err != nil {
+		return err
+	}
+	if err := db.Exec(`
+		CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+			FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only()`).Error; err != nil {
+		return err
+	}
 	
-	// Create default user if no users exist
-	var userCount int64
-	db.Model(&User{}).Count(&userCount)
-	
-	if userCount == 0 {
-		passwordHash, err := auth.HashPassword("mirzat")
-		if err != nil {
+	return nil
+}
+
+// legacyDefaultUsername and its password were seeded by earlier versions and are publicly known
+const legacyDefaultUsername = "mirzat"
+
+// disableLegacyDefaultUser disables the account earlier versions created on every install
+// while it still has its published password. An administrator can re-enable it after
+// resetting the password.
+func disableLegacyDefaultUser(db *gorm.DB) {
+	var user User
+	if err := db.Where("username = ? AND disabled = ?", legacyDefaultUsername, false).First(&user).Error; err != nil {
+		return
+	}
+	if user.PasswordHash == "" || !auth.VerifyPassword(legacyDefaultUsername, user.PasswordHash) {
+		return
+	}
+
+	if err := db.Model(&User{}).Where("id = ?", user.ID).
+		Updates(map[string]interface{}{"disabled": true, "must_change_password": true}).Error; err != nil {
+		log.Printf("WARNING: failed to disable user %q, which still has its publicly known default password: %v", user.Username, err)
+		return
+	}
+	log.Printf("WARNING: disabled user %q, which still had the publicly known default password. "+
+		"Reset its password and re-enable it, or delete it, as an administrator.", user.Username)
+}
+
+// projectOwnedTables lists the tables whose rows belong to a project
+var projectOwnedTables = []string{"jobs", "files", "datasets", "executor_binaries", "secrets"}
+
+// migrateProjects adds project ownership to datasets and executor binaries and moves
+// everything created before projects existed into the default project
+func migrateProjects(db *gorm.DB) error {
+	for _, table := range []string{"datasets", "executor_binaries"} {
+		if err := db.Exec("ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS project_id varchar(36)").Error; err != nil {
 			return err
 		}
-		
-		defaultUser := &User{
-			ID:           uuid.New().String(),
-			Username:     "mirzat",
-			PasswordHash: passwordHash,
-			CreatedAt:    time.Now(),
-			UpdatedAt:    time.Now(),
-		}
-		
-		if err := db.Create(defaultUser).Error; err != nil {
+		if err := db.Exec("CREATE INDEX IF NOT EXISTS idx_" + table + "_project_id ON " + table + " (project_id)").Error; err != nil {
 			return err
 		}
 	}
-	
-	return nil
-}
 
+	var projectCount int64
+	if err := db.Model(&Project{}).Count(&projectCount).Error; err != nil {
+		return err
+	}
+	if projectCount > 0 {
+		return nil
+	}
+
+	// First start with projects: existing users become members of the default project
+	// with their global role, so nobody loses access
+	now := time.Now()
+	project := &Project{
+		ID:          uuid.New().String(),
+		Name:        DefaultProjectName,
+		Description: "Everything created before projects were introduced",
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(project).Error; err != nil {
+			return err
+		}
+
+		var users []User
+		if err := tx.Find(&users).Error; err != nil {
+			return err
+		}
+		for _, user := range users {
+			member := &ProjectMember{ProjectID: project.ID, UserID: user.ID, Role: user.Role, CreatedAt: now, UpdatedAt: now}
+			if err := tx.Create(member).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, table := range projectOwnedTables {
+			if err := tx.Exec("UPDATE "+table+" SET project_id = ? WHERE project_id IS NULL OR project_id = ''", project.ID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
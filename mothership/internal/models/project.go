@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DefaultProjectName is the project that owns everything created before projects existed
+const DefaultProjectName = "default"
+
+// Project groups jobs, datasets, files, secrets and dedicated runners of one team
+type Project struct {
+	ID          string         `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	Name        string         `gorm:"uniqueIndex;not null;type:varchar(255)" json:"name"`
+	Description string         `gorm:"type:text" json:"description"`
+	CreatedBy   string         `gorm:"type:varchar(36)" json:"created_by"`
+	CreatedAt   time.Time      `gorm:"not null" json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+func (Project) TableName() string {
+	return "projects"
+}
+
+// ProjectMember grants a user a role within a project. The role uses the same
+// names as global roles; a member holds a permission in the project only if
+// both their global role and their project role grant it.
+type ProjectMember struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ProjectID string    `gorm:"not null;type:varchar(36);uniqueIndex:idx_project_member" json:"project_id"`
+	UserID    string    `gorm:"not null;type:varchar(36);uniqueIndex:idx_project_member;index" json:"user_id"`
+	Role      string    `gorm:"not null;type:varchar(50)" json:"role"` // admin, operator, submitter, viewer
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+func (ProjectMember) TableName() string {
+	return "project_members"
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+// RateLimitBucket is a token bucket shared between mothership instances
+type RateLimitBucket struct {
+	Key       string    `gorm:"primaryKey;type:varchar(255)" json:"key"`
+	Tokens    float64   `gorm:"not null" json:"tokens"`
+	UpdatedAt time.Time `gorm:"not null;index" json:"updated_at"`
+}
+
+func (RateLimitBucket) TableName() string {
+	return "rate_limit_buckets"
+}
+
+// LoginFailure counts recent failed logins for a username or client IP
+type LoginFailure struct {
+	Key           string     `gorm:"primaryKey;type:varchar(255)" json:"key"`
+	Failures      int        `gorm:"not null;default:0" json:"failures"`
+	LastFailureAt time.Time  `gorm:"not null;index" json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+func (LoginFailure) TableName() string {
+	return "login_failures"
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"gorm.io/gorm"
@@ -32,6 +33,17 @@ type Runner struct {
 	ScreenFPS              float64   `gorm:"default:2.0" json:"screen_fps"` // Frames per second (0.5-10)
 	SelectedScreenIndex    int32     `gorm:"default:0" json:"selected_screen_index"` // Index of selected display (0 = primary)
 	Runtimes               string    `gorm:"type:jsonb" json:"runtimes"` // JSON array of runtime configurations
+	AgentVersion           string    `gorm:"type:varchar(50)" json:"agent_version"` // Reported in the agent WebSocket handshake
+	ProtocolVersion        int32     `gorm:"default:0" json:"protocol_version"` // Agent protocol version of the last connection, 0 before versioning
+	AgentFeatures          string    `gorm:"type:text" json:"agent_features"` // JSON array of features negotiated at registration and in the handshake
+	ProjectID              string    `gorm:"type:varchar(36);index" json:"project_id"` // Empty for shared runners, set for runners dedicated to a project
+	// Credentials
+	SecretHash             string     `gorm:"type:varchar(64);index" json:"-"` // SHA256 hash of the per-runner secret
+	EnrollmentTokenID      string     `gorm:"type:varchar(36);index" json:"enrollment_token_id"`
+	CredentialIssuedAt     *time.Time `json:"credential_issued_at"`
+	CredentialRevokedAt    *time.Time `json:"credential_revoked_at"`
+	CertificateSerial      string     `gorm:"type:varchar(64)" json:"-"` // Serial (hex) of the current client certificate; older certificates are rejected
+	CertificateExpiresAt   *time.Time `json:"certificate_expires_at"`
 	RegisteredAt           time.Time `gorm:"not null" json:"registered_at"`
 	LastHeartbeat    time.Time `gorm:"not null" json:"last_heartbeat"`
 	CreatedAt        time.Time `json:"created_at"`
@@ -45,3 +57,18 @@ func (Runner) TableName() string {
 	return "runners"
 }
 
+// RunnerFeatureSandbox is the agent feature of runners that can run sandboxed tasks
+const RunnerFeatureSandbox = "sandbox"
+
+// HasAgentFeature reports whether the runner's agent supports a feature
+func (r *Runner) HasAgentFeature(feature string) bool {
+	var features []string
+	json.Unmarshal([]byte(r.AgentFeatures), &features)
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+)
+
+// Secret is a named value that jobs inject into task environments. The value is
+// encrypted at rest and never returned by the API.
+type Secret struct {
+	ID          string    `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	ProjectID   string    `gorm:"type:varchar(36);uniqueIndex:idx_secret_project_name" json:"project_id"`
+	Name        string    `gorm:"not null;type:varchar(255);uniqueIndex:idx_secret_project_name" json:"name"` // Unique within the project
+	Description string    `gorm:"type:text" json:"description"`
+	Ciphertext  string    `gorm:"not null;type:text" json:"-"`
+	CreatedBy   string    `gorm:"type:varchar(36)" json:"created_by"`
+	UpdatedBy   string    `gorm:"type:varchar(36)" json:"updated_by"`
+	CreatedAt   time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (Secret) TableName() string {
+	return "secrets"
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+)
+
+// Session is a server-side login session. Access tokens reference it by ID and
+// stop working once it is revoked; the refresh token rotates on every use.
+type Session struct {
+	ID                       string     `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	UserID                   string     `gorm:"not null;type:varchar(36);index" json:"user_id"`
+	RefreshTokenHash         string     `gorm:"uniqueIndex;not null;type:varchar(64)" json:"-"`
+	PreviousRefreshTokenHash string     `gorm:"type:varchar(64);index" json:"-"` // Detects reuse of a rotated refresh token
+	UserAgent                string     `gorm:"type:varchar(500)" json:"user_agent"`
+	IPAddress                string     `gorm:"type:varchar(64)" json:"ip_address"`
+	ExpiresAt                time.Time  `gorm:"not null" json:"expires_at"`
+	LastUsedAt               *time.Time `json:"last_used_at"`
+	RevokedAt                *time.Time `json:"revoked_at"`
+	CreatedAt                time.Time  `gorm:"not null" json:"created_at"`
+	UpdatedAt                time.Time  `json:"updated_at"`
+}
+
+func (Session) TableName() string {
+	return "sessions"
+}
+
+// IsActive reports whether the session can still be used
+func (s *Session) IsActive(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
@@ -20,6 +20,10 @@ type Task struct {
 	IsDispatched  bool       `gorm:"default:false;index" json:"is_dispatched"` // Whether task has been dispatched to a runner
 	Result        string     `gorm:"type:jsonb" json:"result"`                  // JSON result data from processing
 	Reason        string     `gorm:"type:text" json:"reason"`                  // Failure reason when status is failed
+	PeakMemoryBytes int64    `gorm:"default:0" json:"peak_memory_bytes"`       // Resource usage, reported by runners that measure it
+	CPUTimeMs     int64      `gorm:"default:0" json:"cpu_time_ms"`
+	OOMKilled     bool       `gorm:"default:false" json:"oom_killed"`          // Killed for exceeding the job's memory limit
+	LimitsNotEnforced string `gorm:"type:text" json:"limits_not_enforced,omitempty"` // Why the runner could not enforce the job's limits
 	CreatedAt     time.Time  `gorm:"not null" json:"created_at"`
 	UpdatedAt     time.Time  `json:"updated_at"`
 	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
@@ -38,6 +42,7 @@ func (Task) TableName() string {
 type TaskLog struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
 	TaskID    string    `gorm:"not null;type:varchar(36);index" json:"task_id"`
+	Seq       int64     `gorm:"not null;default:0" json:"seq,omitempty"` // Chunk number reported by the runner; 0 for other entries
 	Level     string    `gorm:"not null;type:varchar(20);default:'info'" json:"level"` // stdout, stderr, info, error
 	Message   string    `gorm:"type:text" json:"message"`
 	Timestamp time.Time `gorm:"not null;index" json:"timestamp"`
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+)
+
+// TaskLogSegment indexes a block of archived task log entries. Old entries are moved
+// out of task_logs into gzip files, one gzip member per segment, so each segment can
+// be read on its own.
+type TaskLogSegment struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	TaskID       string    `gorm:"not null;type:varchar(36);index" json:"task_id"`
+	Path         string    `gorm:"not null;type:varchar(512)" json:"-"` // Archive file relative to the archive directory
+	Offset       int64     `gorm:"not null" json:"offset"`
+	Length       int64     `gorm:"not null" json:"length"` // Compressed size
+	Entries      int       `gorm:"not null" json:"entries"`
+	FirstLogID   uint      `gorm:"not null;index" json:"first_log_id"`
+	LastLogID    uint      `gorm:"not null" json:"last_log_id"`
+	MinTimestamp time.Time `gorm:"not null" json:"min_timestamp"`
+	MaxTimestamp time.Time `gorm:"not null" json:"max_timestamp"`
+	CreatedAt    time.Time `gorm:"not null" json:"created_at"`
+}
+
+func (TaskLogSegment) TableName() string {
+	return "task_log_segments"
+}
@@ -5,14 +5,19 @@ import (
 )
 
 type User struct {
-	ID           string    `gorm:"primaryKey;type:varchar(36)" json:"id"`
-	Username     string    `gorm:"uniqueIndex;not null;type:varchar(255)" json:"username"`
-	PasswordHash string    `gorm:"not null;type:varchar(255)" json:"-"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID                 string     `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	Username           string     `gorm:"uniqueIndex;not null;type:varchar(255)" json:"username"`
+	PasswordHash       string     `gorm:"not null;type:varchar(255)" json:"-"`                            // Empty for single sign-on users
+	AuthProvider       string     `gorm:"not null;type:varchar(50);default:'local'" json:"auth_provider"` // local, oidc
+	ExternalID         *string    `gorm:"uniqueIndex;type:varchar(512)" json:"-"`                         // Issuer and subject of single sign-on users
+	Role               string     `gorm:"not null;type:varchar(50);default:'viewer'" json:"role"`         // admin, operator, submitter, viewer
+	Disabled           bool       `gorm:"default:false" json:"disabled"`
+	MustChangePassword bool       `gorm:"default:false" json:"must_change_password"` // Set for bootstrap and admin-reset passwords
+	PasswordChangedAt  *time.Time `json:"password_changed_at"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
 }
 
 func (User) TableName() string {
 	return "users"
 }
-
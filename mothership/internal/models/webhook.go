@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is an HTTP endpoint that receives signed event notifications
+type Webhook struct {
+	ID        string    `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	ProjectID string    `gorm:"type:varchar(36);index" json:"project_id"` // Empty for webhooks receiving events of every project and shared runners
+	Name      string    `gorm:"not null;type:varchar(255)" json:"name"`
+	URL       string    `gorm:"not null;type:varchar(2048)" json:"url"`
+	Secret    string    `gorm:"not null;type:varchar(255)" json:"-"` // HMAC key deliveries are signed with
+	Events    string    `gorm:"type:jsonb" json:"events"`            // JSON array of event types, "*" or a prefix like "job.*"
+	Active    bool      `gorm:"not null;default:true" json:"active"`
+	CreatedBy string    `gorm:"type:varchar(36)" json:"created_by"`
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (Webhook) TableName() string {
+	return "webhooks"
+}
+
+// WebhookDelivery is one event sent to one webhook, with the outcome of its latest attempt
+type WebhookDelivery struct {
+	ID             string     `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	WebhookID      string     `gorm:"not null;type:varchar(36);index" json:"webhook_id"`
+	EventID        string     `gorm:"not null;type:varchar(36);index" json:"event_id"`
+	EventType      string     `gorm:"not null;type:varchar(100)" json:"event_type"`
+	Payload        string     `gorm:"not null;type:jsonb" json:"payload"`
+	RedeliveryOf   string     `gorm:"type:varchar(36)" json:"redelivery_of,omitempty"` // Delivery this one was manually resent from
+	Status         string     `gorm:"not null;type:varchar(20);index" json:"status"`
+	Attempts       int        `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt  *time.Time `gorm:"index" json:"next_attempt_at"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at"`
+	ResponseStatus int        `json:"response_status"`
+	Error          string     `gorm:"type:text" json:"error"`
+	DurationMs     int64      `json:"duration_ms"`
+	CreatedAt      time.Time  `gorm:"not null;index" json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+func (WebhookDelivery) TableName() string {
+	return "webhook_deliveries"
+}
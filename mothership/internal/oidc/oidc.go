@@ -0,0 +1,385 @@
+// Package oidc implements OpenID Connect authorization-code login with PKCE
+// for dashboard users.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"borg/mothership/internal/auth"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Config configures the identity provider used for single sign-on
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string   // Must point at /api/v1/auth/oidc/callback
+	Scopes       []string // Defaults to openid, profile, email, groups
+	GroupsClaim  string   // ID token claim holding group names, defaults to "groups"
+	RoleMapping  map[string]string
+	DefaultRole  string // Role for users without a mapped group, "" denies them
+}
+
+// ConfigFromEnv reads the OIDC configuration from OIDC_* environment variables.
+// It returns false if OIDC_ISSUER is not set.
+func ConfigFromEnv() (Config, bool) {
+	cfg := Config{
+		Issuer:       os.Getenv("OIDC_ISSUER"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		DefaultRole:  os.Getenv("OIDC_DEFAULT_ROLE"),
+		RoleMapping:  make(map[string]string),
+	}
+	if cfg.Issuer == "" {
+		return cfg, false
+	}
+
+	if scopes := os.Getenv("OIDC_SCOPES"); scopes != "" {
+		cfg.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+	}
+
+	// OIDC_ROLE_MAPPING=borg-admins=admin,borg-ops=operator
+	for _, pair := range strings.Split(os.Getenv("OIDC_ROLE_MAPPING"), ",") {
+		group, role, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && group != "" {
+			cfg.RoleMapping[group] = role
+		}
+	}
+
+	return cfg, true
+}
+
+// Validate checks that the configuration is complete
+func (c *Config) Validate() error {
+	if c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+		return errors.New("oidc: issuer, client ID and redirect URL are required")
+	}
+	for group, role := range c.RoleMapping {
+		if !auth.ValidRole(role) {
+			return fmt.Errorf("oidc: group %q maps to unknown role %q", group, role)
+		}
+	}
+	if c.DefaultRole != "" && !auth.ValidRole(c.DefaultRole) {
+		return fmt.Errorf("oidc: unknown default role %q", c.DefaultRole)
+	}
+	return nil
+}
+
+// discoveryDocument is the subset of the provider metadata that is used
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to an OpenID Connect identity provider
+type Provider struct {
+	cfg        Config
+	httpClient *http.Client
+	discovery  discoveryDocument
+
+	keysMu sync.RWMutex
+	keys   map[string]*rsa.PublicKey
+}
+
+// NewProvider fetches the provider's discovery document and returns a ready provider
+func NewProvider(ctx context.Context, cfg Config) (*Provider, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email", "groups"}
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+
+	p := &Provider{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		keys:       make(map[string]*rsa.PublicKey),
+	}
+
+	wellKnown := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &p.discovery); err != nil {
+		return nil, fmt.Errorf("oidc: discovery failed: %w", err)
+	}
+	if p.discovery.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("oidc: issuer mismatch: configured %q, provider reports %q", cfg.Issuer, p.discovery.Issuer)
+	}
+	if p.discovery.AuthorizationEndpoint == "" || p.discovery.TokenEndpoint == "" || p.discovery.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing endpoints")
+	}
+
+	return p, nil
+}
+
+// AuthCodeURL returns the URL to redirect the browser to, using the S256 PKCE challenge
+func (p *Provider) AuthCodeURL(state, nonce, codeChallenge string) string {
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(p.discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.discovery.AuthorizationEndpoint + sep + params.Encode()
+}
+
+// tokenResponse is the token endpoint response
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange redeems an authorization code and returns the raw ID token
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {codeVerifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("oidc: failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc: token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var token tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", fmt.Errorf("oidc: invalid token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return "", fmt.Errorf("oidc: token endpoint returned %d: %s %s", resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return "", errors.New("oidc: token response has no id_token")
+	}
+
+	return token.IDToken, nil
+}
+
+// Identity is the verified identity from an ID token
+type Identity struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	PreferredUsername string
+	Name              string
+	Groups            []string
+}
+
+// VerifyIDToken validates the signature, issuer, audience, expiry and nonce of an ID token
+func (p *Provider) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512"}),
+		jwt.WithIssuer(p.cfg.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid ID token: %w", err)
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce == "" || tokenNonce != nonce {
+		return nil, errors.New("oidc: ID token nonce mismatch")
+	}
+
+	identity := &Identity{Issuer: p.cfg.Issuer}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.PreferredUsername, _ = claims["preferred_username"].(string)
+	identity.Name, _ = claims["name"].(string)
+	if identity.Subject == "" {
+		return nil, errors.New("oidc: ID token has no subject")
+	}
+
+	switch groups := claims[p.cfg.GroupsClaim].(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if name, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	case string:
+		identity.Groups = []string{groups}
+	}
+
+	return identity, nil
+}
+
+// rolePriority orders roles from most to least privileged
+var rolePriority = []string{auth.RoleAdmin, auth.RoleOperator, auth.RoleSubmitter, auth.RoleViewer}
+
+// RoleForGroups returns the most privileged role mapped from the user's groups,
+// falling back to the default role. It returns false if the user gets no role.
+func (p *Provider) RoleForGroups(groups []string) (string, bool) {
+	mapped := make(map[string]bool)
+	for _, group := range groups {
+		if role, ok := p.cfg.RoleMapping[group]; ok {
+			mapped[role] = true
+		}
+	}
+	for _, role := range rolePriority {
+		if mapped[role] {
+			return role, true
+		}
+	}
+
+	if p.cfg.DefaultRole != "" {
+		return p.cfg.DefaultRole, true
+	}
+	return "", false
+}
+
+// publicKey returns the signing key with the given key ID, refreshing the JWKS once if it is unknown
+func (p *Provider) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	if key := p.cachedKey(kid); key != nil {
+		return key, nil
+	}
+	if err := p.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+	if key := p.cachedKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// cachedKey looks up a key by ID. An empty ID matches if the provider publishes a single key.
+func (p *Provider) cachedKey(kid string) *rsa.PublicKey {
+	p.keysMu.RLock()
+	defer p.keysMu.RUnlock()
+
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+// jsonWebKey is an RSA key from a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// refreshKeys fetches the provider's JWKS
+func (p *Provider) refreshKeys(ctx context.Context) error {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.discovery.JWKSURI, &jwks); err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	p.keysMu.Lock()
+	p.keys = keys
+	p.keysMu.Unlock()
+	return nil
+}
+
+// getJSON fetches a JSON document
+func (p *Provider) getJSON(ctx context.Context, rawURL string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", rawURL, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// RandomString returns a URL-safe random string, used for state, nonce and PKCE verifiers
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge returns the S256 PKCE challenge for a verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,400 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID     = "borg-dashboard"
+	testClientSecret = "s3cret"
+	testRedirectURL  = "http://borg.test/api/v1/auth/oidc/callback"
+)
+
+// mockProvider is an in-process OIDC provider that issues codes without user interaction
+type mockProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	// Claims added to issued ID tokens
+	subject string
+	groups  []string
+
+	mu    sync.Mutex
+	codes map[string]pendingCode
+
+	// Overrides for negative tests
+	nonceOverride string
+}
+
+type pendingCode struct {
+	challenge string
+	nonce     string
+	clientID  string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	m := &mockProvider{
+		t:       t,
+		key:     key,
+		kid:     "test-key",
+		subject: "user-123",
+		codes:   make(map[string]pendingCode),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.handleDiscovery)
+	mux.HandleFunc("/authorize", m.handleAuthorize)
+	mux.HandleFunc("/token", m.handleToken)
+	mux.HandleFunc("/jwks", m.handleJWKS)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+
+	return m
+}
+
+func (m *mockProvider) issuer() string {
+	return m.server.URL
+}
+
+func (m *mockProvider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 m.issuer(),
+		"authorization_endpoint": m.issuer() + "/authorize",
+		"token_endpoint":         m.issuer() + "/token",
+		"jwks_uri":               m.issuer() + "/jwks",
+	})
+}
+
+func (m *mockProvider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := "code-" + q.Get("state")
+	m.mu.Lock()
+	m.codes[code] = pendingCode{
+		challenge: q.Get("code_challenge"),
+		nonce:     q.Get("nonce"),
+		clientID:  q.Get("client_id"),
+	}
+	m.mu.Unlock()
+
+	redirect, _ := url.Parse(q.Get("redirect_uri"))
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (m *mockProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != testClientID || clientSecret != testClientSecret {
+		tokenError("invalid_client")
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError("invalid_request")
+		return
+	}
+
+	m.mu.Lock()
+	pending, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+	if !ok || pending.clientID != clientID {
+		tokenError("invalid_grant")
+		return
+	}
+	if CodeChallenge(r.PostForm.Get("code_verifier")) != pending.challenge {
+		tokenError("invalid_grant")
+		return
+	}
+
+	nonce := pending.nonce
+	if m.nonceOverride != "" {
+		nonce = m.nonceOverride
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                m.issuer(),
+		"sub":                m.subject,
+		"aud":                testClientID,
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              nonce,
+		"email":              "ada@example.com",
+		"preferred_username": "ada",
+		"groups":             m.groups,
+	})
+	token.Header["kid"] = m.kid
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		m.t.Errorf("failed to sign ID token: %v", err)
+		tokenError("server_error")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func (m *mockProvider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": m.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+func newTestProvider(t *testing.T, m *mockProvider) *Provider {
+	t.Helper()
+
+	p, err := NewProvider(context.Background(), Config{
+		Issuer:       m.issuer(),
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+		RoleMapping: map[string]string{
+			"borg-admins": "admin",
+			"borg-ops":    "operator",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	return p
+}
+
+// authorize follows the provider's authorization redirect and returns the code and state
+func authorize(t *testing.T, authURL string) (code, state string) {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %d, want 302", resp.StatusCode)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid redirect: %v", err)
+	}
+	if !strings.HasPrefix(location.String(), testRedirectURL) {
+		t.Fatalf("redirected to %s, want %s", location, testRedirectURL)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+// startLogin performs the steps of the login handler before the callback
+// and returns the authorization URL and the login cookie
+func startLogin(t *testing.T, p *Provider) (string, string) {
+	t.Helper()
+
+	state, _ := RandomString()
+	nonce, _ := RandomString()
+	verifier, _ := RandomString()
+	cookie, err := EncodeLoginState(LoginState{State: state, Nonce: nonce, CodeVerifier: verifier})
+	if err != nil {
+		t.Fatalf("EncodeLoginState: %v", err)
+	}
+
+	return p.AuthCodeURL(state, nonce, CodeChallenge(verifier)), cookie
+}
+
+func TestAuthorizationCodeFlowWithPKCE(t *testing.T) {
+	m := newMockProvider(t)
+	m.groups = []string{"engineering", "borg-ops"}
+	p := newTestProvider(t, m)
+	authURL, cookie := startLogin(t, p)
+
+	code, state := authorize(t, authURL)
+
+	login, ok := DecodeLoginState(cookie, state)
+	if !ok {
+		t.Fatal("login cookie rejected for its own state")
+	}
+
+	idToken, err := p.Exchange(context.Background(), code, login.CodeVerifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	identity, err := p.VerifyIDToken(context.Background(), idToken, login.Nonce)
+	if err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+	if identity.Subject != "user-123" || identity.PreferredUsername != "ada" || identity.Email != "ada@example.com" {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+	if identity.Issuer != m.issuer() {
+		t.Fatalf("issuer = %q, want %q", identity.Issuer, m.issuer())
+	}
+
+	role, ok := p.RoleForGroups(identity.Groups)
+	if !ok || role != "operator" {
+		t.Fatalf("RoleForGroups(%v) = %q, %v; want operator", identity.Groups, role, ok)
+	}
+}
+
+func TestLoginStateIsBoundToCookie(t *testing.T) {
+	m := newMockProvider(t)
+	p := newTestProvider(t, m)
+
+	// An attacker's callback URL carries a state the victim's browser never started
+	victimURL, victimCookie := startLogin(t, p)
+	_, victimState := authorize(t, victimURL)
+	attackerURL, _ := startLogin(t, p)
+	_, attackerState := authorize(t, attackerURL)
+
+	if _, ok := DecodeLoginState(victimCookie, attackerState); ok {
+		t.Fatal("login cookie accepted for another login's state")
+	}
+	if _, ok := DecodeLoginState("", attackerState); ok {
+		t.Fatal("callback accepted without a login cookie")
+	}
+	if _, ok := DecodeLoginState(victimCookie+"x", victimState); ok {
+		t.Fatal("tampered login cookie accepted")
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	m := newMockProvider(t)
+	p := newTestProvider(t, m)
+	authURL, _ := startLogin(t, p)
+
+	code, _ := authorize(t, authURL)
+
+	if _, err := p.Exchange(context.Background(), code, "not-the-verifier"); err == nil {
+		t.Fatal("Exchange succeeded with a wrong PKCE verifier")
+	}
+}
+
+func TestVerifyIDTokenRejectsNonceMismatch(t *testing.T) {
+	m := newMockProvider(t)
+	m.nonceOverride = "replayed-nonce"
+	p := newTestProvider(t, m)
+	authURL, cookie := startLogin(t, p)
+
+	code, state := authorize(t, authURL)
+	login, _ := DecodeLoginState(cookie, state)
+
+	idToken, err := p.Exchange(context.Background(), code, login.CodeVerifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if _, err := p.VerifyIDToken(context.Background(), idToken, login.Nonce); err == nil {
+		t.Fatal("VerifyIDToken accepted a token with a different nonce")
+	}
+}
+
+func TestVerifyIDTokenRejectsForeignSignature(t *testing.T) {
+	m := newMockProvider(t)
+	p := newTestProvider(t, m)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   m.issuer(),
+		"sub":   "attacker",
+		"aud":   testClientID,
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": "n",
+	})
+	token.Header["kid"] = m.kid
+	forged, _ := token.SignedString(otherKey)
+
+	if _, err := p.VerifyIDToken(context.Background(), forged, "n"); err == nil {
+		t.Fatal("VerifyIDToken accepted a token signed with an unknown key")
+	}
+}
+
+func TestRoleForGroups(t *testing.T) {
+	p := &Provider{cfg: Config{RoleMapping: map[string]string{
+		"borg-admins": "admin",
+		"borg-ops":    "operator",
+		"staff":       "viewer",
+	}}}
+
+	tests := []struct {
+		groups []string
+		want   string
+		ok     bool
+	}{
+		{[]string{"staff", "borg-admins"}, "admin", true},
+		{[]string{"staff"}, "viewer", true},
+		{[]string{"unmapped"}, "", false},
+		{nil, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := p.RoleForGroups(tt.groups)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("RoleForGroups(%v) = %q, %v; want %q, %v", tt.groups, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	p.cfg.DefaultRole = "viewer"
+	if got, ok := p.RoleForGroups([]string{"unmapped"}); got != "viewer" || !ok {
+		t.Errorf("RoleForGroups with default role = %q, %v; want viewer, true", got, ok)
+	}
+}
+
+func TestNewProviderRejectsIssuerMismatch(t *testing.T) {
+	m := newMockProvider(t)
+
+	_, err := NewProvider(context.Background(), Config{
+		Issuer:      m.issuer() + "/",
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+	})
+	if err == nil {
+		t.Fatal("NewProvider accepted a discovery document for a different issuer")
+	}
+}
@@ -0,0 +1,41 @@
+package oidc
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"borg/mothership/internal/auth"
+)
+
+// LoginStateTTL bounds how long a user may take at the identity provider
+const LoginStateTTL = 10 * time.Minute
+
+// LoginState is kept between redirecting to the provider and handling the callback.
+// It travels in a signed cookie, so the callback only succeeds in the browser that
+// started the login and on any mothership instance.
+type LoginState struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+// EncodeLoginState signs a pending login for the login cookie
+func EncodeLoginState(login LoginState) (string, error) {
+	return auth.GenerateLoginStateToken(login.State, login.Nonce, login.CodeVerifier, LoginStateTTL)
+}
+
+// DecodeLoginState verifies a login cookie and returns its pending login if it was
+// issued for the OAuth state parameter of the callback
+func DecodeLoginState(cookie, state string) (LoginState, bool) {
+	if cookie == "" || state == "" {
+		return LoginState{}, false
+	}
+	claims, err := auth.ValidateLoginStateToken(cookie)
+	if err != nil {
+		return LoginState{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.State), []byte(state)) != 1 {
+		return LoginState{}, false
+	}
+	return LoginState{State: claims.State, Nonce: claims.Nonce, CodeVerifier: claims.CodeVerifier}, true
+}
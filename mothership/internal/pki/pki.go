@@ -0,0 +1,315 @@
+// Package pki runs the small internal certificate authority that issues runner
+// client certificates for mutual TLS, and builds the server's TLS configuration.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Runner certificate modes
+const (
+	MTLSOff      = "off"      // Runners authenticate with their secret only
+	MTLSOptional = "optional" // Runners get certificates; secrets are still accepted
+	MTLSRequired = "required" // Runner endpoints reject requests without a valid certificate
+)
+
+const (
+	caCertFile     = "ca.crt"
+	caKeyFile      = "ca.key"
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 365 * 24 * time.Hour
+	// clockSkew backdates certificates so hosts with slightly wrong clocks accept them
+	clockSkew = 5 * time.Minute
+)
+
+// Config holds the TLS settings of the mothership
+type Config struct {
+	Dir           string        // Where the internal CA is kept
+	CertFile      string        // Server certificate; with KeyFile enables HTTPS
+	KeyFile       string        //
+	Hosts         []string      // Issue the server certificate from the internal CA for these names instead
+	RunnerMTLS    string        // off, optional or required
+	RunnerCertTTL time.Duration // Lifetime of runner certificates
+}
+
+// ConfigFromEnv reads PKI_DIR, TLS_CERT_FILE, TLS_KEY_FILE, TLS_HOSTS, RUNNER_MTLS and RUNNER_CERT_TTL
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Dir:           os.Getenv("PKI_DIR"),
+		CertFile:      os.Getenv("TLS_CERT_FILE"),
+		KeyFile:       os.Getenv("TLS_KEY_FILE"),
+		RunnerMTLS:    strings.ToLower(os.Getenv("RUNNER_MTLS")),
+		RunnerCertTTL: 30 * 24 * time.Hour,
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = "./pki"
+	}
+	if cfg.RunnerMTLS == "" {
+		cfg.RunnerMTLS = MTLSOff
+	}
+	for _, host := range strings.Split(os.Getenv("TLS_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			cfg.Hosts = append(cfg.Hosts, host)
+		}
+	}
+	if ttl := os.Getenv("RUNNER_CERT_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d < time.Hour {
+			return cfg, fmt.Errorf("RUNNER_CERT_TTL must be a duration of at least 1h, got %q", ttl)
+		}
+		cfg.RunnerCertTTL = d
+	}
+
+	switch {
+	case cfg.RunnerMTLS != MTLSOff && cfg.RunnerMTLS != MTLSOptional && cfg.RunnerMTLS != MTLSRequired:
+		return cfg, fmt.Errorf("RUNNER_MTLS must be off, optional or required, got %q", cfg.RunnerMTLS)
+	case (cfg.CertFile == "") != (cfg.KeyFile == ""):
+		return cfg, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	case cfg.RunnerMTLS != MTLSOff && !cfg.TLSEnabled():
+		return cfg, errors.New("RUNNER_MTLS requires TLS, set TLS_CERT_FILE/TLS_KEY_FILE or TLS_HOSTS")
+	}
+	return cfg, nil
+}
+
+// TLSEnabled reports whether the mothership serves HTTPS
+func (c Config) TLSEnabled() bool {
+	return c.CertFile != "" || len(c.Hosts) > 0
+}
+
+// NeedsCA reports whether the internal CA is used
+func (c Config) NeedsCA() bool {
+	return c.RunnerMTLS != MTLSOff || (c.CertFile == "" && len(c.Hosts) > 0)
+}
+
+// CA is the internal certificate authority
+type CA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+}
+
+// LoadOrCreateCA loads the CA from dir, creating a new one on first use.
+// The private key is written with owner-only permissions.
+func LoadOrCreateCA(dir string) (*CA, error) {
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if certErr == nil && keyErr == nil {
+		return parseCA(certPEM, keyPEM)
+	}
+	if !os.IsNotExist(certErr) || !os.IsNotExist(keyErr) {
+		return nil, fmt.Errorf("pki: incomplete CA in %s, expected both %s and %s", dir, caCertFile, caKeyFile)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "borg internal CA", Organization: []string{"borg"}},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("pki: failed to create %s: %w", dir, err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("pki: failed to write CA key: %w", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return nil, fmt.Errorf("pki: failed to write CA certificate: %w", err)
+	}
+	return parseCA(certPEM, keyPEM)
+}
+
+func parseCA(certPEM, keyPEM []byte) (*CA, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, errors.New("pki: invalid CA certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("pki: invalid CA certificate: %w", err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("pki: invalid CA key PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("pki: invalid CA key: %w", err)
+	}
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("pki: CA key cannot sign")
+	}
+	return &CA{cert: cert, key: key, certPEM: certPEM}, nil
+}
+
+// CertPEM returns the CA certificate runners and clients should trust
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// Pool returns a pool containing only the CA certificate
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// IssuedCertificate is a certificate signed by the CA
+type IssuedCertificate struct {
+	CertPEM  []byte
+	Serial   string // Hex encoded
+	NotAfter time.Time
+}
+
+// SignRunnerCSR issues a client certificate for a runner. The runner ID becomes the
+// common name; the key stays on the runner, only its public half is in the CSR.
+func (ca *CA) SignRunnerCSR(csrPEM []byte, runnerID string, ttl time.Duration) (*IssuedCertificate, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("invalid certificate signing request PEM")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate signing request: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate signing request signature: %w", err)
+	}
+
+	now := time.Now()
+	return ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: runnerID, Organization: []string{"borg runners"}},
+		NotBefore:   now.Add(-clockSkew),
+		NotAfter:    now.Add(ttl),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, csr.PublicKey)
+}
+
+// ServerCertificate issues a serving certificate for the given host names and IP addresses
+func (ca *CA) ServerCertificate(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: hosts[0], Organization: []string{"borg"}},
+		NotBefore:   now.Add(-clockSkew),
+		NotAfter:    now.Add(serverValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	issued, err := ca.issue(template, key.Public())
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(issued.CertPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+func (ca *CA) issue(template *x509.Certificate, pub crypto.PublicKey) (*IssuedCertificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("pki: failed to sign certificate: %w", err)
+	}
+	return &IssuedCertificate{
+		CertPEM:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Serial:   serial.Text(16),
+		NotAfter: template.NotAfter,
+	}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// SerialHex formats a certificate serial the way IssuedCertificate does
+func SerialHex(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+// ServerTLSConfig builds the TLS configuration of the HTTP server. With a CA, client
+// certificates signed by it are verified when presented; browsers connect without one.
+func ServerTLSConfig(cfg Config, ca *CA) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if cfg.CertFile != "" {
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	} else {
+		cert, err = ca.ServerCertificate(cfg.Hosts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pki: failed to load server certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if ca != nil && cfg.RunnerMTLS != MTLSOff {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = ca.Pool()
+	}
+	return tlsConfig, nil
+}
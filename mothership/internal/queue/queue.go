@@ -5,22 +5,82 @@ import (
 	"fmt"
 	"time"
 
+	"borg/mothership/internal/events"
 	"borg/mothership/internal/models"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Queue manages job queue and task distribution
 type Queue struct {
-	db *gorm.DB
+	db     *gorm.DB
+	events *events.Bus // nil discards state change events
 }
 
+// terminalStatuses are the statuses a job or task never leaves
+var terminalStatuses = []string{"completed", "failed", "cancelled"}
+
 // NewQueue creates a new queue instance
 func NewQueue(db *gorm.DB) *Queue {
 	return &Queue{db: db}
 }
 
+// SetEvents publishes job and task state changes to bus
+func (q *Queue) SetEvents(bus *events.Bus) {
+	q.events = bus
+}
+
+// JobEventData describes a job in event payloads
+func JobEventData(job *models.Job) map[string]interface{} {
+	return map[string]interface{}{
+		"job_id":     job.ID,
+		"name":       job.Name,
+		"type":       job.Type,
+		"status":     job.Status,
+		"created_by": job.CreatedBy,
+	}
+}
+
+// publishJob publishes a job event, loading the job for its payload
+func (q *Queue) publishJob(t events.Type, jobID string) {
+	if q.events == nil {
+		return
+	}
+	var job models.Job
+	if err := q.db.Unscoped().First(&job, "id = ?", jobID).Error; err != nil {
+		return
+	}
+	q.events.Publish(t, job.ProjectID, JobEventData(&job))
+}
+
+// TaskEventData describes a task in event payloads
+func TaskEventData(task *models.Task) map[string]interface{} {
+	return map[string]interface{}{
+		"task_id":       task.ID,
+		"job_id":        task.JobID,
+		"runner_id":     task.RunnerID,
+		"status":        task.Status,
+		"retry_count":   task.RetryCount,
+		"exit_code":     task.ExitCode,
+		"error_message": task.ErrorMessage,
+		"oom_killed":    task.OOMKilled,
+	}
+}
+
+// publishTasks publishes an event for each of a job's tasks
+func (q *Queue) publishTasks(t events.Type, tasks ...models.Task) {
+	if q.events == nil || len(tasks) == 0 {
+		return
+	}
+	var job models.Job
+	q.db.Unscoped().Select("id", "project_id").First(&job, "id = ?", tasks[0].JobID)
+	for i := range tasks {
+		q.events.Publish(t, job.ProjectID, TaskEventData(&tasks[i]))
+	}
+}
+
 // EnqueueJob creates a new job and initial task
 func (q *Queue) EnqueueJob(job *models.Job) error {
 	job.ID = uuid.New().String()
@@ -46,6 +106,8 @@ func (q *Queue) EnqueueJob(job *models.Job) error {
 		return fmt.Errorf("failed to create task: %w", err)
 	}
 
+	q.events.Publish(events.JobCreated, job.ProjectID, JobEventData(job))
+	q.publishTasks(events.TaskQueued, *task)
 	return nil
 }
 
@@ -53,12 +115,26 @@ func (q *Queue) EnqueueJob(job *models.Job) error {
 func (q *Queue) GetNextTask(runnerID string, runnerCapabilities map[string]interface{}) (*models.Task, error) {
 	var task models.Task
 
+	// Runners dedicated to a project only run that project's jobs
+	var runner models.Runner
+	if err := q.db.Select("id", "project_id", "agent_features").First(&runner, "id = ?", runnerID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load runner: %w", err)
+	}
+
 	// Find pending task from a pending or running job, ordered by creation time
 	// Only assign tasks from jobs that are pending or running (not paused, cancelled, etc.)
 	// Use a subquery to filter by job status
+	jobs := q.db.Model(&models.Job{}).Select("id").Where("status IN ?", []string{"pending", "running"})
+	if runner.ProjectID != "" {
+		jobs = jobs.Where("project_id = ?", runner.ProjectID)
+	}
+	// Agents that cannot sandbox would fail or, if older, run the task unconfined
+	if !runner.HasAgentFeature(models.RunnerFeatureSandbox) {
+		jobs = jobs.Where("sandbox_enabled = ?", false)
+	}
 	query := q.db.
 		Where("status = ?", "pending").
-		Where("job_id IN (SELECT id FROM jobs WHERE status IN (?))", []string{"pending", "running"}).
+		Where("job_id IN (?)", jobs).
 		Order("created_at ASC").
 		First(&task)
 
@@ -85,9 +161,15 @@ func (q *Queue) GetNextTask(runnerID string, runnerCapabilities map[string]inter
 	if err := q.db.Save(&task).Error; err != nil {
 		return nil, fmt.Errorf("failed to lock task: %w", err)
 	}
+	if q.events != nil {
+		q.events.Publish(events.TaskStarted, task.Job.ProjectID, TaskEventData(&task))
+	}
 
-	// Update job status
-	q.db.Model(&models.Job{}).Where("id = ?", task.JobID).Update("status", "running")
+	// Update job status; the first task of a job starts it
+	started := q.db.Model(&models.Job{}).Where("id = ? AND status = ?", task.JobID, "pending").Update("status", "running")
+	if started.Error == nil && started.RowsAffected > 0 {
+		q.publishJob(events.JobStarted, task.JobID)
+	}
 
 	return &task, nil
 }
@@ -100,6 +182,7 @@ func (q *Queue) UpdateTaskStatus(taskID string, status string, exitCode *int32,
 	}
 
 	now := time.Now()
+	previous := task.Status
 	task.Status = status
 	task.ExitCode = exitCode
 	task.ErrorMessage = errorMessage
@@ -113,11 +196,23 @@ func (q *Queue) UpdateTaskStatus(taskID string, status string, exitCode *int32,
 		return fmt.Errorf("failed to update task: %w", err)
 	}
 
+	// Failures are published below with the retry decision. Finished tasks are
+	// published even when they already had the status, since results are saved first.
+	if status != "failed" && (status != previous || task.CompletedAt != nil) {
+		q.publishTasks(events.TaskStatusType(status), task)
+	}
+
 	// Handle retries
 	if status == "failed" {
 		var job models.Job
 		if err := q.db.First(&job, "id = ?", task.JobID).Error; err == nil {
-			if task.RetryCount < job.MaxRetries {
+			willRetry := task.RetryCount < job.MaxRetries
+			data := TaskEventData(&task)
+			data["job_name"] = job.Name
+			data["will_retry"] = willRetry
+			q.events.Publish(events.TaskFailed, job.ProjectID, data)
+
+			if willRetry {
 				// Create new task for retry
 				newTask := &models.Task{
 					ID:         uuid.New().String(),
@@ -130,17 +225,24 @@ func (q *Queue) UpdateTaskStatus(taskID string, status string, exitCode *int32,
 				if err := q.db.Create(newTask).Error; err != nil {
 					return fmt.Errorf("failed to create retry task: %w", err)
 				}
+				q.publishTasks(events.TaskQueued, *newTask)
 			} else {
 				// Max retries reached, mark job as failed
-				q.db.Model(&job).Update("status", "failed")
+				failed := q.db.Model(&models.Job{}).Where("id = ? AND status NOT IN ?", job.ID, terminalStatuses).Update("status", "failed")
+				if failed.Error == nil && failed.RowsAffected > 0 {
+					q.publishJob(events.JobFailed, job.ID)
+				}
 			}
 		}
 	} else if status == "completed" {
 		// Check if all tasks for this job are completed
 		var count int64
-		q.db.Model(&models.Task{}).Where("job_id = ? AND status NOT IN (?)", task.JobID, []string{"completed", "failed", "cancelled"}).Count(&count)
+		q.db.Model(&models.Task{}).Where("job_id = ? AND status NOT IN (?)", task.JobID, terminalStatuses).Count(&count)
 		if count == 0 {
-			q.db.Model(&models.Job{}).Where("id = ?", task.JobID).Update("status", "completed")
+			completed := q.db.Model(&models.Job{}).Where("id = ? AND status NOT IN ?", task.JobID, terminalStatuses).Update("status", "completed")
+			if completed.Error == nil && completed.RowsAffected > 0 {
+				q.publishJob(events.JobCompleted, task.JobID)
+			}
 		}
 	}
 
@@ -155,20 +257,27 @@ func (q *Queue) PauseJob(jobID string) error {
 	}
 
 	// Update running tasks to paused
-	if err := q.db.Model(&models.Task{}).
+	var paused []models.Task
+	if err := q.db.Model(&paused).Clauses(clause.Returning{}).
 		Where("job_id = ? AND status = ?", jobID, "running").
 		Update("status", "paused").Error; err != nil {
 		return fmt.Errorf("failed to pause tasks: %w", err)
 	}
 
+	q.publishJob(events.JobPaused, jobID)
+	q.publishTasks(events.TaskPaused, paused...)
 	return nil
 }
 
 // ResumeJob resumes a paused job
 func (q *Queue) ResumeJob(jobID string) error {
 	// Update job status
-	if err := q.db.Model(&models.Job{}).Where("id = ? AND status = ?", jobID, "paused").Update("status", "pending").Error; err != nil {
-		return fmt.Errorf("failed to resume job: %w", err)
+	resumed := q.db.Model(&models.Job{}).Where("id = ? AND status = ?", jobID, "paused").Update("status", "pending")
+	if resumed.Error != nil {
+		return fmt.Errorf("failed to resume job: %w", resumed.Error)
+	}
+	if resumed.RowsAffected > 0 {
+		q.publishJob(events.JobResumed, jobID)
 	}
 
 	// Create new tasks for paused tasks
@@ -190,9 +299,12 @@ func (q *Queue) ResumeJob(jobID string) error {
 		if err := q.db.Create(newTask).Error; err != nil {
 			return fmt.Errorf("failed to create resumed task: %w", err)
 		}
+		q.publishTasks(events.TaskQueued, *newTask)
 
 		// Mark old task as cancelled
 		q.db.Model(&task).Update("status", "cancelled")
+		task.Status = "cancelled"
+		q.publishTasks(events.TaskCancelled, task)
 	}
 
 	return nil
@@ -201,14 +313,16 @@ func (q *Queue) ResumeJob(jobID string) error {
 // CancelJob cancels a job and all its tasks
 func (q *Queue) CancelJob(jobID string) error {
 	// Update job status
-	if err := q.db.Model(&models.Job{}).Where("id = ?", jobID).Update("status", "cancelled").Error; err != nil {
-		return fmt.Errorf("failed to cancel job: %w", err)
+	cancelled := q.db.Model(&models.Job{}).Where("id = ? AND status NOT IN ?", jobID, terminalStatuses).Update("status", "cancelled")
+	if cancelled.Error != nil {
+		return fmt.Errorf("failed to cancel job: %w", cancelled.Error)
 	}
 
 	// Update all non-terminal tasks to cancelled
 	now := time.Now()
-	if err := q.db.Model(&models.Task{}).
-		Where("job_id = ? AND status NOT IN (?)", jobID, []string{"completed", "failed", "cancelled"}).
+	var cancelledTasks []models.Task
+	if err := q.db.Model(&cancelledTasks).Clauses(clause.Returning{}).
+		Where("job_id = ? AND status NOT IN (?)", jobID, terminalStatuses).
 		Updates(map[string]interface{}{
 			"status":       "cancelled",
 			"completed_at": now,
@@ -217,6 +331,10 @@ func (q *Queue) CancelJob(jobID string) error {
 		return fmt.Errorf("failed to cancel tasks: %w", err)
 	}
 
+	if cancelled.RowsAffected > 0 {
+		q.publishJob(events.JobCancelled, jobID)
+	}
+	q.publishTasks(events.TaskCancelled, cancelledTasks...)
 	return nil
 }
 
@@ -230,7 +348,7 @@ func (q *Queue) GetJob(jobID string) (*models.Job, error) {
 }
 
 // ListJobs returns a list of jobs with pagination
-func (q *Queue) ListJobs(limit, offset int, status string) ([]models.Job, int64, error) {
+func (q *Queue) ListJobs(limit, offset int, status string, projectIDs []string) ([]models.Job, int64, error) {
 	var jobs []models.Job
 	var total int64
 
@@ -238,6 +356,9 @@ func (q *Queue) ListJobs(limit, offset int, status string) ([]models.Job, int64,
 	if status != "" {
 		query = query.Where("status = ?", status)
 	}
+	if projectIDs != nil {
+		query = query.Where("project_id IN ?", projectIDs)
+	}
 
 	if err := query.Count(&total).Error; err != nil {
 		return nil, 0, fmt.Errorf("failed to count jobs: %w", err)
@@ -251,7 +372,7 @@ func (q *Queue) ListJobs(limit, offset int, status string) ([]models.Job, int64,
 }
 
 // GetStats returns queue statistics
-func (q *Queue) GetStats(ctx context.Context) (map[string]interface{}, error) {
+func (q *Queue) GetStats(ctx context.Context, projectIDs []string) (map[string]interface{}, error) {
 	stats := make(map[string]interface{})
 
 	// Count jobs by status
@@ -259,7 +380,11 @@ func (q *Queue) GetStats(ctx context.Context) (map[string]interface{}, error) {
 	statuses := []string{"pending", "running", "paused", "completed", "failed", "cancelled"}
 	for _, status := range statuses {
 		var count int64
-		q.db.Model(&models.Job{}).Where("status = ?", status).Count(&count)
+		query := q.db.Model(&models.Job{}).Where("status = ?", status)
+		if projectIDs != nil {
+			query = query.Where("project_id IN ?", projectIDs)
+		}
+		query.Count(&count)
 		jobCounts[status] = count
 	}
 	stats["jobs"] = jobCounts
@@ -268,7 +393,11 @@ func (q *Queue) GetStats(ctx context.Context) (map[string]interface{}, error) {
 	taskCounts := make(map[string]int64)
 	for _, status := range statuses {
 		var count int64
-		q.db.Model(&models.Task{}).Where("status = ?", status).Count(&count)
+		query := q.db.Model(&models.Task{}).Where("status = ?", status)
+		if projectIDs != nil {
+			query = query.Where("job_id IN (?)", q.db.Model(&models.Job{}).Select("id").Where("project_id IN ?", projectIDs))
+		}
+		query.Count(&count)
 		taskCounts[status] = count
 	}
 	stats["tasks"] = taskCounts
@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often idle entries are dropped from the memory store
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+	window      time.Duration
+}
+
+// MemoryStore keeps state in process memory, for a single mothership instance
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	failures  map[string]*failures
+	lastSweep time.Time
+}
+
+// NewMemoryStore creates an empty memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   make(map[string]*bucket),
+		failures:  make(map[string]*failures),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take implements Store
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+
+	var result Result
+	b.tokens, result = take(b.tokens, b.updated, now, limit)
+	b.updated = now
+	b.limit = limit
+	return result, nil
+}
+
+// RecordFailure implements Store
+func (s *MemoryStore) RecordFailure(ctx context.Context, key string, policy LockoutPolicy) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	f, ok := s.failures[key]
+	if !ok || now.Sub(f.last) > policy.Window {
+		f = &failures{}
+		s.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	f.window = policy.Window
+	if d := policy.lockout(f.count); d > 0 {
+		f.lockedUntil = now.Add(d)
+	}
+	return f.lockedUntil, nil
+}
+
+// LockedUntil implements Store
+func (s *MemoryStore) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.failures[key]; ok && time.Now().Before(f.lockedUntil) {
+		return f.lockedUntil, nil
+	}
+	return time.Time{}, nil
+}
+
+// Reset implements Store
+func (s *MemoryStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, key)
+	return nil
+}
+
+// sweep drops full buckets and expired failures. Must be called with mu held.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for key, b := range s.buckets {
+		refill := time.Duration((float64(b.limit.Burst) - b.tokens) / b.limit.Rate * float64(time.Second))
+		if now.Sub(b.updated) >= refill {
+			delete(s.buckets, key)
+		}
+	}
+	for key, f := range s.failures {
+		if now.Sub(f.last) > f.window && now.After(f.lockedUntil) {
+			delete(s.failures, key)
+		}
+	}
+}
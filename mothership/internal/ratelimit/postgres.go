@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"borg/mothership/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// pruneInterval is how often idle rows are deleted from Postgres
+const pruneInterval = 10 * time.Minute
+
+// idleBucketTTL is how long an unused bucket row is kept. Buckets of the
+// configured limits are full again long before this.
+const idleBucketTTL = time.Hour
+
+// PostgresStore keeps state in Postgres so limits are shared between mothership instances.
+// Row locks serialize concurrent updates of the same key.
+type PostgresStore struct {
+	db *gorm.DB
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+// NewPostgresStore creates a store on the rate_limit_buckets and login_failures tables
+func NewPostgresStore(db *gorm.DB) *PostgresStore {
+	return &PostgresStore{db: db, lastPrune: time.Now()}
+}
+
+// Take implements Store
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.prune(ctx)
+
+	var result Result
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		row := models.RateLimitBucket{Key: key, Tokens: float64(limit.Burst), UpdatedAt: now}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&row, "key = ?", key).Error; err != nil {
+			return err
+		}
+
+		var tokens float64
+		tokens, result = take(row.Tokens, row.UpdatedAt, now, limit)
+		return tx.Model(&models.RateLimitBucket{}).Where("key = ?", key).
+			Updates(map[string]interface{}{"tokens": tokens, "updated_at": now}).Error
+	})
+	return result, err
+}
+
+// RecordFailure implements Store
+func (s *PostgresStore) RecordFailure(ctx context.Context, key string, policy LockoutPolicy) (time.Time, error) {
+	var lockedUntil time.Time
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		row := models.LoginFailure{Key: key, LastFailureAt: now}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&row, "key = ?", key).Error; err != nil {
+			return err
+		}
+
+		if now.Sub(row.LastFailureAt) > policy.Window {
+			row.Failures = 0
+			row.LockedUntil = nil
+		}
+		row.Failures++
+		row.LastFailureAt = now
+		if d := policy.lockout(row.Failures); d > 0 {
+			until := now.Add(d)
+			row.LockedUntil = &until
+		}
+		if row.LockedUntil != nil {
+			lockedUntil = *row.LockedUntil
+		}
+		return tx.Save(&row).Error
+	})
+	return lockedUntil, err
+}
+
+// LockedUntil implements Store
+func (s *PostgresStore) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	var rows []models.LoginFailure
+	if err := s.db.WithContext(ctx).Where("key = ? AND locked_until > ?", key, time.Now()).Limit(1).Find(&rows).Error; err != nil {
+		return time.Time{}, err
+	}
+	if len(rows) == 0 || rows[0].LockedUntil == nil {
+		return time.Time{}, nil
+	}
+	return *rows[0].LockedUntil, nil
+}
+
+// Reset implements Store
+func (s *PostgresStore) Reset(ctx context.Context, key string) error {
+	return s.db.WithContext(ctx).Where("key = ?", key).Delete(&models.LoginFailure{}).Error
+}
+
+// prune deletes idle buckets and old failures every pruneInterval
+func (s *PostgresStore) prune(ctx context.Context) {
+	s.mu.Lock()
+	now := time.Now()
+	if now.Sub(s.lastPrune) < pruneInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPrune = now
+	s.mu.Unlock()
+
+	db := s.db.WithContext(ctx)
+	db.Where("updated_at < ?", now.Add(-idleBucketTTL)).Delete(&models.RateLimitBucket{})
+	db.Where("last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)", now.Add(-idleBucketTTL), now).Delete(&models.LoginFailure{})
+}
@@ -0,0 +1,248 @@
+// Package ratelimit implements token-bucket rate limits and login lockouts
+// backed by process memory or, for several mothership instances, Postgres.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a token bucket that refills Rate tokens per second up to Burst.
+// The zero Limit is unlimited.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Unlimited reports whether the limit is disabled
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// String describes the limit for logs
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "off"
+	}
+	return fmt.Sprintf("%g/s:%d", l.Rate, l.Burst)
+}
+
+// ParseLimit reads "N/unit" or "N/unit:burst" where unit is s, m or h, e.g. "600/m".
+// The burst defaults to N. "off" or "0" disables the limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "off" || s == "0" {
+		return Limit{}, nil
+	}
+
+	spec, burstStr, hasBurst := strings.Cut(s, ":")
+	countStr, unit, ok := strings.Cut(spec, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, expected N/unit", s)
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count < 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: bad count", s)
+	}
+
+	var period time.Duration
+	switch unit {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		return Limit{}, fmt.Errorf("invalid rate limit %q: unit must be s, m or h", s)
+	}
+
+	burst := count
+	if hasBurst {
+		burst, err = strconv.Atoi(burstStr)
+		if err != nil || burst < 0 {
+			return Limit{}, fmt.Errorf("invalid rate limit %q: bad burst", s)
+		}
+	}
+	return Limit{Rate: float64(count) / period.Seconds(), Burst: burst}, nil
+}
+
+// Result is the outcome of taking a token
+type Result struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // Set when not allowed
+}
+
+// take refills a bucket holding tokens since last and takes one token from it
+func take(tokens float64, last, now time.Time, limit Limit) (float64, Result) {
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens += elapsed * limit.Rate
+	}
+	tokens = math.Min(tokens, float64(limit.Burst))
+
+	if tokens < 1 {
+		wait := time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+		return tokens, Result{Allowed: false, RetryAfter: wait}
+	}
+	tokens--
+	return tokens, Result{Allowed: true, Remaining: int(tokens)}
+}
+
+// LockoutPolicy locks a key after repeated failures, doubling the lockout for
+// each further failure up to Max. Failures older than Window are forgotten.
+type LockoutPolicy struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+	Window    time.Duration
+}
+
+// lockout returns how long a key with the given number of failures is locked
+func (p LockoutPolicy) lockout(failures int) time.Duration {
+	if p.Threshold <= 0 || failures < p.Threshold {
+		return 0
+	}
+	d := p.Base
+	for i := p.Threshold; i < failures && d < p.Max; i++ {
+		d *= 2
+	}
+	if d > p.Max {
+		d = p.Max
+	}
+	return d
+}
+
+// Store keeps bucket and lockout state
+type Store interface {
+	// Take takes a token from the bucket for key
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+	// RecordFailure counts a failed attempt and returns until when key is locked (zero if not locked)
+	RecordFailure(ctx context.Context, key string, policy LockoutPolicy) (time.Time, error)
+	// LockedUntil returns until when key is locked (zero if not locked)
+	LockedUntil(ctx context.Context, key string) (time.Time, error)
+	// Reset forgets the failures of key
+	Reset(ctx context.Context, key string) error
+}
+
+// Config holds the configured limits
+type Config struct {
+	Store       string        // memory or postgres
+	Login       Limit         // Unauthenticated auth endpoints, per client IP
+	API         Limit         // Dashboard and API key requests, per user or API key
+	Runner      Limit         // Runner endpoints, per runner
+	UserLockout LockoutPolicy // Failed logins per username
+	IPLockout   LockoutPolicy // Failed logins per client IP
+	// Addresses or CIDRs of reverse proxies whose X-Forwarded-For is trusted for the
+	// client IP. Empty trusts none, so the header cannot be used to dodge limits.
+	TrustedProxies []string
+}
+
+// ConfigFromEnv reads limits from the environment, falling back to defaults:
+//
+//	RATE_LIMIT_STORE=memory         # or postgres to share state between instances
+//	RATE_LIMIT_LOGIN=20/m           # login, refresh and runner registration per IP
+//	RATE_LIMIT_API=600/m            # per user or API key
+//	RATE_LIMIT_RUNNER=1800/m        # per runner
+//	LOGIN_LOCKOUT_THRESHOLD=5       # failed logins per username before lockout
+//	LOGIN_LOCKOUT_IP_THRESHOLD=20   # failed logins per IP before lockout
+//	LOGIN_LOCKOUT_BASE=30s          # first lockout, doubled for each further failure
+//	LOGIN_LOCKOUT_MAX=15m
+//	LOGIN_LOCKOUT_WINDOW=15m        # failures older than this are forgotten
+//	TRUSTED_PROXIES=                # e.g. 10.0.0.0/8,127.0.0.1; none by default
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Store: envOr("RATE_LIMIT_STORE", "memory")}
+	if cfg.Store != "memory" && cfg.Store != "postgres" {
+		return cfg, fmt.Errorf("RATE_LIMIT_STORE must be memory or postgres, got %q", cfg.Store)
+	}
+
+	var err error
+	for _, l := range []struct {
+		env, def string
+		dst      *Limit
+	}{
+		{"RATE_LIMIT_LOGIN", "20/m", &cfg.Login},
+		{"RATE_LIMIT_API", "600/m", &cfg.API},
+		{"RATE_LIMIT_RUNNER", "1800/m", &cfg.Runner},
+	} {
+		if *l.dst, err = ParseLimit(envOr(l.env, l.def)); err != nil {
+			return cfg, fmt.Errorf("%s: %w", l.env, err)
+		}
+	}
+
+	userThreshold, err := strconv.Atoi(envOr("LOGIN_LOCKOUT_THRESHOLD", "5"))
+	if err != nil {
+		return cfg, fmt.Errorf("LOGIN_LOCKOUT_THRESHOLD: %w", err)
+	}
+	ipThreshold, err := strconv.Atoi(envOr("LOGIN_LOCKOUT_IP_THRESHOLD", "20"))
+	if err != nil {
+		return cfg, fmt.Errorf("LOGIN_LOCKOUT_IP_THRESHOLD: %w", err)
+	}
+
+	policy := LockoutPolicy{}
+	for _, d := range []struct {
+		env, def string
+		dst      *time.Duration
+	}{
+		{"LOGIN_LOCKOUT_BASE", "30s", &policy.Base},
+		{"LOGIN_LOCKOUT_MAX", "15m", &policy.Max},
+		{"LOGIN_LOCKOUT_WINDOW", "15m", &policy.Window},
+	} {
+		if *d.dst, err = time.ParseDuration(envOr(d.env, d.def)); err != nil {
+			return cfg, fmt.Errorf("%s: %w", d.env, err)
+		}
+	}
+
+	cfg.UserLockout = policy
+	cfg.UserLockout.Threshold = userThreshold
+	cfg.IPLockout = policy
+	cfg.IPLockout.Threshold = ipThreshold
+
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			cfg.TrustedProxies = append(cfg.TrustedProxies, proxy)
+		}
+	}
+	return cfg, nil
+}
+
+func envOr(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+// Limiter applies configured limits to a store
+type Limiter struct {
+	store  Store
+	config Config
+}
+
+// New creates a limiter
+func New(store Store, config Config) *Limiter {
+	return &Limiter{store: store, config: config}
+}
+
+// Config returns the configured limits
+func (l *Limiter) Config() Config {
+	return l.config
+}
+
+// Store returns the underlying store
+func (l *Limiter) Store() Store {
+	return l.store
+}
+
+// Take takes a token for key from a bucket with the given limit. Unlimited buckets always allow.
+func (l *Limiter) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	if limit.Unlimited() {
+		return Result{Allowed: true}, nil
+	}
+	return l.store.Take(ctx, key, limit)
+}
@@ -0,0 +1,149 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Limit
+	}{
+		{"", Limit{}},
+		{"off", Limit{}},
+		{"0", Limit{}},
+		{"10/s", Limit{Rate: 10, Burst: 10}},
+		{"600/m", Limit{Rate: 10, Burst: 600}},
+		{" 3600/h:5 ", Limit{Rate: 1, Burst: 5}},
+		{"60/m:0", Limit{Rate: 1, Burst: 0}},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimit(tt.in)
+		if err != nil {
+			t.Fatalf("ParseLimit(%q): %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Fatalf("ParseLimit(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"10", "10/d", "x/m", "-1/m", "10/m:x", "10/m:-1"} {
+		if _, err := ParseLimit(in); err == nil {
+			t.Fatalf("ParseLimit(%q) succeeded, want an error", in)
+		}
+	}
+
+	if limit, _ := ParseLimit("60/m:0"); !limit.Unlimited() {
+		t.Fatal("a limit without burst must be unlimited")
+	}
+}
+
+func TestTakeRefillsBucket(t *testing.T) {
+	limit := Limit{Rate: 2, Burst: 3}
+	start := time.Now()
+
+	tokens := float64(limit.Burst)
+	var result Result
+	for i := 0; i < limit.Burst; i++ {
+		tokens, result = take(tokens, start, start, limit)
+		if !result.Allowed {
+			t.Fatalf("request %d denied within burst", i+1)
+		}
+	}
+	if result.Remaining != 0 {
+		t.Fatalf("Remaining = %d after the burst, want 0", result.Remaining)
+	}
+
+	tokens, result = take(tokens, start, start, limit)
+	if result.Allowed {
+		t.Fatal("request allowed with an empty bucket")
+	}
+	if result.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("RetryAfter = %v, want 500ms at 2 tokens/s", result.RetryAfter)
+	}
+
+	// Half a second refills one token
+	tokens, result = take(tokens, start, start.Add(500*time.Millisecond), limit)
+	if !result.Allowed {
+		t.Fatal("request denied after the bucket refilled a token")
+	}
+
+	// A long pause refills up to the burst, not beyond
+	_, result = take(tokens, start, start.Add(time.Hour), limit)
+	if !result.Allowed || result.Remaining != limit.Burst-1 {
+		t.Fatalf("after a long pause: allowed %v, remaining %d; want true, %d", result.Allowed, result.Remaining, limit.Burst-1)
+	}
+}
+
+func TestLockoutPolicyDoublesUpToMax(t *testing.T) {
+	policy := LockoutPolicy{Threshold: 3, Base: time.Second, Max: 5 * time.Second}
+
+	for failures, want := range map[int]time.Duration{
+		0: 0,
+		2: 0,
+		3: time.Second,
+		4: 2 * time.Second,
+		5: 4 * time.Second,
+		6: 5 * time.Second,
+		9: 5 * time.Second,
+	} {
+		if got := policy.lockout(failures); got != want {
+			t.Fatalf("lockout(%d) = %v, want %v", failures, got, want)
+		}
+	}
+
+	if got := (LockoutPolicy{Base: time.Second, Max: time.Minute}).lockout(100); got != 0 {
+		t.Fatalf("lockout without a threshold = %v, want 0", got)
+	}
+}
+
+func TestMemoryStoreLockoutExpires(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	policy := LockoutPolicy{Threshold: 2, Base: 50 * time.Millisecond, Max: time.Second, Window: time.Minute}
+
+	if until, _ := store.RecordFailure(ctx, "user:ada", policy); !until.IsZero() {
+		t.Fatalf("locked after one failure until %v", until)
+	}
+	if until, _ := store.RecordFailure(ctx, "user:ada", policy); until.IsZero() {
+		t.Fatal("not locked after reaching the threshold")
+	}
+	if until, _ := store.LockedUntil(ctx, "user:ada"); until.IsZero() {
+		t.Fatal("LockedUntil does not report the lockout")
+	}
+	if until, _ := store.LockedUntil(ctx, "user:grace"); !until.IsZero() {
+		t.Fatal("lockout applies to another key")
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if until, _ := store.LockedUntil(ctx, "user:ada"); !until.IsZero() {
+		t.Fatalf("still locked until %v after the lockout expired", until)
+	}
+
+	// Failures within the window still count, so the next one locks for longer
+	until, _ := store.RecordFailure(ctx, "user:ada", policy)
+	if d := time.Until(until); d <= 50*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("third failure locks for %v, want about 100ms", d)
+	}
+
+	if err := store.Reset(ctx, "user:ada"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if until, _ := store.LockedUntil(ctx, "user:ada"); !until.IsZero() {
+		t.Fatal("still locked after Reset")
+	}
+}
+
+func TestMemoryStoreForgetsFailuresOutsideWindow(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	policy := LockoutPolicy{Threshold: 2, Base: time.Minute, Max: time.Minute, Window: 30 * time.Millisecond}
+
+	store.RecordFailure(ctx, "ip:192.0.2.1", policy)
+	time.Sleep(50 * time.Millisecond)
+	if until, _ := store.RecordFailure(ctx, "ip:192.0.2.1", policy); !until.IsZero() {
+		t.Fatal("a failure outside the window counted towards the lockout")
+	}
+}
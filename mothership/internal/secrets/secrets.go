@@ -0,0 +1,112 @@
+// Package secrets encrypts secret values at rest and masks them in task output.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Mask replaces secret values in task output
+const Mask = "********"
+
+// minMaskLength keeps very short values from masking unrelated output
+const minMaskLength = 3
+
+// ciphertextVersion prefixes stored values so the format can change later
+const ciphertextVersion = "v1:"
+
+var errMalformedCiphertext = errors.New("malformed secret ciphertext")
+
+// Cipher encrypts and decrypts secret values with AES-256-GCM
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher creates a cipher from a 32-byte key
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secrets key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// CipherFromEnv creates a cipher from SECRETS_KEY, a base64 or hex encoded 32-byte key.
+// ok is false if SECRETS_KEY is not set.
+func CipherFromEnv() (c *Cipher, ok bool, err error) {
+	encoded := strings.TrimSpace(os.Getenv("SECRETS_KEY"))
+	if encoded == "" {
+		return nil, false, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		key, err = hex.DecodeString(encoded)
+		if err != nil {
+			return nil, true, errors.New("SECRETS_KEY must be 32 bytes, base64 or hex encoded")
+		}
+	}
+
+	c, err = NewCipher(key)
+	return c, true, err
+}
+
+// Encrypt encrypts a value. name is bound to the ciphertext so it cannot be moved to another secret.
+func (c *Cipher) Encrypt(name, value string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return ciphertextVersion + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value produced by Encrypt for the same name
+func (c *Cipher) Decrypt(name, ciphertext string) (string, error) {
+	if !strings.HasPrefix(ciphertext, ciphertextVersion) {
+		return "", errMalformedCiphertext
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, ciphertextVersion))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", errMalformedCiphertext
+	}
+
+	nonce, sealed := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	value, err := c.aead.Open(nil, nonce, sealed, []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret %q: %w", name, err)
+	}
+	return string(value), nil
+}
+
+// MaskValues replaces every occurrence of the given values in text.
+// Longer values are replaced first so a secret containing another is fully masked.
+func MaskValues(text string, values []string) string {
+	sorted := make([]string, 0, len(values))
+	for _, v := range values {
+		if len(v) >= minMaskLength {
+			sorted = append(sorted, v)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	for _, v := range sorted {
+		text = strings.ReplaceAll(text, v, Mask)
+	}
+	return text
+}
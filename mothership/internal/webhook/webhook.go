@@ -0,0 +1,446 @@
+// Package webhook delivers events to registered HTTP endpoints. Deliveries are
+// queued in Postgres, signed with HMAC-SHA256 and retried with exponential backoff,
+// so several mothership instances can share the work.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"borg/mothership/internal/events"
+	"borg/mothership/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Headers set on every delivery
+const (
+	HeaderEvent     = "X-Borg-Event"
+	HeaderDelivery  = "X-Borg-Delivery"
+	HeaderTimestamp = "X-Borg-Timestamp"
+	HeaderSignature = "X-Borg-Signature"
+)
+
+const (
+	// MaxAttempts is how often a delivery is tried before it is marked failed
+	MaxAttempts = 8
+
+	baseBackoff     = 30 * time.Second
+	maxBackoff      = time.Hour
+	requestTimeout  = 10 * time.Second
+	pollInterval    = 5 * time.Second
+	claimLease      = 2 * time.Minute // Claimed deliveries are skipped by other workers this long
+	batchSize       = 20
+	maxResponseBody = 4096 // Read and discarded so connections can be reused
+)
+
+// EventTypes are the events webhooks receive. Frequent events such as task output
+// and runner status changes only reach dashboard clients.
+var EventTypes = []events.Type{
+	events.JobCreated, events.JobStarted, events.JobCompleted, events.JobFailed, events.JobCancelled,
+	events.TaskFailed,
+	events.RunnerOnline, events.RunnerOffline,
+	events.DatasetProcessed,
+}
+
+// deliverable reports whether webhooks receive events of type t
+func deliverable(t events.Type) bool {
+	for _, known := range EventTypes {
+		if known == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the signature header value for a delivery body sent at timestamp
+// (Unix seconds): "sha256=" followed by the hex HMAC-SHA256 of "<timestamp>.<body>".
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Matches reports whether an event filter selects an event type. A filter entry
+// is an event type, "*" for every event or a prefix like "job.*". An empty
+// filter selects every event.
+func Matches(filter []string, t events.Type) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		switch {
+		case f == "*", f == string(t):
+			return true
+		case strings.HasSuffix(f, ".*") && strings.HasPrefix(string(t), strings.TrimSuffix(f, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+// ValidFilter checks that every entry of an event filter matches some event type
+func ValidFilter(filter []string) error {
+	for _, f := range filter {
+		matched := false
+		for _, t := range EventTypes {
+			if Matches([]string{f}, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("unknown event type %q", f)
+		}
+	}
+	return nil
+}
+
+// ErrForbiddenAddress is returned for webhook URLs and connections to addresses that are
+// not publicly routable, such as loopback, private networks and cloud metadata services
+var ErrForbiddenAddress = errors.New("webhook address is not publicly routable")
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which netip does not classify
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddress reports whether deliveries may connect to ip
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() && ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip) &&
+		!(ip.Is4() && ip.As4()[0] == 0)
+}
+
+// dialControl refuses connections to addresses that are not public. It runs after DNS
+// resolution for every connection, so neither hostnames nor DNS rebinding get around it.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddress(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addrPort.Addr())
+	}
+	return nil
+}
+
+// ValidateURL accepts absolute http and https URLs whose host is not a literal non-public
+// address. Hostnames are checked again each time a delivery connects.
+func ValidateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrForbiddenAddress
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !publicAddress(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// newHTTPClient returns the client deliveries are sent with. It only connects to public
+// addresses, ignores proxy settings, which would connect on its behalf, and does not follow
+// redirects, which count as failed deliveries.
+func newHTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: requestTimeout, Control: dialControl}
+	return &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: requestTimeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// backoff returns the delay before the attempt after the given number of failed attempts
+func backoff(attempts int) time.Duration {
+	d := baseBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	// Up to 10% jitter keeps retries of many deliveries from arriving together
+	return d + time.Duration(rand.Int63n(int64(d/10)+1))
+}
+
+// Dispatcher queues deliveries for published events and sends them
+type Dispatcher struct {
+	db     *gorm.DB
+	client *http.Client
+	wake   chan struct{}
+}
+
+// NewDispatcher creates a dispatcher
+func NewDispatcher(db *gorm.DB) *Dispatcher {
+	return &Dispatcher{
+		db:     db,
+		client: newHTTPClient(),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Subscribe queues a delivery to every matching webhook for each event published on bus
+func (d *Dispatcher) Subscribe(bus *events.Bus) {
+	bus.Subscribe(func(event events.Event) {
+		if event.Remote || !deliverable(event.Type) {
+			return
+		}
+		go func() {
+			if err := d.enqueue(event); err != nil {
+				log.Printf("Failed to queue webhook deliveries for %s event %s: %v", event.Type, event.ID, err)
+			}
+		}()
+	})
+}
+
+// enqueue creates pending deliveries of an event for the active webhooks that want it
+func (d *Dispatcher) enqueue(event events.Event) error {
+	var hooks []models.Webhook
+	query := d.db.Where("active = ?", true)
+	if event.ProjectID != "" {
+		query = query.Where("project_id = '' OR project_id IS NULL OR project_id = ?", event.ProjectID)
+	} else {
+		query = query.Where("project_id = '' OR project_id IS NULL")
+	}
+	if err := query.Find(&hooks).Error; err != nil {
+		return err
+	}
+
+	var payload []byte
+	now := time.Now()
+	queued := 0
+	for _, hook := range hooks {
+		var filter []string
+		if hook.Events != "" {
+			if err := json.Unmarshal([]byte(hook.Events), &filter); err != nil {
+				log.Printf("Webhook %s has an invalid event filter: %v", hook.ID, err)
+				continue
+			}
+		}
+		if !Matches(filter, event.Type) {
+			continue
+		}
+
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(event); err != nil {
+				return err
+			}
+		}
+		delivery := &models.WebhookDelivery{
+			ID:            uuid.New().String(),
+			WebhookID:     hook.ID,
+			EventID:       event.ID,
+			EventType:     string(event.Type),
+			Payload:       string(payload),
+			Status:        models.DeliveryPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		if err := d.db.Create(delivery).Error; err != nil {
+			return err
+		}
+		queued++
+	}
+
+	if queued > 0 {
+		d.notify()
+	}
+	return nil
+}
+
+// Redeliver queues a new delivery with the payload of an earlier one
+func (d *Dispatcher) Redeliver(original *models.WebhookDelivery) (*models.WebhookDelivery, error) {
+	now := time.Now()
+	delivery := &models.WebhookDelivery{
+		ID:            uuid.New().String(),
+		WebhookID:     original.WebhookID,
+		EventID:       original.EventID,
+		EventType:     original.EventType,
+		Payload:       original.Payload,
+		RedeliveryOf:  original.ID,
+		Status:        models.DeliveryPending,
+		NextAttemptAt: &now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := d.db.Create(delivery).Error; err != nil {
+		return nil, err
+	}
+	d.notify()
+	return delivery, nil
+}
+
+// notify wakes the delivery loop
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends due deliveries until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := d.sendDue(ctx)
+			if err != nil {
+				log.Printf("Failed to send webhook deliveries: %v", err)
+			}
+			if n < batchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// sendDue claims a batch of due deliveries and sends them. Returns how many were claimed.
+func (d *Dispatcher) sendDue(ctx context.Context) (int, error) {
+	var due []models.WebhookDelivery
+	now := time.Now()
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", models.DeliveryPending, now).
+			Order("next_attempt_at ASC").Limit(batchSize).Find(&due).Error; err != nil {
+			return err
+		}
+		if len(due) == 0 {
+			return nil
+		}
+		ids := make([]string, len(due))
+		for i := range due {
+			ids[i] = due[i].ID
+		}
+		return tx.Model(&models.WebhookDelivery{}).Where("id IN ?", ids).Update("next_attempt_at", now.Add(claimLease)).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for i := range due {
+		wg.Add(1)
+		go func(delivery *models.WebhookDelivery) {
+			defer wg.Done()
+			d.attempt(ctx, delivery)
+		}(&due[i])
+	}
+	wg.Wait()
+	return len(due), nil
+}
+
+// attempt sends a delivery once and records the outcome
+func (d *Dispatcher) attempt(ctx context.Context, delivery *models.WebhookDelivery) {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"attempts":        delivery.Attempts + 1,
+		"last_attempt_at": now,
+		"updated_at":      now,
+	}
+
+	var hook models.Webhook
+	if err := d.db.First(&hook, "id = ?", delivery.WebhookID).Error; err != nil {
+		updates["status"] = models.DeliveryFailed
+		updates["error"] = "webhook was deleted"
+		updates["next_attempt_at"] = nil
+		d.db.Model(delivery).Updates(updates)
+		return
+	}
+
+	status, sendErr := d.send(ctx, &hook, delivery)
+	updates["duration_ms"] = time.Since(now).Milliseconds()
+	updates["response_status"] = status
+	updates["error"] = ""
+
+	switch {
+	case sendErr == nil && status >= 200 && status < 300:
+		updates["status"] = models.DeliverySucceeded
+		updates["next_attempt_at"] = nil
+	default:
+		if sendErr != nil {
+			updates["error"] = sendErr.Error()
+		} else {
+			updates["error"] = fmt.Sprintf("endpoint responded with status %d", status)
+		}
+		if delivery.Attempts+1 >= MaxAttempts {
+			updates["status"] = models.DeliveryFailed
+			updates["next_attempt_at"] = nil
+			log.Printf("Webhook delivery %s to %s failed after %d attempts: %v", delivery.ID, hook.URL, MaxAttempts, updates["error"])
+		} else {
+			updates["next_attempt_at"] = now.Add(backoff(delivery.Attempts + 1))
+		}
+	}
+
+	if err := d.db.Model(delivery).Updates(updates).Error; err != nil {
+		log.Printf("Failed to record webhook delivery %s: %v", delivery.ID, err)
+	}
+}
+
+// send posts a delivery and returns the response status. The response body is not kept,
+// so webhooks cannot be used to read from the endpoints they reach.
+func (d *Dispatcher) send(ctx context.Context, hook *models.Webhook, delivery *models.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Borg-Webhook/1")
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(hook.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBody))
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,71 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+	for _, addr := range []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946", "8.8.8.8"} {
+		if !publicAddress(netip.MustParseAddr(addr)) {
+			t.Fatalf("%s rejected, want it allowed", addr)
+		}
+	}
+	for _, addr := range []string{
+		"127.0.0.1", "::1", // loopback
+		"10.1.2.3", "172.16.0.1", "192.168.1.1", "fd00::1", // private
+		"169.254.169.254", "fe80::1", // link-local, including cloud metadata
+		"224.0.0.1", "ff02::1", // multicast
+		"0.0.0.0", "0.1.2.3", "::", // unspecified
+		"100.64.0.1",       // carrier-grade NAT
+		"::ffff:127.0.0.1", // IPv4-mapped loopback
+	} {
+		if publicAddress(netip.MustParseAddr(addr)) {
+			t.Fatalf("%s allowed, want it rejected", addr)
+		}
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	for _, raw := range []string{"https://hooks.example.com/borg", "http://93.184.216.34:8080/hook"} {
+		if err := ValidateURL(raw); err != nil {
+			t.Fatalf("ValidateURL(%q): %v", raw, err)
+		}
+	}
+	for _, raw := range []string{
+		"ftp://example.com/", "/relative", "https://",
+		"http://localhost:8080/", "http://api.localhost/", "http://127.0.0.1/",
+		"http://[::1]/", "http://169.254.169.254/latest/meta-data/", "http://10.0.0.1/",
+	} {
+		if err := ValidateURL(raw); err == nil {
+			t.Fatalf("ValidateURL(%q) succeeded, want an error", raw)
+		}
+	}
+}
+
+func TestClientRefusesNonPublicAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal data"))
+	}))
+	defer server.Close()
+
+	// The test server listens on loopback, like an internal service would
+	_, err := newHTTPClient().Post(server.URL, "application/json", nil)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("delivery to %s: err = %v, want ErrForbiddenAddress", server.URL, err)
+	}
+}
+
+func TestClientDoesNotFollowRedirects(t *testing.T) {
+	client := newHTTPClient()
+	if client.CheckRedirect == nil {
+		t.Fatal("client follows redirects")
+	}
+	req := httptest.NewRequest(http.MethodPost, "https://hooks.example.com/", nil)
+	if err := client.CheckRedirect(req, []*http.Request{req}); !errors.Is(err, http.ErrUseLastResponse) {
+		t.Fatalf("CheckRedirect = %v, want http.ErrUseLastResponse", err)
+	}
+}
@@ -2,6 +2,7 @@ package websocket
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -13,15 +14,22 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-// HandleWebSocket handles WebSocket connections
-func HandleWebSocket(hub *Hub) gin.HandlerFunc {
+// HandleWebSocket handles dashboard WebSocket connections. Clients receive the events of
+// the topics they subscribe to, initially those in the comma-separated topics query
+// parameter, filtered by the authorizer access builds from the authenticated request.
+// Clients are disconnected once access's revalidator reports their credentials invalid.
+func HandleWebSocket(hub *Hub, access func(c *gin.Context) (Authorizer, Revalidator)) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
 			return
 		}
 		
-		client := NewClient(hub, conn)
+		authorize, revalidate := access(c)
+		client := NewClient(hub, conn, authorize, revalidate)
+		if topics := c.Query("topics"); topics != "" {
+			client.Subscribe(strings.Split(topics, ","))
+		}
 		client.hub.register <- client
 		
 		// Allow collection of memory referenced by the caller by doing all work in new goroutines
@@ -6,16 +6,34 @@ import (
 	"sync"
 	"time"
 
+	"borg/mothership/internal/events"
+
 	"github.com/gorilla/websocket"
 )
 
+// Authorizer decides whether a client may receive an event of a type and project, whichever
+// topic it was published on. projectID is empty for shared runners.
+type Authorizer func(eventType events.Type, projectID string) bool
+
+// Revalidator reports whether a client's credentials are still valid. It is checked with
+// every ping, and the client is disconnected once it reports false.
+type Revalidator func() bool
+
+// outbound is a message for the clients subscribed to one of its topics
+type outbound struct {
+	data      []byte
+	topics    []string // nil for messages to every client
+	eventType events.Type
+	projectID string
+}
+
 // Hub maintains the set of active clients and broadcasts messages to clients
 type Hub struct {
 	// Registered clients
 	clients map[*Client]bool
 	
-	// Inbound messages from clients
-	broadcast chan []byte
+	// Outbound messages for clients
+	broadcast chan outbound
 	
 	// Register requests from clients
 	register chan *Client
@@ -30,7 +48,7 @@ type Hub struct {
 func NewHub() *Hub {
 	return &Hub{
 		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte, 256),
+		broadcast:  make(chan outbound, 256),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 	}
@@ -50,22 +68,26 @@ func (h *Hub) Run() {
 			h.mu.Lock()
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
-				close(client.send)
+				client.close()
 			}
 			h.mu.Unlock()
 			log.Printf("Client disconnected. Total clients: %d", len(h.clients))
 			
 		case message := <-h.broadcast:
-			h.mu.RLock()
+			h.mu.Lock()
 			for client := range h.clients {
+				if message.topics != nil && !client.accepts(message.topics, message.eventType, message.projectID) {
+					continue
+				}
 				select {
-				case client.send <- message:
+				case client.send <- message.data:
 				default:
-					close(client.send)
+					// Client is too slow, drop it
+					client.close()
 					delete(h.clients, client)
 				}
 			}
-			h.mu.RUnlock()
+			h.mu.Unlock()
 		}
 	}
 }
@@ -79,12 +101,32 @@ func (h *Hub) Broadcast(message interface{}) {
 	}
 	
 	select {
-	case h.broadcast <- data:
+	case h.broadcast <- outbound{data: data}:
 	default:
 		log.Println("Broadcast channel full, dropping message")
 	}
 }
 
+// PublishEvent sends an event to the clients subscribed to one of its topics and
+// allowed to see it
+func (h *Hub) PublishEvent(event events.Event) {
+	topics := event.Topics()
+	if len(topics) == 0 {
+		return
+	}
+	data, err := json.Marshal(NewMessage(string(event.Type), event))
+	if err != nil {
+		log.Printf("Error marshaling event: %v", err)
+		return
+	}
+	
+	select {
+	case h.broadcast <- outbound{data: data, topics: topics, eventType: event.Type, projectID: event.ProjectID}:
+	default:
+		log.Printf("Broadcast channel full, dropping %s event", event.Type)
+	}
+}
+
 // ClientCount returns the number of connected clients
 func (h *Hub) ClientCount() int {
 	h.mu.RLock()
@@ -94,9 +136,15 @@ func (h *Hub) ClientCount() int {
 
 // Client represents a websocket connection
 type Client struct {
-	hub  *Hub
-	conn *websocket.Conn
-	send chan []byte
+	hub       *Hub
+	conn      *websocket.Conn
+	send      chan []byte
+	authorize  Authorizer  // nil allows every event
+	revalidate Revalidator // nil keeps the client connected
+	
+	mu     sync.Mutex
+	topics map[string]bool
+	closed bool
 }
 
 const (
@@ -111,12 +159,120 @@ const (
 )
 
 // NewClient creates a new client
-func NewClient(hub *Hub, conn *websocket.Conn) *Client {
+func NewClient(hub *Hub, conn *websocket.Conn, authorize Authorizer, revalidate Revalidator) *Client {
 	return &Client{
-		hub:  hub,
-		conn: conn,
-		send: make(chan []byte, 256),
+		hub:        hub,
+		conn:       conn,
+		send:       make(chan []byte, 256),
+		authorize:  authorize,
+		revalidate: revalidate,
+		topics:     make(map[string]bool),
+	}
+}
+
+// accepts reports whether the client may see an event of the type and project and
+// subscribed to one of its topics
+func (c *Client) accepts(topics []string, eventType events.Type, projectID string) bool {
+	if c.authorize != nil && !c.authorize(eventType, projectID) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		if c.topics[topic] {
+			return true
+		}
 	}
+	return false
+}
+
+// Subscribe adds topics to the client's subscriptions. Unknown topics are returned and ignored.
+func (c *Client) Subscribe(topics []string) (invalid []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		if !events.ValidTopic(topic) {
+			invalid = append(invalid, topic)
+			continue
+		}
+		c.topics[topic] = true
+	}
+	return invalid
+}
+
+// Unsubscribe removes topics from the client's subscriptions
+func (c *Client) Unsubscribe(topics []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		delete(c.topics, topic)
+	}
+}
+
+// Topics returns the client's subscriptions
+func (c *Client) Topics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// reply queues a message to the client unless it was disconnected
+func (c *Client) reply(messageType string, data interface{}) {
+	message, err := json.Marshal(NewMessage(messageType, data))
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- message:
+	default:
+	}
+}
+
+// close stops the write pump; only the hub closes clients
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+// ClientMessage is sent by dashboard clients to choose the topics they receive
+type ClientMessage struct {
+	Action string   `json:"action"` // subscribe or unsubscribe
+	Topics []string `json:"topics"`
+}
+
+// handleMessage applies a subscription change and confirms the resulting subscriptions
+func (c *Client) handleMessage(data []byte) {
+	var message ClientMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		c.reply("error", map[string]string{"message": "invalid message"})
+		return
+	}
+	
+	switch message.Action {
+	case "subscribe":
+		if invalid := c.Subscribe(message.Topics); len(invalid) > 0 {
+			c.reply("error", map[string]interface{}{"message": "unknown topics", "topics": invalid})
+		}
+	case "unsubscribe":
+		c.Unsubscribe(message.Topics)
+	default:
+		c.reply("error", map[string]string{"message": "unknown action " + message.Action})
+		return
+	}
+	c.reply("subscriptions", map[string]interface{}{"topics": c.Topics()})
 }
 
 // ReadPump pumps messages from the websocket connection to the hub
@@ -134,19 +290,24 @@ func (c *Client) ReadPump() {
 	})
 	
 	for {
-		_, _, err := c.conn.ReadMessage()
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
 			break
 		}
+		c.handleMessage(data)
 	}
 }
 
-// WritePump pumps messages from the hub to the websocket connection
+// WritePump pumps messages from the hub to the websocket connection, one JSON message per frame
 func (c *Client) WritePump() {
-	defer c.conn.Close()
+	ticker := time.NewTicker(pingPeriod * time.Second)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
 	
 	for {
 		select {
@@ -157,20 +318,18 @@ func (c *Client) WritePump() {
 				return
 			}
 			
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
-			w.Write(message)
 			
-			// Add queued messages to current websocket message
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.send)
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait * time.Second))
+			if c.revalidate != nil && !c.revalidate() {
+				c.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "credentials are no longer valid"))
+				return
 			}
-			
-			if err := w.Close(); err != nil {
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
@@ -26,8 +26,12 @@ const (
 	agentPingPeriod = (agentReadWait * 9) / 10
 )
 
+// ViewerSessionFunc is called when a viewer connected and returns a function
+// that is called once the viewer disconnects
+type ViewerSessionFunc func(c *gin.Context, runnerID string) func()
+
 // HandleScreenWebSocket handles WebSocket connections for screen streaming (viewers)
-func HandleScreenWebSocket(hub *ScreenHub) gin.HandlerFunc {
+func HandleScreenWebSocket(hub *ScreenHub, onSession ViewerSessionFunc) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		runnerID := c.Param("runnerID")
 		if runnerID == "" {
@@ -41,6 +45,9 @@ func HandleScreenWebSocket(hub *ScreenHub) gin.HandlerFunc {
 		}
 		
 		client := NewScreenClient(hub, conn, runnerID)
+		if onSession != nil {
+			client.onClose = onSession(c, runnerID)
+		}
 		hub.RegisterViewer(client)
 		
 		// Allow collection of memory referenced by the caller by doing all work in new goroutines
@@ -22,6 +22,12 @@ type ScreenHub struct {
 	// Callback to notify when streaming should start/stop
 	onStreamingChange func(runnerID string, shouldStream bool)
 	
+	// Optional callback when the number of viewers of a runner changes
+	onViewersChange func(runnerID string, viewers int)
+	
+	// Optional callback for frames that viewers on other instances may need
+	forwardFrame func(runnerID string, frameData []byte)
+	
 	mu sync.RWMutex
 }
 
@@ -31,6 +37,7 @@ type ScreenClient struct {
 	conn    *websocket.Conn
 	runnerID string
 	send    chan []byte
+	onClose func() // Optional, called when the viewer disconnects
 }
 
 // NewScreenHub creates a new screen streaming hub
@@ -43,6 +50,21 @@ func NewScreenHub(onStreamingChange func(runnerID string, shouldStream bool)) *S
 	}
 }
 
+// SetViewersChangeHandler sets a callback for changes of the number of viewers of a runner
+func (h *ScreenHub) SetViewersChangeHandler(fn func(runnerID string, viewers int)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onViewersChange = fn
+}
+
+// SetFrameForwarder sets a callback that receives every broadcast frame, to pass
+// frames on to viewers connected to other instances
+func (h *ScreenHub) SetFrameForwarder(fn func(runnerID string, frameData []byte)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.forwardFrame = fn
+}
+
 // RegisterViewer registers a new viewer for a runner
 func (h *ScreenHub) RegisterViewer(client *ScreenClient) {
 	h.mu.Lock()
@@ -54,6 +76,9 @@ func (h *ScreenHub) RegisterViewer(client *ScreenClient) {
 	}
 	
 	h.viewers[client.runnerID][client] = true
+	if h.onViewersChange != nil {
+		go h.onViewersChange(client.runnerID, len(h.viewers[client.runnerID]))
+	}
 	
 	// If this is the first viewer and not already streaming, start streaming
 	if len(h.viewers[client.runnerID]) == 1 && !h.streaming[client.runnerID] {
@@ -75,6 +100,9 @@ func (h *ScreenHub) UnregisterViewer(client *ScreenClient) {
 		if _, exists := viewers[client]; exists {
 			delete(viewers, client)
 			close(client.send)
+			if h.onViewersChange != nil {
+				go h.onViewersChange(client.runnerID, len(viewers))
+			}
 			
 			// If no viewers remain, stop streaming
 			if len(viewers) == 0 {
@@ -95,6 +123,18 @@ func (h *ScreenHub) UnregisterViewer(client *ScreenClient) {
 
 // BroadcastFrame sends a frame to all viewers of a runner
 func (h *ScreenHub) BroadcastFrame(runnerID string, frameData []byte) {
+	h.DeliverFrame(runnerID, frameData)
+	
+	h.mu.RLock()
+	forward := h.forwardFrame
+	h.mu.RUnlock()
+	if forward != nil {
+		forward(runnerID, frameData)
+	}
+}
+
+// DeliverFrame sends a frame to the viewers of a runner connected to this instance
+func (h *ScreenHub) DeliverFrame(runnerID string, frameData []byte) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 	
@@ -138,6 +178,18 @@ func (h *ScreenHub) ViewerCount(runnerID string) int {
 	return 0
 }
 
+// Viewers returns the number of viewers of every runner with viewers
+func (h *ScreenHub) Viewers() map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	
+	counts := make(map[string]int, len(h.viewers))
+	for runnerID, viewers := range h.viewers {
+		counts[runnerID] = len(viewers)
+	}
+	return counts
+}
+
 // ScreenFrameMessage is deprecated - frames are now sent as binary messages
 // Kept for reference but no longer used
 
@@ -167,6 +219,9 @@ func (c *ScreenClient) ReadPump() {
 	defer func() {
 		c.hub.UnregisterViewer(c)
 		c.conn.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
 	}()
 	
 	c.conn.SetReadDeadline(time.Now().Add(screenPongWait))
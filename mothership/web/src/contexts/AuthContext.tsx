@@ -4,6 +4,10 @@ import axios from 'axios'
 interface User {
   id: string
   username: string
+  role: 'admin' | 'operator' | 'submitter' | 'viewer'
+  auth_provider: 'local' | 'oidc'
+  disabled: boolean
+  must_change_password: boolean
   created_at: string
   updated_at: string
 }
@@ -12,15 +16,60 @@ interface AuthContextType {
   user: User | null
   token: string | null
   login: (username: string, password: string) => Promise<void>
+  changePassword: (currentPassword: string, newPassword: string) => Promise<void>
   logout: () => void
+  logoutAll: () => Promise<void>
   isAuthenticated: boolean
 }
 
 const AuthContext = createContext<AuthContextType | undefined>(undefined)
 
+function storeTokens(token: string, refreshToken?: string) {
+  localStorage.setItem('token', token)
+  if (refreshToken) {
+    localStorage.setItem('refresh_token', refreshToken)
+  }
+}
+
+function clearTokens() {
+  localStorage.removeItem('token')
+  localStorage.removeItem('refresh_token')
+}
+
+// Single sign-on hands over the session tokens in the URL fragment of /login
+function takeTokenFromHash(): string | null {
+  const params = new URLSearchParams(window.location.hash.replace(/^#/, ''))
+  const ssoToken = params.get('token')
+  if (!ssoToken) {
+    return null
+  }
+  storeTokens(ssoToken, params.get('refresh_token') ?? undefined)
+  window.history.replaceState(null, '', window.location.pathname + window.location.search)
+  return ssoToken
+}
+
+// Refresh tokens are single-use, so concurrent 401s must share one refresh request
+let pendingRefresh: Promise<string> | null = null
+
+function refreshAccessToken(): Promise<string> {
+  if (!pendingRefresh) {
+    const refreshToken = localStorage.getItem('refresh_token')
+    pendingRefresh = (refreshToken
+      ? axios.post('/api/v1/auth/refresh', { refresh_token: refreshToken }).then((res) => {
+          storeTokens(res.data.token, res.data.refresh_token)
+          return res.data.token as string
+        })
+      : Promise.reject(new Error('no refresh token'))
+    ).finally(() => {
+      pendingRefresh = null
+    })
+  }
+  return pendingRefresh
+}
+
 export function AuthProvider({ children }: { children: ReactNode }) {
   const [user, setUser] = useState<User | null>(null)
-  const [token, setToken] = useState<string | null>(localStorage.getItem('token'))
+  const [token, setToken] = useState<string | null>(() => takeTokenFromHash() ?? localStorage.getItem('token'))
 
   // Set up axios interceptor to add token to requests
   useEffect(() => {
@@ -36,12 +85,28 @@ export function AuthProvider({ children }: { children: ReactNode }) {
       }
     )
 
-    // Add response interceptor to handle 401 errors
+    // Add response interceptor to refresh expired access tokens, logging out if that fails
     const responseInterceptor = axios.interceptors.response.use(
       (response) => response,
-      (error) => {
-        if (error.response?.status === 401) {
-          logout()
+      async (error) => {
+        const original = error.config
+        if (
+          error.response?.status === 401 &&
+          original &&
+          !original._retried &&
+          !original.url?.includes('/api/v1/auth/')
+        ) {
+          original._retried = true
+          try {
+            const newToken = await refreshAccessToken()
+            setToken(newToken)
+            original.headers.Authorization = `Bearer ${newToken}`
+            return axios(original)
+          } catch {
+            clearSession()
+          }
+        } else if (error.response?.status === 401 && !original?.url?.includes('/api/v1/auth/login')) {
+          clearSession()
         }
         return Promise.reject(error)
       }
@@ -60,25 +125,50 @@ export function AuthProvider({ children }: { children: ReactNode }) {
         headers: { Authorization: `Bearer ${token}` }
       })
         .then((res) => setUser(res.data))
-        .catch(() => {
-          localStorage.removeItem('token')
-          setToken(null)
-        })
+        .catch(() =>
+          refreshAccessToken()
+            .then((newToken) => setToken(newToken))
+            .catch(() => clearSession())
+        )
     }
   }, [token])
 
   const login = async (username: string, password: string) => {
     const res = await axios.post('/api/v1/auth/login', { username, password })
-    const { token: newToken, user: newUser } = res.data
+    const { token: newToken, refresh_token: newRefreshToken, user: newUser } = res.data
+    storeTokens(newToken, newRefreshToken)
     setToken(newToken)
     setUser(newUser)
-    localStorage.setItem('token', newToken)
   }
 
-  const logout = () => {
+  const changePassword = async (currentPassword: string, newPassword: string) => {
+    const res = await axios.post('/api/v1/auth/password', {
+      current_password: currentPassword,
+      new_password: newPassword,
+    })
+    const { token: newToken, refresh_token: newRefreshToken, user: newUser } = res.data
+    storeTokens(newToken, newRefreshToken)
+    setToken(newToken)
+    setUser(newUser)
+  }
+
+  const clearSession = () => {
     setToken(null)
     setUser(null)
-    localStorage.removeItem('token')
+    clearTokens()
+  }
+
+  const logout = () => {
+    // Revoke the session on the server; the local session is cleared either way
+    if (token) {
+      axios.post('/api/v1/auth/logout').catch(() => {})
+    }
+    clearSession()
+  }
+
+  const logoutAll = async () => {
+    await axios.post('/api/v1/auth/logout-all')
+    clearSession()
   }
 
   return (
@@ -87,7 +177,9 @@ export function AuthProvider({ children }: { children: ReactNode }) {
         user,
         token,
         login,
+        changePassword,
         logout,
+        logoutAll,
         isAuthenticated: !!token && !!user,
       }}
     >
@@ -0,0 +1,113 @@
+import { useState } from 'react'
+import { useAuth } from '../contexts/AuthContext'
+
+export default function ChangePassword() {
+  const [currentPassword, setCurrentPassword] = useState('')
+  const [newPassword, setNewPassword] = useState('')
+  const [confirmPassword, setConfirmPassword] = useState('')
+  const [error, setError] = useState('')
+  const [loading, setLoading] = useState(false)
+  const { changePassword, logout } = useAuth()
+
+  const handleSubmit = async (e: React.FormEvent) => {
+    e.preventDefault()
+    setError('')
+
+    if (newPassword !== confirmPassword) {
+      setError('New passwords do not match')
+      return
+    }
+
+    setLoading(true)
+    try {
+      await changePassword(currentPassword, newPassword)
+    } catch (err: any) {
+      setError(err.response?.data?.error || 'Failed to change password')
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  const inputClass =
+    'w-full px-4 py-2 bg-gray-800 border border-gray-700 rounded-lg text-white focus:outline-none focus:ring-2 focus:ring-white focus:border-transparent'
+
+  return (
+    <div className="min-h-screen bg-black flex items-center justify-center">
+      <div className="w-full max-w-md">
+        <div className="bg-gray-900 border border-gray-800 rounded-lg p-8">
+          <div className="text-center mb-8">
+            <h1 className="text-3xl font-bold text-white mb-2">Change Password</h1>
+            <p className="text-gray-400">You must set a new password before continuing</p>
+          </div>
+
+          <form onSubmit={handleSubmit} className="space-y-6">
+            {error && (
+              <div className="bg-red-900/50 border border-red-800 text-red-200 px-4 py-3 rounded">
+                {error}
+              </div>
+            )}
+
+            <div>
+              <label htmlFor="current-password" className="block text-sm font-medium text-gray-300 mb-2">
+                Current password
+              </label>
+              <input
+                id="current-password"
+                type="password"
+                value={currentPassword}
+                onChange={(e) => setCurrentPassword(e.target.value)}
+                required
+                className={inputClass}
+              />
+            </div>
+
+            <div>
+              <label htmlFor="new-password" className="block text-sm font-medium text-gray-300 mb-2">
+                New password
+              </label>
+              <input
+                id="new-password"
+                type="password"
+                value={newPassword}
+                onChange={(e) => setNewPassword(e.target.value)}
+                required
+                minLength={8}
+                className={inputClass}
+              />
+            </div>
+
+            <div>
+              <label htmlFor="confirm-password" className="block text-sm font-medium text-gray-300 mb-2">
+                Confirm new password
+              </label>
+              <input
+                id="confirm-password"
+                type="password"
+                value={confirmPassword}
+                onChange={(e) => setConfirmPassword(e.target.value)}
+                required
+                minLength={8}
+                className={inputClass}
+              />
+            </div>
+
+            <button
+              type="submit"
+              disabled={loading}
+              className="w-full bg-white text-black font-semibold py-2 px-4 rounded-lg hover:bg-gray-200 transition-colors disabled:opacity-50 disabled:cursor-not-allowed"
+            >
+              {loading ? 'Saving...' : 'Change password'}
+            </button>
+            <button
+              type="button"
+              onClick={logout}
+              className="w-full text-gray-400 hover:text-white text-sm"
+            >
+              Log out
+            </button>
+          </form>
+        </div>
+      </div>
+    </div>
+  )
+}
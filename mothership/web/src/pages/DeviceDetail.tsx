@@ -117,7 +117,8 @@ export default function DeviceDetail() {
     }
 
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:'
-    const wsUrl = `${protocol}//${window.location.host}/ws/screen/${id}`
+    const token = localStorage.getItem('token') ?? ''
+    const wsUrl = `${protocol}//${window.location.host}/ws/screen/${id}?token=${encodeURIComponent(token)}`
     
     const connect = () => {
       if (wsRef.current?.readyState === WebSocket.OPEN) {
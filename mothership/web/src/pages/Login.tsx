@@ -1,15 +1,24 @@
-import { useState } from 'react'
+import { useEffect, useState } from 'react'
+import axios from 'axios'
 import { useAuth } from '../contexts/AuthContext'
-import { useNavigate } from 'react-router-dom'
+import { useNavigate, useSearchParams } from 'react-router-dom'
 
 export default function Login() {
   const [username, setUsername] = useState('')
   const [password, setPassword] = useState('')
-  const [error, setError] = useState('')
+  const [searchParams] = useSearchParams()
+  const [error, setError] = useState(searchParams.get('error') || '')
   const [loading, setLoading] = useState(false)
+  const [ssoEnabled, setSsoEnabled] = useState(false)
   const { login } = useAuth()
   const navigate = useNavigate()
 
+  useEffect(() => {
+    axios.get('/api/v1/auth/oidc/config')
+      .then((res) => setSsoEnabled(res.data.enabled))
+      .catch(() => setSsoEnabled(false))
+  }, [])
+
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault()
     setError('')
@@ -78,6 +87,15 @@ export default function Login() {
             >
               {loading ? 'Logging in...' : 'Login'}
             </button>
+
+            {ssoEnabled && (
+              <a
+                href="/api/v1/auth/oidc/login"
+                className="block w-full text-center border border-gray-700 text-white font-semibold py-2 px-4 rounded-lg hover:bg-gray-800 transition-colors"
+              >
+                Sign in with SSO
+              </a>
+            )}
           </form>
         </div>
       </div>
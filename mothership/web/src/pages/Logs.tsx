@@ -21,7 +21,7 @@ export default function Logs() {
     queryFn: async () => {
       if (!taskId) return []
       const res = await axios.get(`/api/v1/tasks/${taskId}/logs`)
-      return res.data
+      return res.data.logs
     },
     enabled: !!taskId,
     refetchInterval: 2000,
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -17,16 +19,28 @@ import (
 
 	"borg/solder/internal/client"
 	"borg/solder/internal/config"
+	"borg/solder/internal/credential"
 	"borg/solder/internal/deviceid"
 	"borg/solder/internal/downloader"
+	"borg/solder/internal/endpoints"
 	"borg/solder/internal/executor"
 	"borg/solder/internal/heartbeat"
+	"borg/solder/internal/logstream"
+	"borg/solder/internal/outbox"
 	"borg/solder/internal/resources"
 	"borg/solder/internal/screencapture"
 	"borg/solder/internal/uploader"
 )
 
+// version is reported to the mothership; set it with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
+	// Sandboxed tasks start as this binary, which sets up the sandbox and runs them
+	if len(os.Args) == 3 && os.Args[1] == executor.SandboxInitCommand {
+		executor.SandboxInit(os.Args[2])
+	}
+
 	// Set custom usage function
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
@@ -34,6 +48,7 @@ func main() {
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nEnvironment variables (used as fallback if flags not provided):\n")
 		fmt.Fprintf(os.Stderr, "  MOTHERSHIP_ADDR  - Mothership server address\n")
+		fmt.Fprintf(os.Stderr, "  MOTHERSHIP_ADDRS - Comma-separated mothership addresses, in order of preference\n")
 		fmt.Fprintf(os.Stderr, "  RUNNER_NAME      - Runner name\n")
 		fmt.Fprintf(os.Stderr, "  RUNNER_TOKEN     - Runner authentication token\n")
 		fmt.Fprintf(os.Stderr, "  WORK_DIR         - Working directory for tasks\n")
@@ -66,6 +81,15 @@ func main() {
 	}
 	log.Printf("Device ID: %s", deviceID)
 
+	// Load the runner secret issued at a previous enrollment (if any)
+	runnerSecret, err := credential.LoadRunnerSecret(cfg.Work.Directory)
+	if err != nil {
+		log.Fatalf("Failed to load runner secret: %v", err)
+	}
+	if runnerSecret == "" && cfg.Solder.Token == "" {
+		log.Fatalf("No runner secret found and no enrollment token configured (set solder.token or RUNNER_TOKEN)")
+	}
+
 	// Create screen capture service to check availability
 	screenCapture := screencapture.NewCaptureService(cfg.ScreenCapture)
 	screenMonitoringEnabled := screenCapture.IsEnabled()
@@ -90,8 +114,39 @@ The agent will continue running without screen monitoring.
 		}
 	}
 
+	// Load the client certificate issued at a previous enrollment (if any)
+	identity := &credential.Identity{}
+	clientCert, err := credential.LoadCertificate(cfg.Work.Directory)
+	if err != nil {
+		log.Printf("Warning: Ignoring stored client certificate: %v", err)
+	} else if clientCert != nil {
+		identity.Set(clientCert)
+	}
+	storedCA, err := credential.LoadCACertificate(cfg.Work.Directory)
+	if err != nil {
+		log.Printf("Warning: Failed to read stored mothership CA: %v", err)
+	}
+	tlsConfig, err := credential.TLSConfig(identity, cfg.Server.CAFile, storedCA)
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+
+	// Pick a healthy mothership endpoint
+	ctx := context.Background()
+	endpointList, err := endpoints.New(cfg.Server.Endpoints(), cfg.Server.DiscoveryFile)
+	if err != nil {
+		log.Fatalf("Failed to load mothership endpoints: %v", err)
+	}
+	endpointList.SetTLSConfig(tlsConfig)
+	address, err := endpointList.Select(ctx)
+	if err != nil {
+		address = endpointList.Current()
+		log.Printf("Warning: %v", err)
+	}
+
 	// Create client
-	httpClient := client.NewClient(cfg.Server.Address, "")
+	httpClient := client.NewClient(address, "")
+	httpClient.SetTLSConfig(tlsConfig)
 
 	// Convert runtime configs to client format
 	runtimeConfigs := make([]client.RuntimeConfig, 0, len(cfg.Runtimes))
@@ -103,9 +158,15 @@ The agent will continue running without screen monitoring.
 		})
 	}
 
+	// Sandboxed jobs are only dispatched to runners that advertise they can run them
+	if err := executor.SandboxSupported(); err == nil {
+		client.EnableFeature(client.FeatureSandbox)
+	} else {
+		log.Printf("Sandboxed jobs will not be dispatched to this runner: %v", err)
+	}
+
 	// Register runner
-	ctx := context.Background()
-	log.Printf("Registering to mothership: %s", cfg.Server.Address)
+	log.Printf("Registering to mothership: %s", address)
 
 	registerReq := &client.RegisterRunnerRequest{
 		Name:                    runnerName,
@@ -116,8 +177,10 @@ The agent will continue running without screen monitoring.
 		MaxConcurrentTasks:      cfg.Tasks.MaxConcurrent,
 		Labels:                  getLabels(),
 		Token:                   cfg.Solder.Token,
+		RunnerSecret:            runnerSecret,
 		ScreenMonitoringEnabled: screenMonitoringEnabled,
 		Runtimes:               runtimeConfigs,
+		Features:                client.Features(),
 	}
 
 	// Detect and fill resource information
@@ -128,20 +191,50 @@ The agent will continue running without screen monitoring.
 	log.Printf("Resources detected - CPU: %d cores, Memory: %.2f GB, Disk: %.2f GB, GPU: %d, Public IPs: %v",
 		registerReq.CPUCores, registerReq.MemoryGB, registerReq.DiskSpaceGB, len(registerReq.GPUInfo), registerReq.PublicIPs)
 
-	registerResp, err := httpClient.RegisterRunner(ctx, registerReq)
+	registerResp, err := registerRunner(ctx, httpClient, registerReq, identity, tlsConfig, cfg.Work.Directory)
 	if err != nil {
-		log.Fatalf("Registration failed to mothership %s: %v", cfg.Server.Address, err)
+		log.Fatalf("Registration to mothership %s failed: %v", address, err)
 	}
 
-	if !registerResp.Success {
-		log.Fatalf("Registration to mothership %s failed: %s", cfg.Server.Address, registerResp.Message)
+	runnerID := registerResp.RunnerID
+	if registerResp.RunnerSecret != "" {
+		runnerSecret = registerResp.RunnerSecret
 	}
 
-	runnerID := registerResp.RunnerID
-	log.Printf("✅ Successfully registered to mothership %s with runner ID: %s", cfg.Server.Address, runnerID)
+	log.Printf("✅ Successfully registered to mothership %s with runner ID: %s", address, runnerID)
 
 	// Recreate client with runner ID
-	httpClient = client.NewClient(cfg.Server.Address, runnerID)
+	httpClient = client.NewClient(address, runnerID)
+	httpClient.SetAgentVersion(version)
+	httpClient.SetRunnerSecret(runnerSecret)
+	httpClient.SetTLSConfig(tlsConfig)
+
+	// Fail over to another mothership endpoint when this one stays unreachable. The
+	// device ID and runner secret keep the runner's identity across the registration;
+	// if the runner ID changes anyway, registerRunner requests a matching certificate.
+	httpClient.SetFailover(func(ctx context.Context) error {
+		address, err := endpointList.Failover(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("Registering to mothership: %s", address)
+		registerClient := client.NewClient(address, "")
+		registerClient.SetTLSConfig(tlsConfig)
+		registerReq.RunnerSecret = runnerSecret
+		resp, err := registerRunner(ctx, registerClient, registerReq, identity, tlsConfig, cfg.Work.Directory)
+		if err != nil {
+			return fmt.Errorf("registration to mothership %s failed: %w", address, err)
+		}
+		if resp.RunnerSecret != "" {
+			runnerSecret = resp.RunnerSecret
+		}
+		if previous := httpClient.RunnerID(); resp.RunnerID != previous {
+			log.Printf("Warning: Mothership %s registered this device as runner %s, was %s", address, resp.RunnerID, previous)
+		}
+		httpClient.SetEndpoint(address, resp.RunnerID, runnerSecret)
+		log.Printf("✅ Failed over to mothership %s with runner ID: %s", address, resp.RunnerID)
+		return nil
+	})
 
 	// Attempt to connect WebSocket for real-time communication
 	log.Printf("Attempting to connect WebSocket to mothership...")
@@ -156,6 +249,20 @@ The agent will continue running without screen monitoring.
 	if err != nil {
 		log.Fatalf("Failed to create executor: %v", err)
 	}
+	killGrace := time.Duration(cfg.Tasks.KillGraceSeconds) * time.Second
+	if err := exec.SetKillPolicy(cfg.Tasks.KillSignal, killGrace); err != nil {
+		log.Fatalf("Invalid tasks.kill_signal or tasks.kill_grace_seconds: %v", err)
+	}
+	if err := exec.SetWasmMemory(cfg.Tasks.WasmMemoryMB, cfg.Tasks.WasmTotalMemoryMB); err != nil {
+		log.Fatalf("Invalid tasks.wasm_memory_mb or tasks.wasm_total_memory_mb: %v", err)
+	}
+	if err := exec.SetSandboxPolicy(executor.SandboxPolicy{
+		Mode:          cfg.Sandbox.Mode,
+		AllowNetwork:  cfg.Sandbox.AllowNetwork,
+		ReadOnlyPaths: cfg.Sandbox.ReadOnlyPaths,
+	}); err != nil {
+		log.Fatalf("Invalid sandbox configuration: %v", err)
+	}
 
 	// Convert runtime configs to executor format and set them
 	executorRuntimes := make([]executor.RuntimeConfig, 0, len(cfg.Runtimes))
@@ -184,6 +291,19 @@ The agent will continue running without screen monitoring.
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Status updates, results and artifacts are kept on disk until the mothership has them
+	ob, err := outbox.Open(filepath.Join(cfg.Work.Directory, ".outbox"), func(ctx context.Context, entry *outbox.Entry) error {
+		return deliver(ctx, httpClient, up, entry)
+	})
+	if err != nil {
+		log.Fatalf("Failed to open outbox: %v", err)
+	}
+	httpClient.SetOnAgentReconnect(ob.Wake)
+	go ob.Run(ctx)
+
+	// Renew the client certificate before it expires
+	go renewClientCertificate(ctx, httpClient, identity, runnerName, cfg.Work.Directory)
+
 	// Screen streaming management
 	var streamingCtx context.Context
 	var streamingCancel context.CancelFunc
@@ -354,8 +474,8 @@ The agent will continue running without screen monitoring.
 								ErrorMessage: fmt.Sprintf("failed to download file: %v", err),
 								Timestamp:    time.Now().Unix(),
 							}
-							if err := httpClient.SendTaskStatusWebSocket(ctx, taskID, failReq); err != nil {
-								httpClient.UpdateTaskStatusWithID(ctx, taskID, failReq)
+							if err := ob.Send(&outbox.Entry{Kind: outbox.KindStatus, TaskID: taskID, Status: failReq}); err != nil {
+								log.Printf("Failed to queue status of task %s: %v", taskID, err)
 							}
 							activeTasks.Delete(taskID)
 							hb.SetActiveTasks(int32(len(semaphore)))
@@ -368,28 +488,21 @@ The agent will continue running without screen monitoring.
 						Status:    "running",
 						Timestamp: time.Now().Unix(),
 					}
-					if err := httpClient.SendTaskStatusWebSocket(ctx, taskID, statusReq); err != nil {
-						httpClient.UpdateTaskStatusWithID(ctx, taskID, statusReq)
+					if err := ob.Send(&outbox.Entry{Kind: outbox.KindStatus, TaskID: taskID, Status: statusReq}); err != nil {
+						log.Printf("Failed to queue status of task %s: %v", taskID, err)
 					}
 
-					// Create stdout/stderr buffers
-					stdoutBuf := make([]byte, 0)
-					stderrBuf := make([]byte, 0)
-
-					// Create multi-writers to capture output
-					stdoutWriter := &bufferWriter{
-						buf:    &stdoutBuf,
-						client: httpClient,
-						taskID: taskID,
-						ctx:    ctx,
-					}
-					stderrWriter := &bufferWriter{
-						buf:    &stderrBuf,
-						client: httpClient,
-						taskID: taskID,
-						ctx:    ctx,
-						isErr:  true,
-					}
+					// Stream output to mothership while the task runs. Motherships without log
+					// streaming receive the end of the output with the final status instead.
+					streamLogs := httpClient.ServerSupports(client.FeatureLogStreaming)
+					output := logstream.New(ctx, taskID, func(ctx context.Context, chunks []client.TaskLogChunk) (int64, error) {
+						if !streamLogs {
+							return chunks[len(chunks)-1].Seq, nil
+						}
+						return httpClient.AppendTaskLogs(ctx, taskID, chunks)
+					}, logstream.DefaultMaxBuffered)
+					stdoutWriter := output.Writer(logstream.Stdout)
+					stderrWriter := output.Writer(logstream.Stderr)
 
 					// Convert client.Job to executor.Job
 					execJob := &executor.Job{
@@ -407,10 +520,33 @@ The agent will continue running without screen monitoring.
 						RequiredFiles:    j.RequiredFiles,
 						ExecutorBinaryID: j.ExecutorBinaryID,
 						TaskData:         j.TaskData,
+						TaskToken:        j.TaskToken,
+						APIURL:           httpClient.BaseURL(),
+					}
+					if j.Limits != nil {
+						execJob.Limits = executor.ResourceLimits{
+							CPU:      j.Limits.CPU,
+							MemoryMB: j.Limits.MemoryMB,
+							Pids:     j.Limits.Pids,
+							IOWeight: j.Limits.IOWeight,
+						}
+					}
+					if j.Sandbox != nil {
+						execJob.Sandbox = executor.SandboxOptions{
+							Enabled: j.Sandbox.Enabled,
+							Network: j.Sandbox.Network,
+						}
 					}
 
 					// Execute task
 					result, err := exec.Execute(ctx, execJob, taskDir, stdoutWriter, stderrWriter)
+					if result == nil {
+						result = &executor.ExecuteResult{ExitCode: -1}
+					}
+
+					if err := output.Close(outputFlushTimeout); err != nil {
+						log.Printf("Failed to send output of task %s: %v", taskID, err)
+					}
 
 					status := "completed"
 					exitCode := result.ExitCode
@@ -420,6 +556,10 @@ The agent will continue running without screen monitoring.
 						status = "failed"
 						if err != nil {
 							errorMsg = err.Error()
+						} else if errors.Is(result.Error, executor.ErrOutOfMemory) ||
+							errors.Is(result.Error, executor.ErrTimedOut) ||
+							errors.Is(result.Error, executor.ErrStopped) {
+							errorMsg = result.Error.Error()
 						}
 					}
 
@@ -429,20 +569,20 @@ The agent will continue running without screen monitoring.
 						resultJSONPath := filepath.Join(taskDir, "result.json")
 						if resultData, err := os.ReadFile(resultJSONPath); err == nil {
 							// Upload result
-							if err := httpClient.UploadJobResult(ctx, j.TaskID, j.JobID, string(resultData), taskDir); err != nil {
-								log.Printf("Failed to upload job result: %v", err)
+							if err := ob.Send(&outbox.Entry{Kind: outbox.KindResult, TaskID: j.TaskID, JobID: j.JobID, ResultData: string(resultData), Dir: taskDir}); err != nil {
+								log.Printf("Failed to queue job result: %v", err)
 							}
 						} else {
 							// If no result.json, create one from stdout if available
-							if len(stdoutBuf) > 0 {
+							if stdoutTail := output.Tail(logstream.Stdout); len(stdoutTail) > 0 {
 								resultData := map[string]interface{}{
-									"stdout": string(stdoutBuf),
-									"stderr": string(stderrBuf),
+									"stdout": string(stdoutTail),
+									"stderr": string(output.Tail(logstream.Stderr)),
 									"exit_code": exitCode,
 								}
 								resultJSON, _ := json.Marshal(resultData)
-								if err := httpClient.UploadJobResult(ctx, j.TaskID, j.JobID, string(resultJSON), taskDir); err != nil {
-									log.Printf("Failed to upload job result: %v", err)
+								if err := ob.Send(&outbox.Entry{Kind: outbox.KindResult, TaskID: j.TaskID, JobID: j.JobID, ResultData: string(resultJSON), Dir: taskDir}); err != nil {
+									log.Printf("Failed to queue job result: %v", err)
 								}
 							}
 						}
@@ -451,9 +591,8 @@ The agent will continue running without screen monitoring.
 					// Upload artifacts if any
 					artifactDir := filepath.Join(taskDir, "artifacts")
 					if _, err := os.Stat(artifactDir); err == nil {
-						_, err := up.UploadArtifacts(ctx, taskID, artifactDir)
-						if err != nil {
-							log.Printf("Failed to upload artifacts: %v", err)
+						if err := ob.Send(&outbox.Entry{Kind: outbox.KindArtifacts, TaskID: taskID, Dir: artifactDir}); err != nil {
+							log.Printf("Failed to queue artifacts: %v", err)
 						}
 					}
 
@@ -462,12 +601,23 @@ The agent will continue running without screen monitoring.
 						Status:       status,
 						ExitCode:     &exitCode,
 						ErrorMessage: errorMsg,
-						Stdout:       stdoutBuf,
-						Stderr:       stderrBuf,
 						Timestamp:    time.Now().Unix(),
 					}
-					if err := httpClient.SendTaskStatusWebSocket(ctx, taskID, finalStatusReq); err != nil {
-						httpClient.UpdateTaskStatusWithID(ctx, taskID, finalStatusReq)
+					if usage := result.Usage; usage != nil {
+						finalStatusReq.Usage = &client.TaskUsage{
+							PeakMemoryBytes: usage.PeakMemoryBytes,
+							CPUTimeMs:       usage.CPUTime.Milliseconds(),
+							OOMKilled:       usage.OOMKilled,
+
+							LimitsNotEnforced: usage.LimitsNotEnforced,
+						}
+					}
+					if !streamLogs {
+						finalStatusReq.Stdout = output.Tail(logstream.Stdout)
+						finalStatusReq.Stderr = output.Tail(logstream.Stderr)
+					}
+					if err := ob.Send(&outbox.Entry{Kind: outbox.KindStatus, TaskID: taskID, Status: finalStatusReq}); err != nil {
+						log.Printf("Failed to queue status of task %s: %v", taskID, err)
 					}
 
 					log.Printf("Task %s completed with status %s", taskID, status)
@@ -491,8 +641,13 @@ The agent will continue running without screen monitoring.
 	cancel()
 	hb.Stop()
 
-	// Wait for active tasks to complete (with timeout)
-	timeout := time.After(30 * time.Second)
+	// Wait for active tasks to complete (with timeout). Cancelled tasks may take up to
+	// twice the kill grace period to stop: once for their first process, once for the rest.
+	shutdownWait := 30 * time.Second
+	if wait := 2*killGrace + 15*time.Second; wait > shutdownWait {
+		shutdownWait = wait
+	}
+	timeout := time.After(shutdownWait)
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
@@ -516,6 +671,152 @@ The agent will continue running without screen monitoring.
 	}
 }
 
+// outputFlushTimeout is how long a finished task waits for its remaining output to be delivered
+const outputFlushTimeout = 30 * time.Second
+
+// deliver sends an outbox entry to the mothership, with the entry's idempotency key so
+// entries delivered before are not applied twice
+func deliver(ctx context.Context, httpClient *client.Client, up *uploader.Uploader, entry *outbox.Entry) error {
+	ctx = client.WithIdempotencyKey(ctx, entry.Key)
+
+	var err error
+	switch entry.Kind {
+	case outbox.KindStatus:
+		// WebSocket with HTTP fallback
+		if err = httpClient.SendTaskStatusWebSocket(ctx, entry.TaskID, entry.Status); err != nil {
+			_, err = httpClient.UpdateTaskStatusWithID(ctx, entry.TaskID, entry.Status)
+		}
+	case outbox.KindResult:
+		err = httpClient.UploadJobResult(ctx, entry.TaskID, entry.JobID, entry.ResultData, entry.Dir)
+	case outbox.KindArtifacts:
+		if _, statErr := os.Stat(entry.Dir); statErr != nil {
+			return outbox.Permanent(statErr)
+		}
+		_, err = up.UploadArtifacts(ctx, entry.TaskID, entry.Dir)
+	default:
+		return outbox.Permanent(fmt.Errorf("unknown outbox entry kind %q", entry.Kind))
+	}
+
+	var statusErr *client.StatusError
+	if errors.As(err, &statusErr) && statusErr.Permanent() {
+		return outbox.Permanent(err)
+	}
+	return err
+}
+
+// certRenewRetryInterval is how long to wait after a failed certificate renewal
+const certRenewRetryInterval = 5 * time.Minute
+
+// registerRunner registers with the mothership c talks to and keeps the client certificate
+// usable. A CSR is sent when there is no certificate or it is due for renewal. When the
+// mothership assigns another runner ID than the certificate's or issues a new secret, the
+// certificate no longer matches the runner, so the runner registers again with a CSR. A
+// secret issued by either registration is stored, set on req and returned in the response.
+func registerRunner(ctx context.Context, c *client.Client, req *client.RegisterRunnerRequest, identity *credential.Identity, tlsConfig *tls.Config, dir string) (*client.RegisterRunnerResponse, error) {
+	var issuedSecret string
+	for attempt := 0; ; attempt++ {
+		var keyPEM []byte
+		req.CSR = ""
+		if renewAt := identity.RenewAt(); attempt > 0 || renewAt.IsZero() || time.Now().After(renewAt) {
+			var csrPEM []byte
+			var err error
+			keyPEM, csrPEM, err = credential.NewKeyAndCSR(req.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create client certificate request: %w", err)
+			}
+			req.CSR = string(csrPEM)
+		}
+
+		resp, err := c.RegisterRunner(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Success {
+			return nil, errors.New(resp.Message)
+		}
+
+		// Persist the secret issued in exchange for the enrollment token before anything
+		// else can fail, and register again with it so the token is not used twice
+		if resp.RunnerSecret != "" {
+			if err := credential.SaveRunnerSecret(dir, resp.RunnerSecret); err != nil {
+				return nil, fmt.Errorf("failed to store runner secret: %w", err)
+			}
+			log.Println("Enrolled with mothership, runner secret stored")
+			issuedSecret = resp.RunnerSecret
+			req.RunnerSecret = resp.RunnerSecret
+		}
+		resp.RunnerSecret = issuedSecret
+
+		// Persist the client certificate issued for our CSR
+		if resp.Certificate != "" && keyPEM != nil {
+			if err := storeClientCertificate(dir, identity, &resp.CertificateResponse, keyPEM); err != nil {
+				return nil, fmt.Errorf("failed to store client certificate: %w", err)
+			}
+			// Trust the internal CA from now on
+			tlsConfig.RootCAs.AppendCertsFromPEM([]byte(resp.CACertificate))
+			log.Printf("Client certificate stored, valid until %s", resp.ExpiresAt.Format(time.RFC3339))
+			return resp, nil
+		}
+
+		if keyPEM != nil || (identity.RunnerID() == resp.RunnerID && issuedSecret == "") {
+			return resp, nil
+		}
+		log.Printf("Client certificate no longer matches runner %s, requesting a new one", resp.RunnerID)
+	}
+}
+
+// storeClientCertificate saves an issued certificate and makes it the current identity
+func storeClientCertificate(dir string, identity *credential.Identity, resp *client.CertificateResponse, keyPEM []byte) error {
+	cert, err := credential.SaveCertificate(dir, []byte(resp.Certificate), keyPEM, []byte(resp.CACertificate))
+	if err != nil {
+		return err
+	}
+	identity.Set(cert)
+	return nil
+}
+
+// renewClientCertificate renews the client certificate after two thirds of its lifetime,
+// retrying until it succeeds. Returns immediately if the runner has no certificate.
+func renewClientCertificate(ctx context.Context, c *client.Client, identity *credential.Identity, name, dir string) {
+	for {
+		renewAt := identity.RenewAt()
+		if renewAt.IsZero() {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(renewAt)):
+		}
+
+		err := func() error {
+			keyPEM, csrPEM, err := credential.NewKeyAndCSR(name)
+			if err != nil {
+				return err
+			}
+			resp, err := c.RenewCertificate(ctx, csrPEM)
+			if err != nil {
+				return err
+			}
+			return storeClientCertificate(dir, identity, resp, keyPEM)
+		}()
+		if err != nil {
+			log.Printf("Failed to renew client certificate (expires %s): %v", identity.NotAfter().Format(time.RFC3339), err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(certRenewRetryInterval):
+			}
+			continue
+		}
+
+		// The mothership only accepts the newest certificate, so reconnect with it
+		c.CloseIdleConnections()
+		log.Printf("Client certificate renewed, valid until %s", identity.NotAfter().Format(time.RFC3339))
+	}
+}
+
 func getHostname() string {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -530,36 +831,3 @@ func getLabels() map[string]string {
 	labels["arch"] = runtime.GOARCH
 	return labels
 }
-
-// bufferWriter captures output and sends it to mothership
-type bufferWriter struct {
-	buf    *[]byte
-	client *client.Client
-	taskID string
-	ctx    context.Context
-	isErr  bool
-}
-
-func (w *bufferWriter) Write(p []byte) (n int, err error) {
-	*w.buf = append(*w.buf, p...)
-
-	// Send output update (WebSocket with HTTP fallback)
-	req := &client.UpdateTaskStatusRequest{
-		Status:    "running",
-		Timestamp: time.Now().Unix(),
-	}
-	if w.isErr {
-		req.Stderr = p
-	} else {
-		req.Stdout = p
-	}
-
-	// Don't block on status updates
-	go func() {
-		if err := w.client.SendTaskStatusWebSocket(w.ctx, w.taskID, req); err != nil {
-			w.client.UpdateTaskStatusWithID(w.ctx, w.taskID, req)
-		}
-	}()
-
-	return len(p), nil
-}
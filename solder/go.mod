@@ -6,7 +6,9 @@ require (
 	github.com/gorilla/websocket v1.5.3
 	github.com/kbinani/screenshot v0.0.0-20230812210009-b87d31814237
 	github.com/spf13/viper v1.18.2
+	github.com/tetratelabs/wazero v1.8.2
 	golang.org/x/image v0.15.0
+	golang.org/x/sys v0.15.0
 )
 
 require (
@@ -28,7 +30,6 @@ require (
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.9.0 // indirect
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9 // indirect
-	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
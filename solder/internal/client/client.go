@@ -3,16 +3,20 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -24,6 +28,22 @@ type Client struct {
 	httpClient *http.Client
 	runnerID   string
 
+	// Secret issued at enrollment, sent as a bearer token on runner endpoints
+	runnerSecret string
+
+	// Guards baseURL, runnerID and runnerSecret, which change on failover
+	endpointMu sync.RWMutex
+
+	// Moves the client to another mothership endpoint, see SetFailover
+	failover func(ctx context.Context) error
+	// Held while failing over, so the agent WebSocket and HTTP requests fail over once
+	failoverMu sync.Mutex
+	// Polls and heartbeats in a row that found the mothership unreachable
+	unreachable atomic.Int32
+
+	// TLS configuration with the runner's client certificate, nil for the defaults
+	tlsConfig *tls.Config
+
 	// WebSocket connection for screen streaming
 	screenWSConn   *websocket.Conn
 	screenWSMu     sync.Mutex
@@ -32,6 +52,12 @@ type Client struct {
 	// WebSocket connection for agent communication
 	agentWSClient *AgentWebSocketClient
 	agentWSMu     sync.Mutex
+
+	// Version reported in the agent WebSocket handshake
+	agentVersion string
+
+	// Called after the agent WebSocket reconnected
+	onAgentReconnect func()
 }
 
 // NewClient creates a new HTTP client connection to mothership
@@ -50,7 +76,189 @@ func NewClient(baseURL, runnerID string) *Client {
 
 // SetRunnerID sets the runner ID for the client
 func (c *Client) SetRunnerID(runnerID string) {
+	c.endpointMu.Lock()
+	defer c.endpointMu.Unlock()
+	c.runnerID = runnerID
+}
+
+// RunnerID returns the runner ID the mothership assigned at registration
+func (c *Client) RunnerID() string {
+	c.endpointMu.RLock()
+	defer c.endpointMu.RUnlock()
+	return c.runnerID
+}
+
+// BaseURL returns the URL of the mothership endpoint in use
+func (c *Client) BaseURL() string {
+	c.endpointMu.RLock()
+	defer c.endpointMu.RUnlock()
+	return c.baseURL
+}
+
+// SetEndpoint moves the client to another mothership endpoint, with the runner ID and
+// secret of the registration there. An open agent WebSocket connects to it when it
+// reconnects.
+func (c *Client) SetEndpoint(baseURL, runnerID, secret string) {
+	c.endpointMu.Lock()
+	c.baseURL = baseURL
 	c.runnerID = runnerID
+	c.runnerSecret = secret
+	c.endpointMu.Unlock()
+
+	c.agentWSMu.Lock()
+	defer c.agentWSMu.Unlock()
+	if c.agentWSClient != nil {
+		c.agentWSClient.SetEndpoint(baseURL, runnerID, c.authHeader())
+	}
+}
+
+// SetFailover sets a function that moves the client to another mothership endpoint with
+// SetEndpoint. It is called when the agent WebSocket cannot reconnect to the current
+// endpoint, or when task polls and heartbeats over HTTP keep failing.
+func (c *Client) SetFailover(fn func(ctx context.Context) error) {
+	c.agentWSMu.Lock()
+	defer c.agentWSMu.Unlock()
+	c.failover = fn
+}
+
+// Failover moves the client to another mothership endpoint. It returns errNoFailover
+// without a failover function and errFailoverInProgress while another failover runs.
+func (c *Client) Failover(ctx context.Context) error {
+	if !c.failoverMu.TryLock() {
+		return errFailoverInProgress
+	}
+	defer c.failoverMu.Unlock()
+
+	c.agentWSMu.Lock()
+	fn := c.failover
+	c.agentWSMu.Unlock()
+	if fn == nil {
+		return errNoFailover
+	}
+	if err := fn(ctx); err != nil {
+		return err
+	}
+	c.unreachable.Store(0)
+	return nil
+}
+
+// checkReachable counts polls and heartbeats that could not reach the mothership and
+// fails over after failoverAttempts of them in a row. Agents polling over HTTP have no
+// agent WebSocket to notice that the endpoint is gone.
+func (c *Client) checkReachable(ctx context.Context, resp *http.Response, err error) {
+	if err == nil {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		default:
+			c.unreachable.Store(0)
+			return
+		}
+	} else if ctx.Err() != nil {
+		return // Cancelled, not a failure of the mothership
+	}
+	if c.unreachable.Add(1) < failoverAttempts {
+		return
+	}
+	log.Printf("Mothership %s unreachable %d times in a row, failing over", c.BaseURL(), failoverAttempts)
+
+	failoverCtx, cancel := context.WithTimeout(context.Background(), failoverTimeout)
+	defer cancel()
+	if err := c.Failover(failoverCtx); err != nil && !errors.Is(err, errNoFailover) && !errors.Is(err, errFailoverInProgress) {
+		log.Printf("Mothership failover failed: %v", err)
+	}
+}
+
+// SetAgentVersion sets the agent version reported to the mothership
+func (c *Client) SetAgentVersion(version string) {
+	c.agentVersion = version
+}
+
+// SetOnAgentReconnect sets a function called whenever the agent WebSocket reconnects
+func (c *Client) SetOnAgentReconnect(fn func()) {
+	c.agentWSMu.Lock()
+	defer c.agentWSMu.Unlock()
+	c.onAgentReconnect = fn
+}
+
+// SetRunnerSecret sets the runner secret used to authenticate with mothership
+func (c *Client) SetRunnerSecret(secret string) {
+	c.endpointMu.Lock()
+	defer c.endpointMu.Unlock()
+	c.runnerSecret = secret
+}
+
+// SetTLSConfig sets the TLS configuration used for HTTPS requests and WebSocket connections
+func (c *Client) SetTLSConfig(tlsConfig *tls.Config) {
+	c.tlsConfig = tlsConfig
+	c.httpClient.Transport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	c.screenWSDialer.TLSClientConfig = tlsConfig
+}
+
+// CloseIdleConnections drops kept-alive connections, e.g. so a renewed client certificate is used
+func (c *Client) CloseIdleConnections() {
+	c.httpClient.CloseIdleConnections()
+}
+
+// authHeader returns the headers that authenticate the runner
+func (c *Client) authHeader() http.Header {
+	c.endpointMu.RLock()
+	secret := c.runnerSecret
+	c.endpointMu.RUnlock()
+
+	header := http.Header{}
+	if secret != "" {
+		header.Set("Authorization", "Bearer "+secret)
+	}
+	return header
+}
+
+// do sends an authenticated request to a runner endpoint
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if auth := c.authHeader().Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if key := IdempotencyKey(req.Context()); key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	return c.httpClient.Do(req)
+}
+
+type idempotencyKeyContext struct{}
+
+// WithIdempotencyKey returns a context whose requests carry key, so the mothership
+// applies a request that is sent several times only once
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContext{}, key)
+}
+
+// IdempotencyKey returns the idempotency key of ctx, or an empty string
+func IdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyContext{}).(string)
+	return key
+}
+
+// StatusError is a request the mothership answered with an error status
+type StatusError struct {
+	Op         string // "request" or "upload"
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s failed with status %d: %s", e.Op, e.StatusCode, e.Body)
+}
+
+// Permanent reports whether sending the request again cannot succeed. 409 answers a
+// request whose Idempotency-Key is in use by a copy still being handled.
+func (e *StatusError) Permanent() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 &&
+		e.StatusCode != http.StatusRequestTimeout && e.StatusCode != http.StatusTooManyRequests &&
+		e.StatusCode != http.StatusConflict
 }
 
 // Close closes the client (closes WebSocket connections if open)
@@ -73,7 +281,9 @@ type RegisterRunnerRequest struct {
 	Architecture       string            `json:"architecture"`
 	MaxConcurrentTasks int32             `json:"max_concurrent_tasks"`
 	Labels             map[string]string `json:"labels"`
-	Token              string            `json:"token"`
+	Token              string            `json:"token"`         // Enrollment token
+	RunnerSecret       string            `json:"runner_secret"` // Secret issued at enrollment, if any
+	CSR                string            `json:"csr,omitempty"` // PEM certificate signing request for a client certificate
 	// Resource information
 	CPUCores                int32             `json:"cpu_cores"`
 	CPUModel                string            `json:"cpu_model"`
@@ -86,6 +296,7 @@ type RegisterRunnerRequest struct {
 	PublicIPs               []string          `json:"public_ips"`
 	ScreenMonitoringEnabled bool              `json:"screen_monitoring_enabled"`
 	Runtimes                []RuntimeConfig   `json:"runtimes"`
+	Features                []string          `json:"features"` // Agent features, for motherships without the WebSocket hello
 }
 
 // GPUInfo represents GPU information
@@ -104,9 +315,49 @@ type RuntimeConfig struct {
 
 // RegisterRunnerResponse represents runner registration response
 type RegisterRunnerResponse struct {
-	RunnerID string `json:"runner_id"`
-	Success  bool   `json:"success"`
-	Message  string `json:"message"`
+	RunnerID     string `json:"runner_id"`
+	RunnerSecret string `json:"runner_secret,omitempty"` // Set when the mothership issued a new secret
+	Success      bool   `json:"success"`
+	Message      string `json:"message"`
+	CertificateResponse
+}
+
+// CertificateResponse carries a client certificate issued by the mothership
+type CertificateResponse struct {
+	Certificate   string    `json:"certificate,omitempty"`    // PEM, empty if runner certificates are disabled
+	CACertificate string    `json:"ca_certificate,omitempty"` // PEM
+	ExpiresAt     time.Time `json:"certificate_expires_at,omitempty"`
+}
+
+// RenewCertificate requests a new client certificate for the key in csrPEM
+func (c *Client) RenewCertificate(ctx context.Context, csrPEM []byte) (*CertificateResponse, error) {
+	body, err := json.Marshal(map[string]string{"csr": string(csrPEM)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL()+"/api/v1/runners/"+c.RunnerID()+"/certificate", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("certificate renewal failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var certResp CertificateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&certResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &certResp, nil
 }
 
 // RegisterRunner registers the runner with mothership
@@ -116,7 +367,7 @@ func (c *Client) RegisterRunner(ctx context.Context, req *RegisterRunnerRequest)
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/v1/runners/register", bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL()+"/api/v1/runners/register", bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -146,7 +397,7 @@ type Job struct {
 	TaskID           string                 `json:"task_id"`
 	JobID            string                 `json:"job_id"`
 	JobName          string                 `json:"job_name"`
-	Type             string                 `json:"type"` // shell, binary, docker, executor_binary
+	Type             string                 `json:"type"` // shell, binary, docker, executor_binary, wasm
 	Command          string                 `json:"command"`
 	Args             []string               `json:"args"`
 	Env              map[string]string      `json:"env"`
@@ -157,16 +408,34 @@ type Job struct {
 	RequiredFiles    []string               `json:"required_files"`
 	ExecutorBinaryID string                `json:"executor_binary_id,omitempty"` // For executor_binary type
 	TaskData         map[string]interface{} `json:"task_data,omitempty"`          // CSV row data
+	TaskToken        string                 `json:"task_token,omitempty"`         // Scoped token for reporting results of this task
+	Limits           *ResourceLimits        `json:"limits,omitempty"`             // Resource limits of the task
+	Sandbox          *SandboxOptions        `json:"sandbox,omitempty"`            // Run the task in a sandbox
+}
+
+// ResourceLimits are the resources a task may use; zero means unlimited
+type ResourceLimits struct {
+	CPU      float64 `json:"cpu"` // CPU cores
+	MemoryMB int64   `json:"memory_mb"`
+	Pids     int32   `json:"pids"`
+	IOWeight int32   `json:"io_weight"`
+}
+
+// SandboxOptions confine a task to its task directory and read-only system paths
+type SandboxOptions struct {
+	Enabled bool `json:"enabled"`
+	Network bool `json:"network"` // Keep network access inside the sandbox
 }
 
 // GetNextTask gets the next task for the runner
 func (c *Client) GetNextTask(ctx context.Context) (*Job, error) {
-	httpReq, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/v1/runners/"+c.runnerID+"/tasks/next", nil)
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL()+"/api/v1/runners/"+c.RunnerID()+"/tasks/next", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	resp, err := c.httpClient.Do(httpReq)
+	resp, err := c.do(httpReq)
+	c.checkReachable(ctx, resp, err)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
@@ -196,12 +465,22 @@ func (c *Client) GetNextTask(ctx context.Context) (*Job, error) {
 
 // UpdateTaskStatusRequest represents task status update request
 type UpdateTaskStatusRequest struct {
-	Status       string `json:"status"` // pending, running, completed, failed, cancelled
-	ExitCode     *int32 `json:"exit_code"`
-	ErrorMessage string `json:"error_message"`
-	Stdout       []byte `json:"stdout"`
-	Stderr       []byte `json:"stderr"`
-	Timestamp    int64  `json:"timestamp"`
+	Status       string     `json:"status"` // pending, running, completed, failed, cancelled
+	ExitCode     *int32     `json:"exit_code"`
+	ErrorMessage string     `json:"error_message"`
+	Stdout       []byte     `json:"stdout"`
+	Stderr       []byte     `json:"stderr"`
+	Timestamp    int64      `json:"timestamp"`
+	Usage        *TaskUsage `json:"usage,omitempty"` // With the final status
+}
+
+// TaskUsage is the resource usage of a finished task
+type TaskUsage struct {
+	PeakMemoryBytes int64 `json:"peak_memory_bytes"`
+	CPUTimeMs       int64 `json:"cpu_time_ms"`
+	OOMKilled       bool  `json:"oom_killed"` // Killed for exceeding the memory limit
+
+	LimitsNotEnforced string `json:"limits_not_enforced,omitempty"` // Why the job's limits were not enforced
 }
 
 // UpdateTaskStatusResponse represents task status update response
@@ -217,13 +496,13 @@ func (c *Client) UpdateTaskStatusWithID(ctx context.Context, taskID string, req
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/v1/tasks/"+taskID+"/status", bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL()+"/api/v1/tasks/"+taskID+"/status", bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(httpReq)
+	resp, err := c.do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
@@ -231,7 +510,7 @@ func (c *Client) UpdateTaskStatusWithID(ctx context.Context, taskID string, req
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		return nil, &StatusError{Op: "request", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 
 	var updateResp UpdateTaskStatusResponse
@@ -242,6 +521,57 @@ func (c *Client) UpdateTaskStatusWithID(ctx context.Context, taskID string, req
 	return &updateResp, nil
 }
 
+// TaskLogChunk is a piece of task output. Seq numbers the chunks of a task from 1.
+type TaskLogChunk struct {
+	Seq       int64  `json:"seq"`
+	Stream    string `json:"stream"` // stdout or stderr
+	Data      []byte `json:"data"`
+	Timestamp int64  `json:"timestamp"` // Unix milliseconds
+}
+
+// AppendTaskLogsRequest carries output chunks in sequence order
+type AppendTaskLogsRequest struct {
+	Chunks []TaskLogChunk `json:"chunks"`
+}
+
+// AppendTaskLogsResponse acknowledges the chunks up to AckedSeq
+type AppendTaskLogsResponse struct {
+	Success  bool  `json:"success"`
+	AckedSeq int64 `json:"acked_seq"`
+}
+
+// AppendTaskLogs sends output chunks of a running task and returns the highest
+// acknowledged sequence number. Resending acknowledged chunks is harmless.
+func (c *Client) AppendTaskLogs(ctx context.Context, taskID string, chunks []TaskLogChunk) (int64, error) {
+	body, err := json.Marshal(&AppendTaskLogsRequest{Chunks: chunks})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL()+"/api/v1/tasks/"+taskID+"/logs", bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var appendResp AppendTaskLogsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&appendResp); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return appendResp.AckedSeq, nil
+}
+
 // ResourceUpdate represents resource information update
 type ResourceUpdate struct {
 	DiskSpaceGB      float64  `json:"disk_space_gb,omitempty"`       // Free/available disk space
@@ -276,13 +606,14 @@ func (c *Client) Heartbeat(ctx context.Context, status string, activeTasks int32
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/v1/runners/"+c.runnerID+"/heartbeat", bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL()+"/api/v1/runners/"+c.RunnerID()+"/heartbeat", bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(httpReq)
+	resp, err := c.do(httpReq)
+	c.checkReachable(ctx, resp, err)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
@@ -303,12 +634,12 @@ func (c *Client) Heartbeat(ctx context.Context, status string, activeTasks int32
 
 // DownloadFile downloads a file from mothership
 func (c *Client) DownloadFile(ctx context.Context, fileID string, writer io.Writer) error {
-	httpReq, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/v1/files/"+fileID+"/download", nil)
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL()+"/api/v1/files/"+fileID+"/download", nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
-	resp, err := c.httpClient.Do(httpReq)
+	resp, err := c.do(httpReq)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
@@ -358,13 +689,13 @@ func (c *Client) UploadArtifact(ctx context.Context, taskID, filename string, re
 		return nil, fmt.Errorf("failed to close multipart writer: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/v1/artifacts/upload", &requestBody)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL()+"/api/v1/artifacts/upload", &requestBody)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	httpReq.Header.Set("Content-Type", writer.FormDataContentType())
 
-	resp, err := c.httpClient.Do(httpReq)
+	resp, err := c.do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
@@ -372,7 +703,7 @@ func (c *Client) UploadArtifact(ctx context.Context, taskID, filename string, re
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		return nil, &StatusError{Op: "upload", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 
 	var uploadResp UploadArtifactResponse
@@ -442,13 +773,13 @@ func (c *Client) UploadScreenshot(ctx context.Context, screenshotData []byte) er
 	}
 
 	httpReq, err := http.NewRequestWithContext(ctx, "POST",
-		c.baseURL+"/api/v1/runners/"+c.runnerID+"/screenshots", &requestBody)
+		c.BaseURL()+"/api/v1/runners/"+c.RunnerID()+"/screenshots", &requestBody)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 	httpReq.Header.Set("Content-Type", writer.FormDataContentType())
 
-	resp, err := c.httpClient.Do(httpReq)
+	resp, err := c.do(httpReq)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
@@ -464,7 +795,7 @@ func (c *Client) UploadScreenshot(ctx context.Context, screenshotData []byte) er
 
 // SendScreenFrame sends a screen frame to mothership for streaming
 func (c *Client) SendScreenFrame(ctx context.Context, frameData []byte) error {
-	if c.runnerID == "" {
+	if c.RunnerID() == "" {
 		return fmt.Errorf("runner ID not set, cannot send screen frame")
 	}
 
@@ -482,13 +813,13 @@ func (c *Client) SendScreenFrame(ctx context.Context, frameData []byte) error {
 	}
 
 	httpReq, err := http.NewRequestWithContext(ctx, "POST",
-		c.baseURL+"/api/v1/runners/"+c.runnerID+"/screen/frame", bytes.NewReader(body))
+		c.BaseURL()+"/api/v1/runners/"+c.RunnerID()+"/screen/frame", bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(httpReq)
+	resp, err := c.do(httpReq)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
@@ -514,12 +845,12 @@ type ScreenStreamStatus struct {
 // GetScreenStreamStatus checks if screen streaming is requested and returns settings
 func (c *Client) GetScreenStreamStatus(ctx context.Context) (*ScreenStreamStatus, error) {
 	httpReq, err := http.NewRequestWithContext(ctx, "GET",
-		c.baseURL+"/api/v1/runners/"+c.runnerID+"/screen/status", nil)
+		c.BaseURL()+"/api/v1/runners/"+c.RunnerID()+"/screen/status", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	resp, err := c.httpClient.Do(httpReq)
+	resp, err := c.do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
@@ -555,12 +886,12 @@ func (c *Client) ConnectScreenWebSocket(ctx context.Context) error {
 		return nil
 	}
 
-	if c.runnerID == "" {
+	if c.RunnerID() == "" {
 		return fmt.Errorf("runner ID not set, cannot connect WebSocket")
 	}
 
 	// Convert HTTP URL to WebSocket URL
-	wsURL, err := url.Parse(c.baseURL)
+	wsURL, err := url.Parse(c.BaseURL())
 	if err != nil {
 		return fmt.Errorf("invalid base URL: %w", err)
 	}
@@ -570,9 +901,9 @@ func (c *Client) ConnectScreenWebSocket(ctx context.Context) error {
 	} else {
 		wsURL.Scheme = "ws"
 	}
-	wsURL.Path = fmt.Sprintf("/ws/screen/agent/%s", c.runnerID)
+	wsURL.Path = fmt.Sprintf("/ws/screen/agent/%s", c.RunnerID())
 
-	conn, _, err := c.screenWSDialer.DialContext(ctx, wsURL.String(), nil)
+	conn, _, err := c.screenWSDialer.DialContext(ctx, wsURL.String(), c.authHeader())
 	if err != nil {
 		return fmt.Errorf("failed to connect WebSocket: %w", err)
 	}
@@ -635,11 +966,20 @@ func (c *Client) ConnectAgentWebSocket(ctx context.Context) error {
 		return nil // Already connected
 	}
 
-	if c.runnerID == "" {
+	if c.RunnerID() == "" {
 		return fmt.Errorf("runner ID not set, cannot connect WebSocket")
 	}
 
-	c.agentWSClient = NewAgentWebSocketClient(c.baseURL, c.runnerID)
+	c.agentWSClient = NewAgentWebSocketClient(c.BaseURL(), c.RunnerID(), c.authHeader(), c.tlsConfig, c.agentVersion)
+	c.agentWSClient.onReconnect = func() {
+		c.agentWSMu.Lock()
+		fn := c.onAgentReconnect
+		c.agentWSMu.Unlock()
+		if fn != nil {
+			fn()
+		}
+	}
+	c.agentWSClient.failover = c.Failover
 	return c.agentWSClient.Connect(ctx)
 }
 
@@ -663,7 +1003,7 @@ func (c *Client) StreamJobsWebSocket(ctx context.Context, jobChan chan<- *Job) e
 				return fmt.Errorf("WebSocket message channel closed")
 			}
 
-			if message.Type == "task_assignment" {
+			if message.Type == MsgTaskAssignment {
 				var job Job
 				if err := json.Unmarshal(message.Data, &job); err != nil {
 					// Log error but continue - will be handled by HTTP fallback
@@ -716,13 +1056,13 @@ func (c *Client) UploadJobResult(ctx context.Context, taskID, jobID, resultDataJ
 		return fmt.Errorf("failed to close multipart writer: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/v1/jobs/"+jobID+"/results/upload", &requestBody)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL()+"/api/v1/jobs/"+jobID+"/results/upload", &requestBody)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 	httpReq.Header.Set("Content-Type", writer.FormDataContentType())
 
-	resp, err := c.httpClient.Do(httpReq)
+	resp, err := c.do(httpReq)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
@@ -730,7 +1070,7 @@ func (c *Client) UploadJobResult(ctx context.Context, taskID, jobID, resultDataJ
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		return &StatusError{Op: "upload", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 
 	return nil
@@ -746,16 +1086,11 @@ func (c *Client) SendHeartbeatWebSocket(ctx context.Context, status string, acti
 		return fmt.Errorf("WebSocket not connected")
 	}
 
-	heartbeatData := map[string]interface{}{
-		"status":       status,
-		"active_tasks": activeTasks,
-	}
-
-	if resources != nil {
-		heartbeatData["resources"] = resources
-	}
-
-	return client.SendMessage("heartbeat", heartbeatData)
+	return client.SendMessage(MsgHeartbeat, HeartbeatMessage{
+		Status:      status,
+		ActiveTasks: activeTasks,
+		Resources:   resources,
+	})
 }
 
 // SendTaskStatusWebSocket sends a task status update via WebSocket
@@ -768,26 +1103,39 @@ func (c *Client) SendTaskStatusWebSocket(ctx context.Context, taskID string, req
 		return fmt.Errorf("WebSocket not connected")
 	}
 
-	statusData := map[string]interface{}{
-		"task_id":   taskID,
-		"status":    req.Status,
-		"timestamp": req.Timestamp,
+	message := TaskStatusMessage{TaskID: taskID, IdempotencyKey: IdempotencyKey(ctx), UpdateTaskStatusRequest: *req}
+	if client.Session().ProtocolVersion == 0 {
+		// Unversioned motherships send replies that cannot be matched to the request
+		return client.SendMessage(MsgTaskStatus, message)
 	}
 
-	if req.ExitCode != nil {
-		statusData["exit_code"] = *req.ExitCode
-	}
-	if req.ErrorMessage != "" {
-		statusData["error_message"] = req.ErrorMessage
+	// Wait for the mothership to confirm, so the caller can fall back to HTTP
+	message.ID = client.newRequestID()
+	reply, err := client.Request(ctx, MsgTaskStatus, message.ID, message, statusReplyTimeout)
+	if err != nil {
+		return err
 	}
-	if len(req.Stdout) > 0 {
-		statusData["stdout"] = req.Stdout
+	var resp TaskStatusResponse
+	if err := json.Unmarshal(reply.Data, &resp); err != nil {
+		return fmt.Errorf("invalid task status response: %w", err)
 	}
-	if len(req.Stderr) > 0 {
-		statusData["stderr"] = req.Stderr
+	if !resp.Success {
+		return fmt.Errorf("task status rejected: %s", resp.Message)
 	}
+	return nil
+}
 
-	return client.SendMessage("task_status", statusData)
+// ServerSupports reports whether the mothership supports an optional feature. Without
+// an agent WebSocket connection the mothership is assumed to be current.
+func (c *Client) ServerSupports(feature string) bool {
+	c.agentWSMu.Lock()
+	client := c.agentWSClient
+	c.agentWSMu.Unlock()
+
+	if client == nil || !client.IsConnected() {
+		return true
+	}
+	return client.Session().Supports(feature)
 }
 
 // IsAgentWebSocketConnected returns whether the agent WebSocket is connected
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPollFailuresTriggerFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("null"))
+	}))
+	defer up.Close()
+
+	c := NewClient(down.URL, "runner-1")
+	failovers := 0
+	c.SetFailover(func(ctx context.Context) error {
+		failovers++
+		c.SetEndpoint(up.URL, "runner-2", "secret")
+		return nil
+	})
+
+	ctx := context.Background()
+	for i := 1; i < failoverAttempts; i++ {
+		if _, err := c.GetNextTask(ctx); err == nil {
+			t.Fatal("GetNextTask succeeded against an unavailable mothership")
+		}
+	}
+	if failovers != 0 {
+		t.Fatalf("failed over after %d failures, want %d", failoverAttempts-1, failoverAttempts)
+	}
+
+	c.GetNextTask(ctx)
+	if failovers != 1 {
+		t.Fatalf("failovers = %d after %d failures in a row, want 1", failovers, failoverAttempts)
+	}
+	if c.BaseURL() != up.URL || c.RunnerID() != "runner-2" {
+		t.Fatalf("client uses %s as %s after failover", c.BaseURL(), c.RunnerID())
+	}
+
+	if _, err := c.GetNextTask(ctx); err != nil {
+		t.Fatalf("GetNextTask after failover: %v", err)
+	}
+}
+
+func TestPollSuccessResetsFailures(t *testing.T) {
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("null"))
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL, "runner-1")
+	c.SetFailover(func(ctx context.Context) error {
+		t.Fatal("failed over although the mothership answered in between")
+		return nil
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 3*failoverAttempts; i++ {
+		healthy.Store(i%failoverAttempts == 0)
+		c.GetNextTask(ctx)
+	}
+}
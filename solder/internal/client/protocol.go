@@ -0,0 +1,134 @@
+package client
+
+import (
+	"fmt"
+)
+
+// Agent WebSocket protocol, mirroring the mothership's. Every message is a
+// {"type", "data"} envelope whose data carries a Header. The agent opens each
+// connection with a hello; a mothership that does not answer it predates protocol
+// versioning and is spoken to in version 0.
+
+// Protocol versions the agent speaks
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Message types
+const (
+	MsgHello              = "hello"
+	MsgWelcome            = "welcome"
+	MsgHeartbeat          = "heartbeat"
+	MsgHeartbeatResponse  = "heartbeat_response"
+	MsgTaskStatus         = "task_status"
+	MsgTaskStatusResponse = "task_status_response"
+	MsgTaskAssignment     = "task_assignment"
+	MsgError              = "error"
+)
+
+// Optional features negotiated in the handshake
+const (
+	FeatureLogStreaming = "log_streaming" // Output is streamed while the task runs
+	FeatureCancel       = "cancel"        // Running tasks can be cancelled
+	FeatureFileCache    = "file_cache"    // Downloaded files are cached
+	FeatureSandbox      = "sandbox"       // Tasks of sandboxed jobs can be run
+)
+
+// agentFeatures are the features this agent supports
+var agentFeatures = []string{FeatureLogStreaming}
+
+// EnableFeature adds a feature that depends on the host to those the agent advertises.
+// Call it before registering.
+func EnableFeature(feature string) {
+	agentFeatures = append(agentFeatures, feature)
+}
+
+// Features returns the features the agent advertises at registration and in the hello
+func Features() []string {
+	return append([]string(nil), agentFeatures...)
+}
+
+// Error codes of "error" replies
+const (
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidMessage     = "invalid_message"
+	ErrCodeNotAssigned        = "not_assigned"
+	ErrCodeInternal           = "internal"
+	ErrCodeInProgress         = "in_progress"
+)
+
+// Header correlates requests and replies
+type Header struct {
+	ID      string `json:"id,omitempty"`       // Chosen by the sender of a request
+	ReplyTo string `json:"reply_to,omitempty"` // ID of the request a reply answers
+}
+
+// Hello opens a connection
+type Hello struct {
+	Header
+	ProtocolVersion    int      `json:"protocol_version"`
+	MinProtocolVersion int      `json:"min_protocol_version"`
+	AgentVersion       string   `json:"agent_version"`
+	Features           []string `json:"features"`
+}
+
+// Welcome accepts a hello
+type Welcome struct {
+	Header
+	ProtocolVersion int      `json:"protocol_version"` // Version used on this connection
+	Features        []string `json:"features"`         // Features both sides support
+}
+
+// HeartbeatMessage reports the runner's state
+type HeartbeatMessage struct {
+	Header
+	Status      string          `json:"status"`
+	ActiveTasks int32           `json:"active_tasks"`
+	Resources   *ResourceUpdate `json:"resources,omitempty"`
+}
+
+// TaskStatusMessage reports a task's status
+type TaskStatusMessage struct {
+	Header
+	TaskID         string `json:"task_id"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	UpdateTaskStatusRequest
+}
+
+// TaskStatusResponse answers a task status
+type TaskStatusResponse struct {
+	Header
+	TaskID  string `json:"task_id,omitempty"`
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// ProtocolError is an "error" reply
+type ProtocolError struct {
+	Header
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Type    string `json:"type,omitempty"` // Type of the rejected message
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("mothership rejected %s message (%s): %s", e.Type, e.Code, e.Message)
+}
+
+// Session is the outcome of the handshake of a connection
+type Session struct {
+	ProtocolVersion int // 0 if the mothership did not answer the hello
+	Features        []string
+}
+
+// Supports reports whether both sides of the connection support a feature
+func (s Session) Supports(feature string) bool {
+	for _, f := range s.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
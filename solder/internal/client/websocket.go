@@ -2,11 +2,16 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,6 +21,7 @@ import (
 type AgentWebSocketClient struct {
 	baseURL    string
 	runnerID   string
+	header     http.Header // Authentication headers sent on dial
 	conn       *websocket.Conn
 	connMu     sync.Mutex
 	dialer     *websocket.Dialer
@@ -24,6 +30,13 @@ type AgentWebSocketClient struct {
 	stopChan   chan struct{}
 	messageChan chan *AgentMessage
 	sendChan   chan []byte // Channel for sending messages (writePump reads from this)
+	agentVersion string
+	session    Session // Negotiated in the handshake, guarded by connMu
+	lastID     uint64  // Last request ID, used atomically
+	pending    map[string]chan *AgentMessage // Requests waiting for a reply, by ID
+	pendingMu  sync.Mutex
+	onReconnect func() // Optional, called after a lost connection was restored
+	failover   func(ctx context.Context) error // Optional, moves to another mothership endpoint
 }
 
 // AgentMessage represents a WebSocket message
@@ -43,18 +56,39 @@ const (
 	agentMaxMessageSize = 512 * 1024 // 512KB
 	// Reconnect delay
 	reconnectDelay = 5 * time.Second
+	// Time to wait for the answer to a hello; older motherships never answer
+	helloTimeout = 10 * time.Second
+	// Time to wait for the mothership to confirm a task status
+	statusReplyTimeout = 10 * time.Second
+	// Failed reconnects in a row before failing over to another mothership endpoint
+	failoverAttempts = 3
+	// Time allowed to find a healthy endpoint and register there
+	failoverTimeout = 60 * time.Second
 )
 
-// NewAgentWebSocketClient creates a new WebSocket client
-func NewAgentWebSocketClient(baseURL, runnerID string) *AgentWebSocketClient {
+// errNoReply means a request was not answered in time
+var errNoReply = errors.New("no reply from mothership")
+
+// errNoFailover means the client has no failover configured
+var errNoFailover = errors.New("no mothership failover configured")
+
+// errFailoverInProgress means another failover is running
+var errFailoverInProgress = errors.New("mothership failover in progress")
+
+// NewAgentWebSocketClient creates a new WebSocket client. tlsConfig carries the runner's
+// client certificate for wss:// connections and may be nil.
+func NewAgentWebSocketClient(baseURL, runnerID string, header http.Header, tlsConfig *tls.Config, agentVersion string) *AgentWebSocketClient {
 	return &AgentWebSocketClient{
 		baseURL:     baseURL,
 		runnerID:    runnerID,
-		dialer:      &websocket.Dialer{HandshakeTimeout: 10 * time.Second},
+		header:      header,
+		dialer:      &websocket.Dialer{HandshakeTimeout: 10 * time.Second, TLSClientConfig: tlsConfig},
 		reconnect:   true,
 		stopChan:    make(chan struct{}),
 		messageChan: make(chan *AgentMessage, 256),
 		sendChan:    make(chan []byte, 256), // Buffer up to 256 messages - all writes go through this
+		agentVersion: agentVersion,
+		pending:     make(map[string]chan *AgentMessage),
 	}
 }
 
@@ -71,10 +105,11 @@ func (c *AgentWebSocketClient) Connect(ctx context.Context) error {
 	c.sendChan = make(chan []byte, 256)
 	c.stopChan = make(chan struct{})
 	
+	baseURL, runnerID, header := c.baseURL, c.runnerID, c.header
 	c.connMu.Unlock()
 
 	// Convert HTTP URL to WebSocket URL
-	wsURL, err := url.Parse(c.baseURL)
+	wsURL, err := url.Parse(baseURL)
 	if err != nil {
 		return fmt.Errorf("invalid base URL: %w", err)
 	}
@@ -84,9 +119,9 @@ func (c *AgentWebSocketClient) Connect(ctx context.Context) error {
 	} else {
 		wsURL.Scheme = "ws"
 	}
-	wsURL.Path = fmt.Sprintf("/ws/agent/%s", c.runnerID)
+	wsURL.Path = fmt.Sprintf("/ws/agent/%s", runnerID)
 
-	conn, _, err := c.dialer.DialContext(ctx, wsURL.String(), nil)
+	conn, _, err := c.dialer.DialContext(ctx, wsURL.String(), header)
 	if err != nil {
 		return fmt.Errorf("failed to connect WebSocket: %w", err)
 	}
@@ -108,9 +143,132 @@ func (c *AgentWebSocketClient) Connect(ctx context.Context) error {
 	go c.readPump()
 	go c.writePump()
 
+	if err := c.handshake(ctx); err != nil {
+		var protocolErr *ProtocolError
+		if errors.As(err, &protocolErr) && protocolErr.Code == ErrCodeUnsupportedVersion {
+			// Reconnecting cannot help until the agent or the mothership is upgraded
+			c.connMu.Lock()
+			c.reconnect = false
+			c.connMu.Unlock()
+		}
+		conn.Close()
+		return fmt.Errorf("WebSocket handshake failed: %w", err)
+	}
+
 	return nil
 }
 
+// handshake says hello and records the protocol version and features both sides support
+func (c *AgentWebSocketClient) handshake(ctx context.Context) error {
+	hello := Hello{
+		Header:             Header{ID: c.newRequestID()},
+		ProtocolVersion:    ProtocolVersion,
+		MinProtocolVersion: MinProtocolVersion,
+		AgentVersion:       c.agentVersion,
+		Features:           Features(),
+	}
+
+	session := Session{}
+	reply, err := c.Request(ctx, MsgHello, hello.ID, hello, helloTimeout)
+	switch {
+	case errors.Is(err, errNoReply):
+		log.Printf("Mothership did not answer hello, using the unversioned agent protocol")
+	case err != nil:
+		return err
+	default:
+		var welcome Welcome
+		if err := json.Unmarshal(reply.Data, &welcome); err != nil {
+			return fmt.Errorf("invalid welcome: %w", err)
+		}
+		session = Session{ProtocolVersion: welcome.ProtocolVersion, Features: welcome.Features}
+		log.Printf("Agent protocol %d negotiated, features %v", session.ProtocolVersion, session.Features)
+	}
+
+	c.connMu.Lock()
+	c.session = session
+	c.connMu.Unlock()
+	return nil
+}
+
+// SetEndpoint changes the mothership endpoint, runner ID and authentication headers used
+// by the next connection
+func (c *AgentWebSocketClient) SetEndpoint(baseURL, runnerID string, header http.Header) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.baseURL = baseURL
+	c.runnerID = runnerID
+	c.header = header
+}
+
+// Session returns the outcome of the handshake of the current connection
+func (c *AgentWebSocketClient) Session() Session {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.session
+}
+
+// newRequestID returns an ID for a request, unique for this client
+func (c *AgentWebSocketClient) newRequestID() string {
+	return strconv.FormatUint(atomic.AddUint64(&c.lastID, 1), 10)
+}
+
+// Request sends a message whose header carries id and waits up to timeout for the
+// reply. An "error" reply is returned as a *ProtocolError.
+func (c *AgentWebSocketClient) Request(ctx context.Context, messageType, id string, data interface{}, timeout time.Duration) (*AgentMessage, error) {
+	replies := make(chan *AgentMessage, 1)
+	c.pendingMu.Lock()
+	c.pending[id] = replies
+	c.pendingMu.Unlock()
+	defer func() {
+		c.pendingMu.Lock()
+		delete(c.pending, id)
+		c.pendingMu.Unlock()
+	}()
+
+	if err := c.SendMessage(messageType, data); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-replies:
+		if reply.Type == MsgError {
+			protocolErr := &ProtocolError{}
+			if err := json.Unmarshal(reply.Data, protocolErr); err != nil {
+				return nil, fmt.Errorf("invalid error reply: %w", err)
+			}
+			return nil, protocolErr
+		}
+		return reply, nil
+	case <-timer.C:
+		return nil, errNoReply
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// deliverReply hands a reply to the request waiting for it. Returns false for messages
+// that are not replies to a pending request.
+func (c *AgentWebSocketClient) deliverReply(message *AgentMessage) bool {
+	var header Header
+	if len(message.Data) == 0 || json.Unmarshal(message.Data, &header) != nil || header.ReplyTo == "" {
+		return false
+	}
+
+	c.pendingMu.Lock()
+	replies, ok := c.pending[header.ReplyTo]
+	c.pendingMu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case replies <- message:
+	default:
+	}
+	return true
+}
+
 // Disconnect closes the WebSocket connection
 func (c *AgentWebSocketClient) Disconnect() error {
 	c.connMu.Lock()
@@ -229,6 +387,18 @@ func (c *AgentWebSocketClient) readPump() {
 			continue
 		}
 
+		// Replies go to the request waiting for them
+		if c.deliverReply(&message) {
+			continue
+		}
+		if message.Type == MsgError {
+			var protocolErr ProtocolError
+			if err := json.Unmarshal(message.Data, &protocolErr); err == nil {
+				log.Printf("%v", &protocolErr)
+			}
+			continue
+		}
+
 		// Send message to channel
 		select {
 		case c.messageChan <- &message:
@@ -312,8 +482,10 @@ func (c *AgentWebSocketClient) writePump() {
 	}
 }
 
-// reconnectLoop attempts to reconnect when connection is lost
+// reconnectLoop attempts to reconnect when connection is lost. After failoverAttempts
+// failed attempts in a row it fails over to another mothership endpoint, if it can.
 func (c *AgentWebSocketClient) reconnectLoop() {
+	failures := 0
 	for c.reconnect {
 		time.Sleep(reconnectDelay)
 		
@@ -323,9 +495,26 @@ func (c *AgentWebSocketClient) reconnectLoop() {
 
 		if err == nil {
 			log.Printf("WebSocket reconnected successfully")
+			if c.onReconnect != nil {
+				c.onReconnect()
+			}
 			return
 		}
-		log.Printf("WebSocket reconnect failed: %v, retrying in %v", err, reconnectDelay)
+
+		failures++
+		if c.failover == nil || failures < failoverAttempts {
+			log.Printf("WebSocket reconnect failed: %v, retrying in %v", err, reconnectDelay)
+			continue
+		}
+		log.Printf("WebSocket reconnect failed %d times: %v, failing over", failures, err)
+		failures = 0
+
+		ctx, cancel = context.WithTimeout(context.Background(), failoverTimeout)
+		err = c.failover(ctx)
+		cancel()
+		if err != nil && !errors.Is(err, errNoFailover) && !errors.Is(err, errFailoverInProgress) {
+			log.Printf("Mothership failover failed: %v, retrying in %v", err, reconnectDelay)
+		}
 	}
 }
 
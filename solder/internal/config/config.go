@@ -14,6 +14,7 @@ type Config struct {
 	Server        ServerConfig        `mapstructure:"server"`
 	Work          WorkConfig          `mapstructure:"work"`
 	Tasks         TasksConfig         `mapstructure:"tasks"`
+	Sandbox       SandboxConfig       `mapstructure:"sandbox"`
 	Heartbeat     HeartbeatConfig     `mapstructure:"heartbeat"`
 	ScreenCapture ScreenCaptureConfig `mapstructure:"screen_capture"`
 	Runtimes      []RuntimeConfig     `mapstructure:"runtimes"`
@@ -25,7 +26,19 @@ type SolderConfig struct {
 }
 
 type ServerConfig struct {
-	Address string `mapstructure:"address"`
+	Address       string   `mapstructure:"address"`
+	Addresses     []string `mapstructure:"addresses"`      // Mothership endpoints in order of preference, replaces Address
+	DiscoveryFile string   `mapstructure:"discovery_file"` // File of "priority weight url" lines, read on every failover
+	CAFile        string   `mapstructure:"ca_file"`        // Extra CA certificate to trust for HTTPS, e.g. the mothership's internal CA
+}
+
+// Endpoints returns the configured mothership addresses in order of preference. Address
+// only counts when neither Addresses nor DiscoveryFile is set.
+func (s ServerConfig) Endpoints() []string {
+	if len(s.Addresses) > 0 || s.DiscoveryFile != "" {
+		return s.Addresses
+	}
+	return []string{s.Address}
 }
 
 type WorkConfig struct {
@@ -33,7 +46,19 @@ type WorkConfig struct {
 }
 
 type TasksConfig struct {
-	MaxConcurrent int32 `mapstructure:"max_concurrent"`
+	MaxConcurrent    int32  `mapstructure:"max_concurrent"`
+	KillSignal       string `mapstructure:"kill_signal"`        // Asks a stopped task to exit
+	KillGraceSeconds int    `mapstructure:"kill_grace_seconds"` // Until the task is killed
+
+	WasmMemoryMB      int64 `mapstructure:"wasm_memory_mb"`       // Linear memory of wasm tasks without a job limit
+	WasmTotalMemoryMB int64 `mapstructure:"wasm_total_memory_mb"` // Of all running wasm tasks, 0 for no bound
+}
+
+// SandboxConfig is the runner's policy for sandboxing shell and dataset tasks
+type SandboxConfig struct {
+	Mode          string   `mapstructure:"mode"`            // job: when the job asks for it, always: every task
+	AllowNetwork  bool     `mapstructure:"allow_network"`   // Jobs may keep network access in the sandbox
+	ReadOnlyPaths []string `mapstructure:"read_only_paths"` // Visible to sandboxed tasks besides the system paths
 }
 
 type HeartbeatConfig struct {
@@ -72,10 +97,20 @@ func Load(configPath string) (*Config, error) {
 
 	// Set defaults
 	viper.SetDefault("solder.name", "")
-	viper.SetDefault("solder.token", "default-token")
+	viper.SetDefault("solder.token", "")
 	viper.SetDefault("server.address", "http://localhost:8080")
+	viper.SetDefault("server.addresses", []string{})
+	viper.SetDefault("server.discovery_file", "")
+	viper.SetDefault("server.ca_file", "")
 	viper.SetDefault("work.directory", "./work")
 	viper.SetDefault("tasks.max_concurrent", 1)
+	viper.SetDefault("tasks.kill_signal", "SIGTERM")
+	viper.SetDefault("tasks.kill_grace_seconds", 10)
+	viper.SetDefault("tasks.wasm_memory_mb", 256)
+	viper.SetDefault("tasks.wasm_total_memory_mb", 0)
+	viper.SetDefault("sandbox.mode", "job")
+	viper.SetDefault("sandbox.allow_network", true)
+	viper.SetDefault("sandbox.read_only_paths", []string{})
 	viper.SetDefault("heartbeat.interval_seconds", 30)
 	viper.SetDefault("screen_capture.enabled", true)
 	viper.SetDefault("screen_capture.interval_seconds", 30.0)
@@ -92,6 +127,9 @@ func Load(configPath string) (*Config, error) {
 	if addr := os.Getenv("MOTHERSHIP_ADDR"); addr != "" {
 		viper.Set("server.address", addr)
 	}
+	if addrs := os.Getenv("MOTHERSHIP_ADDRS"); addrs != "" {
+		viper.Set("server.addresses", strings.Split(addrs, ","))
+	}
 	if name := os.Getenv("RUNNER_NAME"); name != "" {
 		viper.Set("solder.name", name)
 	}
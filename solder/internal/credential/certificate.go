@@ -0,0 +1,194 @@
+package credential
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Client certificate files, stored next to the runner secret
+const (
+	certFileName   = ".runner_cert.pem"
+	keyFileName    = ".runner_key.pem"
+	caCertFileName = ".mothership_ca.pem"
+)
+
+// NewKeyAndCSR generates a private key and a certificate signing request for it.
+// The mothership sets the certificate subject, so the CSR only proves key possession.
+func NewKeyAndCSR(commonName string) (keyPEM, csrPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	csrPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+	return keyPEM, csrPEM, nil
+}
+
+// LoadCertificate returns the stored client certificate, or nil if none is stored
+func LoadCertificate(dir string) (*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, certFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, keyFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client key: %w", err)
+	}
+	return parseCertificate(certPEM, keyPEM)
+}
+
+// SaveCertificate stores a client certificate with its key, and the CA that issued it
+func SaveCertificate(dir string, certPEM, keyPEM, caPEM []byte) (*tls.Certificate, error) {
+	cert, err := parseCertificate(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	// Write the key first so a crash never leaves a certificate without its key
+	if err := os.WriteFile(filepath.Join(dir, keyFileName), keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write client key: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, certFileName), certPEM, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write client certificate: %w", err)
+	}
+	if len(caPEM) > 0 {
+		if err := os.WriteFile(filepath.Join(dir, caCertFileName), caPEM, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write CA certificate: %w", err)
+		}
+	}
+	return cert, nil
+}
+
+// LoadCACertificate returns the stored mothership CA certificate, or nil if none is stored
+func LoadCACertificate(dir string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(dir, caCertFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func parseCertificate(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+	}
+	return &cert, nil
+}
+
+// Identity holds the current client certificate. It can be swapped while
+// connections are open; new TLS handshakes use the latest certificate.
+type Identity struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Set replaces the client certificate
+func (i *Identity) Set(cert *tls.Certificate) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.cert = cert
+}
+
+// NotAfter returns when the current certificate expires, or the zero time without one
+func (i *Identity) NotAfter() time.Time {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cert == nil || i.cert.Leaf == nil {
+		return time.Time{}
+	}
+	return i.cert.Leaf.NotAfter
+}
+
+// RunnerID returns the runner ID the current certificate was issued to (its common name),
+// or "" without a certificate
+func (i *Identity) RunnerID() string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cert == nil || i.cert.Leaf == nil {
+		return ""
+	}
+	return i.cert.Leaf.Subject.CommonName
+}
+
+// RenewAt returns when the current certificate should be renewed: after two thirds
+// of its lifetime. Returns the zero time without a certificate.
+func (i *Identity) RenewAt() time.Time {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cert == nil || i.cert.Leaf == nil {
+		return time.Time{}
+	}
+	leaf := i.cert.Leaf
+	return leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3)
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate. Without a
+// certificate an empty one is sent and the runner falls back to its secret.
+func (i *Identity) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return i.cert, nil
+}
+
+// TLSConfig builds the client TLS configuration. The mothership is trusted through the
+// system roots, the CA file from the configuration and the CA stored at enrollment.
+func TLSConfig(identity *Identity, caFile string, storedCA []byte) (*tls.Config, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, errors.New("CA file contains no certificates")
+		}
+	}
+	if len(storedCA) > 0 {
+		roots.AppendCertsFromPEM(storedCA)
+	}
+
+	return &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		RootCAs:              roots,
+		GetClientCertificate: identity.GetClientCertificate,
+	}, nil
+}
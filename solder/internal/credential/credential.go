@@ -0,0 +1,34 @@
+package credential
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runnerSecretFileName is stored next to the cached device ID
+const runnerSecretFileName = ".runner_secret"
+
+// LoadRunnerSecret returns the runner secret issued at enrollment, or "" if none is stored
+func LoadRunnerSecret(dir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, runnerSecretFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read runner secret: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SaveRunnerSecret stores the runner secret with owner-only permissions
+func SaveRunnerSecret(dir, secret string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, runnerSecretFileName), []byte(secret), 0600); err != nil {
+		return fmt.Errorf("failed to write runner secret: %w", err)
+	}
+	return nil
+}
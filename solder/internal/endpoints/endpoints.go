@@ -0,0 +1,265 @@
+// Package endpoints keeps the mothership endpoints an agent may use and picks a healthy
+// one when the current endpoint stops answering.
+//
+// Endpoints come from the configured address list, in order of preference, and from an
+// optional discovery file in the spirit of DNS SRV records: one endpoint per line as
+// "priority weight url". Lower priorities are preferred; among endpoints of the same
+// priority, one is picked at random in proportion to its weight, spreading agents over
+// the instances. The discovery file is read again on every failover, so endpoints can be
+// added and removed without restarting agents.
+package endpoints
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	healthPath         = "/api/v1/health"
+	healthCheckTimeout = 5 * time.Second
+)
+
+// Endpoint is a mothership base URL
+type Endpoint struct {
+	URL      string
+	Priority int // Lower is preferred
+	Weight   int // Relative share among endpoints of the same priority
+}
+
+// List is the set of mothership endpoints of an agent
+type List struct {
+	addresses     []string
+	discoveryFile string
+	httpClient    *http.Client
+
+	mu      sync.Mutex
+	current string
+}
+
+// New creates a list of the given addresses, in order of preference, and the endpoints
+// of discoveryFile, which may be empty
+func New(addresses []string, discoveryFile string) (*List, error) {
+	l := &List{
+		discoveryFile: discoveryFile,
+		httpClient:    &http.Client{Timeout: healthCheckTimeout},
+	}
+	for _, address := range addresses {
+		if address = strings.TrimSpace(address); address != "" {
+			l.addresses = append(l.addresses, strings.TrimRight(address, "/"))
+		}
+	}
+
+	endpoints, err := l.Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no mothership endpoints configured")
+	}
+	l.current = endpoints[0].URL
+	return l, nil
+}
+
+// SetTLSConfig sets the TLS configuration used for health checks
+func (l *List) SetTLSConfig(tlsConfig *tls.Config) {
+	l.httpClient.Transport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: healthCheckTimeout,
+	}
+}
+
+// Current returns the endpoint in use
+func (l *List) Current() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current
+}
+
+// Endpoints returns every endpoint in order of preference. Endpoints of the same priority
+// are shuffled by weight, so the order differs between calls.
+func (l *List) Endpoints() ([]Endpoint, error) {
+	var endpoints []Endpoint
+	for i, address := range l.addresses {
+		endpoints = append(endpoints, Endpoint{URL: address, Priority: i})
+	}
+	if l.discoveryFile != "" {
+		discovered, err := readDiscoveryFile(l.discoveryFile)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, discovered...)
+	}
+	return order(dedupe(endpoints)), nil
+}
+
+// Select makes the most preferred healthy endpoint current and returns it
+func (l *List) Select(ctx context.Context) (string, error) {
+	return l.pick(ctx, "")
+}
+
+// Failover makes the most preferred healthy endpoint other than the current one current
+// and returns it. The current endpoint is only picked again if no other one is healthy.
+func (l *List) Failover(ctx context.Context) (string, error) {
+	return l.pick(ctx, l.Current())
+}
+
+// pick makes the first healthy endpoint current, trying avoid last
+func (l *List) pick(ctx context.Context, avoid string) (string, error) {
+	endpoints, err := l.Endpoints()
+	if err != nil {
+		return "", err
+	}
+	candidates := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if endpoint.URL != avoid {
+			candidates = append(candidates, endpoint.URL)
+		}
+	}
+	if avoid != "" {
+		candidates = append(candidates, avoid)
+	}
+
+	var errs []error
+	for _, candidate := range candidates {
+		if err := l.Check(ctx, candidate); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", candidate, err))
+			continue
+		}
+		l.mu.Lock()
+		l.current = candidate
+		l.mu.Unlock()
+		return candidate, nil
+	}
+	return "", fmt.Errorf("no healthy mothership endpoint: %w", errors.Join(errs...))
+}
+
+// Check probes the health endpoint of a mothership
+func (l *List) Check(ctx context.Context, endpoint string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+healthPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// Motherships that predate the health endpoint answer 404 when they are up
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("health check failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// readDiscoveryFile parses a discovery file. Blank lines and lines starting with # are
+// ignored.
+func readDiscoveryFile(path string) ([]Endpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read discovery file: %w", err)
+	}
+	defer f.Close()
+
+	var endpoints []Endpoint
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"priority weight url\"", path, lineNo)
+		}
+		priority, err := strconv.Atoi(fields[0])
+		if err != nil || priority < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid priority %q", path, lineNo, fields[0])
+		}
+		weight, err := strconv.Atoi(fields[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid weight %q", path, lineNo, fields[1])
+		}
+		u, err := url.Parse(fields[2])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s:%d: invalid URL %q", path, lineNo, fields[2])
+		}
+		endpoints = append(endpoints, Endpoint{
+			URL:      strings.TrimRight(fields[2], "/"),
+			Priority: priority,
+			Weight:   weight,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read discovery file: %w", err)
+	}
+	return endpoints, nil
+}
+
+// dedupe drops repeated URLs, keeping the first occurrence
+func dedupe(endpoints []Endpoint) []Endpoint {
+	seen := make(map[string]bool, len(endpoints))
+	out := endpoints[:0]
+	for _, endpoint := range endpoints {
+		if !seen[endpoint.URL] {
+			seen[endpoint.URL] = true
+			out = append(out, endpoint)
+		}
+	}
+	return out
+}
+
+// order sorts endpoints by priority and orders each priority by weighted random
+// selection, as RFC 2782 does for SRV records
+func order(endpoints []Endpoint) []Endpoint {
+	sort.SliceStable(endpoints, func(i, j int) bool { return endpoints[i].Priority < endpoints[j].Priority })
+
+	ordered := make([]Endpoint, 0, len(endpoints))
+	for start := 0; start < len(endpoints); {
+		end := start
+		for end < len(endpoints) && endpoints[end].Priority == endpoints[start].Priority {
+			end++
+		}
+		group := append([]Endpoint(nil), endpoints[start:end]...)
+		for len(group) > 0 {
+			i := pickWeighted(group)
+			ordered = append(ordered, group[i])
+			group = append(group[:i], group[i+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
+
+// pickWeighted returns the index of a random endpoint, chosen in proportion to the
+// weights. Endpoints of weight 0 are only chosen when all weights are 0, and then in order.
+func pickWeighted(group []Endpoint) int {
+	total := 0
+	for _, endpoint := range group {
+		total += endpoint.Weight
+	}
+	if total == 0 {
+		return 0
+	}
+	n := rand.Intn(total)
+	for i, endpoint := range group {
+		if n < endpoint.Weight {
+			return i
+		}
+		n -= endpoint.Weight
+	}
+	return 0
+}
@@ -0,0 +1,148 @@
+package endpoints
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func urls(endpoints []Endpoint) []string {
+	out := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		out[i] = endpoint.URL
+	}
+	return out
+}
+
+func TestOrderSortsByPriority(t *testing.T) {
+	endpoints := []Endpoint{
+		{URL: "https://c", Priority: 2, Weight: 10},
+		{URL: "https://a", Priority: 0, Weight: 10},
+		{URL: "https://b", Priority: 1, Weight: 10},
+	}
+	got := urls(order(endpoints))
+	want := []string{"https://a", "https://b", "https://c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+}
+
+func TestOrderKeepsEveryEndpointOfAPriority(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		endpoints := []Endpoint{
+			{URL: "https://a", Priority: 0, Weight: 1},
+			{URL: "https://b", Priority: 0, Weight: 5},
+			{URL: "https://c", Priority: 0, Weight: 0},
+			{URL: "https://d", Priority: 1, Weight: 1},
+		}
+		got := urls(order(endpoints))
+		if len(got) != 4 || got[3] != "https://d" {
+			t.Fatalf("order = %v, want a, b and c before d", got)
+		}
+		// Weight 0 is only picked once no weighted endpoint is left
+		if got[2] != "https://c" {
+			t.Fatalf("order = %v, want the endpoint of weight 0 last in its priority", got)
+		}
+	}
+}
+
+func TestPickWeighted(t *testing.T) {
+	group := []Endpoint{
+		{URL: "https://light", Weight: 1},
+		{URL: "https://heavy", Weight: 3},
+		{URL: "https://never", Weight: 0},
+	}
+	counts := make([]int, len(group))
+	const picks = 4000
+	for i := 0; i < picks; i++ {
+		counts[pickWeighted(group)]++
+	}
+	if counts[2] != 0 {
+		t.Fatalf("endpoint of weight 0 picked %d times", counts[2])
+	}
+	// Expect about 1000 and 3000
+	if counts[0] < 800 || counts[0] > 1200 {
+		t.Fatalf("endpoint of weight 1 picked %d of %d times, want about a quarter", counts[0], picks)
+	}
+
+	if i := pickWeighted([]Endpoint{{URL: "https://a"}, {URL: "https://b"}}); i != 0 {
+		t.Fatalf("pickWeighted without weights = %d, want the first endpoint", i)
+	}
+}
+
+func writeDiscoveryFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "motherships")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadDiscoveryFile(t *testing.T) {
+	path := writeDiscoveryFile(t,
+		"# priority weight url",
+		"",
+		"10 60 https://borg-1.example.com/",
+		"  10 40   https://borg-2.example.com:8443  ",
+		"20 0 http://borg-dr.example.com",
+	)
+	got, err := readDiscoveryFile(path)
+	if err != nil {
+		t.Fatalf("readDiscoveryFile: %v", err)
+	}
+	want := []Endpoint{
+		{URL: "https://borg-1.example.com", Priority: 10, Weight: 60},
+		{URL: "https://borg-2.example.com:8443", Priority: 10, Weight: 40},
+		{URL: "http://borg-dr.example.com", Priority: 20, Weight: 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("readDiscoveryFile = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadDiscoveryFileRejectsInvalidLines(t *testing.T) {
+	for _, line := range []string{
+		"10 https://borg.example.com",
+		"10 60 https://borg.example.com extra",
+		"high 60 https://borg.example.com",
+		"-1 60 https://borg.example.com",
+		"10 -5 https://borg.example.com",
+		"10 60 ftp://borg.example.com",
+		"10 60 borg.example.com",
+	} {
+		if _, err := readDiscoveryFile(writeDiscoveryFile(t, line)); err == nil {
+			t.Fatalf("readDiscoveryFile accepted %q", line)
+		}
+	}
+
+	if _, err := readDiscoveryFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("readDiscoveryFile accepted a missing file")
+	}
+}
+
+func TestNewMergesAddressesAndDiscoveryFile(t *testing.T) {
+	path := writeDiscoveryFile(t, "1 1 https://borg-2.example.com", "0 1 https://borg-1.example.com/")
+	list, err := New([]string{"https://borg-1.example.com/", " "}, path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	endpoints, err := list.Endpoints()
+	if err != nil {
+		t.Fatalf("Endpoints: %v", err)
+	}
+	got := urls(endpoints)
+	want := []string{"https://borg-1.example.com", "https://borg-2.example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Endpoints = %v, want %v", got, want)
+	}
+	if list.Current() != "https://borg-1.example.com" {
+		t.Fatalf("Current = %s, want the first configured address", list.Current())
+	}
+
+	if _, err := New(nil, ""); err == nil {
+		t.Fatal("New accepted no endpoints")
+	}
+}
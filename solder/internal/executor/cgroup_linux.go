@@ -0,0 +1,303 @@
+//go:build linux
+// +build linux
+
+package executor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	cgroupRoot        = "/sys/fs/cgroup"
+	cgroupCPUPeriod   = 100000 // Microseconds
+	cgroupTaskPrefix  = "task-"
+	cgroupRemoveGrace = 5 * time.Second
+)
+
+// cgroupControllers are enabled for task cgroups where the kernel offers them
+var cgroupControllers = []string{"cpu", "memory", "pids", "io"}
+
+// cgroupManager creates a cgroup v2 for each task below the agent's own cgroup. The
+// agent needs write access to its cgroup, e.g. as a systemd service with Delegate=yes.
+type cgroupManager struct {
+	once sync.Once
+	base string // Parent of the task cgroups
+	err  error  // Why tasks cannot get cgroups
+}
+
+func newCgroupManager() *cgroupManager {
+	return &cgroupManager{}
+}
+
+// setup prepares the cgroup holding the task cgroups
+func (m *cgroupManager) setup() error {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return errors.New("cgroup v2 is not mounted at " + cgroupRoot)
+	}
+	if !kernelAtLeast(5, 7) {
+		return errors.New("starting tasks in a cgroup needs Linux 5.7 or newer")
+	}
+	own, err := ownCgroup()
+	if err != nil {
+		return err
+	}
+
+	var base string
+	if own == "/" {
+		// The root cgroup may hold processes and controllers at once
+		base = filepath.Join(cgroupRoot, "solder")
+		if err := os.MkdirAll(base, 0755); err != nil {
+			return fmt.Errorf("failed to create cgroup: %w", err)
+		}
+		if err := enableControllers(cgroupRoot); err != nil {
+			return err
+		}
+	} else {
+		// Other cgroups may not, so the agent moves into a leaf next to the tasks
+		base = filepath.Join(cgroupRoot, own)
+		if err := moveProcesses(base, filepath.Join(base, "agent")); err != nil {
+			return err
+		}
+	}
+	if err := enableControllers(base); err != nil {
+		return err
+	}
+
+	// Task cgroups left by an agent that did not shut down cleanly
+	entries, _ := os.ReadDir(base)
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), cgroupTaskPrefix) {
+			removeCgroup(filepath.Join(base, entry.Name()))
+		}
+	}
+
+	m.base = base
+	return nil
+}
+
+// kernelAtLeast reports whether the running kernel is at least major.minor
+func kernelAtLeast(major, minor int) bool {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return false
+	}
+	var release strings.Builder
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release.WriteByte(byte(c))
+	}
+	var gotMajor, gotMinor int
+	fmt.Sscanf(release.String(), "%d.%d", &gotMajor, &gotMinor)
+	return gotMajor > major || (gotMajor == major && gotMinor >= minor)
+}
+
+// ownCgroup returns the path of the agent's cgroup below the cgroup root
+func ownCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", fmt.Errorf("failed to read own cgroup: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", errors.New("agent is not in a cgroup v2")
+}
+
+// moveProcesses moves every process of the cgroup from into the cgroup to
+func moveProcesses(from, to string) error {
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	procs, err := os.ReadFile(filepath.Join(from, "cgroup.procs"))
+	if err != nil {
+		return fmt.Errorf("failed to list processes of cgroup %s: %w", from, err)
+	}
+	for _, pid := range strings.Fields(string(procs)) {
+		err := os.WriteFile(filepath.Join(to, "cgroup.procs"), []byte(pid), 0644)
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("failed to move process %s to cgroup %s: %w", pid, to, err)
+		}
+	}
+	return nil
+}
+
+// enableControllers makes the available task controllers usable by the children of path
+func enableControllers(path string) error {
+	available, err := os.ReadFile(filepath.Join(path, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("failed to read controllers of cgroup %s: %w", path, err)
+	}
+	var enable []string
+	for _, controller := range cgroupControllers {
+		for _, name := range strings.Fields(string(available)) {
+			if name == controller {
+				enable = append(enable, "+"+controller)
+			}
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(path, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0644); err != nil {
+		return fmt.Errorf("failed to enable controllers of cgroup %s: %w", path, err)
+	}
+	return nil
+}
+
+// taskCgroup is the cgroup of a running task
+type taskCgroup struct {
+	path string
+	dir  *os.File // Open for starting the task directly in the cgroup
+}
+
+// create creates the cgroup of a task with the given limits. If a limit cannot be set,
+// the cgroup is returned together with an error naming the limits not enforced.
+func (m *cgroupManager) create(taskID string, limits ResourceLimits) (*taskCgroup, error) {
+	m.once.Do(func() {
+		if m.err = m.setup(); m.err != nil {
+			log.Printf("Warning: Tasks run without resource limits: %v", m.err)
+		}
+	})
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	path := filepath.Join(m.base, cgroupTaskPrefix+filepath.Base(taskID))
+	removeCgroup(path)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create task cgroup: %w", err)
+	}
+
+	var errs []error
+	if limits.CPU > 0 {
+		quota := int64(limits.CPU * cgroupCPUPeriod)
+		if quota < 1000 {
+			quota = 1000
+		}
+		errs = append(errs, writeLimit(path, "cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)))
+	}
+	if limits.MemoryMB > 0 {
+		errs = append(errs, writeLimit(path, "memory.max", strconv.FormatInt(limits.MemoryMB*1024*1024, 10)))
+		// Kernels without swap accounting have no memory.swap.max and no swap to limit
+		if err := writeLimit(path, "memory.swap.max", "0"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+		// Kill the whole task when one of its processes runs out of memory
+		errs = append(errs, writeLimit(path, "memory.oom.group", "1"))
+	}
+	if limits.Pids > 0 {
+		errs = append(errs, writeLimit(path, "pids.max", strconv.Itoa(int(limits.Pids))))
+	}
+	if limits.IOWeight > 0 {
+		errs = append(errs, writeLimit(path, "io.weight", fmt.Sprintf("default %d", limits.IOWeight)))
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		removeCgroup(path)
+		return nil, fmt.Errorf("failed to open task cgroup: %w", err)
+	}
+	return &taskCgroup{path: path, dir: dir}, errors.Join(errs...)
+}
+
+// writeLimit sets a limit of a task cgroup
+func writeLimit(path, file, value string) error {
+	if err := os.WriteFile(filepath.Join(path, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to set %s: %w", file, err)
+	}
+	return nil
+}
+
+// apply makes cmd start inside the cgroup, so no process of the task escapes it
+func (cg *taskCgroup) apply(cmd *exec.Cmd) {
+	if cg == nil {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.dir.Fd())
+}
+
+// usage reads the resource usage of the task so far
+func (cg *taskCgroup) usage() *Usage {
+	if cg == nil {
+		return nil
+	}
+	usage := &Usage{}
+	if peak, err := os.ReadFile(filepath.Join(cg.path, "memory.peak")); err == nil {
+		usage.PeakMemoryBytes, _ = strconv.ParseInt(strings.TrimSpace(string(peak)), 10, 64)
+	}
+	if usec, ok := readCgroupStat(cg.path, "cpu.stat", "usage_usec"); ok {
+		usage.CPUTime = time.Duration(usec) * time.Microsecond
+	}
+	if kills, ok := readCgroupStat(cg.path, "memory.events", "oom_kill"); ok {
+		usage.OOMKilled = kills > 0
+	}
+	return usage
+}
+
+// remove kills what is left of the task and removes the cgroup
+func (cg *taskCgroup) remove() {
+	if cg == nil {
+		return
+	}
+	cg.dir.Close()
+	removeCgroup(cg.path)
+}
+
+// readCgroupStat reads a "key value" line of a cgroup file
+func readCgroupStat(path, file, key string) (int64, bool) {
+	data, err := os.ReadFile(filepath.Join(path, file))
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			value, err := strconv.ParseInt(fields[1], 10, 64)
+			return value, err == nil
+		}
+	}
+	return 0, false
+}
+
+// removeCgroup kills the processes of a cgroup and removes it once they are gone
+func removeCgroup(path string) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	os.WriteFile(filepath.Join(path, "cgroup.kill"), []byte("1"), 0644)
+
+	deadline := time.Now().Add(cgroupRemoveGrace)
+	for {
+		err := os.Remove(path)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Warning: Failed to remove cgroup %s: %v", path, err)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
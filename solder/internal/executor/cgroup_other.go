@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// cgroupManager is a no-op: only Linux has cgroups
+type cgroupManager struct{}
+
+func newCgroupManager() *cgroupManager {
+	return &cgroupManager{}
+}
+
+// taskCgroup is the cgroup of a running task
+type taskCgroup struct{}
+
+func (m *cgroupManager) create(taskID string, limits ResourceLimits) (*taskCgroup, error) {
+	return nil, errors.New("resource limits are only enforced on Linux")
+}
+
+func (cg *taskCgroup) apply(cmd *exec.Cmd) {}
+
+func (cg *taskCgroup) usage() *Usage {
+	return nil
+}
+
+func (cg *taskCgroup) remove() {}
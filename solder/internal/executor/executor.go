@@ -3,16 +3,21 @@ package executor
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/tetratelabs/wazero"
 )
 
 // RuntimeConfig represents a runtime configuration
@@ -22,11 +27,31 @@ type RuntimeConfig struct {
 	URL  string
 }
 
+// Default way of stopping a task on cancel, timeout or shutdown
+const (
+	DefaultKillSignal = "SIGTERM"
+	DefaultKillGrace  = 10 * time.Second
+)
+
+// killConfirmTimeout is how long the processes of a task may take to die after SIGKILL
+const killConfirmTimeout = 5 * time.Second
+
+// dockerRemoveTimeout bounds "docker rm -f" of a task's container
+const dockerRemoveTimeout = 30 * time.Second
+
 // Executor executes tasks
 type Executor struct {
-	workDir   string
-	runtimes  map[string]RuntimeConfig // runtime name -> config
-	runtimeMu sync.RWMutex
+	workDir    string
+	runtimes   map[string]RuntimeConfig // runtime name -> config
+	runtimeMu  sync.RWMutex
+	cgroups    *cgroupManager
+	killSignal string        // Sent to every process of a task to stop it
+	killGrace  time.Duration // Time between killSignal and SIGKILL
+	sandbox    SandboxPolicy
+	wasmCache  wazero.CompilationCache // Compiled wasm modules, reused across tasks
+
+	wasmDefaultMB int64             // Memory limit of wasm tasks whose job has none
+	wasmMemory    *wasmMemoryBudget // Memory of all running wasm tasks
 }
 
 // NewExecutor creates a new executor
@@ -36,11 +61,34 @@ func NewExecutor(workDir string) (*Executor, error) {
 	}
 	
 	return &Executor{
-		workDir:  workDir,
-		runtimes: make(map[string]RuntimeConfig),
+		workDir:    workDir,
+		runtimes:   make(map[string]RuntimeConfig),
+		cgroups:    newCgroupManager(),
+		killSignal: DefaultKillSignal,
+		killGrace:  DefaultKillGrace,
+		sandbox:    SandboxPolicy{Mode: SandboxModeJob},
+		wasmCache:  wazero.NewCompilationCache(),
+
+		wasmDefaultMB: DefaultWasmMemoryMB,
+		wasmMemory:    newWasmMemoryBudget(0),
 	}, nil
 }
 
+// SetKillPolicy sets how tasks are stopped: signal is sent to all of a task's processes,
+// which are killed if they have not exited after grace. A grace of 0 kills them right
+// away. Windows has no signals and terminates tasks right away.
+func (e *Executor) SetKillPolicy(signal string, grace time.Duration) error {
+	if _, err := parseKillSignal(signal); err != nil {
+		return err
+	}
+	if grace < 0 {
+		return fmt.Errorf("kill grace period must not be negative, got %s", grace)
+	}
+	e.killSignal = signal
+	e.killGrace = grace
+	return nil
+}
+
 // SetRuntimes configures the runtimes available for execution
 func (e *Executor) SetRuntimes(runtimes []RuntimeConfig) {
 	e.runtimeMu.Lock()
@@ -63,8 +111,26 @@ type ExecuteResult struct {
 	Stdout      []byte
 	Stderr      []byte
 	Error       error
+	Usage       *Usage // nil if not measured
+}
+
+// Usage is the resource usage of a task
+type Usage struct {
+	PeakMemoryBytes int64 // 0 if unknown
+	CPUTime         time.Duration
+	OOMKilled       bool // A process of the task was killed for exceeding the memory limit
+
+	// Why the job's resource limits were not (all) enforced, empty if they were
+	LimitsNotEnforced string
 }
 
+// Errors of tasks that were stopped
+var (
+	ErrOutOfMemory = errors.New("task exceeded its memory limit")
+	ErrTimedOut    = errors.New("task timed out")
+	ErrStopped     = errors.New("task was stopped")
+)
+
 // Execute executes a job
 func (e *Executor) Execute(ctx context.Context, job *Job, taskDir string, stdout, stderr io.Writer) (*ExecuteResult, error) {
 	// Create task directory
@@ -72,6 +138,14 @@ func (e *Executor) Execute(ctx context.Context, job *Job, taskDir string, stdout
 		return nil, fmt.Errorf("failed to create task directory: %w", err)
 	}
 	
+	// Set timeout if specified
+	parent := ctx
+	if job.TimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(job.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	
 	var cmd *exec.Cmd
 	var err error
 	
@@ -95,6 +169,9 @@ func (e *Executor) Execute(ctx context.Context, job *Job, taskDir string, stdout
 				cmd, err = e.executeExecutorBinary(ctx, job, taskDir)
 			case "dataset":
 				cmd, err = e.executeDataset(ctx, job, taskDir)
+			case "wasm":
+				// Runs in-process, without a command
+				return e.executeWasm(ctx, parent, job, taskDir, stdout, stderr)
 			default:
 				return nil, fmt.Errorf("unsupported job type: %v", job.Type)
 			}
@@ -111,26 +188,91 @@ func (e *Executor) Execute(ctx context.Context, job *Job, taskDir string, stdout
 		cmd.Dir = taskDir
 	}
 	
-	// Set environment variables
-	env := os.Environ()
+	// Set environment variables, keeping those the job type already set
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
 	for k, v := range job.Env {
 		env = append(env, fmt.Sprintf("%s=%s", k, v))
 	}
 	cmd.Env = env
 	
+	// Confine shell and dataset tasks to a sandbox if their job or the runner asks for it
+	if sandbox := e.sandboxFor(job); sandbox != nil {
+		if err := e.sandboxCommand(cmd, sandbox, taskDir); err != nil {
+			return nil, fmt.Errorf("failed to sandbox task: %w", err)
+		}
+	}
+	
 	// Capture stdout and stderr
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
 	
-	// Set timeout if specified
-	if job.TimeoutSeconds > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(job.TimeoutSeconds)*time.Second)
-		defer cancel()
+	// Run the task in a process tree of its own, so stopping it stops every process it
+	// started. On cancel or timeout the whole tree gets the kill signal, and the first
+	// process is killed if it is still running after the grace period. Without a grace
+	// period the tree is killed at once; WaitDelay 0 would wait for it forever.
+	tree, err := newProcessTree(cmd, e.killSignal)
+	if err != nil {
+		return nil, err
+	}
+	defer tree.close()
+	cmd.Cancel = tree.interrupt
+	cmd.WaitDelay = e.killGrace
+	if e.killGrace == 0 {
+		cmd.Cancel = tree.kill
+		cmd.WaitDelay = killConfirmTimeout
+	}
+	
+	// Run the task in its own cgroup, which enforces the limits and measures usage. Docker
+	// enforces the limits of docker jobs, whose cgroup only holds the docker client.
+	limits := job.Limits
+	if job.Type == "docker" {
+		limits = ResourceLimits{}
+	}
+	cg, cgErr := e.cgroups.create(job.TaskID, limits)
+	if cgErr != nil && !limits.IsZero() {
+		log.Printf("Warning: Running task %s without its resource limits: %v", job.TaskID, cgErr)
+	}
+	cg.apply(cmd)
+	
+	// Execute command, then stop what is left of the task
+	if err = cmd.Start(); err == nil {
+		if startErr := tree.started(); startErr != nil {
+			// The task would run outside its process tree, where it cannot be stopped
+			cmd.Wait()
+			err = startErr
+		} else {
+			err = cmd.Wait()
+		}
+		if errors.Is(err, exec.ErrWaitDelay) && ctx.Err() == nil {
+			// The task succeeded, but processes it left running kept its output open
+			err = nil
+		}
+	}
+	if stopErr := e.stopProcessTree(tree); stopErr != nil {
+		log.Printf("Warning: Task %s: %v", job.TaskID, stopErr)
+	}
+	if job.Type == "docker" {
+		// Killing the docker client leaves its container running
+		if rmErr := removeDockerContainer(job.TaskID); rmErr != nil {
+			log.Printf("Warning: Task %s: %v", job.TaskID, rmErr)
+		}
+	}
+	usage := cg.usage()
+	cg.remove()
+	if usage == nil && cmd.ProcessState != nil {
+		usage = &Usage{CPUTime: cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()}
+	}
+	if cgErr != nil && !limits.IsZero() {
+		// Reported with the final status, so the job's owner learns of it
+		if usage == nil {
+			usage = &Usage{}
+		}
+		usage.LimitsNotEnforced = cgErr.Error()
 	}
 	
-	// Execute command
-	err = cmd.Run()
 	exitCode := int32(0)
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
@@ -139,14 +281,59 @@ func (e *Executor) Execute(ctx context.Context, job *Job, taskDir string, stdout
 			// Context timeout or other error
 			exitCode = -1
 		}
+		switch {
+		case usage != nil && usage.OOMKilled:
+			err = fmt.Errorf("%w of %d MB and was killed", ErrOutOfMemory, job.Limits.MemoryMB)
+		case parent.Err() != nil:
+			err = ErrStopped
+		case ctx.Err() != nil:
+			err = fmt.Errorf("%w after %d seconds", ErrTimedOut, job.TimeoutSeconds)
+		}
 	}
 	
 	return &ExecuteResult{
 		ExitCode: exitCode,
 		Error:    err,
+		Usage:    usage,
 	}, nil
 }
 
+// stopProcessTree stops the processes a task left running after its first process
+// exited: they get the kill signal, are killed after the grace period, and are waited
+// for until they are gone
+func (e *Executor) stopProcessTree(tree *processTree) error {
+	if !tree.alive() {
+		return nil
+	}
+	if e.killGrace > 0 {
+		if err := tree.interrupt(); err != nil {
+			return fmt.Errorf("failed to stop remaining processes: %w", err)
+		}
+		if waitProcessTree(tree, e.killGrace) {
+			return nil
+		}
+	}
+	if err := tree.kill(); err != nil {
+		return fmt.Errorf("failed to kill remaining processes: %w", err)
+	}
+	if waitProcessTree(tree, killConfirmTimeout) {
+		return nil
+	}
+	return errors.New("processes of the task are still running after being killed")
+}
+
+// waitProcessTree waits up to timeout for the processes of a task to be gone
+func waitProcessTree(tree *processTree, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for tree.alive() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
 // executeShell executes a shell command
 func (e *Executor) executeShell(ctx context.Context, job *Job, taskDir string) (*exec.Cmd, error) {
 	var shell string
@@ -197,8 +384,14 @@ func (e *Executor) executeDocker(ctx context.Context, job *Job, taskDir string)
 		return nil, fmt.Errorf("docker image not specified")
 	}
 	
-	// Build docker run command
-	args := []string{"run", "--rm"}
+	// A container left behind by an earlier run of the task, e.g. before the agent
+	// crashed, would keep the name taken
+	if err := removeDockerContainer(job.TaskID); err != nil {
+		return nil, err
+	}
+	
+	// Build docker run command, naming the container so it can be removed when the task is stopped
+	args := []string{"run", "--rm", "--name", dockerContainerName(job.TaskID)}
 	
 	// Mount task directory
 	args = append(args, "-v", fmt.Sprintf("%s:/work", taskDir))
@@ -218,6 +411,23 @@ func (e *Executor) executeDocker(ctx context.Context, job *Job, taskDir string)
 		args = append(args, "--privileged")
 	}
 	
+	// Resource limits; the container runs outside the task's cgroup
+	if job.Limits.CPU > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(job.Limits.CPU, 'f', -1, 64))
+	}
+	if job.Limits.MemoryMB > 0 {
+		memory := fmt.Sprintf("%dm", job.Limits.MemoryMB)
+		args = append(args, "--memory", memory, "--memory-swap", memory)
+	}
+	if job.Limits.Pids > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(int(job.Limits.Pids)))
+	}
+	if job.Limits.IOWeight > 0 {
+		// Docker takes a blkio weight of 10-1000 and maps it onto io.weight 1-10000
+		weight := 10 + (int(job.Limits.IOWeight)-1)*990/9999
+		args = append(args, "--blkio-weight", strconv.Itoa(weight))
+	}
+	
 	// Image and command
 	args = append(args, job.DockerImage)
 	args = append(args, job.Command)
@@ -227,6 +437,24 @@ func (e *Executor) executeDocker(ctx context.Context, job *Job, taskDir string)
 	return cmd, nil
 }
 
+// dockerContainerName names the container of a docker task
+func dockerContainerName(taskID string) string {
+	return "borg-" + taskID
+}
+
+// removeDockerContainer force-removes the container of a docker task if it exists
+func removeDockerContainer(taskID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRemoveTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "docker", "rm", "-f", dockerContainerName(taskID)).CombinedOutput()
+	if err != nil && !strings.Contains(string(output), "No such container") &&
+		!strings.Contains(string(output), "already in progress") {
+		return fmt.Errorf("failed to remove container %s: %v: %s", dockerContainerName(taskID), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
 // executeExecutorBinary executes an executor binary with task data
 func (e *Executor) executeExecutorBinary(ctx context.Context, job *Job, taskDir string) (*exec.Cmd, error) {
 	// Find executor binary in required files (should be the last one)
@@ -380,7 +608,13 @@ func (e *Executor) executeDataset(ctx context.Context, job *Job, taskDir string)
 	// These will be used by the Python script to update results
 	env = append(env, fmt.Sprintf("TASK_ID=%s", job.TaskID))
 	env = append(env, fmt.Sprintf("JOB_ID=%s", job.JobID))
-	// API_URL will be set by the caller if available
+	if job.APIURL != "" {
+		env = append(env, fmt.Sprintf("API_URL=%s", job.APIURL))
+	}
+	// TASK_TOKEN authenticates POST /api/v1/tasks/{TASK_ID}/result for this task only
+	if job.TaskToken != "" {
+		env = append(env, fmt.Sprintf("TASK_TOKEN=%s", job.TaskToken))
+	}
 
 	// Set other environment variables from job
 	for k, v := range job.Env {
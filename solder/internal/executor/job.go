@@ -5,7 +5,7 @@ type Job struct {
 	TaskID           string
 	JobID            string
 	JobName          string
-	Type             string // shell, binary, docker, executor_binary
+	Type             string // shell, binary, docker, executor_binary, dataset, wasm
 	Command          string
 	Args             []string
 	Env              map[string]string
@@ -16,5 +16,30 @@ type Job struct {
 	RequiredFiles    []string
 	ExecutorBinaryID string
 	TaskData         map[string]interface{} // CSV row data
+	TaskToken        string                 // Scoped token for reporting results of this task
+	APIURL           string                 // Mothership address for task processes
+	Limits           ResourceLimits
+	Sandbox          SandboxOptions
+}
+
+// ResourceLimits are the resources a task may use; zero means unlimited. They are
+// enforced with cgroup v2 on Linux and by Docker for docker jobs.
+type ResourceLimits struct {
+	CPU      float64 // CPU cores
+	MemoryMB int64
+	Pids     int32
+	IOWeight int32 // 1-10000, relative share of disk bandwidth
+}
+
+// IsZero reports whether no limit is set
+func (l ResourceLimits) IsZero() bool {
+	return l == ResourceLimits{}
+}
+
+// SandboxOptions ask for a shell or dataset task to be confined to its task directory
+// and read-only system paths. Sandboxes need Linux.
+type SandboxOptions struct {
+	Enabled bool
+	Network bool // Keep network access inside the sandbox
 }
 
@@ -0,0 +1,99 @@
+//go:build !windows
+// +build !windows
+
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// killSignals are the signals a task may be asked to stop with
+var killSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// parseKillSignal returns the signal called name, e.g. "SIGTERM" or "term"
+func parseKillSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := killSignals[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported kill signal %q", name)
+	}
+	return sig, nil
+}
+
+// processTree is the process group a task runs in. Every process the task starts
+// joins the group unless it sets up a group or session of its own.
+type processTree struct {
+	cmd    *exec.Cmd
+	signal syscall.Signal // Asks the task to stop before it is killed
+}
+
+func newProcessTree(cmd *exec.Cmd, signal string) (*processTree, error) {
+	sig, err := parseKillSignal(signal)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	return &processTree{cmd: cmd, signal: sig}, nil
+}
+
+// started is called once the task's first process runs
+func (t *processTree) started() error {
+	return nil
+}
+
+// interrupt asks every process of the task to stop
+func (t *processTree) interrupt() error {
+	return t.send(t.signal)
+}
+
+// kill kills every process of the task
+func (t *processTree) kill() error {
+	return t.send(syscall.SIGKILL)
+}
+
+func (t *processTree) send(sig syscall.Signal) error {
+	if t.cmd.Process == nil {
+		return nil
+	}
+	err := syscall.Kill(-t.cmd.Process.Pid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
+
+// alive reports whether a process of the task is left. It reaps the processes that are
+// children of the agent, which orphans are when the agent runs as init.
+func (t *processTree) alive() bool {
+	if t.cmd.Process == nil {
+		return false
+	}
+	pgid := t.cmd.Process.Pid
+	for {
+		pid, err := syscall.Wait4(-pgid, nil, syscall.WNOHANG, nil)
+		if err != nil || pid <= 0 {
+			break
+		}
+	}
+	return syscall.Kill(-pgid, 0) == nil
+}
+
+// close releases the resources of the tree
+func (t *processTree) close() {}
@@ -0,0 +1,160 @@
+//go:build windows
+// +build windows
+
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// jobObjectBasicAccountingInformation is JOBOBJECT_BASIC_ACCOUNTING_INFORMATION
+type jobObjectBasicAccountingInformation struct {
+	TotalUserTime             int64
+	TotalKernelTime           int64
+	ThisPeriodTotalUserTime   int64
+	ThisPeriodTotalKernelTime int64
+	TotalPageFaultCount       uint32
+	TotalProcesses            uint32
+	ActiveProcesses           uint32
+	TotalTerminatedProcesses  uint32
+}
+
+// parseKillSignal accepts any signal name: Windows has no signals, so tasks are
+// terminated without a grace period
+func parseKillSignal(name string) (string, error) {
+	return name, nil
+}
+
+// processTree is the job object a task runs in. The task's first process starts
+// suspended and only runs once it is in the job, so every process the task starts joins
+// the job, and closing the job's last handle, e.g. when the agent dies, terminates them all.
+type processTree struct {
+	cmd *exec.Cmd
+
+	mu       sync.Mutex
+	job      windows.Handle
+	assigned bool // The task's first process is in the job
+	stopped  bool // Terminated before the process was assigned
+}
+
+func newProcessTree(cmd *exec.Cmd, signal string) (*processTree, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job object: %w", err)
+	}
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	if _, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		windows.CloseHandle(job)
+		return nil, fmt.Errorf("failed to configure job object: %w", err)
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= windows.CREATE_SUSPENDED
+	return &processTree{cmd: cmd, job: job}, nil
+}
+
+// started assigns the task's suspended first process to the job and lets it run. If
+// that fails, the process is terminated before it ran.
+func (t *processTree) started() error {
+	if err := t.assign(); err != nil {
+		t.cmd.Process.Kill()
+		return err
+	}
+	if err := resumeProcess(uint32(t.cmd.Process.Pid)); err != nil {
+		t.kill()
+		return err
+	}
+	return nil
+}
+
+// assign puts the task's first process into the job
+func (t *processTree) assign() error {
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(t.cmd.Process.Pid))
+	if err != nil {
+		return fmt.Errorf("failed to open task process: %w", err)
+	}
+	defer windows.CloseHandle(process)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := windows.AssignProcessToJobObject(t.job, process); err != nil {
+		return fmt.Errorf("failed to assign task to job object: %w", err)
+	}
+	t.assigned = true
+	if t.stopped {
+		windows.TerminateJobObject(t.job, 1)
+	}
+	return nil
+}
+
+// resumeProcess resumes the main thread of a process created suspended, its only thread
+func resumeProcess(pid uint32) error {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPTHREAD, 0)
+	if err != nil {
+		return fmt.Errorf("failed to list threads of task process: %w", err)
+	}
+	defer windows.CloseHandle(snapshot)
+
+	entry := windows.ThreadEntry32{Size: uint32(unsafe.Sizeof(windows.ThreadEntry32{}))}
+	for err = windows.Thread32First(snapshot, &entry); err == nil; err = windows.Thread32Next(snapshot, &entry) {
+		if entry.OwnerProcessID != pid {
+			continue
+		}
+		thread, err := windows.OpenThread(windows.THREAD_SUSPEND_RESUME, false, entry.ThreadID)
+		if err != nil {
+			return fmt.Errorf("failed to open task thread: %w", err)
+		}
+		defer windows.CloseHandle(thread)
+		if _, err := windows.ResumeThread(thread); err != nil {
+			return fmt.Errorf("failed to resume task: %w", err)
+		}
+		return nil
+	}
+	if errors.Is(err, windows.ERROR_NO_MORE_FILES) {
+		return errors.New("failed to resume task: its process has no thread")
+	}
+	return fmt.Errorf("failed to list threads of task process: %w", err)
+}
+
+// interrupt terminates the task: there is no signal to ask it to stop
+func (t *processTree) interrupt() error {
+	return t.kill()
+}
+
+// kill terminates every process of the task
+func (t *processTree) kill() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.assigned {
+		t.stopped = true
+		if t.cmd.Process != nil {
+			t.cmd.Process.Kill()
+		}
+		return nil
+	}
+	return windows.TerminateJobObject(t.job, 1)
+}
+
+// alive reports whether a process of the task is left
+func (t *processTree) alive() bool {
+	var info jobObjectBasicAccountingInformation
+	err := windows.QueryInformationJobObject(t.job, windows.JobObjectBasicAccountingInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)), nil)
+	return err == nil && info.ActiveProcesses > 0
+}
+
+// close releases the job object, terminating what is left of the task
+func (t *processTree) close() {
+	windows.CloseHandle(t.job)
+}
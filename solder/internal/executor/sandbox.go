@@ -0,0 +1,104 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Sandbox modes of a runner
+const (
+	SandboxModeJob    = "job"    // Sandbox the tasks of jobs that ask for it
+	SandboxModeAlways = "always" // Sandbox every shell and dataset task
+)
+
+// SandboxInitCommand is the argument that makes the agent binary set up a sandbox and
+// run a task in it; see SandboxInit
+const SandboxInitCommand = "sandbox-init"
+
+// SandboxPolicy is a runner's policy for sandboxing tasks
+type SandboxPolicy struct {
+	Mode          string   // SandboxModeJob or SandboxModeAlways
+	AllowNetwork  bool     // Sandboxed tasks keep network access if their job asks for it
+	ReadOnlyPaths []string // Visible to sandboxed tasks in addition to the system paths
+}
+
+// SandboxSupported reports why tasks cannot run in a sandbox on this host, or nil if
+// they can
+func SandboxSupported() error {
+	return sandboxSupported()
+}
+
+// SetSandboxPolicy sets which tasks run in a sandbox
+func (e *Executor) SetSandboxPolicy(policy SandboxPolicy) error {
+	switch policy.Mode {
+	case "":
+		policy.Mode = SandboxModeJob
+	case SandboxModeJob:
+	case SandboxModeAlways:
+		if err := sandboxSupported(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown sandbox mode %q", policy.Mode)
+	}
+	e.sandbox = policy
+	return nil
+}
+
+// sandboxFor returns the sandbox a task runs in, or nil if it runs unconfined
+func (e *Executor) sandboxFor(job *Job) *SandboxOptions {
+	if job.Type != "shell" && job.Type != "dataset" {
+		return nil
+	}
+	if !job.Sandbox.Enabled && e.sandbox.Mode != SandboxModeAlways {
+		return nil
+	}
+	return &SandboxOptions{
+		Enabled: true,
+		Network: job.Sandbox.Network && e.sandbox.AllowNetwork,
+	}
+}
+
+// sandboxEnvKeys are the variables of the agent's environment that sandboxed tasks keep
+var sandboxEnvKeys = map[string]bool{
+	"PATH":     true,
+	"LANG":     true,
+	"LANGUAGE": true,
+	"TZ":       true,
+	"TERM":     true,
+}
+
+// sandboxEnv removes the agent's own variables, which may hold its token or
+// configuration, from the environment of a task
+func sandboxEnv(env []string, taskDir string) []string {
+	agent := make(map[string]bool)
+	for _, kv := range os.Environ() {
+		agent[kv] = true
+	}
+
+	result := []string{"HOME=" + taskDir, "TMPDIR=/tmp"}
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if agent[kv] && !sandboxEnvKeys[key] && !strings.HasPrefix(key, "LC_") {
+			continue
+		}
+		result = append(result, kv)
+	}
+	return result
+}
+
+// SandboxInit sets up the sandbox described by spec and runs a task in it. The agent
+// starts itself with SandboxInitCommand and spec as arguments in new namespaces for
+// every sandboxed task. It does not return.
+func SandboxInit(spec string) {
+	code, err := runSandboxInit(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(sandboxFailedExitCode)
+	}
+	os.Exit(code)
+}
+
+// sandboxFailedExitCode is the exit code of tasks whose sandbox could not be set up
+const sandboxFailedExitCode = 125
@@ -0,0 +1,430 @@
+//go:build linux
+// +build linux
+
+package executor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sandboxRootDir  = ".sandbox" // Below the work directory, where each sandbox mounts its root
+	sandboxNobody   = 65534      // Host user and group of the tasks of an agent running as root
+	sandboxHostname = "sandbox"
+)
+
+// sandboxSystemPaths are visible read-only in every sandbox if they exist. /etc is not
+// shared as a whole, as it may hold the agent's configuration.
+var sandboxSystemPaths = []string{
+	"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32",
+	"/etc/alternatives", "/etc/ld.so.cache", "/etc/ld.so.conf", "/etc/ld.so.conf.d",
+	"/etc/ssl", "/etc/ca-certificates", "/etc/pki", "/etc/localtime",
+	"/etc/passwd", "/etc/group", "/etc/nsswitch.conf", "/etc/hosts", "/etc/resolv.conf",
+	"/etc/protocols", "/etc/services", "/etc/mime.types",
+}
+
+// sandboxDevices are bound from the host's /dev into the sandbox's
+var sandboxDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// sandboxSpec tells the sandbox init how to set up the sandbox and which task to run
+type sandboxSpec struct {
+	Root     string   `json:"root"`      // Empty directory the root of the sandbox is mounted on
+	TaskDir  string   `json:"task_dir"`  // The only writable host directory
+	ReadOnly []string `json:"read_only"` // Host paths visible read-only
+	Network  bool     `json:"network"`   // The sandbox shares the agent's network namespace
+	Dir      string   `json:"dir"`
+	Path     string   `json:"path"`
+	Args     []string `json:"args"`
+}
+
+// sandboxSupported checks whether the kernel lets the agent create user namespaces
+func sandboxSupported() error {
+	if data, err := os.ReadFile("/proc/sys/user/max_user_namespaces"); err == nil && strings.TrimSpace(string(data)) == "0" {
+		return errors.New("user namespaces are disabled (user.max_user_namespaces is 0)")
+	}
+	if os.Geteuid() != 0 {
+		if data, err := os.ReadFile("/proc/sys/kernel/unprivileged_userns_clone"); err == nil && strings.TrimSpace(string(data)) == "0" {
+			return errors.New("unprivileged user namespaces are disabled (kernel.unprivileged_userns_clone is 0)")
+		}
+	}
+	return nil
+}
+
+// sandboxCommand makes cmd start the agent binary as the init of new user, mount, PID,
+// IPC, UTS and optionally network namespaces, which sets up the sandbox and runs the
+// task in it. The task is root inside its user namespace, which maps to the agent's
+// user, or to nobody if the agent runs as root.
+func (e *Executor) sandboxCommand(cmd *exec.Cmd, sandbox *SandboxOptions, taskDir string) error {
+	if err := sandboxSupported(); err != nil {
+		return err
+	}
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	taskDir, err := filepath.Abs(taskDir)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(cmd.Dir)
+	if err != nil {
+		return err
+	}
+	root, err := filepath.Abs(filepath.Join(e.workDir, sandboxRootDir))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return fmt.Errorf("failed to create sandbox root: %w", err)
+	}
+
+	uid, gid := os.Geteuid(), os.Getegid()
+	if uid == 0 {
+		uid, gid = sandboxNobody, sandboxNobody
+		for _, path := range []string{root, taskDir} {
+			if err := checkTraversable(path); err != nil {
+				return err
+			}
+		}
+		if err := chownTree(taskDir, uid, gid); err != nil {
+			return fmt.Errorf("failed to hand task directory to the sandbox user: %w", err)
+		}
+	}
+
+	spec, err := json.Marshal(sandboxSpec{
+		Root:     root,
+		TaskDir:  taskDir,
+		ReadOnly: append(append([]string{}, sandboxSystemPaths...), e.sandbox.ReadOnlyPaths...),
+		Network:  sandbox.Network,
+		Dir:      dir,
+		Path:     cmd.Path,
+		Args:     cmd.Args,
+	})
+	if err != nil {
+		return err
+	}
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = []string{"solder", SandboxInitCommand, string(spec)}
+	cmd.Env = sandboxEnv(cmd.Env, taskDir)
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	flags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS)
+	if !sandbox.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr.Cloneflags |= flags
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	// Become the mapped root, which an agent running as root is not by itself
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true}
+	// The sandbox dies with the agent
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	return nil
+}
+
+// checkTraversable checks that nobody can reach path, which the sandbox init needs to
+// mount it
+func checkTraversable(path string) error {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm()&0001 == 0 {
+			return fmt.Errorf("sandboxed tasks run as nobody, who cannot enter %s", dir)
+		}
+		if dir == "/" {
+			return nil
+		}
+	}
+}
+
+// chownTree changes the owner of path and everything below it
+func chownTree(path string, uid, gid int) error {
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, uid, gid)
+	})
+}
+
+// runSandboxInit sets up the sandbox and runs the task as PID 1 of the sandbox's PID
+// namespace. When it exits, the kernel kills every process the task left behind.
+func runSandboxInit(specJSON string) (int, error) {
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(specJSON), &spec); err != nil {
+		return 0, fmt.Errorf("invalid sandbox spec: %w", err)
+	}
+
+	if err := setupSandbox(&spec); err != nil {
+		return 0, err
+	}
+
+	cmd := &exec.Cmd{
+		Path:   spec.Path,
+		Args:   spec.Args,
+		Dir:    spec.Dir,
+		Env:    os.Environ(),
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	// Signals for the task reach it through its process group. PID 1 only receives
+	// signals it handles, and the task must not get them twice.
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for range signals {
+		}
+	}()
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// setupSandbox builds the sandbox's root filesystem, switches to it and drops the
+// privileges the task must not have
+func setupSandbox(spec *sandboxSpec) error {
+	// Keep the sandbox's mounts from propagating to the agent
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+	root := spec.Root
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("failed to mount sandbox root: %w", err)
+	}
+
+	// Host paths are mounted last, so a task directory below /tmp is not hidden
+	tmp := filepath.Join(root, "tmp")
+	if err := os.Mkdir(tmp, 01777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("failed to mount /tmp: %w", err)
+	}
+	proc := filepath.Join(root, "proc")
+	if err := os.Mkdir(proc, 0555); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount /proc: %w", err)
+	}
+	if err := setupSandboxDev(root); err != nil {
+		return err
+	}
+	for _, path := range spec.ReadOnly {
+		if err := bindSandboxPath(root, path, true); err != nil {
+			return err
+		}
+	}
+	if err := bindSandboxPath(root, spec.TaskDir, false); err != nil {
+		return err
+	}
+
+	// Switch to the new root and detach the host's filesystem
+	oldRoot := filepath.Join(root, ".oldroot")
+	if err := os.Mkdir(oldRoot, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, oldRoot); err != nil {
+		return fmt.Errorf("failed to switch to sandbox root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to detach host filesystem: %w", err)
+	}
+	if err := os.Remove("/.oldroot"); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("failed to make sandbox root read-only: %w", err)
+	}
+
+	if !spec.Network {
+		if err := setLoopbackUp(); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Sethostname([]byte(sandboxHostname)); err != nil {
+		return fmt.Errorf("failed to set hostname: %w", err)
+	}
+	return dropPrivileges()
+}
+
+// bindSandboxPath makes the host path visible at the same path inside the sandbox.
+// Symlinks to directories, like /lib on merged /usr systems, are copied.
+func bindSandboxPath(root, path string, readOnly bool) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		resolved, err := os.Stat(path)
+		if err != nil {
+			return nil // Dangling
+		}
+		if resolved.IsDir() {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		info = resolved
+	}
+
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		err = os.WriteFile(target, nil, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount(path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to mount %s: %w", path, err)
+	}
+	if !readOnly {
+		return nil
+	}
+
+	// Remounting may not clear flags the host's mount has
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	for stFlag, msFlag := range map[int64]uintptr{
+		0x2:    syscall.MS_NOSUID,     // ST_NOSUID
+		0x4:    syscall.MS_NODEV,      // ST_NODEV
+		0x8:    syscall.MS_NOEXEC,     // ST_NOEXEC
+		0x400:  syscall.MS_NOATIME,    // ST_NOATIME
+		0x800:  syscall.MS_NODIRATIME, // ST_NODIRATIME
+		0x1000: syscall.MS_RELATIME,   // ST_RELATIME
+	} {
+		if int64(st.Flags)&stFlag != 0 {
+			flags |= msFlag
+		}
+	}
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("failed to make %s read-only: %w", path, err)
+	}
+	return nil
+}
+
+// setupSandboxDev creates a /dev with the basic devices only
+func setupSandboxDev(root string) error {
+	dev := filepath.Join(root, "dev")
+	if err := os.Mkdir(dev, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=0755"); err != nil {
+		return fmt.Errorf("failed to mount /dev: %w", err)
+	}
+	for _, name := range sandboxDevices {
+		if err := bindSandboxPath(root, "/dev/"+name, false); err != nil {
+			return err
+		}
+	}
+	shm := filepath.Join(dev, "shm")
+	if err := os.Mkdir(shm, 01777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", shm, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=1777"); err != nil {
+		return fmt.Errorf("failed to mount /dev/shm: %w", err)
+	}
+	for name, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLoopbackUp brings up the loopback interface of the sandbox's network namespace,
+// which is its only interface
+func setLoopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to bring up loopback: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	// struct ifreq: interface name followed by the flags
+	var ifr [40]byte
+	copy(ifr[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		return fmt.Errorf("failed to bring up loopback: %w", errno)
+	}
+	flags := (*uint16)(unsafe.Pointer(&ifr[syscall.IFNAMSIZ]))
+	*flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		return fmt.Errorf("failed to bring up loopback: %w", errno)
+	}
+	return nil
+}
+
+// Constants of prctl(2)
+const (
+	prCapBSetDrop   = 24
+	prSetNoNewPrivs = 38
+)
+
+// dropPrivileges empties the capability bounding set, so the task has no capabilities
+// even though it is root in its user namespace, and keeps it from gaining any
+func dropPrivileges() error {
+	last := 40
+	if data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			last = n
+		}
+	}
+	for c := 0; c <= last; c++ {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapBSetDrop, uintptr(c), 0); errno != 0 && errno != syscall.EINVAL {
+			return fmt.Errorf("failed to drop capabilities: %w", errno)
+		}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %w", errno)
+	}
+	return nil
+}
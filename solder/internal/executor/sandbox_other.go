@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errSandboxUnsupported = errors.New("sandboxed tasks need Linux")
+
+func sandboxSupported() error {
+	return errSandboxUnsupported
+}
+
+// sandboxCommand fails: tasks that ask for a sandbox must not run unconfined
+func (e *Executor) sandboxCommand(cmd *exec.Cmd, sandbox *SandboxOptions, taskDir string) error {
+	return errSandboxUnsupported
+}
+
+func runSandboxInit(spec string) (int, error) {
+	return 0, errSandboxUnsupported
+}
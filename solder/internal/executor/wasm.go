@@ -0,0 +1,218 @@
+package executor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+const (
+	wasmPageSize     = 64 * 1024
+	wasmMaxPages     = 65536 // 4 GiB, the most a 32-bit module can address
+	wasmTaskDataFile = "task_data.json"
+
+	// DefaultWasmMemoryMB caps the linear memory of wasm tasks whose job has no memory limit
+	DefaultWasmMemoryMB = 256
+)
+
+// wasmMemoryBudget bounds the linear memory of all wasm tasks running at once, which
+// lives in the agent's own heap. Tasks reserve their memory limit before they start.
+type wasmMemoryBudget struct {
+	mu    sync.Mutex
+	total int64 // Bytes, 0 for no bound
+	used  int64
+	freed chan struct{} // Closed when memory is released
+}
+
+func newWasmMemoryBudget(total int64) *wasmMemoryBudget {
+	return &wasmMemoryBudget{total: total, freed: make(chan struct{})}
+}
+
+// acquire reserves n bytes, waiting until other tasks release enough of them
+func (b *wasmMemoryBudget) acquire(ctx context.Context, n int64) error {
+	for {
+		b.mu.Lock()
+		if b.total == 0 || b.used+n <= b.total {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		freed := b.freed
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-freed:
+		}
+	}
+}
+
+// release returns n bytes reserved with acquire
+func (b *wasmMemoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// SetWasmMemory sets the memory limit of wasm tasks whose job has none, and the bound
+// on the memory of all wasm tasks running at once, 0 for none. Both are in MB.
+func (e *Executor) SetWasmMemory(defaultMB, totalMB int64) error {
+	if defaultMB <= 0 {
+		return fmt.Errorf("default wasm memory must be positive, got %d MB", defaultMB)
+	}
+	if totalMB < 0 {
+		return fmt.Errorf("total wasm memory must not be negative, got %d MB", totalMB)
+	}
+	e.wasmDefaultMB = defaultMB
+	e.wasmMemory = newWasmMemoryBudget(totalMB * 1024 * 1024)
+	return nil
+}
+
+// executeWasm runs a WebAssembly module in-process with WASI. The task directory is the
+// module's root directory, and the task's memory limit, or the runner's default, caps its
+// linear memory. Modules cannot open network connections or start processes.
+func (e *Executor) executeWasm(ctx, parent context.Context, job *Job, taskDir string, stdout, stderr io.Writer) (*ExecuteResult, error) {
+	modulePath := filepath.Join(taskDir, job.Command)
+	wasm, err := os.ReadFile(modulePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wasm module: %w", err)
+	}
+
+	memoryMB := job.Limits.MemoryMB
+	if memoryMB <= 0 {
+		memoryMB = e.wasmDefaultMB
+	}
+	pages := memoryMB * 1024 * 1024 / wasmPageSize
+	if pages > wasmMaxPages {
+		pages = wasmMaxPages
+	}
+	reserved := pages * wasmPageSize
+	if total := e.wasmMemory.total; total > 0 && reserved > total {
+		return nil, fmt.Errorf("wasm memory limit of %d MB exceeds the runner's total wasm memory of %d MB",
+			memoryMB, total/1024/1024)
+	}
+	if err := e.wasmMemory.acquire(ctx, reserved); err != nil {
+		return wasmStopped(parent, job), nil
+	}
+	defer e.wasmMemory.release(reserved)
+
+	config := wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithCompilationCache(e.wasmCache).
+		WithMemoryLimitPages(uint32(pages))
+	r := wazero.NewRuntimeWithConfig(ctx, config)
+	defer r.Close(context.Background())
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		return nil, fmt.Errorf("failed to set up WASI: %w", err)
+	}
+	compiled, err := r.CompileModule(ctx, wasm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile wasm module: %w", err)
+	}
+
+	// The module gets the task's variables only, not the agent's environment
+	env := map[string]string{
+		"TASK_ID": job.TaskID,
+		"JOB_ID":  job.JobID,
+	}
+	if len(job.TaskData) > 0 {
+		taskDataJSON, err := json.Marshal(job.TaskData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode task data: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(taskDir, wasmTaskDataFile), taskDataJSON, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write task data: %w", err)
+		}
+		env["TASK_DATA_JSON"] = string(taskDataJSON)
+		env["TASK_DATA_PATH"] = "/" + wasmTaskDataFile
+	}
+	for k, v := range job.Env {
+		env[k] = v
+	}
+
+	moduleConfig := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(append([]string{job.Command}, job.Args...)...).
+		WithStdout(stdout).
+		WithStderr(stderr).
+		WithFSConfig(wazero.NewFSConfig().WithDirMount(taskDir, "/")).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep().
+		WithRandSource(rand.Reader).
+		WithStartFunctions() // _start is called below, so the module's memory can be read after it exits
+	for k, v := range env {
+		moduleConfig = moduleConfig.WithEnv(k, v)
+	}
+
+	start := time.Now()
+	mod, err := r.InstantiateModule(ctx, compiled, moduleConfig)
+	if err == nil {
+		if fn := mod.ExportedFunction("_start"); fn != nil {
+			_, err = fn.Call(ctx)
+		} else {
+			err = errors.New("wasm module has no _start function")
+		}
+	}
+
+	// The module runs on a single goroutine, so its run time stands in for its CPU time
+	usage := &Usage{CPUTime: time.Since(start)}
+	if job.Limits.CPU > 0 || job.Limits.Pids > 0 || job.Limits.IOWeight > 0 {
+		usage.LimitsNotEnforced = "wasm tasks only support a memory limit"
+	}
+	if mod != nil {
+		// Linear memory never shrinks, so its size is the module's peak
+		if mem := mod.Memory(); mem != nil {
+			usage.PeakMemoryBytes = int64(mem.Size())
+		}
+	}
+
+	if ctx.Err() != nil {
+		result := wasmStopped(parent, job)
+		result.Usage = usage
+		return result, nil
+	}
+
+	exitCode := int32(0)
+	var exitErr *sys.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		exitCode, err = int32(exitErr.ExitCode()), nil
+		if exitCode != 0 {
+			err = fmt.Errorf("exit status %d", exitCode)
+		}
+	case err != nil:
+		fmt.Fprintf(stderr, "wasm: %v\n", err)
+		exitCode = -1
+	}
+
+	return &ExecuteResult{
+		ExitCode: exitCode,
+		Error:    err,
+		Usage:    usage,
+	}, nil
+}
+
+// wasmStopped is the result of a wasm task that was stopped or timed out
+func wasmStopped(parent context.Context, job *Job) *ExecuteResult {
+	err := fmt.Errorf("%w after %d seconds", ErrTimedOut, job.TimeoutSeconds)
+	if parent.Err() != nil {
+		err = ErrStopped
+	}
+	return &ExecuteResult{ExitCode: -1, Error: err}
+}
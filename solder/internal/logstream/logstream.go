@@ -0,0 +1,273 @@
+// Package logstream ships the output of a running task to the mothership in
+// numbered chunks. Output is buffered up to a limit; beyond it writes block until
+// the mothership acknowledges earlier chunks, which slows chatty tasks down
+// instead of exhausting the runner's memory.
+package logstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"borg/solder/internal/client"
+)
+
+// Output streams
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+const (
+	// DefaultMaxBuffered is how many unacknowledged bytes a task may write before its writes block
+	DefaultMaxBuffered = 4 << 20
+
+	maxChunkSize  = 64 << 10
+	maxBatchSize  = 1 << 20
+	flushInterval = 500 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+	tailSize      = 256 << 10
+)
+
+// SendFunc delivers chunks in sequence order and returns the highest acknowledged sequence number
+type SendFunc func(ctx context.Context, chunks []client.TaskLogChunk) (int64, error)
+
+// Streamer numbers, buffers and sends the output of one task
+type Streamer struct {
+	taskID      string
+	send        SendFunc
+	maxBuffered int
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []client.TaskLogChunk // Unacknowledged chunks in sequence order
+	inFlight int                   // Leading pending chunks being sent, which must not grow
+	buffered int                   // Bytes in pending
+	seq      int64
+	closing  bool
+	tails    map[string][]byte
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// New starts streaming the output of a task until Close is called or ctx is cancelled
+func New(ctx context.Context, taskID string, send SendFunc, maxBuffered int) *Streamer {
+	if maxBuffered <= 0 {
+		maxBuffered = DefaultMaxBuffered
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Streamer{
+		taskID:      taskID,
+		send:        send,
+		maxBuffered: maxBuffered,
+		ctx:         ctx,
+		cancel:      cancel,
+		tails:       make(map[string][]byte),
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+// Writer returns a writer for one output stream
+func (s *Streamer) Writer(stream string) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		return s.write(stream, p)
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// Tail returns the last output written to a stream, up to 256 KiB
+func (s *Streamer) Tail(stream string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.tails[stream]...)
+}
+
+func (s *Streamer) write(stream string, p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		piece := p[written:]
+		if len(piece) > maxChunkSize {
+			piece = piece[:maxChunkSize]
+		}
+
+		// Wait for acknowledgements while the buffer is full. A single piece is
+		// always accepted into an empty buffer.
+		for s.buffered > 0 && s.buffered+len(piece) > s.maxBuffered && s.ctx.Err() == nil {
+			s.cond.Wait()
+		}
+		if err := s.ctx.Err(); err != nil {
+			return written, err
+		}
+
+		s.append(stream, piece)
+		written += len(piece)
+	}
+
+	tail := append(s.tails[stream], p...)
+	if len(tail) > tailSize {
+		tail = append([]byte(nil), tail[len(tail)-tailSize:]...)
+	}
+	s.tails[stream] = tail
+	return written, nil
+}
+
+// append adds output to the last chunk if it belongs to the same stream and is not
+// being sent, and starts a new chunk otherwise. Callers hold s.mu.
+func (s *Streamer) append(stream string, data []byte) {
+	if n := len(s.pending); n > s.inFlight {
+		last := &s.pending[n-1]
+		if last.Stream == stream && len(last.Data)+len(data) <= maxChunkSize {
+			last.Data = append(last.Data, data...)
+			s.buffered += len(data)
+			return
+		}
+	}
+
+	s.seq++
+	s.pending = append(s.pending, client.TaskLogChunk{
+		Seq:       s.seq,
+		Stream:    stream,
+		Data:      append([]byte(nil), data...),
+		Timestamp: time.Now().UnixMilli(),
+	})
+	s.buffered += len(data)
+	if s.buffered >= maxChunkSize {
+		s.notify()
+	}
+}
+
+func (s *Streamer) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends buffered chunks every flush interval, or sooner when a full chunk is ready
+func (s *Streamer) run() {
+	defer close(s.done)
+	defer func() {
+		// Release writers blocked on a cancelled stream
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	retryDelay := time.Second
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+
+		for {
+			batch := s.nextBatch()
+			if len(batch) == 0 {
+				break
+			}
+
+			acked, err := s.send(s.ctx, batch)
+			if err != nil {
+				s.mu.Lock()
+				s.inFlight = 0
+				s.mu.Unlock()
+				if s.ctx.Err() != nil {
+					return
+				}
+				log.Printf("Failed to send output of task %s (retrying in %v): %v", s.taskID, retryDelay, err)
+				select {
+				case <-s.ctx.Done():
+					return
+				case <-time.After(retryDelay):
+				}
+				if retryDelay *= 2; retryDelay > maxRetryDelay {
+					retryDelay = maxRetryDelay
+				}
+				continue
+			}
+			retryDelay = time.Second
+			s.ack(acked)
+		}
+
+		s.mu.Lock()
+		finished := s.closing && len(s.pending) == 0
+		s.mu.Unlock()
+		if finished {
+			return
+		}
+	}
+}
+
+// nextBatch marks the leading pending chunks as in flight and returns a copy of them
+func (s *Streamer) nextBatch() []client.TaskLogChunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := 0
+	n := 0
+	for n < len(s.pending) && (n == 0 || size+len(s.pending[n].Data) <= maxBatchSize) {
+		size += len(s.pending[n].Data)
+		n++
+	}
+	s.inFlight = n
+	return append([]client.TaskLogChunk(nil), s.pending[:n]...)
+}
+
+// ack drops the chunks up to the acknowledged sequence number and wakes blocked writers
+func (s *Streamer) ack(acked int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for n < len(s.pending) && s.pending[n].Seq <= acked {
+		s.buffered -= len(s.pending[n].Data)
+		n++
+	}
+	s.pending = s.pending[n:]
+	s.inFlight = 0
+	s.cond.Broadcast()
+}
+
+// Close sends the remaining output, waiting at most timeout, and stops the streamer.
+// It returns an error if output could not be delivered.
+func (s *Streamer) Close(timeout time.Duration) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.notify()
+
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+	}
+	s.cancel()
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) > 0 {
+		return fmt.Errorf("%d bytes of output were not delivered", s.buffered)
+	}
+	return nil
+}
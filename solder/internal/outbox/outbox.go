@@ -0,0 +1,285 @@
+// Package outbox keeps task status updates, results and artifact uploads on disk until
+// the mothership has received them, so they survive an unreachable mothership and
+// agent restarts. Entries are delivered in the order they were added; each carries an
+// idempotency key, so the mothership ignores entries it received before.
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"borg/solder/internal/client"
+)
+
+const (
+	fileSuffix    = ".json"
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = 2 * time.Minute
+)
+
+// Kind says what an entry delivers
+type Kind string
+
+const (
+	KindStatus    Kind = "status"    // Status update of a task
+	KindResult    Kind = "result"    // Result of an executor_binary task, with the files in Dir
+	KindArtifacts Kind = "artifacts" // Every file under Dir as an artifact of the task
+)
+
+// Entry is a delivery waiting for the mothership
+type Entry struct {
+	Seq        uint64                          `json:"seq"`
+	Key        string                          `json:"key"` // Idempotency key, the same on every attempt
+	Kind       Kind                            `json:"kind"`
+	TaskID     string                          `json:"task_id"`
+	JobID      string                          `json:"job_id,omitempty"`
+	Status     *client.UpdateTaskStatusRequest `json:"status,omitempty"`
+	ResultData string                          `json:"result_data,omitempty"`
+	Dir        string                          `json:"dir,omitempty"`
+	CreatedAt  time.Time                       `json:"created_at"`
+}
+
+// DeliverFunc sends an entry to the mothership. Errors wrapped with Permanent drop the
+// entry; other errors keep it for the next attempt.
+type DeliverFunc func(ctx context.Context, entry *Entry) error
+
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error after which delivering an entry again cannot succeed
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Outbox is the on-disk journal of deliveries
+type Outbox struct {
+	dir     string
+	deliver DeliverFunc
+	wake    chan struct{}
+	added   chan struct{}
+
+	mu      sync.Mutex // Held while adding entries
+	lastSeq uint64
+
+	deliverMu sync.Mutex // Held while delivering, so entries go out in order
+}
+
+// Open opens the outbox in dir, creating it if needed. Entries left by an earlier run
+// are delivered first.
+func Open(dir string, deliver DeliverFunc) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+	o := &Outbox{dir: dir, deliver: deliver, wake: make(chan struct{}, 1), added: make(chan struct{}, 1)}
+
+	seqs, err := o.pending()
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) > 0 {
+		o.lastSeq = seqs[len(seqs)-1]
+		log.Printf("Outbox has %d undelivered entries", len(seqs))
+	}
+	return o, nil
+}
+
+// Send adds an entry for Run to deliver. It returns once the entry is on disk, so a
+// slow or unreachable mothership never holds up the caller.
+func (o *Outbox) Send(entry *Entry) error {
+	if err := o.add(entry); err != nil {
+		return err
+	}
+	select {
+	case o.added <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// add assigns the entry its sequence number and key and writes it to disk
+func (o *Outbox) add(entry *Entry) error {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate idempotency key: %w", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entry.Seq = o.lastSeq + 1
+	entry.Key = hex.EncodeToString(key)
+	entry.CreatedAt = time.Now().UTC()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode outbox entry: %w", err)
+	}
+
+	// Write and sync a temporary file first, so a crash never leaves a partial entry
+	tmp := filepath.Join(o.dir, ".tmp-"+entry.Key)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write outbox entry: %w", err)
+	}
+	if _, err := f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, o.path(entry.Seq))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write outbox entry: %w", err)
+	}
+
+	o.lastSeq = entry.Seq
+	return nil
+}
+
+// Flush delivers pending entries in order. It stops at the first entry that fails and
+// returns its error; entries that can never be delivered are dropped.
+func (o *Outbox) Flush(ctx context.Context) error {
+	o.deliverMu.Lock()
+	defer o.deliverMu.Unlock()
+
+	seqs, err := o.pending()
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		entry, err := o.read(seq)
+		if err != nil {
+			log.Printf("Dropping unreadable outbox entry %d: %v", seq, err)
+			os.Remove(o.path(seq))
+			continue
+		}
+
+		err = o.deliver(ctx, entry)
+		var permanent *permanentError
+		switch {
+		case errors.As(err, &permanent):
+			log.Printf("Dropping %s of task %s, the mothership cannot accept it: %v", entry.Kind, entry.TaskID, err)
+		case err != nil:
+			return err
+		}
+		if err := os.Remove(o.path(seq)); err != nil {
+			return fmt.Errorf("failed to remove delivered outbox entry: %w", err)
+		}
+	}
+	return nil
+}
+
+// Run delivers entries as they are added and retries pending entries until ctx is
+// cancelled, backing off while the mothership stays unreachable
+func (o *Outbox) Run(ctx context.Context) {
+	delay := minRetryDelay
+	failing := false
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+			delay = minRetryDelay
+		case <-o.added:
+			// New entries wait behind the pending ones until the next retry
+			if failing {
+				continue
+			}
+		case <-timer.C:
+		}
+
+		if err := o.Flush(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Outbox delivery failed, retrying in %s: %v", delay, err)
+			failing = true
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		} else {
+			failing = false
+			delay = minRetryDelay
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
+	}
+}
+
+// Wake makes Run retry now, e.g. after the connection to the mothership came back
+func (o *Outbox) Wake() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Pending returns the number of undelivered entries
+func (o *Outbox) Pending() int {
+	seqs, _ := o.pending()
+	return len(seqs)
+}
+
+// pending returns the sequence numbers of the entries on disk, oldest first
+func (o *Outbox) pending() ([]uint64, error) {
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	var seqs []uint64
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, fileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (o *Outbox) path(seq uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d%s", seq, fileSuffix))
+}
+
+func (o *Outbox) read(seq uint64) (*Entry, error) {
+	data, err := os.ReadFile(o.path(seq))
+	if err != nil {
+		return nil, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
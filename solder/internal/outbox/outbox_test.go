@@ -0,0 +1,153 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"borg/solder/internal/client"
+)
+
+// recorder records the tasks of delivered entries and fails while err is set
+type recorder struct {
+	delivered []string
+	keys      []string
+	err       error
+}
+
+func (r *recorder) deliver(ctx context.Context, entry *Entry) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.delivered = append(r.delivered, entry.TaskID)
+	r.keys = append(r.keys, entry.Key)
+	return nil
+}
+
+func statusEntry(taskID string) *Entry {
+	return &Entry{Kind: KindStatus, TaskID: taskID, Status: &client.UpdateTaskStatusRequest{Status: "running"}}
+}
+
+func TestFlushDeliversInOrder(t *testing.T) {
+	r := &recorder{err: errors.New("mothership unreachable")}
+	o, err := Open(t.TempDir(), r.deliver)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	for _, taskID := range []string{"a", "b", "c"} {
+		if err := o.Send(statusEntry(taskID)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	if err := o.Flush(context.Background()); err == nil {
+		t.Fatal("Flush succeeded while delivery fails")
+	}
+	if o.Pending() != 3 {
+		t.Fatalf("Pending = %d after a failed delivery, want 3", o.Pending())
+	}
+
+	r.err = nil
+	if err := o.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(r.delivered, want) {
+		t.Fatalf("delivered %v, want %v", r.delivered, want)
+	}
+	if o.Pending() != 0 {
+		t.Fatalf("Pending = %d after delivery, want 0", o.Pending())
+	}
+	if r.keys[0] == "" || r.keys[0] == r.keys[1] {
+		t.Fatalf("entries have idempotency keys %v, want distinct keys", r.keys)
+	}
+}
+
+func TestFlushDropsPermanentFailures(t *testing.T) {
+	var delivered []string
+	o, err := Open(t.TempDir(), func(ctx context.Context, entry *Entry) error {
+		if entry.TaskID == "rejected" {
+			return Permanent(errors.New("task not found"))
+		}
+		delivered = append(delivered, entry.TaskID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	for _, taskID := range []string{"a", "rejected", "b"} {
+		if err := o.Send(statusEntry(taskID)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	if err := o.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(delivered, want) {
+		t.Fatalf("delivered %v, want %v", delivered, want)
+	}
+	if o.Pending() != 0 {
+		t.Fatalf("Pending = %d, want the rejected entry dropped", o.Pending())
+	}
+}
+
+func TestOpenRecoversPendingEntries(t *testing.T) {
+	dir := t.TempDir()
+	failing := &recorder{err: errors.New("mothership unreachable")}
+	o, err := Open(dir, failing.deliver)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, taskID := range []string{"a", "b"} {
+		if err := o.Send(statusEntry(taskID)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	// The agent restarts with both entries undelivered
+	r := &recorder{}
+	o, err = Open(dir, r.deliver)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if o.Pending() != 2 {
+		t.Fatalf("Pending = %d after reopening, want 2", o.Pending())
+	}
+	if err := o.Send(statusEntry("c")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := o.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(r.delivered, want) {
+		t.Fatalf("delivered %v after reopening, want %v", r.delivered, want)
+	}
+}
+
+func TestRunDeliversSentEntries(t *testing.T) {
+	delivered := make(chan string, 1)
+	o, err := Open(t.TempDir(), func(ctx context.Context, entry *Entry) error {
+		delivered <- entry.TaskID
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.Run(ctx)
+
+	if err := o.Send(statusEntry("a")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	select {
+	case taskID := <-delivered:
+		if taskID != "a" {
+			t.Fatalf("Run delivered task %s, want a", taskID)
+		}
+	case <-time.After(minRetryDelay / 2):
+		t.Fatal("Run did not deliver a sent entry before the next retry")
+	}
+}
@@ -2,6 +2,8 @@ package uploader
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -55,7 +57,15 @@ func (u *Uploader) UploadArtifacts(ctx context.Context, taskID, dirPath string)
 			return nil
 		}
 		
-		artifactID, err := u.UploadArtifact(ctx, taskID, path)
+		// Every file of a resent upload keeps its own key
+		fileCtx := ctx
+		if key := client.IdempotencyKey(ctx); key != "" {
+			rel, _ := filepath.Rel(dirPath, path)
+			sum := sha256.Sum256([]byte(key + "\x00" + rel))
+			fileCtx = client.WithIdempotencyKey(ctx, hex.EncodeToString(sum[:]))
+		}
+		
+		artifactID, err := u.UploadArtifact(fileCtx, taskID, path)
 		if err != nil {
 			return fmt.Errorf("failed to upload artifact %s: %w", path, err)
 		}